@@ -0,0 +1,30 @@
+// Command cardfake runs the fake hosted card checkout on CARD_FAKE_ADDR (default :4002). Start
+// the server with CARD_CHECKOUT_URL=http://localhost:4002 and the same CARD_WEBHOOK_SECRET to
+// send card payments to it; the checkout pages are served on CARD_FAKE_PUBLIC_URL (default
+// http://localhost:4002) and CARD_API_KEY, when set, is required on API calls.
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+
+	"mobile-customer-portal-server/gateway/cardfake"
+)
+
+func main() {
+	addr := os.Getenv("CARD_FAKE_ADDR")
+	if addr == "" {
+		addr = ":4002"
+	}
+	publicURL := os.Getenv("CARD_FAKE_PUBLIC_URL")
+	if publicURL == "" {
+		publicURL = "http://localhost:4002"
+	}
+
+	server := cardfake.New(publicURL, os.Getenv("CARD_WEBHOOK_SECRET"))
+	server.APIKey = os.Getenv("CARD_API_KEY")
+
+	log.Printf("Fake card checkout listening on %s", addr)
+	log.Fatal(http.ListenAndServe(addr, server))
+}
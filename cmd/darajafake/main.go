@@ -0,0 +1,44 @@
+// Command darajafake runs the fake Daraja API on DARAJA_FAKE_ADDR (default :4001). Start the
+// server with DARAJA_BASE_URL=http://localhost:4001 to send STK pushes to it. When
+// DARAJA_FAKE_RESULT is set (e.g. 0 for success or 1032 for cancelled), every push is completed
+// with that result code after DARAJA_FAKE_DELAY (default 5s) and its callback delivered.
+// Paybill payments are made by calling /mpesa/c2b/v1/simulate once the server has registered
+// its C2B URLs.
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"mobile-customer-portal-server/daraja/darajafake"
+)
+
+func main() {
+	addr := os.Getenv("DARAJA_FAKE_ADDR")
+	if addr == "" {
+		addr = ":4001"
+	}
+
+	server := darajafake.New()
+	if value := os.Getenv("DARAJA_FAKE_RESULT"); value != "" {
+		code, err := strconv.Atoi(value)
+		if err != nil {
+			log.Fatalf("Invalid DARAJA_FAKE_RESULT: %v", err)
+		}
+		server.AutoResult = &code
+		server.AutoDelay = 5 * time.Second
+	}
+	if value := os.Getenv("DARAJA_FAKE_DELAY"); value != "" {
+		delay, err := time.ParseDuration(value)
+		if err != nil {
+			log.Fatalf("Invalid DARAJA_FAKE_DELAY: %v", err)
+		}
+		server.AutoDelay = delay
+	}
+
+	log.Printf("Fake Daraja API listening on %s", addr)
+	log.Fatal(http.ListenAndServe(addr, server))
+}
@@ -0,0 +1,30 @@
+// Command expofake runs the fake Expo push API on EXPO_FAKE_ADDR (default :4000). Start the
+// server with EXPO_BASE_URL=http://localhost:4000 to send pushes to it. Tokens listed in
+// EXPO_FAKE_UNREGISTERED (comma separated) report DeviceNotRegistered in their receipts.
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"mobile-customer-portal-server/messaging/expofake"
+)
+
+func main() {
+	addr := os.Getenv("EXPO_FAKE_ADDR")
+	if addr == "" {
+		addr = ":4000"
+	}
+
+	server := expofake.New()
+	for _, token := range strings.Split(os.Getenv("EXPO_FAKE_UNREGISTERED"), ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			server.Unregister(token)
+		}
+	}
+
+	log.Printf("Fake Expo push API listening on %s", addr)
+	log.Fatal(http.ListenAndServe(addr, server))
+}
@@ -0,0 +1,214 @@
+// Package currency converts amounts between Kenyan shillings, the currency every balance,
+// receipt and payment is recorded in, and the currencies customers abroad can choose to see
+// them in or pay by card with. Rates come from a Source and are cached, so a slow or missing
+// rate file never holds up a request.
+package currency
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// Base is the currency of record
+const Base = "KES"
+
+// ErrUnsupported is returned for a currency there is no rate for
+var ErrUnsupported = errors.New("currency: unsupported currency")
+
+// ErrNoBillingRates is returned when a charge is to be priced but no rates fit for billing are
+// configured
+var ErrNoBillingRates = errors.New("currency: no billing rates configured")
+
+// Source supplies exchange rates as shillings per unit of each currency, e.g. {"USD": 129.5}
+type Source interface {
+	Rates() (map[string]float64, error)
+}
+
+// Quote is the rate of a currency at the time it was looked up
+type Quote struct {
+	Currency string `json:"currency"`
+	// Rate is shillings per unit of Currency
+	Rate float64   `json:"rate"`
+	AsOf time.Time `json:"as_of"`
+}
+
+// IsBase reports whether the quote is for shillings, i.e. no conversion
+func (q Quote) IsBase() bool {
+	return q.Currency == Base
+}
+
+// FromBase converts a shilling amount to the quote's currency
+func (q Quote) FromBase(amount float64) float64 {
+	return Round(amount / q.Rate)
+}
+
+// ToBase converts an amount in the quote's currency to shillings
+func (q Quote) ToBase(amount float64) float64 {
+	return Round(amount * q.Rate)
+}
+
+// Round rounds an amount to cents
+func Round(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+// Format formats an amount with its currency code for display, e.g. USD 1,250.5
+func Format(amount float64, code string) string {
+	return code + " " + humanize.CommafWithDigits(amount, 2)
+}
+
+// Normalize turns a user supplied currency code into the form rates are keyed by
+func Normalize(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// Service looks up exchange rates from Source, refreshing them once they are older than TTL.
+// When a refresh fails the last rates it got are used until the next attempt.
+type Service struct {
+	Source Source
+	TTL    time.Duration
+
+	mu        sync.Mutex
+	rates     map[string]float64
+	fetchedAt time.Time
+}
+
+// NewService creates a service caching the rates from source for ttl
+func NewService(source Source, ttl time.Duration) *Service {
+	return &Service{Source: source, TTL: ttl}
+}
+
+// Default is the service used to show amounts in other currencies. It is replaced by Setup.
+var Default = NewService(NewStaticSource(nil), time.Hour)
+
+// Billing is the service used to price charges in other currencies. It is only set when rates
+// come from a source finance maintains; the static table is indicative and is never used to
+// decide how much a customer is charged.
+var Billing *Service
+
+// BillingQuote returns the current rate to charge code at, or ErrNoBillingRates when charges
+// in other currencies cannot be priced
+func BillingQuote(code string) (Quote, error) {
+	if Normalize(code) == Base {
+		return Quote{Currency: Base, Rate: 1, AsOf: time.Now()}, nil
+	}
+	if Billing == nil {
+		return Quote{}, ErrNoBillingRates
+	}
+	return Billing.Quote(code)
+}
+
+// Quote returns the current rate for code. Shillings always have a rate of 1.
+func (s *Service) Quote(code string) (Quote, error) {
+	code = Normalize(code)
+	if code == Base {
+		return Quote{Currency: Base, Rate: 1, AsOf: time.Now()}, nil
+	}
+
+	rates, asOf, err := s.load()
+	if err != nil {
+		return Quote{}, err
+	}
+	rate, ok := rates[code]
+	if !ok || rate <= 0 {
+		return Quote{}, fmt.Errorf("%w: %q", ErrUnsupported, code)
+	}
+	return Quote{Currency: code, Rate: rate, AsOf: asOf}, nil
+}
+
+// Currencies lists the currencies amounts can be shown in, shillings first
+func (s *Service) Currencies() ([]string, error) {
+	rates, _, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, len(rates))
+	for code, rate := range rates {
+		if code != Base && rate > 0 {
+			codes = append(codes, code)
+		}
+	}
+	sort.Strings(codes)
+	return append([]string{Base}, codes...), nil
+}
+
+// load returns the cached rates, fetching them from the source when they are stale
+func (s *Service) load() (map[string]float64, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rates != nil && time.Since(s.fetchedAt) < s.TTL {
+		return s.rates, s.fetchedAt, nil
+	}
+
+	rates, err := s.Source.Rates()
+	if err != nil {
+		if s.rates != nil {
+			log.Printf("Failed to refresh exchange rates, using rates from %s: %v", s.fetchedAt.Format(time.RFC3339), err)
+			// Try again on the next lookup rather than waiting a full TTL
+			return s.rates, s.fetchedAt, nil
+		}
+		return nil, time.Time{}, fmt.Errorf("currency: load rates: %w", err)
+	}
+
+	normalized := make(map[string]float64, len(rates))
+	for code, rate := range rates {
+		normalized[Normalize(code)] = rate
+	}
+	s.rates = normalized
+	s.fetchedAt = time.Now()
+	return s.rates, s.fetchedAt, nil
+}
+
+// Setup configures Default according to EXCHANGE_RATES_MODE:
+//
+//	static (default) - the indicative rates in NewStaticSource, overridden by EXCHANGE_RATES
+//	                   ("USD=129.5,GBP=163.2"), for display only; card payments in other
+//	                   currencies are refused
+//	file             - read rates from the JSON file EXCHANGE_RATES_FILE; see FileSource. These
+//	                   rates are also used to price card payments in other currencies.
+//
+// Rates are cached for EXCHANGE_RATES_TTL (default 1h).
+func Setup() {
+	ttl := time.Hour
+	if value := os.Getenv("EXCHANGE_RATES_TTL"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			log.Fatalf("Invalid EXCHANGE_RATES_TTL %q", value)
+		}
+		ttl = parsed
+	}
+
+	mode := os.Getenv("EXCHANGE_RATES_MODE")
+	switch mode {
+	case "", "static":
+		mode = "static"
+		rates, err := ParseRates(os.Getenv("EXCHANGE_RATES"))
+		if err != nil {
+			log.Fatalf("Invalid EXCHANGE_RATES: %v", err)
+		}
+		Default = NewService(NewStaticSource(rates), ttl)
+		Billing = nil
+	case "file":
+		path := os.Getenv("EXCHANGE_RATES_FILE")
+		if path == "" {
+			log.Fatal("EXCHANGE_RATES_FILE is required when EXCHANGE_RATES_MODE is file")
+		}
+		Default = NewService(&FileSource{Path: path}, ttl)
+		Billing = Default
+	default:
+		log.Fatalf("Unknown EXCHANGE_RATES_MODE %q", mode)
+	}
+
+	log.Printf("Exchange rates configured in %s mode", mode)
+}
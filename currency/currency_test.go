@@ -0,0 +1,80 @@
+package currency
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSetupOnlyBillsFromFileRates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rates.json")
+	if err := os.WriteFile(path, []byte(`{"base": "KES", "rates": {"USD": 130}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	previousDefault, previousBilling := Default, Billing
+	t.Cleanup(func() { Default, Billing = previousDefault, previousBilling })
+
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr error
+		want    float64
+	}{
+		{
+			name:    "static",
+			env:     map[string]string{"EXCHANGE_RATES_MODE": "static"},
+			wantErr: ErrNoBillingRates,
+		},
+		{
+			name:    "static with overrides",
+			env:     map[string]string{"EXCHANGE_RATES_MODE": "", "EXCHANGE_RATES": "USD=131"},
+			wantErr: ErrNoBillingRates,
+		},
+		{
+			name: "file",
+			env:  map[string]string{"EXCHANGE_RATES_MODE": "file", "EXCHANGE_RATES_FILE": path},
+			want: 130,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			Setup()
+
+			// Amounts can always be shown in USD
+			if _, err := Default.Quote("USD"); err != nil {
+				t.Fatalf("display quote: %v", err)
+			}
+
+			quote, err := BillingQuote("usd")
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("BillingQuote err = %v, want %v", err, tt.wantErr)
+				}
+			} else if err != nil || quote.Rate != tt.want {
+				t.Fatalf("BillingQuote = %v, %v; want rate %v", quote, err, tt.want)
+			}
+
+			// Shillings never need a rate
+			if quote, err := BillingQuote(Base); err != nil || quote.Rate != 1 {
+				t.Fatalf("BillingQuote(KES) = %v, %v", quote, err)
+			}
+		})
+	}
+}
+
+func TestQuoteConversion(t *testing.T) {
+	quote := Quote{Currency: "USD", Rate: 129.5, AsOf: time.Now()}
+	if got := quote.ToBase(10); got != 1295 {
+		t.Errorf("ToBase(10) = %v, want 1295", got)
+	}
+	if got := quote.FromBase(1000); got != 7.72 {
+		t.Errorf("FromBase(1000) = %v, want 7.72", got)
+	}
+}
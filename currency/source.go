@@ -0,0 +1,94 @@
+package currency
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// StaticSource is a fixed table of rates. It stands in for a rate feed in development and is
+// the fallback when finance has not set up a rate file.
+type StaticSource struct {
+	rates map[string]float64
+}
+
+// defaultRates are indicative shillings per unit, good enough for showing balances
+var defaultRates = map[string]float64{
+	"USD": 129.0,
+	"GBP": 163.5,
+	"EUR": 140.0,
+	"AED": 35.1,
+	"CAD": 94.5,
+	"AUD": 84.0,
+}
+
+// NewStaticSource serves defaultRates with the given rates added or replacing them
+func NewStaticSource(overrides map[string]float64) *StaticSource {
+	rates := make(map[string]float64, len(defaultRates)+len(overrides))
+	for code, rate := range defaultRates {
+		rates[code] = rate
+	}
+	for code, rate := range overrides {
+		rates[Normalize(code)] = rate
+	}
+	return &StaticSource{rates: rates}
+}
+
+func (s *StaticSource) Rates() (map[string]float64, error) {
+	rates := make(map[string]float64, len(s.rates))
+	for code, rate := range s.rates {
+		rates[code] = rate
+	}
+	return rates, nil
+}
+
+// ParseRates parses rates written as "USD=129.5,GBP=163.2"
+func ParseRates(value string) (map[string]float64, error) {
+	rates := map[string]float64{}
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		code, rateStr, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected CODE=rate, got %q", pair)
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSpace(rateStr), 64)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("invalid rate for %s: %q", code, rateStr)
+		}
+		rates[Normalize(code)] = rate
+	}
+	return rates, nil
+}
+
+// FileSource reads rates from a JSON file finance keeps up to date, re-reading it whenever the
+// cache expires:
+//
+//	{"base": "KES", "rates": {"USD": 129.5, "GBP": 163.2}}
+type FileSource struct {
+	Path string
+}
+
+type rateFile struct {
+	Base  string             `json:"base"`
+	Rates map[string]float64 `json:"rates"`
+}
+
+func (s *FileSource) Rates() (map[string]float64, error) {
+	data, err := os.ReadFile(s.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file rateFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", s.Path, err)
+	}
+	if base := Normalize(file.Base); base != "" && base != Base {
+		return nil, fmt.Errorf("%s: rates must be quoted in %s, not %s", s.Path, Base, base)
+	}
+	return file.Rates, nil
+}
@@ -0,0 +1,114 @@
+package daraja
+
+import (
+	"errors"
+	"strings"
+)
+
+// What M-PESA does with a paybill payment when the validation URL cannot be reached
+const (
+	ResponseTypeCompleted = "Completed"
+	ResponseTypeCancelled = "Cancelled"
+)
+
+// Result codes a validation URL answers with
+const (
+	C2BAccepted             = "0"
+	C2BInvalidAccountNumber = "C2B00012"
+	C2BInvalidAmount        = "C2B00013"
+	C2BOtherError           = "C2B00016"
+)
+
+// registerURLBody is the wire format of a C2B URL registration
+type registerURLBody struct {
+	ShortCode       string `json:"ShortCode"`
+	ResponseType    string `json:"ResponseType"`
+	ConfirmationURL string `json:"ConfirmationURL"`
+	ValidationURL   string `json:"ValidationURL"`
+}
+
+// RegisterURLResponse acknowledges a C2B URL registration
+type RegisterURLResponse struct {
+	OriginatorConversationID string `json:"OriginatorCoversationID"`
+	ResponseCode             string `json:"ResponseCode"`
+	ResponseDescription      string `json:"ResponseDescription"`
+}
+
+// RegisterC2BURLs tells M-PESA where to send validation and confirmation requests for paybill
+// payments to the client's short code. responseType is ResponseTypeCompleted or
+// ResponseTypeCancelled.
+func (c *Client) RegisterC2BURLs(confirmationURL, validationURL, responseType string) (*RegisterURLResponse, error) {
+	if c.BaseURL == "" || c.ShortCode == "" {
+		return nil, ErrNotConfigured
+	}
+
+	var response RegisterURLResponse
+	if err := c.post("/mpesa/c2b/v1/registerurl", registerURLBody{
+		ShortCode:       c.ShortCode,
+		ResponseType:    responseType,
+		ConfirmationURL: confirmationURL,
+		ValidationURL:   validationURL,
+	}, &response); err != nil {
+		return nil, err
+	}
+
+	// Daraja has answered both "0" and "00000000" for a successful registration
+	if strings.Trim(response.ResponseCode, "0") != "" {
+		return nil, &APIError{StatusCode: 200, Code: response.ResponseCode, Message: response.ResponseDescription}
+	}
+	return &response, nil
+}
+
+// simulateBody is the wire format of a sandbox C2B simulation
+type simulateBody struct {
+	ShortCode     string `json:"ShortCode"`
+	CommandID     string `json:"CommandID"`
+	Amount        int    `json:"Amount"`
+	Msisdn        string `json:"Msisdn"`
+	BillRefNumber string `json:"BillRefNumber"`
+}
+
+// SimulateC2B makes a paybill payment from phoneNumber to the client's short code. Only the
+// sandbox and the fake support it.
+func (c *Client) SimulateC2B(amount int, phoneNumber, accountReference string) error {
+	if c.BaseURL == ProductionURL {
+		return errors.New("daraja: C2B payments cannot be simulated in production")
+	}
+	if c.BaseURL == "" || c.ShortCode == "" {
+		return ErrNotConfigured
+	}
+
+	var response map[string]interface{}
+	return c.post("/mpesa/c2b/v1/simulate", simulateBody{
+		ShortCode:     c.ShortCode,
+		CommandID:     CustomerPayBillOnline,
+		Amount:        amount,
+		Msisdn:        phoneNumber,
+		BillRefNumber: accountReference,
+	}, &response)
+}
+
+// C2BTransaction is the body M-PESA posts to the validation and confirmation URLs for a paybill
+// payment. BillRefNumber is the account number the customer typed in.
+type C2BTransaction struct {
+	TransactionType   string `json:"TransactionType"`
+	TransID           string `json:"TransID"`
+	TransTime         string `json:"TransTime"`
+	TransAmount       string `json:"TransAmount"`
+	BusinessShortCode string `json:"BusinessShortCode"`
+	BillRefNumber     string `json:"BillRefNumber"`
+	InvoiceNumber     string `json:"InvoiceNumber"`
+	OrgAccountBalance string `json:"OrgAccountBalance"`
+	ThirdPartyTransID string `json:"ThirdPartyTransID"`
+	MSISDN            string `json:"MSISDN"`
+	FirstName         string `json:"FirstName"`
+	MiddleName        string `json:"MiddleName"`
+	LastName          string `json:"LastName"`
+}
+
+// C2BResponse answers a validation or confirmation request. A validation answered with
+// anything but C2BAccepted is declined and the customer's money is not taken.
+type C2BResponse struct {
+	ResultCode string `json:"ResultCode"`
+	ResultDesc string `json:"ResultDesc"`
+}
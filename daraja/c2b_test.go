@@ -0,0 +1,109 @@
+package daraja_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"mobile-customer-portal-server/daraja"
+)
+
+func TestRegisterC2BURLs(t *testing.T) {
+	client, fake := newFakeClient(t)
+
+	response, err := client.RegisterC2BURLs("https://portal.example.com/c2b/confirm", "https://portal.example.com/c2b/validate", daraja.ResponseTypeCompleted)
+	if err != nil {
+		t.Fatalf("RegisterC2BURLs: %v", err)
+	}
+	if response.ResponseCode != "0" {
+		t.Fatalf("response = %+v", response)
+	}
+
+	registration := fake.Registration()
+	if registration == nil {
+		t.Fatal("nothing registered")
+	}
+	if registration.ShortCode != "174379" || registration.ResponseType != daraja.ResponseTypeCompleted ||
+		registration.ConfirmationURL != "https://portal.example.com/c2b/confirm" ||
+		registration.ValidationURL != "https://portal.example.com/c2b/validate" {
+		t.Fatalf("registration = %+v", registration)
+	}
+}
+
+func TestRegisterC2BURLsRejected(t *testing.T) {
+	client, fake := newFakeClient(t)
+
+	_, err := client.RegisterC2BURLs("https://portal.example.com/c2b/confirm", "https://portal.example.com/c2b/validate", "Sometimes")
+	var apiErr *daraja.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("err = %v, want a 400 APIError", err)
+	}
+	if fake.Registration() != nil {
+		t.Fatal("invalid registration was kept")
+	}
+}
+
+func TestRegisterC2BURLsNotConfigured(t *testing.T) {
+	client, _ := newFakeClient(t)
+	client.ShortCode = ""
+
+	if _, err := client.RegisterC2BURLs("https://a", "https://b", daraja.ResponseTypeCompleted); !errors.Is(err, daraja.ErrNotConfigured) {
+		t.Fatalf("err = %v, want %v", err, daraja.ErrNotConfigured)
+	}
+}
+
+func TestPaybillPaymentReachesRegisteredURLs(t *testing.T) {
+	client, fake := newFakeClient(t)
+
+	var validated, confirmed []daraja.C2BTransaction
+	portal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var transaction daraja.C2BTransaction
+		json.NewDecoder(r.Body).Decode(&transaction)
+		result := daraja.C2BAccepted
+		switch r.URL.Path {
+		case "/validate":
+			validated = append(validated, transaction)
+			if transaction.BillRefNumber == "UNKNOWN" {
+				result = daraja.C2BInvalidAccountNumber
+			}
+		case "/confirm":
+			confirmed = append(confirmed, transaction)
+		}
+		json.NewEncoder(w).Encode(daraja.C2BResponse{ResultCode: result, ResultDesc: "ok"})
+	}))
+	t.Cleanup(portal.Close)
+
+	if _, err := client.RegisterC2BURLs(portal.URL+"/confirm", portal.URL+"/validate", daraja.ResponseTypeCancelled); err != nil {
+		t.Fatalf("RegisterC2BURLs: %v", err)
+	}
+
+	payment, err := fake.Pay(2500, "254712345678", "LF-001")
+	if err != nil {
+		t.Fatalf("Pay: %v", err)
+	}
+	if !payment.Confirmed || payment.Transaction.TransAmount != "2500.00" || payment.Transaction.BusinessShortCode != "174379" {
+		t.Fatalf("payment = %+v", payment)
+	}
+
+	// A declined validation is never confirmed
+	declined, err := fake.Pay(2500, "254712345678", "UNKNOWN")
+	if err != nil {
+		t.Fatalf("Pay: %v", err)
+	}
+	if declined.Confirmed || declined.ValidationResult != daraja.C2BInvalidAccountNumber {
+		t.Fatalf("declined payment = %+v", declined)
+	}
+
+	if len(validated) != 2 || len(confirmed) != 1 || confirmed[0].BillRefNumber != "LF-001" {
+		t.Fatalf("validated %d, confirmed %+v", len(validated), confirmed)
+	}
+}
+
+func TestSimulateC2BRefusedInProduction(t *testing.T) {
+	client := &daraja.Client{BaseURL: daraja.ProductionURL, ConsumerKey: "key", ConsumerSecret: "secret", ShortCode: "174379"}
+	if err := client.SimulateC2B(100, "254712345678", "LF-001"); err == nil {
+		t.Fatal("SimulateC2B allowed against production")
+	}
+}
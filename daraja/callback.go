@@ -0,0 +1,58 @@
+package daraja
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// STKCallback is the body Daraja posts to an STK push's callback URL
+type STKCallback struct {
+	Body struct {
+		STKCallback STKCallbackResult `json:"stkCallback"`
+	} `json:"Body"`
+}
+
+// STKCallbackResult is the outcome of an STK push. CallbackMetadata is only present on success.
+type STKCallbackResult struct {
+	MerchantRequestID string           `json:"MerchantRequestID"`
+	CheckoutRequestID string           `json:"CheckoutRequestID"`
+	ResultCode        int              `json:"ResultCode"`
+	ResultDesc        string           `json:"ResultDesc"`
+	CallbackMetadata  CallbackMetadata `json:"CallbackMetadata"`
+}
+
+// CallbackMetadata lists the transaction details of a successful payment
+type CallbackMetadata struct {
+	Item []CallbackItem `json:"Item"`
+}
+
+// CallbackItem is a single named metadata value. Numbers such as the phone number and
+// transaction date arrive as JSON numbers.
+type CallbackItem struct {
+	Name  string      `json:"Name"`
+	Value interface{} `json:"Value,omitempty"`
+}
+
+// String renders the value as a string without exponent notation
+func (i CallbackItem) String() string {
+	switch v := i.Value.(type) {
+	case string:
+		return strings.TrimSpace(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case json.Number:
+		return v.String()
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// ParseTransactionDate parses a Daraja transaction date such as 20191219102115
+func ParseTransactionDate(value string) (time.Time, error) {
+	return time.ParseInLocation("20060102150405", value, Timezone)
+}
@@ -0,0 +1,250 @@
+// Package daraja is a client for Safaricom's Daraja (M-PESA) API. It caches OAuth tokens until
+// they expire, applies request timeouts and exposes typed requests and responses. The base URL
+// selects the sandbox, production or a local fake (see the darajafake package).
+package daraja
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Daraja environments
+const (
+	SandboxURL    = "https://sandbox.safaricom.co.ke"
+	ProductionURL = "https://api.safaricom.co.ke"
+)
+
+// tokenExpiryMargin renews a cached token this long before Daraja says it expires
+const tokenExpiryMargin = time.Minute
+
+// defaultTimeout bounds every request to Daraja
+const defaultTimeout = 30 * time.Second
+
+// ErrNotConfigured is returned when the client is missing its credentials
+var ErrNotConfigured = errors.New("daraja: M-PESA configuration not properly set")
+
+// Client talks to the Daraja API for a single paybill
+type Client struct {
+	BaseURL        string
+	ConsumerKey    string
+	ConsumerSecret string
+	ShortCode      string
+	PassKey        string
+	HTTPClient     *http.Client
+
+	mu             sync.Mutex
+	token          string
+	tokenExpiresAt time.Time
+}
+
+// Default is the client configured by Setup
+var Default = &Client{HTTPClient: &http.Client{Timeout: defaultTimeout}}
+
+// NewClientFromEnv configures a client from DARAJA_CONSUMER_KEY, DARAJA_CONSUMER_SECRET,
+// DARAJA_BUSINESS_SHORT_CODE and DARAJA_PASSKEY. DARAJA_ENVIRONMENT picks "production"
+// (default) or "sandbox"; DARAJA_BASE_URL overrides both, e.g. to point at a local fake.
+// DARAJA_TIMEOUT sets the request timeout (default 30s).
+func NewClientFromEnv() (*Client, error) {
+	baseURL := os.Getenv("DARAJA_BASE_URL")
+	if baseURL == "" {
+		switch env := os.Getenv("DARAJA_ENVIRONMENT"); env {
+		case "", "production":
+			baseURL = ProductionURL
+		case "sandbox":
+			baseURL = SandboxURL
+		default:
+			return nil, fmt.Errorf("daraja: unknown DARAJA_ENVIRONMENT %q", env)
+		}
+	}
+
+	timeout := defaultTimeout
+	if value := os.Getenv("DARAJA_TIMEOUT"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("daraja: invalid DARAJA_TIMEOUT: %w", err)
+		}
+		timeout = parsed
+	}
+
+	return &Client{
+		BaseURL:        strings.TrimRight(baseURL, "/"),
+		ConsumerKey:    os.Getenv("DARAJA_CONSUMER_KEY"),
+		ConsumerSecret: os.Getenv("DARAJA_CONSUMER_SECRET"),
+		ShortCode:      os.Getenv("DARAJA_BUSINESS_SHORT_CODE"),
+		PassKey:        os.Getenv("DARAJA_PASSKEY"),
+		HTTPClient:     &http.Client{Timeout: timeout},
+	}, nil
+}
+
+// Setup configures Default from the environment
+func Setup() error {
+	client, err := NewClientFromEnv()
+	if err != nil {
+		return err
+	}
+	Default = client
+	return nil
+}
+
+// Configured reports whether the client has the credentials it needs for STK pushes
+func (c *Client) Configured() bool {
+	return c.BaseURL != "" && c.ConsumerKey != "" && c.ConsumerSecret != "" && c.ShortCode != "" && c.PassKey != ""
+}
+
+// APIError is an error response from Daraja
+type APIError struct {
+	StatusCode int
+	RequestID  string `json:"requestId"`
+	Code       string `json:"errorCode"`
+	Message    string `json:"errorMessage"`
+}
+
+func (e *APIError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("daraja: status %d: %s", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("daraja: %s: %s", e.Code, e.Message)
+}
+
+// errorCodeProcessing is the error an STK push query returns while the customer has not answered yet
+const errorCodeProcessing = "500.001.1001"
+
+// IsStillProcessing reports whether err is Daraja saying an STK push has no result yet
+func IsStillProcessing(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.Code == errorCodeProcessing
+}
+
+// tokenResponse is the OAuth response. Daraja sends expires_in as a string.
+type tokenResponse struct {
+	AccessToken string      `json:"access_token"`
+	ExpiresIn   json.Number `json:"expires_in"`
+}
+
+// AccessToken returns a valid OAuth token, fetching a new one only when the cached one is
+// about to expire
+func (c *Client) AccessToken() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != "" && time.Now().Before(c.tokenExpiresAt) {
+		return c.token, nil
+	}
+
+	if c.ConsumerKey == "" || c.ConsumerSecret == "" {
+		return "", ErrNotConfigured
+	}
+
+	req, err := http.NewRequest("GET", c.BaseURL+"/oauth/v1/generate?grant_type=client_credentials", nil)
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(c.ConsumerKey, c.ConsumerSecret)
+
+	var token tokenResponse
+	if err := c.do(req, &token); err != nil {
+		return "", err
+	}
+	if token.AccessToken == "" {
+		return "", errors.New("daraja: access_token not found in response")
+	}
+
+	expiresIn, err := strconv.Atoi(token.ExpiresIn.String())
+	if err != nil || expiresIn <= 0 {
+		expiresIn = 3599
+	}
+
+	c.token = token.AccessToken
+	c.tokenExpiresAt = time.Now().Add(time.Duration(expiresIn)*time.Second - tokenExpiryMargin)
+	return c.token, nil
+}
+
+// invalidateToken forgets the cached token, e.g. after Daraja rejected it
+func (c *Client) invalidateToken() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token = ""
+}
+
+// password is the base64 STK password for a request timestamp
+func (c *Client) password(timestamp string) string {
+	return base64.StdEncoding.EncodeToString([]byte(c.ShortCode + c.PassKey + timestamp))
+}
+
+// post sends an authenticated JSON request and decodes the response into out. A rejected token
+// is renewed and the request retried once.
+func (c *Client) post(path string, body, out interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 0; ; attempt++ {
+		token, err := c.AccessToken()
+		if err != nil {
+			return err
+		}
+
+		req, err := http.NewRequest("POST", c.BaseURL+path, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		err = c.do(req, out)
+		var apiErr *APIError
+		if attempt == 0 && errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusUnauthorized {
+			c.invalidateToken()
+			continue
+		}
+		return err
+	}
+}
+
+// do sends req and decodes a successful JSON response into out, or returns an *APIError
+func (c *Client) do(req *http.Request, out interface{}) error {
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("daraja: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("daraja: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		apiErr := &APIError{StatusCode: resp.StatusCode}
+		if json.Unmarshal(respBody, apiErr) != nil || apiErr.Message == "" {
+			apiErr.Message = strings.TrimSpace(string(respBody))
+		}
+		return apiErr
+	}
+
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return fmt.Errorf("daraja: decode response: %w", err)
+	}
+	return nil
+}
+
+// Timestamp formats t the way Daraja expects in STK requests
+func Timestamp(t time.Time) string {
+	return t.In(Timezone).Format("20060102150405")
+}
+
+// Timezone is the zone Daraja timestamps and transaction dates are in (EAT, UTC+3)
+var Timezone = time.FixedZone("EAT", 3*60*60)
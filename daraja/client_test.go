@@ -0,0 +1,202 @@
+package daraja_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"mobile-customer-portal-server/daraja"
+	"mobile-customer-portal-server/daraja/darajafake"
+)
+
+// newFakeClient returns a client configured against a fresh fake
+func newFakeClient(t *testing.T) (*daraja.Client, *darajafake.Server) {
+	t.Helper()
+	fake := darajafake.New()
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return &daraja.Client{
+		BaseURL:        server.URL,
+		ConsumerKey:    "key",
+		ConsumerSecret: "secret",
+		ShortCode:      "174379",
+		PassKey:        "passkey",
+		HTTPClient:     server.Client(),
+	}, fake
+}
+
+func TestAccessTokenIsCached(t *testing.T) {
+	client, fake := newFakeClient(t)
+
+	first, err := client.AccessToken()
+	if err != nil {
+		t.Fatalf("AccessToken: %v", err)
+	}
+	second, err := client.AccessToken()
+	if err != nil {
+		t.Fatalf("AccessToken: %v", err)
+	}
+	if first != second || fake.TokensIssued() != 1 {
+		t.Fatalf("tokens %q and %q, %d issued; want the first one reused", first, second, fake.TokensIssued())
+	}
+}
+
+func TestAccessTokenRefreshesBeforeExpiry(t *testing.T) {
+	client, fake := newFakeClient(t)
+	// A token that expires within the renewal margin is never reused
+	fake.SetTokenTTL(30 * time.Second)
+
+	first, err := client.AccessToken()
+	if err != nil {
+		t.Fatalf("AccessToken: %v", err)
+	}
+	second, err := client.AccessToken()
+	if err != nil {
+		t.Fatalf("AccessToken: %v", err)
+	}
+	if first == second || fake.TokensIssued() != 2 {
+		t.Fatalf("tokens %q and %q, %d issued; want a new token", first, second, fake.TokensIssued())
+	}
+}
+
+func TestAccessTokenNotConfigured(t *testing.T) {
+	client, fake := newFakeClient(t)
+	client.ConsumerSecret = ""
+
+	if _, err := client.AccessToken(); !errors.Is(err, daraja.ErrNotConfigured) {
+		t.Fatalf("err = %v, want %v", err, daraja.ErrNotConfigured)
+	}
+	if fake.TokensIssued() != 0 {
+		t.Fatal("requested a token without credentials")
+	}
+}
+
+func TestRetryOnUnauthorized(t *testing.T) {
+	client, fake := newFakeClient(t)
+
+	if _, err := client.STKPush(stkRequest()); err != nil {
+		t.Fatalf("STKPush: %v", err)
+	}
+
+	// The cached token is rejected once; the client renews it and tries again
+	fake.RevokeTokens()
+	if _, err := client.STKPush(stkRequest()); err != nil {
+		t.Fatalf("STKPush after revocation: %v", err)
+	}
+	if fake.TokensIssued() != 2 {
+		t.Fatalf("%d tokens issued, want 2", fake.TokensIssued())
+	}
+	if pushes := fake.Pushes(); len(pushes) != 2 {
+		t.Fatalf("%d pushes, want 2", len(pushes))
+	}
+}
+
+func TestRetryOnUnauthorizedOnlyOnce(t *testing.T) {
+	fake := darajafake.New()
+	var posts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			atomic.AddInt32(&posts, 1)
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"errorCode":"404.001.03","errorMessage":"Invalid Access Token"}`))
+			return
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	client := &daraja.Client{
+		BaseURL:        server.URL,
+		ConsumerKey:    "key",
+		ConsumerSecret: "secret",
+		ShortCode:      "174379",
+		PassKey:        "passkey",
+		HTTPClient:     server.Client(),
+	}
+
+	_, err := client.STKPush(stkRequest())
+	var apiErr *daraja.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized || apiErr.Code != "404.001.03" {
+		t.Fatalf("err = %v, want a 401 APIError", err)
+	}
+	if posts != 2 || fake.TokensIssued() != 2 {
+		t.Fatalf("%d requests with %d tokens, want 2 and 2", posts, fake.TokensIssued())
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(release) })
+
+	client := &daraja.Client{
+		BaseURL:        server.URL,
+		ConsumerKey:    "key",
+		ConsumerSecret: "secret",
+		HTTPClient:     &http.Client{Timeout: 50 * time.Millisecond},
+	}
+
+	start := time.Now()
+	_, err := client.AccessToken()
+	if err == nil {
+		t.Fatal("AccessToken succeeded against a server that never answers")
+	}
+	var apiErr *daraja.APIError
+	if errors.As(err, &apiErr) {
+		t.Fatalf("err = %v, want a transport error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("gave up after %s", elapsed)
+	}
+}
+
+func TestNewClientFromEnv(t *testing.T) {
+	tests := []struct {
+		name        string
+		environment string
+		baseURL     string
+		timeout     string
+		wantURL     string
+		wantTimeout time.Duration
+		wantErr     bool
+	}{
+		{name: "production by default", wantURL: daraja.ProductionURL, wantTimeout: 30 * time.Second},
+		{name: "production", environment: "production", wantURL: daraja.ProductionURL, wantTimeout: 30 * time.Second},
+		{name: "sandbox", environment: "sandbox", wantURL: daraja.SandboxURL, wantTimeout: 30 * time.Second},
+		{name: "base url overrides the environment", environment: "sandbox", baseURL: "http://localhost:8090/", wantURL: "http://localhost:8090", wantTimeout: 30 * time.Second},
+		{name: "timeout", timeout: "5s", wantURL: daraja.ProductionURL, wantTimeout: 5 * time.Second},
+		{name: "unknown environment", environment: "staging", wantErr: true},
+		{name: "invalid timeout", timeout: "soon", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DARAJA_ENVIRONMENT", tt.environment)
+			t.Setenv("DARAJA_BASE_URL", tt.baseURL)
+			t.Setenv("DARAJA_TIMEOUT", tt.timeout)
+
+			client, err := daraja.NewClientFromEnv()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewClientFromEnv: %v", err)
+			}
+			if client.BaseURL != tt.wantURL {
+				t.Errorf("BaseURL = %q, want %q", client.BaseURL, tt.wantURL)
+			}
+			if client.HTTPClient.Timeout != tt.wantTimeout {
+				t.Errorf("timeout = %s, want %s", client.HTTPClient.Timeout, tt.wantTimeout)
+			}
+		})
+	}
+}
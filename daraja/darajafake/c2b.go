@@ -0,0 +1,187 @@
+package darajafake
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"mobile-customer-portal-server/daraja"
+)
+
+// ErrNotRegistered is returned for a paybill payment made before any C2B URLs were registered
+var ErrNotRegistered = errors.New("darajafake: no C2B URLs registered")
+
+// C2BRegistration is the last set of C2B URLs registered with the fake
+type C2BRegistration struct {
+	ShortCode       string
+	ResponseType    string
+	ConfirmationURL string
+	ValidationURL   string
+}
+
+// C2BPayment is a paybill payment the fake made, and how the server answered it
+type C2BPayment struct {
+	Transaction daraja.C2BTransaction
+	// ValidationResult is the result code the validation URL answered with
+	ValidationResult string
+	// Confirmed is set once the confirmation was delivered
+	Confirmed bool
+}
+
+// Registration returns the registered C2B URLs, if any
+func (s *Server) Registration() *C2BRegistration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.c2b == nil {
+		return nil
+	}
+	registration := *s.c2b
+	return &registration
+}
+
+// PaybillPayments returns a copy of every paybill payment made so far, oldest first
+func (s *Server) PaybillPayments() []C2BPayment {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]C2BPayment(nil), s.paybill...)
+}
+
+// Pay makes a paybill payment to the registered URLs: the validation URL is asked first and,
+// if it accepts the payment, the confirmation is delivered. When the validation URL cannot be
+// reached the registered response type decides whether the payment goes through.
+func (s *Server) Pay(amount int, msisdn, billRefNumber string) (C2BPayment, error) {
+	s.mu.Lock()
+	registration := s.c2b
+	s.seq++
+	seq := s.seq
+	s.mu.Unlock()
+
+	if registration == nil {
+		return C2BPayment{}, ErrNotRegistered
+	}
+
+	payment := C2BPayment{Transaction: daraja.C2BTransaction{
+		TransactionType:   "Pay Bill",
+		TransID:           fmt.Sprintf("FAKEC%05d", seq),
+		TransTime:         daraja.Timestamp(time.Now()),
+		TransAmount:       fmt.Sprintf("%d.00", amount),
+		BusinessShortCode: registration.ShortCode,
+		BillRefNumber:     billRefNumber,
+		MSISDN:            msisdn,
+		FirstName:         "FAKE",
+	}}
+
+	var validation daraja.C2BResponse
+	err := s.post(registration.ValidationURL, payment.Transaction, &validation)
+	switch {
+	case err == nil:
+		payment.ValidationResult = validation.ResultCode
+	case registration.ResponseType == daraja.ResponseTypeCompleted:
+		log.Printf("darajafake: validation of %s failed, completing: %v", payment.Transaction.TransID, err)
+		payment.ValidationResult = daraja.C2BAccepted
+	default:
+		payment.ValidationResult = daraja.C2BOtherError
+	}
+
+	if payment.ValidationResult == daraja.C2BAccepted {
+		var confirmation daraja.C2BResponse
+		if err := s.post(registration.ConfirmationURL, payment.Transaction, &confirmation); err != nil {
+			log.Printf("darajafake: confirmation of %s failed: %v", payment.Transaction.TransID, err)
+		} else {
+			payment.Confirmed = true
+		}
+	}
+
+	s.mu.Lock()
+	s.paybill = append(s.paybill, payment)
+	s.mu.Unlock()
+
+	return payment, nil
+}
+
+// post sends a C2B request to one of the registered URLs and decodes its answer
+func (s *Server) post(url string, transaction daraja.C2BTransaction, out interface{}) error {
+	body, err := json.Marshal(transaction)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.HTTPClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (s *Server) registerURL(w http.ResponseWriter, r *http.Request) {
+	var body C2BRegistration
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "400.002.02", "Bad Request - Invalid Request")
+		return
+	}
+	if body.ShortCode == "" {
+		writeError(w, http.StatusBadRequest, "400.002.02", "Bad Request - Invalid ShortCode")
+		return
+	}
+	if body.ResponseType != daraja.ResponseTypeCompleted && body.ResponseType != daraja.ResponseTypeCancelled {
+		writeError(w, http.StatusBadRequest, "400.002.02", "Bad Request - Invalid ResponseType")
+		return
+	}
+	for _, url := range []string{body.ConfirmationURL, body.ValidationURL} {
+		if !strings.HasPrefix(url, "http") {
+			writeError(w, http.StatusBadRequest, "400.002.02", "Bad Request - Invalid URL")
+			return
+		}
+	}
+
+	s.mu.Lock()
+	s.c2b = &body
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, daraja.RegisterURLResponse{
+		OriginatorConversationID: "fake-conversation",
+		ResponseCode:             "0",
+		ResponseDescription:      "Success",
+	})
+}
+
+func (s *Server) simulate(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Amount        int
+		Msisdn        string
+		BillRefNumber string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Amount <= 0 {
+		writeError(w, http.StatusBadRequest, "400.002.02", "Bad Request - Invalid Request")
+		return
+	}
+	if s.Registration() == nil {
+		writeError(w, http.StatusBadRequest, "400.002.02", "Bad Request - No URLs registered")
+		return
+	}
+
+	// Like M-PESA, answer first and talk to the registered URLs afterwards
+	go func() {
+		if _, err := s.Pay(body.Amount, body.Msisdn, body.BillRefNumber); err != nil {
+			log.Printf("darajafake: simulate: %v", err)
+		}
+	}()
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"OriginatorCoversationID": "fake-conversation",
+		"ResponseCode":            "0",
+		"ResponseDescription":     "Accept the service request successfully.",
+	})
+}
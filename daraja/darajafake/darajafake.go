@@ -0,0 +1,359 @@
+// Package darajafake is a stand-in for the Daraja API. It issues OAuth tokens, accepts STK
+// pushes and answers STK push queries, and lets the caller decide how each push ends and
+// whether its callback is delivered. It also accepts C2B URL registrations and simulates
+// paybill payments against them. Point DARAJA_BASE_URL at a running instance (see
+// cmd/darajafake) to use it with the server.
+package darajafake
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"mobile-customer-portal-server/daraja"
+)
+
+// ErrUnknownCheckout is returned for a CheckoutRequestID the fake never issued
+var ErrUnknownCheckout = errors.New("darajafake: unknown checkout request")
+
+// Push is an STK push the fake received
+type Push struct {
+	MerchantRequestID string
+	CheckoutRequestID string
+	ShortCode         string
+	Amount            int
+	PhoneNumber       string
+	AccountReference  string
+	CallBackURL       string
+	ResultCode        *int
+	ResultDesc        string
+	ReceiptNumber     string
+}
+
+// Server is an http.Handler implementing the Daraja endpoints the portal uses
+type Server struct {
+	// AutoResult, when set, completes every push with this result code after AutoDelay and
+	// delivers its callback
+	AutoResult *int
+	AutoDelay  time.Duration
+	// HTTPClient delivers callbacks
+	HTTPClient *http.Client
+
+	mu       sync.Mutex
+	seq      int
+	tokens   map[string]time.Time
+	pushes   map[string]*Push
+	order    []string
+	tokenTTL time.Duration
+	issued   int
+	c2b      *C2BRegistration
+	paybill  []C2BPayment
+}
+
+// New creates a fake with no pushes. Tokens it issues are valid for an hour.
+func New() *Server {
+	return &Server{
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+		tokens:     map[string]time.Time{},
+		pushes:     map[string]*Push{},
+		tokenTTL:   time.Hour,
+	}
+}
+
+// Pushes returns a copy of every push received so far, oldest first
+func (s *Server) Pushes() []Push {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pushes := make([]Push, 0, len(s.order))
+	for _, id := range s.order {
+		pushes = append(pushes, *s.pushes[id])
+	}
+	return pushes
+}
+
+// SetTokenTTL changes how long tokens issued from now on are valid for
+func (s *Server) SetTokenTTL(ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokenTTL = ttl
+}
+
+// TokensIssued returns how many OAuth tokens the fake has issued
+func (s *Server) TokensIssued() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.issued
+}
+
+// RevokeTokens invalidates every token issued so far, as when Safaricom rotates them early
+func (s *Server) RevokeTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens = map[string]time.Time{}
+}
+
+// Settle records the outcome of a push without delivering its callback, as when Safaricom's
+// callback is lost; the result is still returned by STK push queries
+func (s *Server) Settle(checkoutRequestID string, resultCode int) error {
+	_, err := s.settle(checkoutRequestID, resultCode)
+	return err
+}
+
+// Complete records the outcome of a push and posts its callback
+func (s *Server) Complete(checkoutRequestID string, resultCode int) error {
+	push, err := s.settle(checkoutRequestID, resultCode)
+	if err != nil {
+		return err
+	}
+	return s.deliver(push)
+}
+
+func (s *Server) settle(checkoutRequestID string, resultCode int) (Push, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	push, ok := s.pushes[checkoutRequestID]
+	if !ok {
+		return Push{}, ErrUnknownCheckout
+	}
+
+	push.ResultCode = &resultCode
+	push.ResultDesc = resultDescription(resultCode)
+	if resultCode == daraja.ResultCodeSuccess && push.ReceiptNumber == "" {
+		push.ReceiptNumber = fmt.Sprintf("FAKE%06d", s.seq)
+	}
+	return *push, nil
+}
+
+// deliver posts the STK callback for a settled push
+func (s *Server) deliver(push Push) error {
+	result := map[string]interface{}{
+		"MerchantRequestID": push.MerchantRequestID,
+		"CheckoutRequestID": push.CheckoutRequestID,
+		"ResultCode":        *push.ResultCode,
+		"ResultDesc":        push.ResultDesc,
+	}
+	if *push.ResultCode == daraja.ResultCodeSuccess {
+		var phone float64
+		fmt.Sscanf(push.PhoneNumber, "%f", &phone)
+		var date float64
+		fmt.Sscanf(daraja.Timestamp(time.Now()), "%f", &date)
+
+		result["CallbackMetadata"] = map[string]interface{}{
+			"Item": []map[string]interface{}{
+				{"Name": "Amount", "Value": float64(push.Amount)},
+				{"Name": "MpesaReceiptNumber", "Value": push.ReceiptNumber},
+				{"Name": "Balance"},
+				{"Name": "TransactionDate", "Value": date},
+				{"Name": "PhoneNumber", "Value": phone},
+			},
+		}
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"Body": map[string]interface{}{"stkCallback": result}})
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.HTTPClient.Post(push.CallBackURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("darajafake: deliver callback: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("darajafake: callback returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func resultDescription(code int) string {
+	switch code {
+	case daraja.ResultCodeSuccess:
+		return "The service request is processed successfully."
+	case daraja.ResultCodeCancelled:
+		return "Request cancelled by user"
+	case daraja.ResultCodeTimeout:
+		return "DS timeout user cannot be reached"
+	case 1:
+		return "The balance is insufficient for the transaction."
+	default:
+		return "The transaction failed."
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/oauth/v1/generate":
+		s.token(w, r)
+	case r.Method == http.MethodPost && r.URL.Path == "/mpesa/stkpush/v1/processrequest":
+		if s.authorized(w, r) {
+			s.stkPush(w, r)
+		}
+	case r.Method == http.MethodPost && r.URL.Path == "/mpesa/stkpushquery/v1/query":
+		if s.authorized(w, r) {
+			s.stkQuery(w, r)
+		}
+	case r.Method == http.MethodPost && r.URL.Path == "/mpesa/c2b/v1/registerurl":
+		if s.authorized(w, r) {
+			s.registerURL(w, r)
+		}
+	case r.Method == http.MethodPost && r.URL.Path == "/mpesa/c2b/v1/simulate":
+		if s.authorized(w, r) {
+			s.simulate(w, r)
+		}
+	default:
+		writeError(w, http.StatusNotFound, "404.001.03", "Invalid Access Token")
+	}
+}
+
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	if _, _, ok := r.BasicAuth(); !ok || r.URL.Query().Get("grant_type") != "client_credentials" {
+		writeError(w, http.StatusBadRequest, "400.008.01", "Invalid Authentication passed")
+		return
+	}
+
+	s.mu.Lock()
+	s.seq++
+	token := fmt.Sprintf("fake-token-%d", s.seq)
+	s.tokens[token] = time.Now().Add(s.tokenTTL)
+	s.issued++
+	ttl := s.tokenTTL
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"access_token": token,
+		"expires_in":   fmt.Sprint(int(ttl.Seconds())),
+	})
+}
+
+func (s *Server) authorized(w http.ResponseWriter, r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	s.mu.Lock()
+	expiresAt, ok := s.tokens[token]
+	s.mu.Unlock()
+
+	if !ok || time.Now().After(expiresAt) {
+		writeError(w, http.StatusUnauthorized, "404.001.03", "Invalid Access Token")
+		return false
+	}
+	return true
+}
+
+func (s *Server) stkPush(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		BusinessShortCode string
+		Password          string
+		Timestamp         string
+		Amount            int
+		PhoneNumber       string
+		CallBackURL       string
+		AccountReference  string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "400.002.02", "Bad Request - Invalid Request")
+		return
+	}
+	if body.BusinessShortCode == "" || body.Password == "" || body.Timestamp == "" {
+		writeError(w, http.StatusBadRequest, "400.002.02", "Bad Request - Invalid BusinessShortCode")
+		return
+	}
+	if body.Amount <= 0 {
+		writeError(w, http.StatusBadRequest, "400.002.02", "Bad Request - Invalid Amount")
+		return
+	}
+	if !strings.HasPrefix(body.CallBackURL, "http") {
+		writeError(w, http.StatusBadRequest, "400.002.02", "Bad Request - Invalid CallBackURL")
+		return
+	}
+
+	s.mu.Lock()
+	s.seq++
+	push := &Push{
+		MerchantRequestID: fmt.Sprintf("fake-merchant-%d", s.seq),
+		CheckoutRequestID: fmt.Sprintf("ws_CO_FAKE_%d", s.seq),
+		ShortCode:         body.BusinessShortCode,
+		Amount:            body.Amount,
+		PhoneNumber:       body.PhoneNumber,
+		AccountReference:  body.AccountReference,
+		CallBackURL:       body.CallBackURL,
+	}
+	s.pushes[push.CheckoutRequestID] = push
+	s.order = append(s.order, push.CheckoutRequestID)
+	autoResult := s.AutoResult
+	s.mu.Unlock()
+
+	if autoResult != nil {
+		go func(id string, code int) {
+			time.Sleep(s.AutoDelay)
+			if err := s.Complete(id, code); err != nil {
+				log.Printf("darajafake: auto-complete %s: %v", id, err)
+			}
+		}(push.CheckoutRequestID, *autoResult)
+	}
+
+	writeJSON(w, http.StatusOK, daraja.STKPushResponse{
+		MerchantRequestID:   push.MerchantRequestID,
+		CheckoutRequestID:   push.CheckoutRequestID,
+		ResponseCode:        "0",
+		ResponseDescription: "Success. Request accepted for processing",
+		CustomerMessage:     "Success. Request accepted for processing",
+	})
+}
+
+func (s *Server) stkQuery(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		CheckoutRequestID string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "400.002.02", "Bad Request - Invalid Request")
+		return
+	}
+
+	s.mu.Lock()
+	push, ok := s.pushes[body.CheckoutRequestID]
+	var snapshot Push
+	if ok {
+		snapshot = *push
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		writeError(w, http.StatusBadRequest, "400.002.02", "Bad Request - Invalid CheckoutRequestID")
+		return
+	}
+	if snapshot.ResultCode == nil {
+		writeError(w, http.StatusInternalServerError, "500.001.1001", "The transaction is being processed")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, daraja.STKQueryResponse{
+		ResponseCode:        "0",
+		ResponseDescription: "The service request has been accepted successsfully",
+		MerchantRequestID:   snapshot.MerchantRequestID,
+		CheckoutRequestID:   snapshot.CheckoutRequestID,
+		ResultCode:          fmt.Sprint(*snapshot.ResultCode),
+		ResultDesc:          snapshot.ResultDesc,
+	})
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, map[string]string{
+		"requestId":    "fake-request",
+		"errorCode":    code,
+		"errorMessage": message,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
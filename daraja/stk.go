@@ -0,0 +1,138 @@
+package daraja
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Transaction types accepted by STK push
+const (
+	CustomerPayBillOnline  = "CustomerPayBillOnline"
+	CustomerBuyGoodsOnline = "CustomerBuyGoodsOnline"
+)
+
+// Result codes with a meaning of their own; every other non-zero code is a failure
+const (
+	ResultCodeSuccess   = 0
+	ResultCodeCancelled = 1032 // the customer dismissed the STK prompt
+	ResultCodeTimeout   = 1037 // the customer's phone could not be reached or never answered
+)
+
+// STKPushRequest asks the customer's phone to authorise a payment. The client fills in the
+// short code, password and timestamp.
+type STKPushRequest struct {
+	Amount           int
+	PhoneNumber      string
+	CallBackURL      string
+	AccountReference string
+	TransactionDesc  string
+	// TransactionType defaults to CustomerPayBillOnline
+	TransactionType string
+}
+
+// stkPushBody is the wire format of an STK push
+type stkPushBody struct {
+	BusinessShortCode string `json:"BusinessShortCode"`
+	Password          string `json:"Password"`
+	Timestamp         string `json:"Timestamp"`
+	TransactionType   string `json:"TransactionType"`
+	Amount            int    `json:"Amount"`
+	PartyA            string `json:"PartyA"`
+	PartyB            string `json:"PartyB"`
+	PhoneNumber       string `json:"PhoneNumber"`
+	CallBackURL       string `json:"CallBackURL"`
+	AccountReference  string `json:"AccountReference"`
+	TransactionDesc   string `json:"TransactionDesc"`
+}
+
+// STKPushResponse acknowledges an STK push. The outcome arrives later on the callback URL.
+type STKPushResponse struct {
+	MerchantRequestID   string `json:"MerchantRequestID"`
+	CheckoutRequestID   string `json:"CheckoutRequestID"`
+	ResponseCode        string `json:"ResponseCode"`
+	ResponseDescription string `json:"ResponseDescription"`
+	CustomerMessage     string `json:"CustomerMessage"`
+}
+
+// STKPush sends an STK push prompt to the customer's phone
+func (c *Client) STKPush(req STKPushRequest) (*STKPushResponse, error) {
+	if !c.Configured() {
+		return nil, ErrNotConfigured
+	}
+
+	transactionType := req.TransactionType
+	if transactionType == "" {
+		transactionType = CustomerPayBillOnline
+	}
+
+	timestamp := Timestamp(time.Now())
+	var response STKPushResponse
+	if err := c.post("/mpesa/stkpush/v1/processrequest", stkPushBody{
+		BusinessShortCode: c.ShortCode,
+		Password:          c.password(timestamp),
+		Timestamp:         timestamp,
+		TransactionType:   transactionType,
+		Amount:            req.Amount,
+		PartyA:            req.PhoneNumber,
+		PartyB:            c.ShortCode,
+		PhoneNumber:       req.PhoneNumber,
+		CallBackURL:       req.CallBackURL,
+		AccountReference:  req.AccountReference,
+		TransactionDesc:   req.TransactionDesc,
+	}, &response); err != nil {
+		return nil, err
+	}
+
+	if response.ResponseCode != "0" {
+		return nil, &APIError{StatusCode: 200, Code: response.ResponseCode, Message: response.ResponseDescription}
+	}
+	return &response, nil
+}
+
+// stkQueryBody is the wire format of an STK push query
+type stkQueryBody struct {
+	BusinessShortCode string `json:"BusinessShortCode"`
+	Password          string `json:"Password"`
+	Timestamp         string `json:"Timestamp"`
+	CheckoutRequestID string `json:"CheckoutRequestID"`
+}
+
+// STKQueryResponse is the result of an STK push query. ResultCode is sent as a string; use Code.
+type STKQueryResponse struct {
+	ResponseCode        string `json:"ResponseCode"`
+	ResponseDescription string `json:"ResponseDescription"`
+	MerchantRequestID   string `json:"MerchantRequestID"`
+	CheckoutRequestID   string `json:"CheckoutRequestID"`
+	ResultCode          string `json:"ResultCode"`
+	ResultDesc          string `json:"ResultDesc"`
+}
+
+// Code returns the numeric result code
+func (r STKQueryResponse) Code() (int, error) {
+	code, err := strconv.Atoi(r.ResultCode)
+	if err != nil {
+		return 0, fmt.Errorf("daraja: invalid result code %q", r.ResultCode)
+	}
+	return code, nil
+}
+
+// STKPushQuery asks for the outcome of an STK push. While the customer has not answered it
+// fails with an error for which IsStillProcessing is true.
+func (c *Client) STKPushQuery(checkoutRequestID string) (*STKQueryResponse, error) {
+	if !c.Configured() {
+		return nil, ErrNotConfigured
+	}
+
+	timestamp := Timestamp(time.Now())
+	var response STKQueryResponse
+	if err := c.post("/mpesa/stkpushquery/v1/query", stkQueryBody{
+		BusinessShortCode: c.ShortCode,
+		Password:          c.password(timestamp),
+		Timestamp:         timestamp,
+		CheckoutRequestID: checkoutRequestID,
+	}, &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
@@ -0,0 +1,103 @@
+package daraja_test
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"mobile-customer-portal-server/daraja"
+)
+
+func stkRequest() daraja.STKPushRequest {
+	return daraja.STKPushRequest{
+		Amount:           1500,
+		PhoneNumber:      "254712345678",
+		CallBackURL:      "https://portal.example.com/api/payments/callback",
+		AccountReference: "LF-001",
+		TransactionDesc:  "Installment",
+	}
+}
+
+func TestSTKPush(t *testing.T) {
+	client, fake := newFakeClient(t)
+
+	response, err := client.STKPush(stkRequest())
+	if err != nil {
+		t.Fatalf("STKPush: %v", err)
+	}
+	if response.CheckoutRequestID == "" || response.MerchantRequestID == "" {
+		t.Fatalf("response = %+v", response)
+	}
+
+	pushes := fake.Pushes()
+	if len(pushes) != 1 {
+		t.Fatalf("%d pushes, want 1", len(pushes))
+	}
+	push := pushes[0]
+	if push.CheckoutRequestID != response.CheckoutRequestID || push.ShortCode != "174379" || push.Amount != 1500 ||
+		push.PhoneNumber != "254712345678" || push.AccountReference != "LF-001" {
+		t.Fatalf("push = %+v", push)
+	}
+}
+
+func TestSTKPushRejected(t *testing.T) {
+	client, _ := newFakeClient(t)
+
+	request := stkRequest()
+	request.Amount = 0
+	_, err := client.STKPush(request)
+	var apiErr *daraja.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("err = %v, want a 400 APIError", err)
+	}
+}
+
+func TestSTKPushNotConfigured(t *testing.T) {
+	client, fake := newFakeClient(t)
+	client.PassKey = ""
+
+	if _, err := client.STKPush(stkRequest()); !errors.Is(err, daraja.ErrNotConfigured) {
+		t.Fatalf("err = %v, want %v", err, daraja.ErrNotConfigured)
+	}
+	if len(fake.Pushes()) != 0 {
+		t.Fatal("push sent without a pass key")
+	}
+}
+
+func TestSTKPushQuery(t *testing.T) {
+	client, fake := newFakeClient(t)
+
+	response, err := client.STKPush(stkRequest())
+	if err != nil {
+		t.Fatalf("STKPush: %v", err)
+	}
+
+	// Until the customer answers, Daraja reports the push as still processing
+	if _, err := client.STKPushQuery(response.CheckoutRequestID); !daraja.IsStillProcessing(err) {
+		t.Fatalf("err = %v, want still processing", err)
+	}
+
+	if err := fake.Settle(response.CheckoutRequestID, daraja.ResultCodeCancelled); err != nil {
+		t.Fatal(err)
+	}
+	result, err := client.STKPushQuery(response.CheckoutRequestID)
+	if err != nil {
+		t.Fatalf("STKPushQuery: %v", err)
+	}
+	if code, err := result.Code(); err != nil || code != daraja.ResultCodeCancelled {
+		t.Fatalf("Code() = %d, %v; want %d", code, err, daraja.ResultCodeCancelled)
+	}
+	if result.CheckoutRequestID != response.CheckoutRequestID {
+		t.Fatalf("result = %+v", result)
+	}
+}
+
+func TestSTKPushQueryUnknownCheckout(t *testing.T) {
+	client, _ := newFakeClient(t)
+
+	_, err := client.STKPushQuery("ws_CO_UNKNOWN")
+	var apiErr *daraja.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest || daraja.IsStillProcessing(err) {
+		t.Fatalf("err = %v, want a 400 APIError", err)
+	}
+}
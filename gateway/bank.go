@@ -0,0 +1,67 @@
+package gateway
+
+import (
+	"errors"
+	"os"
+	"strings"
+
+	"mobile-customer-portal-server/utils"
+)
+
+// ErrNoBankAccount is returned when the project being paid for has no bank details on record
+var ErrNoBankAccount = errors.New("gateway: no bank account on record for this project")
+
+// bankReferenceBytes is the length of the random part of a transfer reference
+const bankReferenceBytes = 4
+
+// BankTransferProvider answers a payment with the bank account to transfer into and a
+// reference to quote. Nothing leaves the process: the payment stays pending until finance posts
+// the transfer and it is matched to the receipt.
+type BankTransferProvider struct {
+	// AccountName is the name the project accounts are held in
+	AccountName string
+}
+
+// NewBankTransferProviderFromEnv names the account holder from BANK_ACCOUNT_NAME, defaulting
+// to Optiven Limited
+func NewBankTransferProviderFromEnv() *BankTransferProvider {
+	name := os.Getenv("BANK_ACCOUNT_NAME")
+	if name == "" {
+		name = "Optiven Limited"
+	}
+	return &BankTransferProvider{AccountName: name}
+}
+
+func (p *BankTransferProvider) Method() Method {
+	return MethodBankTransfer
+}
+
+// Start issues a transfer reference of the form <plot>-<random>, e.g. "VP123-9F2A41C0"
+func (p *BankTransferProvider) Start(req Request) (*Session, error) {
+	if strings.TrimSpace(req.BankName) == "" || strings.TrimSpace(req.AccountNumber) == "" {
+		return nil, ErrNoBankAccount
+	}
+
+	suffix, err := utils.GenerateRandomHex(bankReferenceBytes)
+	if err != nil {
+		return nil, err
+	}
+	reference := strings.ToUpper(suffix)
+	if account := strings.TrimSpace(req.AccountReference); account != "" {
+		reference = strings.ToUpper(account) + "-" + reference
+	}
+
+	instructions := &BankInstructions{
+		BankName:      strings.TrimSpace(req.BankName),
+		AccountName:   p.AccountName,
+		AccountNumber: strings.TrimSpace(req.AccountNumber),
+		Reference:     reference,
+		Amount:        req.Amount,
+		Currency:      req.Currency,
+	}
+	return &Session{
+		Reference:    reference,
+		Message:      "Quote reference " + reference + " on your bank transfer",
+		Instructions: instructions,
+	}, nil
+}
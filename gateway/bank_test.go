@@ -0,0 +1,91 @@
+package gateway_test
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+
+	"mobile-customer-portal-server/gateway"
+)
+
+func TestBankTransferStart(t *testing.T) {
+	provider := &gateway.BankTransferProvider{AccountName: "Optiven Limited"}
+
+	session, err := provider.Start(gateway.Request{
+		Amount:           250000,
+		Currency:         "KES",
+		AccountReference: "vp123",
+		BankName:         " KCB ",
+		AccountNumber:    " 1234567890 ",
+	})
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	if !regexp.MustCompile(`^VP123-[0-9A-F]{8}$`).MatchString(session.Reference) {
+		t.Fatalf("reference = %q, want VP123-<8 hex digits>", session.Reference)
+	}
+	if session.RedirectURL != "" {
+		t.Fatalf("bank transfer has a redirect URL %q", session.RedirectURL)
+	}
+
+	want := gateway.BankInstructions{
+		BankName:      "KCB",
+		AccountName:   "Optiven Limited",
+		AccountNumber: "1234567890",
+		Reference:     session.Reference,
+		Amount:        250000,
+		Currency:      "KES",
+	}
+	if session.Instructions == nil || *session.Instructions != want {
+		t.Fatalf("instructions = %+v, want %+v", session.Instructions, want)
+	}
+}
+
+func TestBankTransferReferencesAreUnique(t *testing.T) {
+	provider := &gateway.BankTransferProvider{AccountName: "Optiven Limited"}
+	request := gateway.Request{Amount: 1000, Currency: "KES", BankName: "KCB", AccountNumber: "1234567890"}
+
+	seen := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		session, err := provider.Start(request)
+		if err != nil {
+			t.Fatalf("Start: %v", err)
+		}
+		// Without a plot the reference is only the random part
+		if !regexp.MustCompile(`^[0-9A-F]{8}$`).MatchString(session.Reference) {
+			t.Fatalf("reference = %q", session.Reference)
+		}
+		if seen[session.Reference] {
+			t.Fatalf("reference %q issued twice", session.Reference)
+		}
+		seen[session.Reference] = true
+	}
+}
+
+func TestBankTransferWithoutAccount(t *testing.T) {
+	provider := &gateway.BankTransferProvider{AccountName: "Optiven Limited"}
+
+	tests := []gateway.Request{
+		{Amount: 1000, AccountNumber: "1234567890"},
+		{Amount: 1000, BankName: "KCB"},
+		{Amount: 1000, BankName: "  ", AccountNumber: "  "},
+	}
+	for _, request := range tests {
+		if _, err := provider.Start(request); !errors.Is(err, gateway.ErrNoBankAccount) {
+			t.Errorf("Start(%+v) err = %v, want %v", request, err, gateway.ErrNoBankAccount)
+		}
+	}
+}
+
+func TestNewBankTransferProviderFromEnv(t *testing.T) {
+	t.Setenv("BANK_ACCOUNT_NAME", "")
+	if provider := gateway.NewBankTransferProviderFromEnv(); provider.AccountName != "Optiven Limited" {
+		t.Errorf("default account name = %q", provider.AccountName)
+	}
+
+	t.Setenv("BANK_ACCOUNT_NAME", "Optiven Properties")
+	if provider := gateway.NewBankTransferProviderFromEnv(); provider.AccountName != "Optiven Properties" {
+		t.Errorf("account name = %q", provider.AccountName)
+	}
+}
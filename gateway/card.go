@@ -0,0 +1,219 @@
+package gateway
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// SignatureHeader carries the hex HMAC-SHA256 of a card webhook body, keyed with the webhook secret
+const SignatureHeader = "X-Signature"
+
+// ErrInvalidSignature is returned for a card webhook that was not signed with our secret
+var ErrInvalidSignature = errors.New("gateway: invalid webhook signature")
+
+// CardProvider starts card payments on a hosted checkout page, Pesapal/Flutterwave style: the
+// app opens RedirectURL, the customer pays there and the provider posts the outcome to the
+// callback URL, signed with WebhookSecret.
+type CardProvider struct {
+	BaseURL       string
+	APIKey        string
+	WebhookSecret string
+	HTTPClient    *http.Client
+}
+
+// NewCardProviderFromEnv configures a card provider from CARD_CHECKOUT_URL, CARD_API_KEY and
+// CARD_WEBHOOK_SECRET. Point CARD_CHECKOUT_URL at cmd/cardfake to pay without a real gateway.
+func NewCardProviderFromEnv() *CardProvider {
+	return &CardProvider{
+		BaseURL:       strings.TrimRight(os.Getenv("CARD_CHECKOUT_URL"), "/"),
+		APIKey:        os.Getenv("CARD_API_KEY"),
+		WebhookSecret: os.Getenv("CARD_WEBHOOK_SECRET"),
+		HTTPClient:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (p *CardProvider) Method() Method {
+	return MethodCard
+}
+
+// CheckoutRequest is the wire format of a hosted checkout session request
+type CheckoutRequest struct {
+	Amount           float64 `json:"amount"`
+	Currency         string  `json:"currency"`
+	Description      string  `json:"description"`
+	AccountReference string  `json:"account_reference"`
+	CustomerEmail    string  `json:"customer_email"`
+	CustomerPhone    string  `json:"customer_phone"`
+	CustomerName     string  `json:"customer_name"`
+	CallbackURL      string  `json:"callback_url"`
+	ReturnURL        string  `json:"return_url"`
+}
+
+// CheckoutSession is the provider's view of a checkout, returned when it is created or queried
+// and posted to the callback URL when it ends
+type CheckoutSession struct {
+	ID            string  `json:"id"`
+	Status        string  `json:"status"`
+	RedirectURL   string  `json:"redirect_url,omitempty"`
+	Amount        float64 `json:"amount"`
+	Currency      string  `json:"currency"`
+	TransactionID string  `json:"transaction_id,omitempty"`
+	PaidAt        string  `json:"paid_at,omitempty"`
+	Message       string  `json:"message,omitempty"`
+}
+
+// Start opens a hosted checkout session
+func (p *CardProvider) Start(req Request) (*Session, error) {
+	var session CheckoutSession
+	if err := p.call("POST", "/v1/checkout-sessions", CheckoutRequest{
+		Amount:           req.Amount,
+		Currency:         req.Currency,
+		Description:      req.Description,
+		AccountReference: req.AccountReference,
+		CustomerEmail:    req.Email,
+		CustomerPhone:    req.PhoneNumber,
+		CustomerName:     req.CustomerName,
+		CallbackURL:      req.CallbackURL,
+		ReturnURL:        req.ReturnURL,
+	}, &session); err != nil {
+		return nil, err
+	}
+	if session.ID == "" || session.RedirectURL == "" {
+		return nil, errors.New("gateway: checkout session missing id or redirect_url")
+	}
+
+	return &Session{
+		Reference:   session.ID,
+		Message:     "Complete your card payment on the checkout page",
+		RedirectURL: session.RedirectURL,
+	}, nil
+}
+
+// Status asks the provider how a checkout session ended
+func (p *CardProvider) Status(reference string) (*Event, error) {
+	var session CheckoutSession
+	if err := p.call("GET", "/v1/checkout-sessions/"+url.PathEscape(reference), nil, &session); err != nil {
+		return nil, err
+	}
+	return session.event(), nil
+}
+
+// ParseWebhook verifies the signature of a webhook and decodes the session it reports on
+func (p *CardProvider) ParseWebhook(header http.Header, body []byte) (*Event, error) {
+	if p.WebhookSecret == "" || !ValidSignature(p.WebhookSecret, body, header.Get(SignatureHeader)) {
+		return nil, ErrInvalidSignature
+	}
+
+	var session CheckoutSession
+	if err := json.Unmarshal(body, &session); err != nil {
+		return nil, fmt.Errorf("gateway: decode webhook: %w", err)
+	}
+	if session.ID == "" {
+		return nil, errors.New("gateway: webhook missing session id")
+	}
+	return session.event(), nil
+}
+
+// Sign returns the signature of a webhook body
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ValidSignature reports whether signature is the signature of body
+func ValidSignature(secret string, body []byte, signature string) bool {
+	expected, err := hex.DecodeString(Sign(secret, body))
+	if err != nil {
+		return false
+	}
+	given, err := hex.DecodeString(strings.TrimSpace(signature))
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(expected, given)
+}
+
+// event maps a checkout session to the generic outcome of a payment
+func (s CheckoutSession) event() *Event {
+	event := &Event{
+		Reference:     s.ID,
+		Amount:        s.Amount,
+		Currency:      s.Currency,
+		TransactionID: s.TransactionID,
+		Message:       s.Message,
+	}
+
+	switch strings.ToLower(s.Status) {
+	case "completed", "succeeded", "successful", "paid":
+		event.Status = StatusSuccess
+	case "failed", "declined", "reversed":
+		event.Status = StatusFailed
+	case "cancelled", "canceled", "expired":
+		event.Status = StatusCancelled
+	default:
+		event.Status = StatusPending
+	}
+
+	if s.PaidAt != "" {
+		if paidAt, err := time.Parse(time.RFC3339, s.PaidAt); err == nil {
+			event.PaidAt = &paidAt
+		}
+	}
+	return event
+}
+
+// call sends an authenticated JSON request and decodes the response into out
+func (p *CardProvider) call(method, path string, body, out interface{}) error {
+	if p.BaseURL == "" || p.APIKey == "" {
+		return errors.New("gateway: card provider not configured")
+	}
+
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequest(method, p.BaseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.APIKey)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("gateway: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("gateway: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("gateway: card provider returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return fmt.Errorf("gateway: decode response: %w", err)
+	}
+	return nil
+}
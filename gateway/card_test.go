@@ -0,0 +1,226 @@
+package gateway_test
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"mobile-customer-portal-server/gateway"
+	"mobile-customer-portal-server/gateway/cardfake"
+)
+
+const testSecret = "whsec_test"
+
+// webhook is a webhook the fake posted
+type webhook struct {
+	header http.Header
+	body   []byte
+}
+
+// newFakeCardProvider returns a provider configured against a fresh fake, and a callback URL
+// whose webhooks are delivered on the returned channel
+func newFakeCardProvider(t *testing.T) (*gateway.CardProvider, *cardfake.Server, string, <-chan webhook) {
+	t.Helper()
+	fake := cardfake.New("", testSecret)
+	fake.APIKey = "sk_test"
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	fake.PublicURL = server.URL
+
+	webhooks := make(chan webhook, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		webhooks <- webhook{header: r.Header.Clone(), body: body}
+	}))
+	t.Cleanup(receiver.Close)
+
+	return &gateway.CardProvider{
+		BaseURL:       server.URL,
+		APIKey:        "sk_test",
+		WebhookSecret: testSecret,
+		HTTPClient:    server.Client(),
+	}, fake, receiver.URL, webhooks
+}
+
+func cardRequest(callbackURL string) gateway.Request {
+	return gateway.Request{
+		Amount:           120.50,
+		Currency:         "USD",
+		Email:            "jane@example.com",
+		PhoneNumber:      "254712345678",
+		CustomerName:     "Jane Doe",
+		AccountReference: "VP123",
+		Description:      "Installment for VP123",
+		CallbackURL:      callbackURL,
+		ReturnURL:        "https://portal.example.com/payments/return",
+	}
+}
+
+func TestCardStart(t *testing.T) {
+	provider, fake, _, _ := newFakeCardProvider(t)
+
+	session, err := provider.Start(cardRequest("https://portal.example.com/api/payments/card/webhook"))
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if session.Reference == "" || !strings.HasSuffix(session.RedirectURL, "/checkout/"+session.Reference) {
+		t.Fatalf("session = %+v", session)
+	}
+
+	checkouts := fake.Checkouts()
+	if len(checkouts) != 1 {
+		t.Fatalf("%d checkouts, want 1", len(checkouts))
+	}
+	request := checkouts[0].Request
+	if request.Amount != 120.50 || request.Currency != "USD" || request.AccountReference != "VP123" ||
+		request.CustomerEmail != "jane@example.com" || request.ReturnURL != "https://portal.example.com/payments/return" {
+		t.Fatalf("checkout request = %+v", request)
+	}
+}
+
+func TestCardStartErrors(t *testing.T) {
+	provider, _, _, _ := newFakeCardProvider(t)
+
+	// The fake refuses a checkout without a callback URL
+	if _, err := provider.Start(cardRequest("")); err == nil {
+		t.Error("Start without a callback URL succeeded")
+	}
+
+	provider.APIKey = "sk_wrong"
+	if _, err := provider.Start(cardRequest("https://portal.example.com/webhook")); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("err = %v, want a 401", err)
+	}
+
+	unconfigured := &gateway.CardProvider{HTTPClient: http.DefaultClient}
+	if _, err := unconfigured.Start(cardRequest("https://portal.example.com/webhook")); err == nil {
+		t.Error("Start without a base URL succeeded")
+	}
+}
+
+func TestCardStatus(t *testing.T) {
+	tests := []struct {
+		settle string
+		want   string
+	}{
+		{"", gateway.StatusPending},
+		{"completed", gateway.StatusSuccess},
+		{"failed", gateway.StatusFailed},
+		{"cancelled", gateway.StatusCancelled},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			provider, fake, _, _ := newFakeCardProvider(t)
+			session, err := provider.Start(cardRequest("https://portal.example.com/webhook"))
+			if err != nil {
+				t.Fatalf("Start: %v", err)
+			}
+			if tt.settle != "" {
+				if err := fake.Settle(session.Reference, tt.settle); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			event, err := provider.Status(session.Reference)
+			if err != nil {
+				t.Fatalf("Status: %v", err)
+			}
+			if event.Reference != session.Reference || event.Status != tt.want || event.Amount != 120.50 || event.Currency != "USD" {
+				t.Fatalf("event = %+v", event)
+			}
+			if tt.want == gateway.StatusSuccess && (event.TransactionID == "" || event.PaidAt == nil) {
+				t.Fatalf("successful event missing transaction details: %+v", event)
+			}
+		})
+	}
+}
+
+func TestCardStatusUnknownSession(t *testing.T) {
+	provider, _, _, _ := newFakeCardProvider(t)
+
+	if _, err := provider.Status("cs_unknown"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("err = %v, want a 404", err)
+	}
+}
+
+func TestCardParseWebhook(t *testing.T) {
+	provider, fake, callbackURL, webhooks := newFakeCardProvider(t)
+	session, err := provider.Start(cardRequest(callbackURL))
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	if err := fake.Complete(session.Reference, "completed"); err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	delivered := <-webhooks
+
+	event, err := provider.ParseWebhook(delivered.header, delivered.body)
+	if err != nil {
+		t.Fatalf("ParseWebhook: %v", err)
+	}
+	if event.Reference != session.Reference || event.Status != gateway.StatusSuccess || event.Amount != 120.50 ||
+		event.Currency != "USD" || event.TransactionID == "" || event.PaidAt == nil {
+		t.Fatalf("event = %+v", event)
+	}
+}
+
+func TestCardParseWebhookRejectsBadSignatures(t *testing.T) {
+	provider, fake, callbackURL, webhooks := newFakeCardProvider(t)
+	session, err := provider.Start(cardRequest(callbackURL))
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if err := fake.Complete(session.Reference, "completed"); err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	delivered := <-webhooks
+
+	tampered := []byte(strings.Replace(string(delivered.body), "120.5", "1.5", 1))
+	otherSecret := http.Header{}
+	otherSecret.Set(gateway.SignatureHeader, gateway.Sign("whsec_other", delivered.body))
+	notHex := http.Header{}
+	notHex.Set(gateway.SignatureHeader, "not-a-signature")
+
+	tests := []struct {
+		name     string
+		provider *gateway.CardProvider
+		header   http.Header
+		body     []byte
+	}{
+		{"tampered body", provider, delivered.header, tampered},
+		{"other secret", provider, otherSecret, delivered.body},
+		{"not hex", provider, notHex, delivered.body},
+		{"no signature", provider, http.Header{}, delivered.body},
+		{"no secret configured", &gateway.CardProvider{}, delivered.header, delivered.body},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.provider.ParseWebhook(tt.header, tt.body); !errors.Is(err, gateway.ErrInvalidSignature) {
+				t.Fatalf("err = %v, want %v", err, gateway.ErrInvalidSignature)
+			}
+		})
+	}
+}
+
+func TestValidSignature(t *testing.T) {
+	body := []byte(`{"id":"cs_1","status":"completed"}`)
+	signature := gateway.Sign(testSecret, body)
+
+	if !gateway.ValidSignature(testSecret, body, signature) {
+		t.Error("own signature rejected")
+	}
+	if !gateway.ValidSignature(testSecret, body, " "+signature+"\n") {
+		t.Error("signature with surrounding whitespace rejected")
+	}
+	if gateway.ValidSignature(testSecret, body, signature[:len(signature)-2]) {
+		t.Error("truncated signature accepted")
+	}
+	if gateway.ValidSignature("other", body, signature) {
+		t.Error("signature under another secret accepted")
+	}
+}
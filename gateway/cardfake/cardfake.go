@@ -0,0 +1,276 @@
+// Package cardfake is a stand-in for a hosted card checkout. It creates checkout sessions,
+// serves a bare checkout page with pay and decline buttons, answers status queries, and posts
+// signed webhooks when a session ends. Point CARD_CHECKOUT_URL at a running instance (see
+// cmd/cardfake) to use it with the server.
+package cardfake
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"mobile-customer-portal-server/gateway"
+)
+
+// ErrUnknownSession is returned for a session ID the fake never issued
+var ErrUnknownSession = errors.New("cardfake: unknown checkout session")
+
+// Checkout is a checkout session the fake created
+type Checkout struct {
+	gateway.CheckoutSession
+	Request gateway.CheckoutRequest
+}
+
+// Server is an http.Handler implementing a hosted card checkout
+type Server struct {
+	// APIKey, when set, must be sent as a bearer token on API calls
+	APIKey string
+	// WebhookSecret signs the webhooks
+	WebhookSecret string
+	// PublicURL is the address the checkout pages are served on
+	PublicURL string
+	// HTTPClient delivers webhooks
+	HTTPClient *http.Client
+
+	mu       sync.Mutex
+	seq      int
+	sessions map[string]*Checkout
+	order    []string
+}
+
+// New creates a fake serving checkout pages on publicURL and signing webhooks with secret
+func New(publicURL, secret string) *Server {
+	return &Server{
+		WebhookSecret: secret,
+		PublicURL:     strings.TrimRight(publicURL, "/"),
+		HTTPClient:    &http.Client{Timeout: 10 * time.Second},
+		sessions:      map[string]*Checkout{},
+	}
+}
+
+// Checkouts returns a copy of every session created so far, oldest first
+func (s *Server) Checkouts() []Checkout {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	checkouts := make([]Checkout, 0, len(s.order))
+	for _, id := range s.order {
+		checkouts = append(checkouts, *s.sessions[id])
+	}
+	return checkouts
+}
+
+// Charge changes what a session reports it charged, as when the processor settles for another
+// amount or currency than was requested. Call it before Settle or Complete.
+func (s *Server) Charge(id string, amount float64, currency string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	checkout, ok := s.sessions[id]
+	if !ok {
+		return ErrUnknownSession
+	}
+	checkout.Amount = amount
+	checkout.Currency = currency
+	return nil
+}
+
+// Settle ends a session with status ("completed", "failed" or "cancelled") without sending
+// its webhook, as when the webhook is lost; status queries still see the outcome
+func (s *Server) Settle(id, status string) error {
+	_, err := s.settle(id, status)
+	return err
+}
+
+// Complete ends a session with status and posts its signed webhook
+func (s *Server) Complete(id, status string) error {
+	checkout, err := s.settle(id, status)
+	if err != nil {
+		return err
+	}
+	return s.deliver(checkout)
+}
+
+func (s *Server) settle(id, status string) (Checkout, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	checkout, ok := s.sessions[id]
+	if !ok {
+		return Checkout{}, ErrUnknownSession
+	}
+
+	checkout.Status = status
+	if status == "completed" {
+		s.seq++
+		checkout.TransactionID = fmt.Sprintf("FAKECARD%06d", s.seq)
+		checkout.PaidAt = time.Now().UTC().Format(time.RFC3339)
+		checkout.Message = "Approved"
+	} else {
+		checkout.Message = "Card " + status
+	}
+	return *checkout, nil
+}
+
+// deliver posts the signed webhook of a settled session
+func (s *Server) deliver(checkout Checkout) error {
+	body, err := json.Marshal(checkout.CheckoutSession)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", checkout.Request.CallbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(gateway.SignatureHeader, gateway.Sign(s.WebhookSecret, body))
+
+	resp, err := s.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("cardfake: deliver webhook: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("cardfake: webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/checkout-sessions":
+		if s.authorized(w, r) {
+			s.create(w, r)
+		}
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v1/checkout-sessions/"):
+		if s.authorized(w, r) {
+			s.status(w, strings.TrimPrefix(r.URL.Path, "/v1/checkout-sessions/"))
+		}
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/checkout/"):
+		s.page(w, strings.TrimPrefix(r.URL.Path, "/checkout/"))
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/checkout/"):
+		s.submit(w, r, strings.TrimPrefix(r.URL.Path, "/checkout/"))
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+	}
+}
+
+func (s *Server) authorized(w http.ResponseWriter, r *http.Request) bool {
+	if s.APIKey != "" && r.Header.Get("Authorization") != "Bearer "+s.APIKey {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid api key"})
+		return false
+	}
+	return true
+}
+
+func (s *Server) create(w http.ResponseWriter, r *http.Request) {
+	var req gateway.CheckoutRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		return
+	}
+	if req.Amount <= 0 || !strings.HasPrefix(req.CallbackURL, "http") {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "amount and callback_url are required"})
+		return
+	}
+
+	s.mu.Lock()
+	s.seq++
+	id := fmt.Sprintf("cs_fake_%d", s.seq)
+	checkout := &Checkout{
+		CheckoutSession: gateway.CheckoutSession{
+			ID:          id,
+			Status:      "pending",
+			RedirectURL: s.PublicURL + "/checkout/" + id,
+			Amount:      req.Amount,
+			Currency:    req.Currency,
+		},
+		Request: req,
+	}
+	s.sessions[id] = checkout
+	s.order = append(s.order, id)
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, checkout.CheckoutSession)
+}
+
+func (s *Server) status(w http.ResponseWriter, id string) {
+	s.mu.Lock()
+	checkout, ok := s.sessions[id]
+	var snapshot gateway.CheckoutSession
+	if ok {
+		snapshot = checkout.CheckoutSession
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown session"})
+		return
+	}
+	writeJSON(w, http.StatusOK, snapshot)
+}
+
+var checkoutPage = template.Must(template.New("checkout").Parse(`<!DOCTYPE html>
+<html><body>
+<h1>Fake card checkout</h1>
+<p>{{.Request.Description}}: {{.Currency}} {{.Amount}}</p>
+<form method="post"><button name="status" value="completed">Pay</button>
+<button name="status" value="failed">Decline</button>
+<button name="status" value="cancelled">Cancel</button></form>
+</body></html>`))
+
+func (s *Server) page(w http.ResponseWriter, id string) {
+	s.mu.Lock()
+	checkout, ok := s.sessions[id]
+	var snapshot Checkout
+	if ok {
+		snapshot = *checkout
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		http.NotFound(w, nil)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	checkoutPage.Execute(w, snapshot)
+}
+
+func (s *Server) submit(w http.ResponseWriter, r *http.Request, id string) {
+	status := r.FormValue("status")
+	if status != "completed" && status != "failed" && status != "cancelled" {
+		http.Error(w, "invalid status", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.Complete(id, status); err != nil {
+		log.Printf("cardfake: complete %s: %v", id, err)
+	}
+
+	s.mu.Lock()
+	returnURL := ""
+	if checkout, ok := s.sessions[id]; ok {
+		returnURL = checkout.Request.ReturnURL
+	}
+	s.mu.Unlock()
+
+	if returnURL != "" {
+		http.Redirect(w, r, returnURL, http.StatusSeeOther)
+		return
+	}
+	fmt.Fprintf(w, "Payment %s", status)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
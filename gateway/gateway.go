@@ -0,0 +1,162 @@
+// Package gateway starts payments through pluggable providers, one per payment method. M-PESA
+// goes through Daraja STK push, cards through a hosted checkout that reports back on a signed
+// webhook, and bank transfers are answered with the project's bank details for the customer to
+// pay into. Each provider can be pointed at a local fake (see darajafake and cardfake); the
+// bank transfer provider never leaves the process.
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"mobile-customer-portal-server/daraja"
+)
+
+// Method identifies how a customer pays
+type Method string
+
+const (
+	MethodMpesa        Method = "mpesa"
+	MethodCard         Method = "card"
+	MethodBankTransfer Method = "bank_transfer"
+)
+
+// Outcomes a provider reports for a payment
+const (
+	StatusPending   = "pending"
+	StatusSuccess   = "success"
+	StatusFailed    = "failed"
+	StatusCancelled = "cancelled"
+)
+
+// Request asks a provider to start a payment. Which fields matter depends on the method: STK
+// push needs PhoneNumber, a hosted checkout needs CallbackURL and ReturnURL, and a bank
+// transfer needs BankName and AccountNumber.
+type Request struct {
+	// Amount is in Currency; M-PESA only takes whole shillings
+	Amount       float64
+	Currency     string
+	PhoneNumber  string
+	Email        string
+	CustomerName string
+	// AccountReference is what the payment is for, usually the plot number
+	AccountReference string
+	Description      string
+	CallbackURL      string
+	ReturnURL        string
+	BankName         string
+	AccountNumber    string
+}
+
+// BankInstructions tell the customer where to send a bank transfer and what to quote on it
+type BankInstructions struct {
+	BankName      string  `json:"bank_name"`
+	AccountName   string  `json:"account_name"`
+	AccountNumber string  `json:"account_number"`
+	Reference     string  `json:"reference"`
+	Amount        float64 `json:"amount"`
+	Currency      string  `json:"currency"`
+}
+
+// Session is a payment a provider has accepted. Its outcome arrives later: on the M-PESA
+// callback, on the card webhook, or when finance posts the bank transfer.
+type Session struct {
+	// Reference is the provider's ID for the payment, e.g. the STK CheckoutRequestID
+	Reference         string
+	MerchantReference string
+	// Message is shown to the customer
+	Message string
+	// Detail is the provider's description of how the request was accepted
+	Detail string
+	// RedirectURL is the hosted checkout page the app opens
+	RedirectURL  string
+	Instructions *BankInstructions
+}
+
+// Event is what a provider reported about a payment, from a webhook or a status query
+type Event struct {
+	Reference     string
+	Status        string
+	Amount        float64
+	Currency      string
+	TransactionID string
+	PaidAt        *time.Time
+	Message       string
+}
+
+// Provider starts payments for one method
+type Provider interface {
+	Method() Method
+	Start(req Request) (*Session, error)
+}
+
+// WebhookParser is implemented by providers that report outcomes on a signed webhook
+type WebhookParser interface {
+	ParseWebhook(header http.Header, body []byte) (*Event, error)
+}
+
+// StatusChecker is implemented by providers that can be asked how a payment ended, for when
+// the webhook never arrives
+type StatusChecker interface {
+	Status(reference string) (*Event, error)
+}
+
+// ErrNoProvider is returned when no provider is registered for a method
+var ErrNoProvider = errors.New("no payment provider registered for method")
+
+var (
+	mu        sync.RWMutex
+	providers = map[Method]Provider{}
+)
+
+// Register sets the provider used for its method
+func Register(provider Provider) {
+	mu.Lock()
+	defer mu.Unlock()
+	providers[provider.Method()] = provider
+}
+
+// Get returns the provider registered for method
+func Get(method Method) (Provider, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	provider, ok := providers[method]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNoProvider, method)
+	}
+	return provider, nil
+}
+
+// Methods lists the methods customers can currently pay with
+func Methods() []Method {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	var methods []Method
+	for _, method := range []Method{MethodMpesa, MethodCard, MethodBankTransfer} {
+		if _, ok := providers[method]; ok {
+			methods = append(methods, method)
+		}
+	}
+	return methods
+}
+
+// Setup registers the M-PESA provider on daraja.Default, the bank transfer provider, and the
+// card provider when CARD_CHECKOUT_URL is set (see NewCardProviderFromEnv). Call it after
+// daraja.Setup.
+func Setup() {
+	Register(NewMpesaProvider(daraja.Default))
+	Register(NewBankTransferProviderFromEnv())
+
+	if os.Getenv("CARD_CHECKOUT_URL") != "" {
+		Register(NewCardProviderFromEnv())
+	}
+
+	log.Printf("Payment methods configured: %v", Methods())
+}
@@ -0,0 +1,44 @@
+package gateway
+
+import (
+	"math"
+
+	"mobile-customer-portal-server/daraja"
+)
+
+// MpesaProvider starts payments as Daraja STK pushes. The outcome arrives on the callback URL
+// in the request.
+type MpesaProvider struct {
+	Client *daraja.Client
+}
+
+// NewMpesaProvider creates a provider sending STK pushes through client
+func NewMpesaProvider(client *daraja.Client) *MpesaProvider {
+	return &MpesaProvider{Client: client}
+}
+
+func (p *MpesaProvider) Method() Method {
+	return MethodMpesa
+}
+
+// Start sends an STK push prompt to the customer's phone. Errors from Daraja are returned as
+// they are, so callers can show a *daraja.APIError's message.
+func (p *MpesaProvider) Start(req Request) (*Session, error) {
+	response, err := p.Client.STKPush(daraja.STKPushRequest{
+		Amount:           int(math.Round(req.Amount)),
+		PhoneNumber:      req.PhoneNumber,
+		CallBackURL:      req.CallbackURL,
+		AccountReference: req.AccountReference,
+		TransactionDesc:  req.Description,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Session{
+		Reference:         response.CheckoutRequestID,
+		MerchantReference: response.MerchantRequestID,
+		Message:           response.CustomerMessage,
+		Detail:            response.ResponseDescription,
+	}, nil
+}
@@ -6,9 +6,9 @@ require (
     github.com/dustin/go-humanize v1.0.1
     github.com/gin-contrib/cors v1.7.2
     github.com/gin-gonic/gin v1.10.0
+    github.com/glebarez/sqlite v1.11.0
     github.com/golang-jwt/jwt v3.2.2+incompatible
     github.com/joho/godotenv v1.5.1
-    github.com/jwambugu/mpesa-golang-sdk v1.0.8
     github.com/phpdave11/gofpdf v1.4.2
     golang.org/x/crypto v0.24.0
     golang.org/x/text v0.19.0
@@ -25,11 +25,13 @@ require (
     github.com/cloudwego/iasm v0.2.0 // indirect
     github.com/gabriel-vasile/mimetype v1.4.4 // indirect
     github.com/gin-contrib/sse v0.1.0 // indirect
+    github.com/glebarez/go-sqlite v1.21.2 // indirect
     github.com/go-playground/locales v0.14.1 // indirect
     github.com/go-playground/universal-translator v0.18.1 // indirect
     github.com/go-playground/validator/v10 v10.21.0 // indirect
     github.com/go-sql-driver/mysql v1.8.1 // indirect
     github.com/goccy/go-json v0.10.3 // indirect
+    github.com/google/uuid v1.3.0 // indirect
     github.com/jinzhu/inflection v1.0.0 // indirect
     github.com/jinzhu/now v1.1.5 // indirect
     github.com/json-iterator/go v1.1.12 // indirect
@@ -40,6 +42,7 @@ require (
     github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
     github.com/modern-go/reflect2 v1.0.2 // indirect
     github.com/pelletier/go-toml/v2 v2.2.2 // indirect
+    github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
     github.com/twitchyliquid64/golang-asm v0.15.1 // indirect
     github.com/ugorji/go/codec v1.2.12 // indirect
     golang.org/x/arch v0.8.0 // indirect
@@ -48,4 +51,8 @@ require (
     google.golang.org/protobuf v1.34.1 // indirect
     gopkg.in/alexcesaro/quotedprintable.v3 v3.0.0-20150716171945-2caba252f4dc // indirect
     gopkg.in/yaml.v3 v3.0.1 // indirect
+    modernc.org/libc v1.22.5 // indirect
+    modernc.org/mathutil v1.5.0 // indirect
+    modernc.org/memory v1.5.0 // indirect
+    modernc.org/sqlite v1.23.1 // indirect
 )
@@ -0,0 +1,148 @@
+package auth
+
+import (
+	"math"
+	"mobile-customer-portal-server/utils"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxOTPAttempts is the number of wrong guesses after which an OTP is burned
+const maxOTPAttempts = 5
+
+// attemptStore backs every attempt limiter in this package
+var attemptStore utils.AttemptStore = utils.NewMemoryAttemptStore()
+
+// accountLimiter limits failed attempts against a single account
+var accountLimiter = &utils.AttemptLimiter{
+	Store:       attemptStore,
+	MaxFailures: 5,
+	BaseLockout: time.Minute,
+	MaxLockout:  time.Hour,
+	Window:      24 * time.Hour,
+}
+
+// ipLimiter limits failed attempts from a single IP address across all accounts
+var ipLimiter = &utils.AttemptLimiter{
+	Store:       attemptStore,
+	MaxFailures: 20,
+	BaseLockout: time.Minute,
+	MaxLockout:  time.Hour,
+	Window:      24 * time.Hour,
+}
+
+// otpLimiter burns an OTP for the rest of its validity once it has been guessed wrong too often
+var otpLimiter = &utils.AttemptLimiter{
+	Store:       attemptStore,
+	MaxFailures: maxOTPAttempts,
+	BaseLockout: otpValidityDuration,
+	MaxLockout:  otpValidityDuration,
+	Window:      otpValidityDuration,
+}
+
+// otpSendLimiter limits how many OTPs are sent for a single account. Every send counts, so
+// that nobody can run up SMS and WhatsApp costs or flood a customer with codes.
+var otpSendLimiter = &utils.AttemptLimiter{
+	Store:       attemptStore,
+	MaxFailures: 3,
+	BaseLockout: 15 * time.Minute,
+	MaxLockout:  24 * time.Hour,
+	Window:      time.Hour,
+}
+
+// otpSendIPLimiter limits how many OTPs a single IP address can have sent, across accounts
+var otpSendIPLimiter = &utils.AttemptLimiter{
+	Store:       attemptStore,
+	MaxFailures: 10,
+	BaseLockout: 15 * time.Minute,
+	MaxLockout:  24 * time.Hour,
+	Window:      time.Hour,
+}
+
+// UseAttemptStore replaces the store behind the login and OTP limiters, e.g. with one shared
+// between server instances. It must be called before the server starts handling requests.
+func UseAttemptStore(store utils.AttemptStore) {
+	attemptStore = store
+	accountLimiter.Store = store
+	ipLimiter.Store = store
+	otpLimiter.Store = store
+	otpSendLimiter.Store = store
+	otpSendIPLimiter.Store = store
+}
+
+func accountAttemptKey(scope, account string) string {
+	return scope + ":account:" + strings.ToLower(strings.TrimSpace(account))
+}
+
+func ipAttemptKey(scope, ip string) string {
+	return scope + ":ip:" + ip
+}
+
+// respondTooManyAttempts aborts the request with a structured 429
+func respondTooManyAttempts(c *gin.Context, retryAfter time.Duration) {
+	respondTooManyRequests(c, retryAfter, "Too many failed attempts. Please try again later.", "too_many_attempts")
+}
+
+func respondTooManyRequests(c *gin.Context, retryAfter time.Duration, message, code string) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+		"error":       message,
+		"code":        code,
+		"retry_after": seconds,
+	})
+}
+
+// checkAttempts responds with 429 and returns false if the account or the client IP is locked out
+func checkAttempts(c *gin.Context, scope, account string) bool {
+	if ok, retryAfter := ipLimiter.Check(ipAttemptKey(scope, c.ClientIP())); !ok {
+		respondTooManyAttempts(c, retryAfter)
+		return false
+	}
+	if ok, retryAfter := accountLimiter.Check(accountAttemptKey(scope, account)); !ok {
+		respondTooManyAttempts(c, retryAfter)
+		return false
+	}
+	return true
+}
+
+// recordFailedAttempt counts a failure against both the account and the client IP
+func recordFailedAttempt(c *gin.Context, scope, account string) {
+	ipLimiter.Fail(ipAttemptKey(scope, c.ClientIP()))
+	accountLimiter.Fail(accountAttemptKey(scope, account))
+}
+
+// recordSuccessfulAttempt clears the account's failures. IP failures are kept so that one
+// valid account cannot be used to reset guessing against others.
+func recordSuccessfulAttempt(scope, account string) {
+	accountLimiter.Reset(accountAttemptKey(scope, account))
+}
+
+// allowOTPSend responds with 429 and returns false if the account or the client IP has had
+// too many OTPs sent recently. Otherwise the send is counted against both and true is returned.
+// It is called before looking the account up, so unknown accounts are limited just the same.
+func allowOTPSend(c *gin.Context, scope, account string) bool {
+	ipKey, accountKey := ipAttemptKey(scope, c.ClientIP()), accountAttemptKey(scope, account)
+	for _, check := range []struct {
+		limiter *utils.AttemptLimiter
+		key     string
+	}{{otpSendIPLimiter, ipKey}, {otpSendLimiter, accountKey}} {
+		if ok, retryAfter := check.limiter.Check(check.key); !ok {
+			respondTooManyRequests(c, retryAfter, "Too many OTP requests. Please try again later.", "too_many_otp_requests")
+			return false
+		}
+	}
+
+	otpSendIPLimiter.Fail(ipKey)
+	otpSendLimiter.Fail(accountKey)
+	return true
+}
+
+// recordWrongOTP counts a wrong guess for the OTP identified by key and reports whether it is now burned
+func recordWrongOTP(key string) bool {
+	return otpLimiter.Fail(key) > 0
+}
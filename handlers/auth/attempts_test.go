@@ -0,0 +1,158 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"mobile-customer-portal-server/utils"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// useTestAttemptStore gives the limiters a fresh store for the duration of a test
+func useTestAttemptStore(t *testing.T) {
+	previous := attemptStore
+	UseAttemptStore(utils.NewMemoryAttemptStore())
+	t.Cleanup(func() { UseAttemptStore(previous) })
+}
+
+// attemptContext is a request context from the given client IP
+func attemptContext(ip string) (*gin.Context, *httptest.ResponseRecorder) {
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/auth/login", nil)
+	c.Request.RemoteAddr = ip + ":40000"
+	return c, recorder
+}
+
+func TestCheckAttemptsLockout(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		// account returns the account the i-th failure is recorded against
+		account func(i int) string
+	}{
+		{
+			name:     "account after 5 failures",
+			failures: 5,
+			account:  func(int) string { return "jane@example.com" },
+		},
+		{
+			name:     "ip after 20 failures across accounts",
+			failures: 20,
+			account:  func(i int) string { return "user" + strconv.Itoa(i) + "@example.com" },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestAttemptStore(t)
+
+			for i := 0; i < tt.failures; i++ {
+				c, _ := attemptContext("10.0.0.1")
+				if !checkAttempts(c, "login", tt.account(i)) {
+					t.Fatalf("attempt %d refused before the limit", i+1)
+				}
+				recordFailedAttempt(c, "login", tt.account(i))
+			}
+
+			c, recorder := attemptContext("10.0.0.1")
+			if checkAttempts(c, "login", tt.account(tt.failures-1)) {
+				t.Fatalf("attempt after %d failures was allowed", tt.failures)
+			}
+			if recorder.Code != http.StatusTooManyRequests {
+				t.Fatalf("status = %d, want %d", recorder.Code, http.StatusTooManyRequests)
+			}
+			if got := recorder.Header().Get("Retry-After"); got != "60" {
+				t.Fatalf("Retry-After = %q, want %q", got, "60")
+			}
+		})
+	}
+}
+
+func TestCheckAttemptsOtherClientsUnaffected(t *testing.T) {
+	useTestAttemptStore(t)
+
+	for i := 0; i < 20; i++ {
+		c, _ := attemptContext("10.0.0.1")
+		recordFailedAttempt(c, "login", "user"+strconv.Itoa(i)+"@example.com")
+	}
+
+	c, recorder := attemptContext("10.0.0.2")
+	if !checkAttempts(c, "login", "someone@example.com") {
+		t.Fatalf("another IP was refused with status %d", recorder.Code)
+	}
+}
+
+func TestRecordSuccessfulAttemptResetsAccount(t *testing.T) {
+	useTestAttemptStore(t)
+
+	for i := 0; i < 4; i++ {
+		c, _ := attemptContext("10.0.0.1")
+		recordFailedAttempt(c, "login", "jane@example.com")
+	}
+	recordSuccessfulAttempt("login", "jane@example.com")
+
+	// Four more failures would have locked the account out had the first four been kept
+	for i := 0; i < 4; i++ {
+		c, _ := attemptContext("10.0.0.1")
+		recordFailedAttempt(c, "login", "jane@example.com")
+	}
+	c, recorder := attemptContext("10.0.0.1")
+	if !checkAttempts(c, "login", "jane@example.com") {
+		t.Fatalf("account refused with status %d after a successful login reset it", recorder.Code)
+	}
+}
+
+func TestAllowOTPSendLimits(t *testing.T) {
+	tests := []struct {
+		name  string
+		sends int
+		// account returns the account the i-th OTP is sent for
+		account func(i int) string
+		ip      func(i int) string
+	}{
+		{
+			name:    "account after 3 sends from different IPs",
+			sends:   3,
+			account: func(int) string { return "jane@example.com" },
+			ip:      func(i int) string { return "10.0.1." + strconv.Itoa(i+1) },
+		},
+		{
+			name:    "ip after 10 sends across accounts",
+			sends:   10,
+			account: func(i int) string { return "user" + strconv.Itoa(i) + "@example.com" },
+			ip:      func(int) string { return "10.0.0.1" },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestAttemptStore(t)
+
+			for i := 0; i < tt.sends; i++ {
+				c, recorder := attemptContext(tt.ip(i))
+				if !allowOTPSend(c, "reset_otp", tt.account(i)) {
+					t.Fatalf("send %d refused with status %d", i+1, recorder.Code)
+				}
+			}
+
+			c, recorder := attemptContext(tt.ip(tt.sends - 1))
+			if allowOTPSend(c, "reset_otp", tt.account(tt.sends-1)) {
+				t.Fatalf("send after %d sends was allowed", tt.sends)
+			}
+			if recorder.Code != http.StatusTooManyRequests {
+				t.Fatalf("status = %d, want %d", recorder.Code, http.StatusTooManyRequests)
+			}
+			if got := recorder.Header().Get("Retry-After"); got != "900" {
+				t.Fatalf("Retry-After = %q, want %q", got, "900")
+			}
+		})
+	}
+}
@@ -1,39 +1,79 @@
 package auth
 
 import (
-	"math/rand"
+	"errors"
+	"io"
+	"log"
 	"mobile-customer-portal-server/models"
 	"mobile-customer-portal-server/utils"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm/clause"
 )
 
 const otpValidityDuration = 10 * time.Minute
 
-// generateOTP generates a 6-digit OTP
-func generateOTP() string {
-	source := rand.NewSource(time.Now().UnixNano())
-	r := rand.New(source)
-	const digits = "0123456789"
-	otp := make([]byte, 6)
-	for i := range otp {
-		otp[i] = digits[r.Intn(len(digits))]
+// verifyOTP checks the code issued to subject for purpose, consuming it when consume is set.
+// Wrong guesses count against the scope/account limiter and burn the code after maxOTPAttempts.
+// On failure the error response has already been written and false is returned.
+func verifyOTP(c *gin.Context, scope, account, subject string, purpose utils.OTPPurpose, code string, consume bool) bool {
+	var record *models.OTPCode
+	var err error
+	if consume {
+		record, err = utils.ConsumeOTP(subject, purpose, code)
+	} else {
+		record, err = utils.CheckOTP(subject, purpose, code)
 	}
-	return string(otp)
-}
 
-// sendOTP sends the OTP via email
-func sendOTP(email, otp string) {
-	utils.SendOTPEmail(email, otp)
+	switch err {
+	case nil:
+		recordSuccessfulAttempt(scope, account)
+		return true
+	case utils.ErrOTPNotFound:
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "OTP not found or expired. Please request a new OTP.",
+		})
+	case utils.ErrOTPExpired:
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "The OTP has expired. Please request a new OTP.",
+		})
+	case utils.ErrOTPInvalid:
+		recordFailedAttempt(c, scope, account)
+		if recordWrongOTP("otp:" + strconv.FormatUint(uint64(record.ID), 10)) {
+			// Burn the OTP so it can no longer be guessed
+			if err := utils.BurnOTP(record); err != nil {
+				log.Printf("Failed to burn OTP %d: %v", record.ID, err)
+			}
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": "This OTP has been invalidated after too many incorrect attempts. Please request a new OTP.",
+			})
+			return false
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "The OTP is incorrect. Please try again or request a new one.",
+		})
+	default:
+		log.Printf("Failed to verify OTP: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "We encountered an issue verifying the OTP. Please try again later.",
+		})
+	}
+	return false
 }
 
+// SavePushToken registers the push token of the device making the request. Each device keeps
+// its own token, so a user signed in on several devices receives pushes on all of them.
 func SavePushToken(c *gin.Context) {
 	var req struct {
-		PushToken string `json:"push_token"`
+		PushToken  string `json:"push_token"`
+		Platform   string `json:"platform"`
+		AppVersion string `json:"app_version"`
 	}
-	if err := c.ShouldBindJSON(&req); err != nil {
+	if err := c.ShouldBindJSON(&req); err != nil || strings.TrimSpace(req.PushToken) == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
 		return
 	}
@@ -44,13 +84,76 @@ func SavePushToken(c *gin.Context) {
 		return
 	}
 	user := userInterface.(models.User)
+	session := c.MustGet("session").(models.Session)
 
-	if err := utils.CustomerPortalDB.Model(&user).Update("push_token", req.PushToken).Error; err != nil {
+	// A token belongs to one device; if it was registered before (possibly by another user
+	// on a shared device) it moves to this user and session
+	device := models.DeviceToken{
+		UserID:           user.ID,
+		SessionID:        &session.ID,
+		Token:            strings.TrimSpace(req.PushToken),
+		Platform:         strings.TrimSpace(req.Platform),
+		AppVersion:       strings.TrimSpace(req.AppVersion),
+		LastRegisteredAt: time.Now(),
+	}
+	if device.Platform == "" {
+		device.Platform = session.Platform
+	}
+	if err := utils.CustomerPortalDB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "token"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"user_id":            device.UserID,
+			"session_id":         device.SessionID,
+			"platform":           device.Platform,
+			"app_version":        device.AppVersion,
+			"last_registered_at": device.LastRegisteredAt,
+			"disabled_at":        nil,
+			"updated_at":         device.LastRegisteredAt,
+		}),
+	}).Create(&device).Error; err != nil {
+		log.Printf("Failed to save push token for user %d: %v", user.ID, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save push token"})
 		return
 	}
 
+	// Keep the legacy column pointing at the most recently registered device
+	if err := utils.CustomerPortalDB.Model(&user).Update("push_token", device.Token).Error; err != nil {
+		log.Printf("Failed to update push token for user %d: %v", user.ID, err)
+	}
+
 	c.JSON(http.StatusOK, gin.H{"status": "Push token saved"})
 }
 
+// UnregisterPushToken stops pushes to a device, e.g. when the app logs out. Without a token in
+// the body, every token registered by the current session is unregistered.
+func UnregisterPushToken(c *gin.Context) {
+	var req struct {
+		PushToken string `json:"push_token"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
 
+	userInterface, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+	user := userInterface.(models.User)
+	session := c.MustGet("session").(models.Session)
+
+	query := utils.CustomerPortalDB.Model(&models.DeviceToken{}).Where("user_id = ? AND disabled_at IS NULL", user.ID)
+	if token := strings.TrimSpace(req.PushToken); token != "" {
+		query = query.Where("token = ?", token)
+	} else {
+		query = query.Where("session_id = ?", session.ID)
+	}
+	if err := query.Update("disabled_at", time.Now()).Error; err != nil {
+		log.Printf("Failed to unregister push token for user %d: %v", user.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unregister push token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "Push token unregistered"})
+}
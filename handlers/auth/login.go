@@ -13,8 +13,10 @@ import (
 
 func Login(c *gin.Context) {
     var input struct {
-        Email    string `json:"email"`
-        Password string `json:"password"`
+        Email      string `json:"email"`
+        Password   string `json:"password"`
+        DeviceName string `json:"device_name"`
+        Platform   string `json:"platform"`
     }
 
     if err := c.ShouldBindJSON(&input); err != nil {
@@ -26,18 +28,27 @@ func Login(c *gin.Context) {
     input.Email = strings.TrimSpace(input.Email)
     input.Password = strings.TrimSpace(input.Password)
 
+    // Refuse early if this account or IP is locked out
+    if !checkAttempts(c, "login", input.Email) {
+        return
+    }
+
     var user models.User
     if err := utils.CustomerPortalDB.Where("email = ?", input.Email).First(&user).Error; err != nil {
+        recordFailedAttempt(c, "login", input.Email)
         c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid email or password."})
         return
     }
 
     // Check password
     if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(input.Password)); err != nil {
+        recordFailedAttempt(c, "login", input.Email)
         c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid email or password."})
         return
     }
 
+    recordSuccessfulAttempt("login", input.Email)
+
     // Fetch CustomerName from CRM database using CustomerNumber
     var customer models.Customer
     if err := utils.CRMDB.Where("customer_no = ?", user.CustomerNumber).First(&customer).Error; err != nil {
@@ -53,25 +64,22 @@ func Login(c *gin.Context) {
         return
     }
 
-    // Generate a non-expiring access token
-    accessToken, err := utils.GenerateAccessToken(user.ID)
+    // Record the login as a session for this device
+    session, err := createSession(c, user.ID, input.DeviceName, input.Platform)
+    if err != nil {
+        log.Printf("Error creating session: %v", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create session"})
+        return
+    }
+
+    // Generate a short-lived access token and a rotating refresh token
+    accessToken, refreshToken, err := issueTokenPair(session)
     if err != nil {
+        log.Printf("Error issuing tokens: %v", err)
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not generate access token"})
         return
     }
 
-    // Return only the access token and user data, no refresh token
-    // c.JSON(http.StatusOK, gin.H{
-    //     "message":      "Login successful.",
-    //     "access_token": accessToken,
-    //     "user": gin.H{
-    //         "id":             user.ID,
-    //         "email":          user.Email,
-    //         "name":           customer.CustomerName,
-    //         "customerNumber": user.CustomerNumber,
-    //         "leadFiles":      leadFiles,
-    //     },
-    // })
     c.JSON(http.StatusOK, gin.H{
         "message":      "Login successful.",
         "access_token": accessToken,
@@ -90,6 +98,7 @@ func Login(c *gin.Context) {
             "customerNumber": user.CustomerNumber,
             "leadFiles":      leadFiles,
         },
-        "refresh_token": "", // For backward compatibility
+        "refresh_token": refreshToken,
+        "expires_in":    int(utils.AccessTokenTTL.Seconds()),
     })
 }
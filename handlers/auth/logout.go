@@ -2,13 +2,12 @@ package auth
 
 import (
 	"mobile-customer-portal-server/models"
-	"mobile-customer-portal-server/utils"
 	"net/http"
-	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+// Logout ends the current session only; the user's other devices stay logged in
 func Logout(c *gin.Context) {
     userInterface, exists := c.Get("user")
     if !exists {
@@ -16,11 +15,9 @@ func Logout(c *gin.Context) {
         return
     }
     user := userInterface.(models.User)
+    session := c.MustGet("session").(models.Session)
 
-    now := time.Now()
-    user.LastLogoutAt = &now
-
-    if err := utils.CustomerPortalDB.Save(&user).Error; err != nil {
+    if err := revokeSessions(user.ID, []uint{session.ID}); err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
         return
     }
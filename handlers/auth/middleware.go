@@ -35,6 +35,12 @@ func AuthMiddleware() gin.HandlerFunc {
         })
 
         if err != nil {
+            // Let clients distinguish an expired token so they know to refresh it
+            if ve, ok := err.(*jwt.ValidationError); ok && ve.Errors&jwt.ValidationErrorExpired != 0 {
+                c.JSON(http.StatusUnauthorized, gin.H{"error": "Token expired", "code": "token_expired"})
+                c.Abort()
+                return
+            }
             c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
             c.Abort()
             return
@@ -68,6 +74,20 @@ func AuthMiddleware() gin.HandlerFunc {
             return
         }
 
+        // Tokens without an expiry are no longer accepted
+        if _, expExists := claims["exp"].(float64); !expExists {
+            c.JSON(http.StatusUnauthorized, gin.H{"error": "Token missing expiry (exp) field"})
+            c.Abort()
+            return
+        }
+
+        jti, ok := claims["jti"].(string)
+        if !ok || jti == "" {
+            c.JSON(http.StatusUnauthorized, gin.H{"error": "Token missing session (jti) field"})
+            c.Abort()
+            return
+        }
+
         userID := uint(userIDFloat)
         iatTime := time.Unix(int64(iatFloat), 0)
 
@@ -86,8 +106,25 @@ func AuthMiddleware() gin.HandlerFunc {
             return
         }
 
-        // Set the user in the context
+        // The session must still be active on this device
+        var session models.Session
+        if err := utils.CustomerPortalDB.Where("jti = ? AND user_id = ?", jti, user.ID).First(&session).Error; err != nil {
+            c.JSON(http.StatusUnauthorized, gin.H{"error": "Session not found"})
+            c.Abort()
+            return
+        }
+
+        if session.RevokedAt != nil {
+            c.JSON(http.StatusUnauthorized, gin.H{"error": "Session has been revoked"})
+            c.Abort()
+            return
+        }
+
+        touchSession(c, &session)
+
+        // Set the user and session in the context
         c.Set("user", user)
+        c.Set("session", session)
 
         c.Next()
     }
@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"mobile-customer-portal-server/messaging"
+	"mobile-customer-portal-server/utils"
+	"strings"
+)
+
+// OTP delivery channels a customer can choose from
+const (
+	otpChannelEmail    = string(messaging.ChannelEmail)
+	otpChannelWhatsApp = string(messaging.ChannelWhatsApp)
+	otpChannelSMS      = string(messaging.ChannelSMS)
+)
+
+// otpChannelOrder is the fallback order used after the customer's preferred channel fails
+var otpChannelOrder = []string{otpChannelEmail, otpChannelWhatsApp, otpChannelSMS}
+
+var errOTPNotDelivered = errors.New("otp could not be delivered on any channel")
+
+// otpRecipient holds the destinations an OTP can be delivered to and the language to use
+type otpRecipient struct {
+	Email  string
+	Phone  string
+	Locale string
+}
+
+func (r otpRecipient) destination(channel string) string {
+	if channel == otpChannelEmail {
+		return strings.TrimSpace(r.Email)
+	}
+	return utils.NormalizePhoneNumber(r.Phone)
+}
+
+func maskDestination(channel, destination string) string {
+	if channel == otpChannelEmail {
+		return utils.MaskEmail(destination)
+	}
+	return utils.MaskPhoneNumber(destination)
+}
+
+// otpDelivery describes where an OTP actually went
+type otpDelivery struct {
+	Channel     string
+	Destination string
+}
+
+// validOTPChannel reports whether channel is empty (no preference) or a known channel
+func validOTPChannel(channel string) bool {
+	if channel == "" {
+		return true
+	}
+	for _, known := range otpChannelOrder {
+		if channel == known {
+			return true
+		}
+	}
+	return false
+}
+
+// otpMessage renders the OTP template in the recipient's language for a channel
+func otpMessage(channel, destination, locale, otp string) (messaging.Message, error) {
+	rendered, err := messaging.Render("otp", locale, map[string]interface{}{
+		"Code":    otp,
+		"Minutes": int(otpValidityDuration.Minutes()),
+	})
+	if err != nil {
+		return messaging.Message{}, err
+	}
+	return rendered.Message(messaging.Channel(channel), destination), nil
+}
+
+// deliverOTP sends the code over the preferred channel, falling back through otpChannelOrder
+// until one succeeds. Channels the recipient has no destination for are skipped.
+func deliverOTP(preferred string, recipient otpRecipient, otp string) (otpDelivery, error) {
+	channels := []string{}
+	if preferred != "" {
+		channels = append(channels, preferred)
+	}
+	for _, channel := range otpChannelOrder {
+		if channel != preferred {
+			channels = append(channels, channel)
+		}
+	}
+
+	for _, channel := range channels {
+		destination := recipient.destination(channel)
+		if destination == "" {
+			continue
+		}
+
+		msg, err := otpMessage(channel, destination, recipient.Locale, otp)
+		if err != nil {
+			return otpDelivery{}, err
+		}
+
+		if _, err := messaging.Send(msg); err != nil {
+			log.Printf("OTP delivery via %s failed, trying next channel: %v", channel, err)
+			continue
+		}
+
+		return otpDelivery{Channel: channel, Destination: maskDestination(channel, destination)}, nil
+	}
+
+	return otpDelivery{}, errOTPNotDelivered
+}
+
+// decoyOTPDelivery is what a delivery to an account that does not exist would have looked like,
+// so that the response to an unknown email has the same shape as one to a real account. The
+// email channel shows the email as given; the phone channels show a masked Kenyan number whose
+// last digits are derived from the email, so that repeated requests agree with each other.
+func decoyOTPDelivery(preferred, email string) otpDelivery {
+	if preferred == "" || preferred == otpChannelEmail {
+		return otpDelivery{Channel: otpChannelEmail, Destination: maskDestination(otpChannelEmail, strings.TrimSpace(email))}
+	}
+
+	mac := hmac.New(sha256.New, utils.JwtSecret)
+	mac.Write([]byte(strings.ToLower(strings.TrimSpace(email))))
+	sum := mac.Sum(nil)
+	phone := fmt.Sprintf("2547%08d", (uint64(sum[0])<<24|uint64(sum[1])<<16|uint64(sum[2])<<8|uint64(sum[3]))%100000000)
+	return otpDelivery{Channel: preferred, Destination: maskDestination(preferred, phone)}
+}
+
+// otpSentMessage describes a successful delivery for the API response
+func otpSentMessage(delivery otpDelivery) string {
+	switch delivery.Channel {
+	case otpChannelWhatsApp:
+		return fmt.Sprintf("OTP sent via WhatsApp to %s.", delivery.Destination)
+	case otpChannelSMS:
+		return fmt.Sprintf("OTP sent via SMS to %s.", delivery.Destination)
+	default:
+		return fmt.Sprintf("OTP sent to your email %s.", delivery.Destination)
+	}
+}
@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"mobile-customer-portal-server/messaging"
+)
+
+// useMemoryMessaging sends every OTP channel to a fresh in-memory transport for the duration
+// of a test
+func useMemoryMessaging(t *testing.T) *messaging.MemoryMessenger {
+	t.Helper()
+	memory := messaging.NewMemoryMessenger()
+	for _, channel := range []messaging.Channel{messaging.ChannelEmail, messaging.ChannelWhatsApp, messaging.ChannelSMS} {
+		messaging.Register(channel, memory)
+	}
+	t.Cleanup(func() {
+		for _, channel := range []messaging.Channel{messaging.ChannelEmail, messaging.ChannelWhatsApp, messaging.ChannelSMS} {
+			messaging.Register(channel, messaging.Memory)
+		}
+	})
+	return memory
+}
+
+func TestDeliverOTPFallback(t *testing.T) {
+	errDown := errors.New("provider down")
+	recipient := otpRecipient{Email: "jane@example.com", Phone: "0712345678", Locale: "en"}
+
+	tests := []struct {
+		name      string
+		preferred string
+		recipient otpRecipient
+		failing   []messaging.Channel
+		want      otpDelivery
+		wantErr   error
+	}{
+		{
+			name:      "email by default",
+			recipient: recipient,
+			want:      otpDelivery{Channel: otpChannelEmail, Destination: "j***@example.com"},
+		},
+		{
+			name:      "preferred channel first",
+			preferred: otpChannelSMS,
+			recipient: recipient,
+			want:      otpDelivery{Channel: otpChannelSMS, Destination: "2547******78"},
+		},
+		{
+			name:      "email down falls back to whatsapp",
+			recipient: recipient,
+			failing:   []messaging.Channel{messaging.ChannelEmail},
+			want:      otpDelivery{Channel: otpChannelWhatsApp, Destination: "2547******78"},
+		},
+		{
+			name:      "email and whatsapp down fall back to sms",
+			recipient: recipient,
+			failing:   []messaging.Channel{messaging.ChannelEmail, messaging.ChannelWhatsApp},
+			want:      otpDelivery{Channel: otpChannelSMS, Destination: "2547******78"},
+		},
+		{
+			name:      "no email skips to whatsapp",
+			recipient: otpRecipient{Phone: "+254 712 345 678"},
+			want:      otpDelivery{Channel: otpChannelWhatsApp, Destination: "2547******78"},
+		},
+		{
+			name:      "every channel down",
+			recipient: recipient,
+			failing:   []messaging.Channel{messaging.ChannelEmail, messaging.ChannelWhatsApp, messaging.ChannelSMS},
+			wantErr:   errOTPNotDelivered,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			memory := useMemoryMessaging(t)
+			for _, channel := range tt.failing {
+				memory.Fail(channel, errDown)
+			}
+
+			delivery, err := deliverOTP(tt.preferred, tt.recipient, "123456")
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				if sent := memory.Messages(); len(sent) != 0 {
+					t.Fatalf("%d messages sent, want none", len(sent))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("deliverOTP: %v", err)
+			}
+			if delivery != tt.want {
+				t.Fatalf("delivery = %+v, want %+v", delivery, tt.want)
+			}
+
+			sent := memory.Messages()
+			if len(sent) != 1 {
+				t.Fatalf("%d messages sent, want 1", len(sent))
+			}
+			if string(sent[0].Channel) != tt.want.Channel || !strings.Contains(sent[0].Text, "123456") {
+				t.Fatalf("sent %+v", sent[0])
+			}
+			// The real destination goes to the provider; only the masked one is shown
+			if sent[0].To == delivery.Destination {
+				t.Fatalf("destination %q was not masked", delivery.Destination)
+			}
+		})
+	}
+}
+
+func TestDeliverOTPLanguage(t *testing.T) {
+	tests := []struct {
+		locale string
+		want   string
+	}{
+		{"en", "Your OTP code is: 654321"},
+		{"sw", "Nambari yako ya OTP ni: 654321"},
+		{"sw-KE", "Nambari yako ya OTP ni: 654321"},
+		{"fr", "Your OTP code is: 654321"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.locale, func(t *testing.T) {
+			memory := useMemoryMessaging(t)
+			if _, err := deliverOTP(otpChannelSMS, otpRecipient{Phone: "0712345678", Locale: tt.locale}, "654321"); err != nil {
+				t.Fatalf("deliverOTP: %v", err)
+			}
+			if sent := memory.Messages(); len(sent) != 1 || sent[0].Text != tt.want {
+				t.Fatalf("sent %+v, want text %q", sent, tt.want)
+			}
+		})
+	}
+}
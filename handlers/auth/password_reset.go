@@ -1,20 +1,32 @@
 package auth
 
 import (
+	"errors"
 	"log"
 	"mobile-customer-portal-server/models"
 	"mobile-customer-portal-server/utils"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
 )
 
-// RequestOTP handles password reset requests by generating and sending a new OTP via email
+// resetOTPSubject identifies the user a password reset OTP is issued to
+func resetOTPSubject(user models.User) string {
+    return "user:" + strconv.FormatUint(uint64(user.ID), 10)
+}
+
+// RequestOTP handles password reset requests by generating and sending a new OTP over the chosen
+// channel, falling back to the others, and says which channel and masked destination it went to.
+// Sends are rate limited. An unknown email gets a decoy response of the same shape, so that this
+// endpoint cannot be used to find out who is registered.
 func RequestOTP(c *gin.Context) {
     var input struct {
-        Email string `json:"email"`
+        Email   string `json:"email"`
+        Channel string `json:"channel"`
     }
 
     if err := c.ShouldBindJSON(&input); err != nil {
@@ -31,40 +43,73 @@ func RequestOTP(c *gin.Context) {
         return
     }
 
-    var user models.User
-    // Check if the user exists in the customer-portal database by email
-    if err := utils.CustomerPortalDB.Where("email = ?", input.Email).First(&user).Error; err != nil {
-        c.JSON(http.StatusUnauthorized, gin.H{
-            "error": "User not found. Please check your email address.",
+    if !validOTPChannel(input.Channel) {
+        c.JSON(http.StatusBadRequest, gin.H{
+            "error": "Invalid OTP channel. Choose email, whatsapp or sms.",
         })
         return
     }
 
-    // Generate a new OTP
-    otp := generateOTP()
-    now := time.Now()
+    // OTPs cost money to send, so limit them per email and per IP whether or not the email exists
+    if !allowOTPSend(c, "reset_otp", input.Email) {
+        return
+    }
 
-    // Create a new PasswordReset record
-    passwordReset := models.PasswordReset{
-        UserID:         user.ID,
-        OTP:            otp,
-        OTPGeneratedAt: now,
+    var user models.User
+    // Check if the user exists in the customer-portal database by email
+    if err := utils.CustomerPortalDB.Where("email = ?", input.Email).First(&user).Error; err != nil {
+        if !errors.Is(err, gorm.ErrRecordNotFound) {
+            log.Printf("Failed to look up user for password reset: %v", err)
+            c.JSON(http.StatusInternalServerError, gin.H{
+                "error": "We could not process your request. Please try again later.",
+            })
+            return
+        }
+        respondOTPSent(c, decoyOTPDelivery(input.Channel, input.Email))
+        return
     }
 
-    // Save the PasswordReset record to the database
-    if err := utils.CustomerPortalDB.Create(&passwordReset).Error; err != nil {
-        log.Printf("Failed to create password reset record: %v", err)
+    // Generate a new OTP; only its hash is stored
+    otp, _, err := utils.IssueOTP(resetOTPSubject(user), utils.OTPPurposePasswordReset, otpValidityDuration)
+    if err != nil {
+        log.Printf("Failed to issue password reset OTP: %v", err)
         c.JSON(http.StatusInternalServerError, gin.H{
-            "error": "We encountered an issue saving the OTP. Please try again later.",
+            "error": "We could not generate your OTP. Please try again later.",
         })
         return
     }
 
-    // Send the OTP via email
-    sendOTP(user.Email, otp)
+    // Send the OTP over the chosen channel, falling back to the others
+    delivery, err := deliverOTP(input.Channel, otpRecipient{Email: user.Email, Phone: user.PhoneNumber, Locale: user.PreferredLanguage}, otp)
+    if err != nil {
+        log.Printf("Failed to deliver password reset OTP to user %d: %v", user.ID, err)
+        respondOTPNotDelivered(c)
+        return
+    }
+
+    respondOTPSent(c, delivery)
+}
+
+// otpRetryAfter is how long a client is asked to wait after an OTP could not be sent on any channel
+const otpRetryAfter = time.Minute
 
+// respondOTPSent reports which channel and masked destination an OTP was sent to
+func respondOTPSent(c *gin.Context, delivery otpDelivery) {
     c.JSON(http.StatusOK, gin.H{
-        "message": "OTP sent to your registered email address.",
+        "message":     otpSentMessage(delivery),
+        "channel":     delivery.Channel,
+        "destination": delivery.Destination,
+    })
+}
+
+// respondOTPNotDelivered responds with 503 and a retry hint when every channel failed
+func respondOTPNotDelivered(c *gin.Context) {
+    seconds := int(otpRetryAfter.Seconds())
+    c.Header("Retry-After", strconv.Itoa(seconds))
+    c.JSON(http.StatusServiceUnavailable, gin.H{
+        "error":       "We could not send your OTP. Please try again in a minute.",
+        "code":        "otp_not_delivered",
+        "retry_after": seconds,
     })
 }
 
@@ -89,37 +134,23 @@ func VerifyOTPReset(c *gin.Context) {
         return
     }
 
+    // Refuse early if this account or IP is locked out
+    if !checkAttempts(c, "reset", input.Email) {
+        return
+    }
+
     var user models.User
     // Check if the user exists in the customer-portal database by email
     if err := utils.CustomerPortalDB.Where("email = ?", input.Email).First(&user).Error; err != nil {
+        recordFailedAttempt(c, "reset", input.Email)
         c.JSON(http.StatusUnauthorized, gin.H{
             "error": "User not found. Please check your email address.",
         })
         return
     }
 
-    var passwordReset models.PasswordReset
-    // Find the latest PasswordReset record for the user
-    if err := utils.CustomerPortalDB.Where("user_id = ?", user.ID).Order("created_at DESC").First(&passwordReset).Error; err != nil {
-        c.JSON(http.StatusUnauthorized, gin.H{
-            "error": "OTP not found or expired. Please request a new OTP.",
-        })
-        return
-    }
-
-    // Check OTP validity
-    if input.OTP != passwordReset.OTP {
-        log.Printf("OTP mismatch: received %s, expected %s", input.OTP, passwordReset.OTP)
-        c.JSON(http.StatusUnauthorized, gin.H{
-            "error": "The OTP is incorrect. Please try again or request a new one.",
-        })
-        return
-    }
-
-    if time.Since(passwordReset.OTPGeneratedAt) > otpValidityDuration {
-        c.JSON(http.StatusUnauthorized, gin.H{
-            "error": "The OTP has expired. Please request a new OTP.",
-        })
+    // Verify the OTP without using it up; it is consumed by ResetPassword
+    if !verifyOTP(c, "reset", input.Email, resetOTPSubject(user), utils.OTPPurposePasswordReset, input.OTP, false) {
         return
     }
 
@@ -151,37 +182,23 @@ func ResetPassword(c *gin.Context) {
         return
     }
 
+    // Refuse early if this account or IP is locked out
+    if !checkAttempts(c, "reset", input.Email) {
+        return
+    }
+
     var user models.User
     // Check if the user exists in the customer-portal database by email
     if err := utils.CustomerPortalDB.Where("email = ?", input.Email).First(&user).Error; err != nil {
+        recordFailedAttempt(c, "reset", input.Email)
         c.JSON(http.StatusUnauthorized, gin.H{
             "error": "User not found. Please check your email address.",
         })
         return
     }
 
-    var passwordReset models.PasswordReset
-    // Find the latest PasswordReset record for the user
-    if err := utils.CustomerPortalDB.Where("user_id = ?", user.ID).Order("created_at DESC").First(&passwordReset).Error; err != nil {
-        c.JSON(http.StatusUnauthorized, gin.H{
-            "error": "OTP not found or expired. Please request a new OTP.",
-        })
-        return
-    }
-
-    // Check OTP validity
-    if input.OTP != passwordReset.OTP {
-        log.Printf("OTP mismatch: received %s, expected %s", input.OTP, passwordReset.OTP)
-        c.JSON(http.StatusUnauthorized, gin.H{
-            "error": "The OTP is incorrect. Please try again or request a new one.",
-        })
-        return
-    }
-
-    if time.Since(passwordReset.OTPGeneratedAt) > otpValidityDuration {
-        c.JSON(http.StatusUnauthorized, gin.H{
-            "error": "The OTP has expired. Please request a new OTP.",
-        })
+    // Verify the OTP and use it up
+    if !verifyOTP(c, "reset", input.Email, resetOTPSubject(user), utils.OTPPurposePasswordReset, input.OTP, true) {
         return
     }
 
@@ -206,12 +223,6 @@ func ResetPassword(c *gin.Context) {
         return
     }
 
-    // Delete the used PasswordReset record
-    if err := utils.CustomerPortalDB.Delete(&passwordReset).Error; err != nil {
-        log.Printf("Failed to delete password reset record: %v", err)
-        // Proceed anyway; this is not critical
-    }
-
     c.JSON(http.StatusOK, gin.H{
         "message": "Your password has been reset successfully. You can now log in with your new password.",
     })
@@ -0,0 +1,182 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"mobile-customer-portal-server/messaging"
+	"mobile-customer-portal-server/models"
+	"mobile-customer-portal-server/utils"
+	"mobile-customer-portal-server/utils/testdb"
+)
+
+var errProviderDown = errors.New("provider down")
+
+// requestResetOTP posts body to RequestOTP and decodes the JSON response
+func requestResetOTP(t *testing.T, body string) (*httptest.ResponseRecorder, map[string]interface{}) {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/auth/request-otp", strings.NewReader(body))
+	c.Request.Header.Set("Content-Type", "application/json")
+	c.Request.RemoteAddr = "10.0.0.1:40000"
+
+	RequestOTP(c)
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("decode %q: %v", recorder.Body.String(), err)
+	}
+	return recorder, response
+}
+
+func createResetUser(t *testing.T) models.User {
+	t.Helper()
+	user := models.User{
+		CustomerNumber: "C001",
+		Email:          "jane@example.com",
+		PhoneNumber:    "0712345678",
+		Password:       "hash",
+		UserType:       "customer",
+	}
+	if err := utils.CustomerPortalDB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func TestRequestOTPReportsDelivery(t *testing.T) {
+	tests := []struct {
+		name            string
+		body            string
+		failing         []messaging.Channel
+		wantChannel     string
+		wantDestination string
+	}{
+		{
+			name:            "email by default",
+			body:            `{"email":"jane@example.com"}`,
+			wantChannel:     otpChannelEmail,
+			wantDestination: "j***@example.com",
+		},
+		{
+			name:            "chosen channel",
+			body:            `{"email":"jane@example.com","channel":"sms"}`,
+			wantChannel:     otpChannelSMS,
+			wantDestination: "2547******78",
+		},
+		{
+			name:            "channel that actually delivered",
+			body:            `{"email":"jane@example.com"}`,
+			failing:         []messaging.Channel{messaging.ChannelEmail},
+			wantChannel:     otpChannelWhatsApp,
+			wantDestination: "2547******78",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testdb.Setup(t)
+			useTestAttemptStore(t)
+			memory := useMemoryMessaging(t)
+			for _, channel := range tt.failing {
+				memory.Fail(channel, errProviderDown)
+			}
+			createResetUser(t)
+
+			recorder, response := requestResetOTP(t, tt.body)
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %v", recorder.Code, http.StatusOK, response)
+			}
+			if response["channel"] != tt.wantChannel || response["destination"] != tt.wantDestination {
+				t.Fatalf("response = %v, want %s to %s", response, tt.wantChannel, tt.wantDestination)
+			}
+			if sent := memory.Messages(); len(sent) != 1 || string(sent[0].Channel) != tt.wantChannel {
+				t.Fatalf("sent %+v, want one message via %s", sent, tt.wantChannel)
+			}
+		})
+	}
+}
+
+func TestRequestOTPEveryChannelDown(t *testing.T) {
+	testdb.Setup(t)
+	useTestAttemptStore(t)
+	memory := useMemoryMessaging(t)
+	for _, channel := range []messaging.Channel{messaging.ChannelEmail, messaging.ChannelWhatsApp, messaging.ChannelSMS} {
+		memory.Fail(channel, errProviderDown)
+	}
+	createResetUser(t)
+
+	recorder, response := requestResetOTP(t, `{"email":"jane@example.com"}`)
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", recorder.Code, http.StatusServiceUnavailable)
+	}
+	if got := recorder.Header().Get("Retry-After"); got != "60" {
+		t.Fatalf("Retry-After = %q, want %q", got, "60")
+	}
+	if response["retry_after"] != float64(60) || response["code"] != "otp_not_delivered" {
+		t.Fatalf("response = %v, want a retry hint", response)
+	}
+	if _, ok := response["channel"]; ok {
+		t.Fatalf("response = %v names a channel although nothing was sent", response)
+	}
+}
+
+func TestRequestOTPUnknownEmailDecoy(t *testing.T) {
+	tests := []struct {
+		name    string
+		channel string
+	}{
+		{"email", ""},
+		{"whatsapp", otpChannelWhatsApp},
+		{"sms", otpChannelSMS},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testdb.Setup(t)
+			useTestAttemptStore(t)
+			memory := useMemoryMessaging(t)
+			createResetUser(t)
+
+			body := `{"email":"jane@example.com","channel":"` + tt.channel + `"}`
+			known, knownResponse := requestResetOTP(t, body)
+			body = `{"email":"nobody@example.com","channel":"` + tt.channel + `"}`
+			unknown, unknownResponse := requestResetOTP(t, body)
+
+			if unknown.Code != known.Code {
+				t.Fatalf("status = %d for an unknown email, %d for a known one", unknown.Code, known.Code)
+			}
+			for key := range knownResponse {
+				if _, ok := unknownResponse[key]; !ok {
+					t.Fatalf("decoy %v is missing %q of %v", unknownResponse, key, knownResponse)
+				}
+			}
+			if unknownResponse["channel"] != knownResponse["channel"] {
+				t.Fatalf("decoy channel %v, known channel %v", unknownResponse["channel"], knownResponse["channel"])
+			}
+			destination, _ := unknownResponse["destination"].(string)
+			if tt.channel == "" && destination != "n*****@example.com" {
+				t.Fatalf("decoy destination = %q, want the masked email", destination)
+			}
+			if tt.channel != "" && (!strings.HasPrefix(destination, "2547******") || len(destination) != 12) {
+				t.Fatalf("decoy destination = %q, want a masked phone number", destination)
+			}
+			if sent := memory.Messages(); len(sent) != 1 {
+				t.Fatalf("%d messages sent, want only the known account's", len(sent))
+			}
+
+			// Asking again shows the same decoy
+			useTestAttemptStore(t)
+			if _, again := requestResetOTP(t, body); again["destination"] != destination {
+				t.Fatalf("decoy destination changed from %q to %v", destination, again["destination"])
+			}
+		})
+	}
+}
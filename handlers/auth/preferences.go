@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"errors"
+	"log"
+	"mobile-customer-portal-server/currency"
+	"mobile-customer-portal-server/messaging"
+	"mobile-customer-portal-server/models"
+	"mobile-customer-portal-server/outbox"
+	"mobile-customer-portal-server/utils"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetPreferences returns the user's communication and display preferences
+func GetPreferences(c *gin.Context) {
+	userInterface, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+	user := userInterface.(models.User)
+
+	currencies, err := currency.Default.Currencies()
+	if err != nil {
+		log.Printf("Error listing currencies: %v", err)
+		currencies = []string{currency.Base}
+	}
+
+	displayCurrency := currency.Normalize(user.DisplayCurrency)
+	if displayCurrency == "" {
+		displayCurrency = currency.Base
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"preferred_language":    messaging.NormalizeLocale(user.PreferredLanguage),
+		"supported_languages":   messaging.SupportedLocales,
+		"display_currency":      displayCurrency,
+		"supported_currencies":  currencies,
+		"notification_channel":  outbox.NotificationChannel(user),
+		"notification_channels": outbox.NotificationChannels,
+	})
+}
+
+// UpdatePreferences changes the user's communication and display preferences
+func UpdatePreferences(c *gin.Context) {
+	var req struct {
+		PreferredLanguage   *string `json:"preferred_language"`
+		DisplayCurrency     *string `json:"display_currency"`
+		NotificationChannel *string `json:"notification_channel"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+
+	userInterface, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+	user := userInterface.(models.User)
+
+	updates := map[string]interface{}{}
+	if req.PreferredLanguage != nil {
+		if !messaging.IsSupportedLocale(*req.PreferredLanguage) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported language"})
+			return
+		}
+		updates["preferred_language"] = *req.PreferredLanguage
+	}
+	if req.DisplayCurrency != nil {
+		quote, err := currency.Default.Quote(*req.DisplayCurrency)
+		if errors.Is(err, currency.ErrUnsupported) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported currency"})
+			return
+		}
+		if err != nil {
+			log.Printf("Error looking up exchange rate for %q: %v", *req.DisplayCurrency, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save preferences"})
+			return
+		}
+		updates["display_currency"] = quote.Currency
+	}
+	if req.NotificationChannel != nil {
+		if !outbox.IsNotificationChannel(*req.NotificationChannel) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported notification channel"})
+			return
+		}
+		updates["notification_channel"] = *req.NotificationChannel
+	}
+
+	if len(updates) > 0 {
+		if err := utils.CustomerPortalDB.Model(&user).Updates(updates).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save preferences"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "Preferences saved"})
+}
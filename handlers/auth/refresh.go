@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"log"
+	"mobile-customer-portal-server/models"
+	"mobile-customer-portal-server/utils"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// issueRefreshToken stores a new refresh token for the session in the given family and returns the raw token
+func issueRefreshToken(db *gorm.DB, userID, sessionID uint, familyID string) (string, *models.RefreshToken, error) {
+	token, hash, err := utils.GenerateRefreshToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	record := models.RefreshToken{
+		UserID:    userID,
+		SessionID: sessionID,
+		FamilyID:  familyID,
+		TokenHash: hash,
+		ExpiresAt: time.Now().Add(utils.RefreshTokenTTL),
+	}
+	if err := db.Create(&record).Error; err != nil {
+		return "", nil, err
+	}
+
+	return token, &record, nil
+}
+
+// issueTokenPair starts a new refresh token family for the session and returns an access/refresh token pair
+func issueTokenPair(session *models.Session) (string, string, error) {
+	familyID, err := utils.GenerateRandomHex(16)
+	if err != nil {
+		return "", "", err
+	}
+
+	accessToken, err := utils.GenerateAccessToken(session.UserID, session.JTI)
+	if err != nil {
+		return "", "", err
+	}
+
+	refreshToken, _, err := issueRefreshToken(utils.CustomerPortalDB, session.UserID, session.ID, familyID)
+	if err != nil {
+		return "", "", err
+	}
+
+	return accessToken, refreshToken, nil
+}
+
+// revokeRefreshTokenFamily revokes every live token in a refresh token family along with its session
+func revokeRefreshTokenFamily(stored models.RefreshToken) {
+	if err := utils.CustomerPortalDB.Model(&models.RefreshToken{}).
+		Where("family_id = ? AND revoked_at IS NULL", stored.FamilyID).
+		Update("revoked_at", time.Now()).Error; err != nil {
+		log.Printf("Failed to revoke refresh token family %s: %v", stored.FamilyID, err)
+	}
+	if err := revokeSessions(stored.UserID, []uint{stored.SessionID}); err != nil {
+		log.Printf("Failed to revoke session %d: %v", stored.SessionID, err)
+	}
+}
+
+// RefreshToken exchanges a valid refresh token for a new access/refresh token pair.
+// The presented refresh token is rotated: it is revoked and replaced by the new one.
+// Presenting a token that has already been rotated revokes its whole family.
+func RefreshToken(c *gin.Context) {
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil || input.RefreshToken == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Refresh token is required."})
+		return
+	}
+
+	var stored models.RefreshToken
+	if err := utils.CustomerPortalDB.Where("token_hash = ?", utils.HashRefreshToken(input.RefreshToken)).First(&stored).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token. Please log in again."})
+		return
+	}
+
+	if stored.RevokedAt != nil {
+		log.Printf("Refresh token reuse detected for user %d, revoking family %s", stored.UserID, stored.FamilyID)
+		revokeRefreshTokenFamily(stored)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token has already been used. Please log in again."})
+		return
+	}
+
+	if time.Now().After(stored.ExpiresAt) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token has expired. Please log in again."})
+		return
+	}
+
+	var session models.Session
+	if err := utils.CustomerPortalDB.First(&session, stored.SessionID).Error; err != nil || session.RevokedAt != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Session has been revoked. Please log in again."})
+		return
+	}
+
+	var user models.User
+	if err := utils.CustomerPortalDB.First(&user, stored.UserID).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		return
+	}
+
+	var newRefreshToken string
+	err := utils.CustomerPortalDB.Transaction(func(tx *gorm.DB) error {
+		token, record, err := issueRefreshToken(tx, user.ID, session.ID, stored.FamilyID)
+		if err != nil {
+			return err
+		}
+
+		// Only rotate if nobody else has rotated this token in the meantime
+		result := tx.Model(&models.RefreshToken{}).
+			Where("id = ? AND revoked_at IS NULL", stored.ID).
+			Updates(map[string]interface{}{"revoked_at": time.Now(), "replaced_by_id": record.ID})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		newRefreshToken = token
+		return nil
+	})
+	if err == gorm.ErrRecordNotFound {
+		log.Printf("Concurrent refresh token reuse detected for user %d, revoking family %s", stored.UserID, stored.FamilyID)
+		revokeRefreshTokenFamily(stored)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token has already been used. Please log in again."})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to rotate refresh token: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not refresh token"})
+		return
+	}
+
+	accessToken, err := utils.GenerateAccessToken(user.ID, session.JTI)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not generate access token"})
+		return
+	}
+
+	touchSession(c, &session)
+
+	c.JSON(http.StatusOK, gin.H{
+		"access_token":  accessToken,
+		"refresh_token": newRefreshToken,
+		"expires_in":    int(utils.AccessTokenTTL.Seconds()),
+	})
+}
@@ -2,6 +2,7 @@ package auth
 
 import (
 	"log"
+	"mobile-customer-portal-server/messaging"
 	"mobile-customer-portal-server/models"
 	"mobile-customer-portal-server/utils"
 	"net/http"
@@ -16,6 +17,8 @@ func VerifyUser(c *gin.Context) {
     var input struct {
         CustomerNumber string `json:"customer_number"`
         Email          string `json:"email"`
+        Channel        string `json:"channel"`
+        Language       string `json:"language"`
     }
 
     if err := c.ShouldBindJSON(&input); err != nil {
@@ -28,6 +31,16 @@ func VerifyUser(c *gin.Context) {
         return
     }
 
+    if !validOTPChannel(input.Channel) {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid OTP channel. Choose email, whatsapp or sms."})
+        return
+    }
+
+    // OTPs cost money to send, so limit them per customer number and per IP
+    if !allowOTPSend(c, "register_otp", input.CustomerNumber) {
+        return
+    }
+
     var customer models.Customer
     // Find the customer by customer number and email in the CRM database
     if err := utils.CRMDB.Where("customer_no = ? AND primary_email = ?", input.CustomerNumber, input.Email).First(&customer).Error; err != nil {
@@ -36,23 +49,46 @@ func VerifyUser(c *gin.Context) {
         return
     }
 
-    // Generate a new OTP and set generation time
-    otp := generateOTP()
-    customer.OTP = otp
-    now := time.Now()
-    customer.OTPGeneratedAt = &now
+    // Generate a new OTP; only its hash is stored
+    otp, otpCode, err := utils.IssueOTP(customer.CustomerNo, utils.OTPPurposeRegistration, otpValidityDuration)
+    if err != nil {
+        log.Printf("Failed to issue registration OTP: %v", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "We encountered an issue processing your request. Please try again later."})
+        return
+    }
 
-    // Save OTP and generation time in the CRM database
-    if err := utils.CRMDB.Save(&customer).Error; err != nil {
-			log.Printf("Failed to save OTP in the CRM database: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "We encountered an issue processing your request. Please try again later."})
-			return
-	}
+    // Start a new registration challenge in the portal database, replacing any unfinished one
+    if err := utils.CustomerPortalDB.
+        Where("customer_number = ? AND completed_at IS NULL", customer.CustomerNo).
+        Delete(&models.RegistrationChallenge{}).Error; err != nil {
+        log.Printf("Failed to clear previous registration challenges: %v", err)
+    }
+
+    challenge := models.RegistrationChallenge{
+        CustomerNumber: customer.CustomerNo,
+        Email:          customer.PrimaryEmail,
+        OTPCodeID:      otpCode.ID,
+        ExpiresAt:      otpCode.ExpiresAt,
+    }
+    if err := utils.CustomerPortalDB.Create(&challenge).Error; err != nil {
+        log.Printf("Failed to create registration challenge: %v", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "We encountered an issue processing your request. Please try again later."})
+        return
+    }
 
-    // Send OTP via email
-    sendOTP(customer.PrimaryEmail, otp)
+    // Send the OTP over the chosen channel, falling back to the others
+    delivery, err := deliverOTP(input.Channel, otpRecipient{Email: customer.PrimaryEmail, Phone: customer.Phone, Locale: input.Language}, otp)
+    if err != nil {
+        log.Printf("Failed to deliver registration OTP to customer %s: %v", customer.CustomerNo, err)
+        c.JSON(http.StatusBadGateway, gin.H{"error": "We could not send your OTP. Please try again later."})
+        return
+    }
 
-    c.JSON(http.StatusOK, gin.H{"message": "OTP sent successfully to your email."})
+    c.JSON(http.StatusOK, gin.H{
+        "message":     otpSentMessage(delivery),
+        "channel":     delivery.Channel,
+        "destination": delivery.Destination,
+    })
 }
 
 // VerifyOTP validates the OTP during registration
@@ -79,36 +115,38 @@ func VerifyOTP(c *gin.Context) {
 			return
 	}
 
+	// Refuse early if this customer or IP is locked out
+	if !checkAttempts(c, "register", input.CustomerNumber) {
+			return
+	}
+
 	var customer models.Customer
 	// Find the customer by customer number and email in the CRM database
 	if err := utils.CRMDB.Where("customer_no = ? AND primary_email = ?", input.CustomerNumber, input.Email).
 			First(&customer).Error; err != nil {
+			recordFailedAttempt(c, "register", input.CustomerNumber)
 			c.JSON(http.StatusUnauthorized, gin.H{
 					"error": "Customer not found. Please verify your customer number and email.",
 			})
 			return
 	}
 
-	// Ensure OTP and OTPGeneratedAt are correctly populated
-	if customer.OTP == "" || customer.OTPGeneratedAt == nil {
-			c.JSON(http.StatusUnauthorized, gin.H{
-					"error": "The OTP is missing or not properly set. Please request a new OTP.",
-			})
+	challenge, ok := findRegistrationChallenge(c, customer)
+	if !ok {
 			return
 	}
 
-	// Verify OTP
-	if input.OTP != customer.OTP {
-			c.JSON(http.StatusUnauthorized, gin.H{
-					"error": "The OTP is incorrect. Please try again or request a new one.",
-			})
+	// Verify the OTP without using it up; it is consumed by CompleteRegistration
+	if !verifyOTP(c, "register", input.CustomerNumber, customer.CustomerNo, utils.OTPPurposeRegistration, input.OTP, false) {
 			return
 	}
 
-	// Check OTP expiration
-	if time.Now().After(customer.OTPGeneratedAt.Add(otpValidityDuration)) {
-			c.JSON(http.StatusUnauthorized, gin.H{
-					"error": "The OTP has expired. Please request a new OTP.",
+	// Remember that this challenge has been verified
+	now := time.Now()
+	if err := utils.CustomerPortalDB.Model(&challenge).Update("verified_at", &now).Error; err != nil {
+			log.Printf("Failed to mark registration challenge as verified: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+					"error": "We encountered an issue processing your request. Please try again later.",
 			})
 			return
 	}
@@ -126,6 +164,7 @@ func CompleteRegistration(c *gin.Context) {
 			Email          string `json:"email"`
 			OTP            string `json:"otp"`
 			NewPassword    string `json:"new_password"`
+			Language       string `json:"language"`
 	}
 
 	// Bind JSON input to the struct
@@ -144,37 +183,36 @@ func CompleteRegistration(c *gin.Context) {
 			return
 	}
 
+	// Refuse early if this customer or IP is locked out
+	if !checkAttempts(c, "register", input.CustomerNumber) {
+			return
+	}
+
 	var customer models.Customer
 	// Find the customer by customer number and email in the CRM database
 	if err := utils.CRMDB.Where("customer_no = ? AND primary_email = ?", input.CustomerNumber, input.Email).
 			First(&customer).Error; err != nil {
+			recordFailedAttempt(c, "register", input.CustomerNumber)
 			c.JSON(http.StatusUnauthorized, gin.H{
 					"error": "Customer not found. Please verify your customer number and email.",
 			})
 			return
 	}
 
-	// Ensure OTP and OTPGeneratedAt are correctly populated
-	if customer.OTP == "" || customer.OTPGeneratedAt == nil {
-			c.JSON(http.StatusUnauthorized, gin.H{
-					"error": "The OTP is missing or not properly set. Please request a new OTP.",
-			})
+	challenge, ok := findRegistrationChallenge(c, customer)
+	if !ok {
 			return
 	}
 
-	// Verify OTP
-	if input.OTP != customer.OTP {
+	if challenge.VerifiedAt == nil {
 			c.JSON(http.StatusUnauthorized, gin.H{
-					"error": "The OTP is incorrect. Please try again or request a new one.",
+					"error": "Please verify your OTP before completing registration.",
 			})
 			return
 	}
 
-	// Check OTP expiration
-	if time.Now().After(customer.OTPGeneratedAt.Add(otpValidityDuration)) {
-			c.JSON(http.StatusUnauthorized, gin.H{
-					"error": "The OTP has expired. Please request a new OTP.",
-			})
+	// Verify the OTP and use it up
+	if !verifyOTP(c, "register", input.CustomerNumber, customer.CustomerNo, utils.OTPPurposeRegistration, input.OTP, true) {
 			return
 	}
 
@@ -189,11 +227,12 @@ func CompleteRegistration(c *gin.Context) {
 
 	// Create a new user in the customer-portal database
 	user := models.User{
-			CustomerNumber: input.CustomerNumber,
-			Email:          input.Email,
-			PhoneNumber:    customer.Phone,
-			Verified:       true,
-			UserType:       "individual",
+			CustomerNumber:    input.CustomerNumber,
+			Email:             input.Email,
+			PhoneNumber:       customer.Phone,
+			Verified:          true,
+			UserType:          "individual",
+			PreferredLanguage: messaging.NormalizeLocale(input.Language),
 	}
 
 	// Hash the new password
@@ -215,15 +254,10 @@ func CompleteRegistration(c *gin.Context) {
 			return
 	}
 
-	// Clear OTP and OTPGeneratedAt in CRM database
-	customer.OTP = ""
-	customer.OTPGeneratedAt = nil
-	if err := utils.CRMDB.Save(&customer).Error; err != nil {
-			log.Printf("Failed to clear OTP in the CRM database: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{
-					"error": "We encountered an issue processing your request. Please try again later.",
-			})
-			return
+	// Close the registration challenge
+	now := time.Now()
+	if err := utils.CustomerPortalDB.Model(&challenge).Update("completed_at", &now).Error; err != nil {
+			log.Printf("Failed to mark registration challenge as completed: %v", err)
 	}
 
 	c.JSON(http.StatusOK, gin.H{
@@ -231,3 +265,27 @@ func CompleteRegistration(c *gin.Context) {
 	})
 }
 
+// findRegistrationChallenge loads the customer's open registration challenge.
+// On failure the error response has already been written and false is returned.
+func findRegistrationChallenge(c *gin.Context, customer models.Customer) (models.RegistrationChallenge, bool) {
+	var challenge models.RegistrationChallenge
+	if err := utils.CustomerPortalDB.
+			Where("customer_number = ? AND email = ? AND completed_at IS NULL", customer.CustomerNo, customer.PrimaryEmail).
+			Order("created_at DESC").
+			First(&challenge).Error; err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{
+					"error": "No registration in progress. Please request a new OTP.",
+			})
+			return challenge, false
+	}
+
+	if time.Now().After(challenge.ExpiresAt) {
+			c.JSON(http.StatusUnauthorized, gin.H{
+					"error": "The OTP has expired. Please request a new OTP.",
+			})
+			return challenge, false
+	}
+
+	return challenge, true
+}
+
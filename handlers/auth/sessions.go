@@ -0,0 +1,180 @@
+package auth
+
+import (
+	"log"
+	"mobile-customer-portal-server/models"
+	"mobile-customer-portal-server/utils"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sessionTouchInterval limits how often a session's last-seen time is written
+const sessionTouchInterval = time.Minute
+
+// createSession records a new login for the user on the requesting device
+func createSession(c *gin.Context, userID uint, deviceName, platform string) (*models.Session, error) {
+	jti, err := utils.GenerateRandomHex(16)
+	if err != nil {
+		return nil, err
+	}
+
+	deviceName = strings.TrimSpace(deviceName)
+	if deviceName == "" {
+		deviceName = c.Request.UserAgent()
+	}
+
+	session := models.Session{
+		UserID:     userID,
+		JTI:        jti,
+		DeviceName: deviceName,
+		Platform:   strings.TrimSpace(platform),
+		IPAddress:  c.ClientIP(),
+		LastSeenAt: time.Now(),
+	}
+	if err := utils.CustomerPortalDB.Create(&session).Error; err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+// touchSession updates the session's last-seen time and IP, at most once per sessionTouchInterval
+func touchSession(c *gin.Context, session *models.Session) {
+	now := time.Now()
+	if now.Sub(session.LastSeenAt) < sessionTouchInterval && session.IPAddress == c.ClientIP() {
+		return
+	}
+
+	session.LastSeenAt = now
+	session.IPAddress = c.ClientIP()
+	if err := utils.CustomerPortalDB.Model(session).
+		Updates(map[string]interface{}{"last_seen_at": now, "ip_address": session.IPAddress}).Error; err != nil {
+		log.Printf("Failed to update session %d last seen: %v", session.ID, err)
+	}
+}
+
+// revokeSessions revokes the matching sessions, every refresh token issued to them and the
+// push tokens their devices registered
+func revokeSessions(userID uint, sessionIDs []uint) error {
+	if len(sessionIDs) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	if err := utils.CustomerPortalDB.Model(&models.Session{}).
+		Where("user_id = ? AND id IN ? AND revoked_at IS NULL", userID, sessionIDs).
+		Update("revoked_at", now).Error; err != nil {
+		return err
+	}
+
+	if err := utils.CustomerPortalDB.Model(&models.RefreshToken{}).
+		Where("user_id = ? AND session_id IN ? AND revoked_at IS NULL", userID, sessionIDs).
+		Update("revoked_at", now).Error; err != nil {
+		return err
+	}
+
+	return utils.CustomerPortalDB.Model(&models.DeviceToken{}).
+		Where("user_id = ? AND session_id IN ? AND disabled_at IS NULL", userID, sessionIDs).
+		Update("disabled_at", now).Error
+}
+
+// GetSessions lists the user's active sessions, flagging the one making the request
+func GetSessions(c *gin.Context) {
+	userInterface, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+	user := userInterface.(models.User)
+	current := c.MustGet("session").(models.Session)
+
+	var sessions []models.Session
+	if err := utils.CustomerPortalDB.
+		Where("user_id = ? AND revoked_at IS NULL", user.ID).
+		Order("last_seen_at DESC").
+		Find(&sessions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch sessions"})
+		return
+	}
+
+	result := make([]gin.H, 0, len(sessions))
+	for _, session := range sessions {
+		result = append(result, gin.H{
+			"id":           session.ID,
+			"device_name":  session.DeviceName,
+			"platform":     session.Platform,
+			"ip_address":   session.IPAddress,
+			"created_at":   session.CreatedAt,
+			"last_seen_at": session.LastSeenAt,
+			"current":      session.ID == current.ID,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"sessions": result})
+}
+
+// RevokeSession logs out a single session belonging to the user
+func RevokeSession(c *gin.Context) {
+	userInterface, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+	user := userInterface.(models.User)
+
+	sessionID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session ID"})
+		return
+	}
+
+	var session models.Session
+	if err := utils.CustomerPortalDB.
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", sessionID, user.ID).
+		First(&session).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+
+	if err := revokeSessions(user.ID, []uint{session.ID}); err != nil {
+		log.Printf("Failed to revoke session %d: %v", session.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke session"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Session revoked."})
+}
+
+// RevokeOtherSessions logs out every session of the user except the one making the request
+func RevokeOtherSessions(c *gin.Context) {
+	userInterface, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+	user := userInterface.(models.User)
+	current := c.MustGet("session").(models.Session)
+
+	var sessionIDs []uint
+	if err := utils.CustomerPortalDB.Model(&models.Session{}).
+		Where("user_id = ? AND id <> ? AND revoked_at IS NULL", user.ID, current.ID).
+		Pluck("id", &sessionIDs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch sessions"})
+		return
+	}
+
+	if err := revokeSessions(user.ID, sessionIDs); err != nil {
+		log.Printf("Failed to revoke other sessions for user %d: %v", user.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Other devices have been logged out.",
+		"revoked": len(sessionIDs),
+	})
+}
@@ -1,38 +1,38 @@
 package notifications
 
 import (
-	"bytes"
-	"encoding/json"
 	"log"
 	"net/http"
 	"strconv"
+	"time"
 
 	"mobile-customer-portal-server/models"
+	"mobile-customer-portal-server/outbox"
 	"mobile-customer-portal-server/utils"
 
 	"github.com/gin-gonic/gin"
 )
 
-type PushMessage struct {
-	To        string                 `json:"to"`
-	Sound     string                 `json:"sound"`
-	Title     string                 `json:"title"`
-	Body      string                 `json:"body"`
-	Data      map[string]interface{} `json:"data,omitempty"`
-	ChannelID string                 `json:"channelId,omitempty"`
-}
-
 func SendNotification(c *gin.Context) {
 	var req struct {
-		UserID uint                   `json:"user_id"`
-		Title  string                 `json:"title"`
-		Body   string                 `json:"body"`
-		Data   map[string]interface{} `json:"data,omitempty"`
+		UserID   uint                   `json:"user_id"`
+		Category string                 `json:"category"`
+		Title    string                 `json:"title"`
+		Body     string                 `json:"body"`
+		Data     map[string]interface{} `json:"data,omitempty"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
 		return
 	}
+	if req.Category == "" {
+		// A campaign or referral announcement is filed by what it links to
+		req.Category = outbox.DataCategory(req.Data)
+	}
+	if !models.IsNotificationCategory(req.Category) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown notification category"})
+		return
+	}
 
 	var user models.User
 	if err := utils.CustomerPortalDB.Where("id = ?", req.UserID).First(&user).Error; err != nil {
@@ -40,59 +40,28 @@ func SendNotification(c *gin.Context) {
 		return
 	}
 
-	if user.PushToken == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "User does not have a push token"})
-		return
-	}
-
-	pushMessage := PushMessage{
-		To:    user.PushToken,
-		Sound: "default",
-		Title: req.Title,
-		Body:  req.Body,
-		Data:  req.Data,
-	}
-
-	body, err := json.Marshal(pushMessage)
+	devices, err := outbox.ActiveDeviceTokens(user.ID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to marshal push message"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch push tokens"})
 		return
 	}
-
-	resp, err := http.Post("https://exp.host/--/api/v2/push/send", "application/json", bytes.NewBuffer(body))
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send push notification"})
+	if len(devices) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User does not have a push token"})
 		return
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Push notification service returned an error"})
+	// Save the notification and queue it for push delivery
+	if _, err := outbox.Notify(user, req.Category, req.Title, req.Body, req.Data); err != nil {
+		log.Printf("Failed to queue notification: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send push notification"})
 		return
 	}
 
-	// Optionally, save the notification to the database
-	notification := models.Notification{
-		UserID: user.ID,
-		Title:  req.Title,
-		Body:   req.Body,
-		Data:   "",
-	}
-
-	if req.Data != nil {
-		dataBytes, err := json.Marshal(req.Data)
-		if err == nil {
-			notification.Data = string(dataBytes)
-		}
-	}
-
-	if err := utils.CustomerPortalDB.Create(&notification).Error; err != nil {
-		log.Printf("Failed to save notification: %v", err)
-	}
-
-	c.JSON(http.StatusOK, gin.H{"status": "Notification sent"})
+	c.JSON(http.StatusOK, gin.H{"status": "Notification queued"})
 }
 
+// GetNotifications pages through the user's notifications, newest first. Archived
+// notifications are only listed with archived=true; category and unread=true narrow the list.
 func GetNotifications(c *gin.Context) {
 	userInterface, exists := c.Get("user")
 	if !exists {
@@ -116,9 +85,27 @@ func GetNotifications(c *gin.Context) {
 
 	offset := (page - 1) * limit
 
+	category := c.Query("category")
+	if category != "" && !models.IsNotificationCategory(category) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown notification category"})
+		return
+	}
+
+	query := utils.CustomerPortalDB.Where("user_id = ?", user.ID)
+	if c.Query("archived") == "true" {
+		query = query.Where("archived_at IS NOT NULL")
+	} else {
+		query = query.Where("archived_at IS NULL")
+	}
+	if category != "" {
+		query = query.Where("category = ?", category)
+	}
+	if c.Query("unread") == "true" {
+		query = query.Where("read_at IS NULL")
+	}
+
 	var notifications []models.Notification
-	if err := utils.CustomerPortalDB.
-			Where("user_id = ?", user.ID).
+	if err := query.
 			Order("created_at DESC").
 			Offset(offset).
 			Limit(limit).
@@ -132,3 +119,137 @@ func GetNotifications(c *gin.Context) {
 	})
 }
 
+
+// GetUnreadCount returns how many of the user's notifications are unread, in total and per
+// category, for the app badge. Archived notifications are not counted.
+func GetUnreadCount(c *gin.Context) {
+	userInterface, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+	user := userInterface.(models.User)
+
+	var rows []struct {
+		Category string
+		Count    int64
+	}
+	if err := utils.CustomerPortalDB.Model(&models.Notification{}).
+		Select("category, COUNT(*) AS count").
+		Where("user_id = ? AND read_at IS NULL AND archived_at IS NULL", user.ID).
+		Group("category").
+		Scan(&rows).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count notifications"})
+		return
+	}
+
+	total := int64(0)
+	byCategory := map[string]int64{}
+	for _, category := range models.NotificationCategories {
+		byCategory[category] = 0
+	}
+	for _, row := range rows {
+		byCategory[row.Category] = row.Count
+		total += row.Count
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"unread_count": total,
+		"by_category":  byCategory,
+	})
+}
+
+// MarkNotificationRead marks one of the user's notifications as read
+func MarkNotificationRead(c *gin.Context) {
+	updateNotification(c, "read_at", "Notification marked as read")
+}
+
+// ArchiveNotification moves one of the user's notifications out of the list
+func ArchiveNotification(c *gin.Context) {
+	updateNotification(c, "archived_at", "Notification archived")
+}
+
+// updateNotification stamps column with the current time on one of the user's notifications,
+// keeping the first time it was set
+func updateNotification(c *gin.Context, column, message string) {
+	userInterface, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+	user := userInterface.(models.User)
+
+	var notification models.Notification
+	if err := utils.CustomerPortalDB.
+		Where("id = ? AND user_id = ?", c.Param("id"), user.ID).
+		First(&notification).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Notification not found"})
+		return
+	}
+
+	if err := utils.CustomerPortalDB.Model(&notification).
+		Where(column + " IS NULL").
+		Update(column, time.Now()).Error; err != nil {
+		log.Printf("Failed to update notification %d: %v", notification.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update notification"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": message})
+}
+
+// MarkAllNotificationsRead marks every unread notification of the user as read, or only those
+// in the category query parameter
+func MarkAllNotificationsRead(c *gin.Context) {
+	userInterface, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+	user := userInterface.(models.User)
+
+	category := c.Query("category")
+	if category != "" && !models.IsNotificationCategory(category) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown notification category"})
+		return
+	}
+
+	query := utils.CustomerPortalDB.Model(&models.Notification{}).
+		Where("user_id = ? AND read_at IS NULL", user.ID)
+	if category != "" {
+		query = query.Where("category = ?", category)
+	}
+	result := query.Update("read_at", time.Now())
+	if result.Error != nil {
+		log.Printf("Failed to mark notifications read for user %d: %v", user.ID, result.Error)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update notifications"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"updated": result.RowsAffected})
+}
+
+// DeleteNotification removes one of the user's notifications for good
+func DeleteNotification(c *gin.Context) {
+	userInterface, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+	user := userInterface.(models.User)
+
+	result := utils.CustomerPortalDB.
+		Where("id = ? AND user_id = ?", c.Param("id"), user.ID).
+		Delete(&models.Notification{})
+	if result.Error != nil {
+		log.Printf("Failed to delete notification: %v", result.Error)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete notification"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Notification not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "Notification deleted"})
+}
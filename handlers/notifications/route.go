@@ -5,4 +5,9 @@ import "github.com/gin-gonic/gin"
 func RegisterNotificationsRoutes(r *gin.RouterGroup) {
 	r.POST("/send-notification", SendNotification)
 	r.GET("/notifications", GetNotifications)
+	r.GET("/notifications/unread-count", GetUnreadCount)
+	r.POST("/notifications/read-all", MarkAllNotificationsRead)
+	r.POST("/notifications/:id/read", MarkNotificationRead)
+	r.POST("/notifications/:id/archive", ArchiveNotification)
+	r.DELETE("/notifications/:id", DeleteNotification)
 }
@@ -0,0 +1,283 @@
+package payments
+
+import (
+    "errors"
+    "math"
+    "mobile-customer-portal-server/models"
+    "mobile-customer-portal-server/utils"
+    "strconv"
+    "strings"
+)
+
+// Errors returned by planAllocations for a split the server cannot accept
+var (
+    errInvalidAllocation  = errors.New("invalid allocation")
+    errAllocationMismatch = errors.New("allocations do not add up to the amount")
+    errNothingOutstanding = errors.New("nothing is outstanding")
+)
+
+// AllocationRequest proposes how much of a payment goes to one property and, optionally, one
+// of its installments
+type AllocationRequest struct {
+    LeadFileNo            string `json:"lead_file_no"`
+    InstallmentScheduleID string `json:"installment_schedule_id"`
+    Amount                string `json:"amount"`
+}
+
+// allocation is the part of a payment applied to one lead file, and to one of its
+// installments when Installment is set
+type allocation struct {
+    LeadFile    models.LeadFile
+    Installment *models.InstallmentSchedule
+    Amount      float64
+}
+
+// allocationPlan is how a payment will be split, as verified against the CRM
+type allocationPlan struct {
+    Allocations []allocation
+    // Outstanding is the most the customer can pay across the plan without overpaying
+    Outstanding float64
+    // Overpayment is set when any part of the plan pays more than is owed
+    Overpayment bool
+}
+
+// Primary is the allocation the payment is filed under, used for the STK account reference and
+// for matching the payment to a receipt
+func (plan allocationPlan) Primary() allocation {
+    primary := plan.Allocations[0]
+    for _, a := range plan.Allocations[1:] {
+        if a.Amount > primary.Amount {
+            primary = a
+        }
+    }
+    return primary
+}
+
+// planAllocations works out how a payment is split. A split proposed by the client is checked
+// line by line; with AutoAllocate the amount is spread over the customer's unpaid installments,
+// oldest due date first; otherwise the whole amount goes to the requested property and
+// installment.
+func planAllocations(customerNumber string, req MpesaPaymentRequest, amount float64) (*allocationPlan, error) {
+    leadFileNo := strings.TrimSpace(req.LeadFileNo)
+    plotNumber := strings.TrimSpace(req.PlotNumber)
+
+    switch {
+    case len(req.Allocations) > 0:
+        return planProposedAllocations(customerNumber, req.Allocations, amount)
+    case req.AutoAllocate:
+        return planAutoAllocations(customerNumber, leadFileNo, plotNumber, amount, req.AllowOverpayment)
+    }
+
+    target, err := resolvePaymentTarget(customerNumber, leadFileNo, plotNumber, strings.TrimSpace(req.InstallmentScheduleID))
+    if err != nil {
+        return nil, err
+    }
+    return &allocationPlan{
+        Allocations: []allocation{{LeadFile: target.LeadFile, Installment: target.Installment, Amount: amount}},
+        Outstanding: target.Outstanding,
+        Overpayment: amount > target.Outstanding,
+    }, nil
+}
+
+// planProposedAllocations checks each line of a client's split against the CRM
+func planProposedAllocations(customerNumber string, requests []AllocationRequest, amount float64) (*allocationPlan, error) {
+    plan := &allocationPlan{}
+    seen := map[string]bool{}
+    perLeadFile := map[string]float64{}
+    total := 0.0
+
+    for _, req := range requests {
+        lineAmount, err := strconv.ParseFloat(strings.TrimSpace(req.Amount), 64)
+        if err != nil || lineAmount <= 0 {
+            return nil, errInvalidAllocation
+        }
+
+        leadFileNo := strings.TrimSpace(req.LeadFileNo)
+        installmentID := strings.TrimSpace(req.InstallmentScheduleID)
+        key := leadFileNo + "/" + installmentID
+        if seen[key] {
+            return nil, errInvalidAllocation
+        }
+        seen[key] = true
+
+        target, err := resolvePaymentTarget(customerNumber, leadFileNo, "", installmentID)
+        if err != nil {
+            return nil, err
+        }
+
+        plan.Allocations = append(plan.Allocations, allocation{
+            LeadFile:    target.LeadFile,
+            Installment: target.Installment,
+            Amount:      lineAmount,
+        })
+        plan.Outstanding += target.Outstanding
+        if lineAmount > target.Outstanding {
+            plan.Overpayment = true
+        }
+
+        // Several installments of one plot still can't add up to more than the plot's balance
+        perLeadFile[target.LeadFile.LeadFileNo] += lineAmount
+        if perLeadFile[target.LeadFile.LeadFileNo] > target.LeadFile.BalanceLCY {
+            plan.Overpayment = true
+        }
+        total += lineAmount
+    }
+
+    if math.Abs(total-amount) > 0.005 {
+        return nil, errAllocationMismatch
+    }
+    plan.Outstanding = math.Min(plan.Outstanding, amountCap(plan.Allocations))
+    return plan, nil
+}
+
+// amountCap is the combined balance of the distinct lead files in allocations
+func amountCap(allocations []allocation) float64 {
+    seen := map[string]bool{}
+    total := 0.0
+    for _, a := range allocations {
+        if !seen[a.LeadFile.LeadFileNo] {
+            seen[a.LeadFile.LeadFileNo] = true
+            total += math.Max(a.LeadFile.BalanceLCY, 0)
+        }
+    }
+    return total
+}
+
+// planAutoAllocations spreads amount over the customer's unpaid installments, oldest due date
+// first, optionally limited to one property. Anything left once every installment is covered is
+// only accepted as an overpayment on the first property.
+func planAutoAllocations(customerNumber, leadFileNo, plotNumber string, amount float64, allowOverpayment bool) (*allocationPlan, error) {
+    query := utils.CRMDB.Where("customer_id = ? AND lead_file_status_dropped = ?", customerNumber, "No")
+    switch {
+    case leadFileNo != "":
+        query = query.Where("lead_file_no = ?", leadFileNo)
+    case plotNumber != "":
+        query = query.Where("plot_number = ?", plotNumber)
+    }
+
+    var leadFiles []models.LeadFile
+    if err := query.Order("lead_file_no ASC").Find(&leadFiles).Error; err != nil {
+        return nil, err
+    }
+    if len(leadFiles) == 0 {
+        return nil, errPropertyNotFound
+    }
+
+    byNumber := map[string]models.LeadFile{}
+    balances := map[string]float64{}
+    leadFileNos := make([]string, 0, len(leadFiles))
+    for _, leadFile := range leadFiles {
+        byNumber[leadFile.LeadFileNo] = leadFile
+        balances[leadFile.LeadFileNo] = math.Max(leadFile.BalanceLCY, 0)
+        leadFileNos = append(leadFileNos, leadFile.LeadFileNo)
+    }
+
+    var installments []models.InstallmentSchedule
+    if err := utils.CRMDB.
+        Where("member_no = ? AND leadfile_no IN ?", customerNumber, leadFileNos).
+        Order("due_date IS NULL, due_date ASC, installment_no ASC").
+        Find(&installments).Error; err != nil {
+        return nil, err
+    }
+
+    plan := &allocationPlan{}
+    remaining := amount
+    for i := range installments {
+        installment := installments[i]
+        if installment.IsPaid() {
+            continue
+        }
+
+        // Never put more on an installment than is left of it or of the plot's balance
+        due := math.Min(installmentOutstanding(installment), balances[installment.LeadfileNo])
+        if due <= 0 {
+            continue
+        }
+        plan.Outstanding += due
+        balances[installment.LeadfileNo] -= due
+
+        if remaining <= 0 {
+            continue
+        }
+        share := math.Min(due, remaining)
+        plan.Allocations = append(plan.Allocations, allocation{
+            LeadFile:    byNumber[installment.LeadfileNo],
+            Installment: &installment,
+            Amount:      share,
+        })
+        remaining -= share
+    }
+
+    if remaining > 0.005 {
+        plan.Overpayment = true
+        if !allowOverpayment {
+            return plan, nil
+        }
+        // The rest goes to the first property's balance as a whole
+        if len(plan.Allocations) > 0 {
+            plan.Allocations = append(plan.Allocations, allocation{LeadFile: plan.Allocations[0].LeadFile, Amount: remaining})
+        } else {
+            plan.Allocations = append(plan.Allocations, allocation{LeadFile: leadFiles[0], Amount: remaining})
+        }
+    }
+
+    if len(plan.Allocations) == 0 {
+        return nil, errNothingOutstanding
+    }
+    return plan, nil
+}
+
+// allocationRecords turns a plan into the rows stored for a payment
+func allocationRecords(paymentID uint, plan allocationPlan) []models.PaymentAllocation {
+    records := make([]models.PaymentAllocation, 0, len(plan.Allocations))
+    for _, a := range plan.Allocations {
+        record := models.PaymentAllocation{
+            MpesaPaymentID: paymentID,
+            LeadFileNo:     a.LeadFile.LeadFileNo,
+            PlotNumber:     a.LeadFile.PlotNumber,
+            Amount:         a.Amount,
+        }
+        if a.Installment != nil {
+            id, number := a.Installment.ISID, a.Installment.InstallmentNo
+            record.InstallmentScheduleID = &id
+            record.InstallmentNo = &number
+            record.DueDate = a.Installment.DueDate
+        }
+        records = append(records, record)
+    }
+    return records
+}
+
+// paymentAllocations loads the allocations of the given payments, keyed by payment ID
+func paymentAllocations(payments []models.MpesaPayment) map[uint][]models.PaymentAllocation {
+    found := map[uint][]models.PaymentAllocation{}
+    if len(payments) == 0 {
+        return found
+    }
+
+    ids := make([]uint, 0, len(payments))
+    for _, payment := range payments {
+        ids = append(ids, payment.ID)
+    }
+
+    var allocations []models.PaymentAllocation
+    if err := utils.CustomerPortalDB.
+        Where("mpesa_payment_id IN ?", ids).
+        Order("id ASC").
+        Find(&allocations).Error; err != nil {
+        return found
+    }
+
+    for _, a := range allocations {
+        found[a.MpesaPaymentID] = append(found[a.MpesaPaymentID], a)
+    }
+    return found
+}
+
+// allocationsOrEmpty keeps payments without allocations rendering as an empty JSON list
+func allocationsOrEmpty(allocations []models.PaymentAllocation) []models.PaymentAllocation {
+    if allocations == nil {
+        return []models.PaymentAllocation{}
+    }
+    return allocations
+}
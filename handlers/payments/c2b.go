@@ -0,0 +1,242 @@
+package payments
+
+import (
+    "crypto/subtle"
+    "encoding/json"
+    "errors"
+    "io"
+    "log"
+    "mobile-customer-portal-server/daraja"
+    "mobile-customer-portal-server/models"
+    "mobile-customer-portal-server/utils"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+
+    "github.com/gin-gonic/gin"
+    "gorm.io/gorm/clause"
+)
+
+// errUnknownAccount is returned by resolvePaybillAccount for an account number that is not one
+// of our plots or lead files
+var errUnknownAccount = errors.New("unknown paybill account")
+
+// RegisterC2BURLs registers the paybill validation and confirmation URLs with Daraja. They are
+// built from DARAJA_C2B_URL, the public address of the /c2b routes, and MPESA_C2B_TOKEN, the
+// secret that authenticates M-PESA's requests to them. DARAJA_C2B_RESPONSE_TYPE decides what
+// happens to a payment when the validation URL cannot be reached: "Completed" (default) takes
+// the money anyway, "Cancelled" declines it. Daraja rejects URLs containing words such as
+// "mpesa", which is why the routes are not under /mpesa.
+func RegisterC2BURLs() error {
+    baseURL := strings.TrimRight(os.Getenv("DARAJA_C2B_URL"), "/")
+    token := os.Getenv("MPESA_C2B_TOKEN")
+    if baseURL == "" || token == "" {
+        return errors.New("DARAJA_C2B_URL and MPESA_C2B_TOKEN must both be set")
+    }
+
+    responseType := os.Getenv("DARAJA_C2B_RESPONSE_TYPE")
+    if responseType == "" {
+        responseType = daraja.ResponseTypeCompleted
+    }
+
+    _, err := daraja.Default.RegisterC2BURLs(
+        baseURL+"/confirmation/"+token,
+        baseURL+"/validation/"+token,
+        responseType,
+    )
+    return err
+}
+
+// c2bTokenValid checks the secret in the URL M-PESA called against MPESA_C2B_TOKEN
+func c2bTokenValid(c *gin.Context) bool {
+    expected := os.Getenv("MPESA_C2B_TOKEN")
+    if expected == "" {
+        return false
+    }
+    return subtle.ConstantTimeCompare([]byte(c.Param("token")), []byte(expected)) == 1
+}
+
+// readC2BTransaction authenticates and parses a validation or confirmation request, writing the
+// error response itself when it fails
+func readC2BTransaction(c *gin.Context) (daraja.C2BTransaction, []byte, bool) {
+    var transaction daraja.C2BTransaction
+
+    if !c2bTokenValid(c) {
+        log.Printf("Rejected C2B request with unknown token from %s", c.ClientIP())
+        c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+        return transaction, nil, false
+    }
+
+    bodyBytes, err := io.ReadAll(c.Request.Body)
+    if err != nil {
+        log.Printf("Error reading C2B request body: %v", err)
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid C2B data"})
+        return transaction, nil, false
+    }
+    if err := json.Unmarshal(bodyBytes, &transaction); err != nil || transaction.TransID == "" {
+        log.Printf("Error parsing C2B request: %v", err)
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid C2B data"})
+        return transaction, nil, false
+    }
+    return transaction, bodyBytes, true
+}
+
+// resolvePaybillAccount finds the active lead file a paybill account number refers to. Customers
+// type either the plot number or the lead file number, in any case.
+func resolvePaybillAccount(account string) (*models.LeadFile, error) {
+    account = strings.ToUpper(strings.TrimSpace(account))
+    if account == "" {
+        return nil, errUnknownAccount
+    }
+
+    var leadFiles []models.LeadFile
+    if err := utils.CRMDB.
+        Where("lead_file_status_dropped = ?", "No").
+        Where("UPPER(lead_file_no) = ? OR UPPER(plot_number) = ?", account, account).
+        Limit(10).
+        Find(&leadFiles).Error; err != nil {
+        return nil, err
+    }
+
+    // A lead file number is unique; a plot number only counts if it names a single sale
+    for _, leadFile := range leadFiles {
+        if strings.EqualFold(leadFile.LeadFileNo, account) {
+            return &leadFile, nil
+        }
+    }
+    if len(leadFiles) != 1 {
+        return nil, errUnknownAccount
+    }
+    return &leadFiles[0], nil
+}
+
+// C2BValidation answers M-PESA's validation request for a paybill payment. Payments to an
+// account that is not one of our plots or lead files are declined before any money moves.
+func C2BValidation(c *gin.Context) {
+    transaction, _, ok := readC2BTransaction(c)
+    if !ok {
+        return
+    }
+
+    if amount, err := strconv.ParseFloat(strings.TrimSpace(transaction.TransAmount), 64); err != nil || amount <= 0 {
+        c.JSON(http.StatusOK, daraja.C2BResponse{ResultCode: daraja.C2BInvalidAmount, ResultDesc: "Rejected"})
+        return
+    }
+
+    if _, err := resolvePaybillAccount(transaction.BillRefNumber); err != nil {
+        if errors.Is(err, errUnknownAccount) {
+            log.Printf("Declined C2B payment %s to unknown account %q", transaction.TransID, transaction.BillRefNumber)
+            c.JSON(http.StatusOK, daraja.C2BResponse{ResultCode: daraja.C2BInvalidAccountNumber, ResultDesc: "Rejected"})
+            return
+        }
+        // Don't turn away a customer's money because the CRM is briefly unavailable
+        log.Printf("Error validating C2B payment %s: %v", transaction.TransID, err)
+    }
+
+    c.JSON(http.StatusOK, daraja.C2BResponse{ResultCode: daraja.C2BAccepted, ResultDesc: "Accepted"})
+}
+
+// C2BConfirmation records a completed paybill payment and notifies the customer. The payment
+// then goes through receipt matching like an STK payment. Repeated confirmations of the same
+// transaction are acknowledged without recording it twice.
+func C2BConfirmation(c *gin.Context) {
+    transaction, bodyBytes, ok := readC2BTransaction(c)
+    if !ok {
+        return
+    }
+
+    var existing int64
+    if err := utils.CustomerPortalDB.Model(&models.MpesaPayment{}).
+        Where("checkout_request_id = ?", transaction.TransID).
+        Count(&existing).Error; err != nil {
+        log.Printf("Failed to look up C2B payment %s: %v", transaction.TransID, err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process confirmation"})
+        return
+    }
+    if existing > 0 {
+        log.Printf("Ignoring repeated C2B confirmation for %s", transaction.TransID)
+        c.JSON(http.StatusOK, daraja.C2BResponse{ResultCode: daraja.C2BAccepted, ResultDesc: "Success"})
+        return
+    }
+
+    amount, _ := strconv.ParseFloat(strings.TrimSpace(transaction.TransAmount), 64)
+    resultCode := daraja.ResultCodeSuccess
+
+    payment := models.MpesaPayment{
+        CheckoutRequestID:  transaction.TransID,
+        Source:             models.MpesaSourceC2B,
+        PhoneNumber:        transaction.MSISDN,
+        Amount:             amount,
+        AmountPaid:         &amount,
+        Status:             models.MpesaStatusSuccess,
+        ResultCode:         &resultCode,
+        ResultDesc:         "Paybill payment confirmed",
+        MpesaReceiptNumber: transaction.TransID,
+        PayerPhoneNumber:   transaction.MSISDN,
+        RawCallback:        string(bodyBytes),
+    }
+    if date, err := daraja.ParseTransactionDate(transaction.TransTime); err == nil {
+        payment.TransactionDate = &date
+    }
+
+    // The money has already been taken, so a payment to an account we can't place is still
+    // recorded and left to finance
+    leadFile, err := resolvePaybillAccount(transaction.BillRefNumber)
+    switch {
+    case err == nil:
+        payment.CustomerNumber = leadFile.CustomerID
+        payment.LeadFileNo = leadFile.LeadFileNo
+        payment.PlotNumber = leadFile.PlotNumber
+        payment.Overpayment = amount > leadFile.BalanceLCY
+    case errors.Is(err, errUnknownAccount):
+        payment.PlotNumber = strings.TrimSpace(transaction.BillRefNumber)
+    default:
+        log.Printf("Error resolving C2B account for %s: %v", transaction.TransID, err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process confirmation"})
+        return
+    }
+
+    result := utils.CustomerPortalDB.Clauses(clause.OnConflict{DoNothing: true}).Create(&payment)
+    if result.Error != nil {
+        log.Printf("Error saving C2B payment %s: %v", transaction.TransID, result.Error)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process confirmation"})
+        return
+    }
+    if result.RowsAffected == 0 {
+        // A concurrent delivery of the same confirmation got there first
+        c.JSON(http.StatusOK, daraja.C2BResponse{ResultCode: daraja.C2BAccepted, ResultDesc: "Success"})
+        return
+    }
+
+    log.Printf("C2B payment %s of KES %s confirmed for account %q", transaction.TransID,
+        formatAmount(amount), transaction.BillRefNumber)
+
+    if leadFile != nil {
+        recordPaybillAllocations(payment, *leadFile)
+    }
+
+    if payment.CustomerNumber == "" {
+        recordMatchException(payment, models.MatchExceptionUnknownAccount, 0,
+            "Paybill account "+strings.TrimSpace(transaction.BillRefNumber)+" matches no plot or lead file")
+    } else {
+        notifyPaymentOutcome(payment, models.MpesaStatusSuccess)
+    }
+
+    c.JSON(http.StatusOK, daraja.C2BResponse{ResultCode: daraja.C2BAccepted, ResultDesc: "Success"})
+}
+
+
+// recordPaybillAllocations spreads a paybill payment over the unpaid installments of the plot it
+// was paid to, oldest first, with anything left over going to the plot's balance
+func recordPaybillAllocations(payment models.MpesaPayment, leadFile models.LeadFile) {
+    plan, err := planAutoAllocations(payment.CustomerNumber, leadFile.LeadFileNo, "", payment.Amount, true)
+    if err != nil {
+        plan = &allocationPlan{Allocations: []allocation{{LeadFile: leadFile, Amount: payment.Amount}}}
+    }
+
+    allocations := allocationRecords(payment.ID, *plan)
+    if err := utils.CustomerPortalDB.Create(&allocations).Error; err != nil {
+        log.Printf("Failed to record allocations of C2B payment %s: %v", payment.CheckoutRequestID, err)
+    }
+}
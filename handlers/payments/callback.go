@@ -0,0 +1,119 @@
+package payments
+
+import (
+    "log"
+    "mobile-customer-portal-server/daraja"
+    "mobile-customer-portal-server/utils"
+    "net"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+)
+
+// callbackTokenBytes is the length of the random secret in each payment's callback URL
+const callbackTokenBytes = 32
+
+// newCallbackURL returns a callback URL carrying a fresh per-payment secret, along with the
+// hash of the secret to store on the payment
+func newCallbackURL(baseURL string) (string, string, error) {
+    token, err := utils.GenerateRandomHex(callbackTokenBytes)
+    if err != nil {
+        return "", "", err
+    }
+    return strings.TrimRight(baseURL, "/") + "/" + token, utils.HashSecret(token), nil
+}
+
+// parseAllowedNetworks parses a comma separated list of IP addresses and CIDR ranges
+func parseAllowedNetworks(list string) []*net.IPNet {
+    var networks []*net.IPNet
+    for _, entry := range strings.Split(list, ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+        if !strings.Contains(entry, "/") {
+            if strings.Contains(entry, ":") {
+                entry += "/128"
+            } else {
+                entry += "/32"
+            }
+        }
+        _, network, err := net.ParseCIDR(entry)
+        if err != nil {
+            log.Printf("Ignoring invalid callback allowlist entry %q: %v", entry, err)
+            continue
+        }
+        networks = append(networks, network)
+    }
+    return networks
+}
+
+// CallbackIPAllowlist rejects callbacks from addresses outside MPESA_CALLBACK_ALLOWED_IPS, a
+// comma separated list of IPs and CIDR ranges. When the variable is empty every address is
+// allowed and the per-payment callback token is the only check. Behind a reverse proxy,
+// TRUSTED_PROXIES must be set so the client IP is taken from the proxy's forwarded header.
+func CallbackIPAllowlist() gin.HandlerFunc {
+    networks := parseAllowedNetworks(os.Getenv("MPESA_CALLBACK_ALLOWED_IPS"))
+
+    return func(c *gin.Context) {
+        if len(networks) == 0 {
+            c.Next()
+            return
+        }
+
+        ip := net.ParseIP(c.ClientIP())
+        for _, network := range networks {
+            if ip != nil && network.Contains(ip) {
+                c.Next()
+                return
+            }
+        }
+
+        log.Printf("Rejected M-PESA callback from %s", c.ClientIP())
+        c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+    }
+}
+
+// callbackMetadata holds the CallbackMetadata items of a successful STK callback
+type callbackMetadata struct {
+    Amount             *float64
+    MpesaReceiptNumber string
+    TransactionDate    *time.Time
+    PhoneNumber        string
+}
+
+// parseCallbackMetadata picks the known items out of the callback metadata, ignoring any it
+// does not recognise or cannot parse
+func parseCallbackMetadata(items []daraja.CallbackItem) callbackMetadata {
+    var metadata callbackMetadata
+    for _, item := range items {
+        value := item.String()
+        if value == "" {
+            continue
+        }
+
+        switch item.Name {
+        case "Amount":
+            if amount, err := strconv.ParseFloat(value, 64); err == nil {
+                metadata.Amount = &amount
+            } else {
+                log.Printf("Ignoring invalid callback amount %q: %v", value, err)
+            }
+        case "MpesaReceiptNumber":
+            metadata.MpesaReceiptNumber = value
+        case "TransactionDate":
+            if date, err := daraja.ParseTransactionDate(value); err == nil {
+                metadata.TransactionDate = &date
+            } else {
+                log.Printf("Ignoring invalid callback transaction date %q: %v", value, err)
+            }
+        case "PhoneNumber":
+            metadata.PhoneNumber = value
+        }
+    }
+    return metadata
+}
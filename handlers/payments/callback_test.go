@@ -0,0 +1,100 @@
+package payments
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"mobile-customer-portal-server/models"
+	"mobile-customer-portal-server/utils"
+	"mobile-customer-portal-server/utils/testdb"
+)
+
+// postSTKCallback posts a successful STK callback for checkoutRequestID to path, routed the way
+// main.go routes M-PESA callbacks
+func postSTKCallback(t *testing.T, path, checkoutRequestID string) int {
+	t.Helper()
+	router := gin.New()
+	router.POST("/mpesa/callback/:token", MpesaCallback)
+	router.POST("/mpesa/callback", MpesaCallback)
+
+	body := `{"Body":{"stkCallback":{"MerchantRequestID":"29115-34620561-1","CheckoutRequestID":"` + checkoutRequestID + `",
+		"ResultCode":0,"ResultDesc":"The service request is processed successfully.","CallbackMetadata":{"Item":[
+		{"Name":"Amount","Value":500},{"Name":"MpesaReceiptNumber","Value":"QAB1CD2EF3"},
+		{"Name":"TransactionDate","Value":20250310101500},{"Name":"PhoneNumber","Value":254712345678}]}}}}`
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(recorder, request)
+	return recorder.Code
+}
+
+// createSTKPayment saves a pending STK payment whose callback URL carried token, or none when
+// token is empty, as before callback URLs carried one
+func createSTKPayment(t *testing.T, checkoutRequestID, token string) models.MpesaPayment {
+	t.Helper()
+	payment := models.MpesaPayment{
+		CheckoutRequestID:     checkoutRequestID,
+		Method:                models.PaymentMethodMpesa,
+		Source:                models.MpesaSourceSTK,
+		InstallmentScheduleID: "1",
+		CustomerNumber:        "C001",
+		PhoneNumber:           "254712345678",
+		Amount:                500,
+		Status:                models.MpesaStatusPending,
+		PlotNumber:            "VP123",
+	}
+	if token != "" {
+		payment.CallbackTokenHash = utils.HashSecret(token)
+	}
+	if err := utils.CustomerPortalDB.Create(&payment).Error; err != nil {
+		t.Fatal(err)
+	}
+	return payment
+}
+
+func TestMpesaCallbackWithToken(t *testing.T) {
+	testdb.Setup(t)
+	payment := createSTKPayment(t, "ws_CO_1", "secret-token")
+
+	if code := postSTKCallback(t, "/mpesa/callback/wrong-token", "ws_CO_1"); code != http.StatusForbidden {
+		t.Fatalf("status with a wrong token = %d, want %d", code, http.StatusForbidden)
+	}
+	if code := postSTKCallback(t, "/mpesa/callback/secret-token", "ws_CO_1"); code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+	if current := reloadPayment(t, payment); current.Status != models.MpesaStatusSuccess {
+		t.Fatalf("status = %q, want %q", current.Status, models.MpesaStatusSuccess)
+	}
+}
+
+func TestMpesaCallbackLegacyRoute(t *testing.T) {
+	testdb.Setup(t)
+	legacy := createSTKPayment(t, "ws_CO_legacy", "")
+	tokened := createSTKPayment(t, "ws_CO_tokened", "secret-token")
+
+	// A payment issued a token is only called back on its own URL
+	if code := postSTKCallback(t, "/mpesa/callback", "ws_CO_tokened"); code != http.StatusForbidden {
+		t.Fatalf("status for a payment with a token = %d, want %d", code, http.StatusForbidden)
+	}
+	if current := reloadPayment(t, tokened); current.Status != models.MpesaStatusPending {
+		t.Fatalf("payment with a token settled through the legacy route: %q", current.Status)
+	}
+
+	// One started before tokens is settled by its checkout request ID
+	if code := postSTKCallback(t, "/mpesa/callback", "ws_CO_legacy"); code != http.StatusOK {
+		t.Fatalf("status for a legacy payment = %d, want %d", code, http.StatusOK)
+	}
+	current := reloadPayment(t, legacy)
+	if current.Status != models.MpesaStatusSuccess || current.MpesaReceiptNumber != "QAB1CD2EF3" {
+		t.Fatalf("legacy payment = %q with receipt %q, want settled", current.Status, current.MpesaReceiptNumber)
+	}
+
+	// Once settled it cannot be called back on the legacy route again
+	if code := postSTKCallback(t, "/mpesa/callback", "ws_CO_legacy"); code != http.StatusForbidden {
+		t.Fatalf("status for a settled legacy payment = %d, want %d", code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,478 @@
+package payments
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "math"
+    "mobile-customer-portal-server/currency"
+    "mobile-customer-portal-server/daraja"
+    "mobile-customer-portal-server/gateway"
+    "mobile-customer-portal-server/models"
+    "mobile-customer-portal-server/utils"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+
+    "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
+)
+
+// PaymentRequest is the body of a payment by any method. PhoneNumber is only needed for
+// M-PESA; ReturnURL is where the card checkout page sends the customer when they are done.
+// Currency, KES unless set, is what the amount and any allocations are in; only cards can be
+// charged in another currency, and only when billing rates are configured.
+type PaymentRequest struct {
+    MpesaPaymentRequest
+    Method    string `json:"method"`
+    Email     string `json:"email"`
+    ReturnURL string `json:"return_url"`
+    Currency  string `json:"currency"`
+}
+
+// startedPayment is a payment a provider accepted and that has been saved with its split
+type startedPayment struct {
+    Payment     models.MpesaPayment
+    Session     *gateway.Session
+    Allocations []models.PaymentAllocation
+}
+
+// methodLabel names a payment method in error messages
+func methodLabel(method gateway.Method) string {
+    switch method {
+    case gateway.MethodCard:
+        return "card"
+    case gateway.MethodBankTransfer:
+        return "bank transfer"
+    default:
+        return "M-PESA"
+    }
+}
+
+// GetPaymentMethods lists the payment methods the app can offer
+func GetPaymentMethods(c *gin.Context) {
+    c.JSON(http.StatusOK, gin.H{"methods": gateway.Methods()})
+}
+
+// InitiatePayment starts a payment with the provider for the requested method: an STK push for
+// M-PESA, a hosted checkout session for cards, or bank details and a reference to quote for a
+// bank transfer. The payment is checked and split exactly like an M-PESA payment.
+func InitiatePayment(c *gin.Context) {
+    var req PaymentRequest
+    if err := c.BindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+        return
+    }
+
+    method := gateway.Method(strings.TrimSpace(req.Method))
+    if method == "" {
+        method = gateway.MethodMpesa
+    }
+
+    amount, err := strconv.ParseFloat(strings.TrimSpace(req.Amount), 64)
+    if err != nil || amount <= 0 {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid amount format"})
+        return
+    }
+
+    if method == gateway.MethodMpesa {
+        // STK push only takes whole shillings
+        if amount != float64(int(amount)) {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid amount format"})
+            return
+        }
+        if !isValidPhoneNumber(req.PhoneNumber) {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid phone number format"})
+            return
+        }
+    }
+
+    userInterface, exists := c.Get("user")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+        return
+    }
+    user := userInterface.(models.User)
+
+    started := startPayment(c, user, req, method, amount)
+    if started == nil {
+        return
+    }
+
+    var instructions interface{}
+    if started.Session.Instructions != nil {
+        instructions = started.Session.Instructions
+    }
+
+    c.JSON(http.StatusOK, gin.H{
+        "message":          "Payment initiated",
+        "method":           started.Payment.Method,
+        "amount":           started.Payment.Amount,
+        "currency":         started.Payment.Currency,
+        "original_amount":  started.Payment.OriginalAmount,
+        "exchange_rate":    started.Payment.ExchangeRate,
+        "reference":        started.Payment.CheckoutRequestID,
+        "status":           started.Payment.Status,
+        "redirect_url":     started.Session.RedirectURL,
+        "instructions":     instructions,
+        "customer_message": started.Session.Message,
+        "allocations":      started.Allocations,
+    })
+}
+
+// startPayment checks that the customer is paying for their own properties, works out the
+// split, starts the payment with the method's provider and saves it. A payment in another
+// currency is converted to KES at the current rate first and charged in its own currency. On
+// failure it writes the error response and returns nil.
+func startPayment(c *gin.Context, user models.User, req PaymentRequest, method gateway.Method, amount float64) *startedPayment {
+    label := methodLabel(method)
+
+    provider, err := gateway.Get(method)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported payment method", "code": "unsupported_method"})
+        return nil
+    }
+
+    // Everything is checked and recorded in KES
+    chargeAmount := amount
+    var quote *currency.Quote
+    if code := currency.Normalize(req.Currency); code != "" && code != currency.Base {
+        if method != gateway.MethodCard {
+            c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Only KES is accepted for %s payments", label), "code": "unsupported_currency"})
+            return nil
+        }
+        var found currency.Quote
+        found, err = currency.BillingQuote(code)
+        if errors.Is(err, currency.ErrNoBillingRates) {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "Card payments are only accepted in KES at the moment", "code": "unsupported_currency"})
+            return nil
+        }
+        if errors.Is(err, currency.ErrUnsupported) {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported currency", "code": "unsupported_currency"})
+            return nil
+        }
+        if err != nil {
+            log.Printf("Error looking up exchange rate for %s: %v", code, err)
+            c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to initiate %s payment", label)})
+            return nil
+        }
+        quote = &found
+        amount, err = amountsToBase(&req.MpesaPaymentRequest, found, chargeAmount)
+    }
+
+    // Make sure the customer is paying for their own properties and work out the split
+    var plan *allocationPlan
+    if err == nil {
+        plan, err = planAllocations(user.CustomerNumber, req.MpesaPaymentRequest, amount)
+    }
+    switch {
+    case errors.Is(err, errPropertyNotFound):
+        c.JSON(http.StatusForbidden, gin.H{"error": "Property not found, does not belong to the user, or is dropped"})
+        return nil
+    case errors.Is(err, errLeadFileRequired):
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Lead file number is required"})
+        return nil
+    case errors.Is(err, errInvalidInstallment):
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid installment schedule ID"})
+        return nil
+    case errors.Is(err, errInvalidAllocation):
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Each allocation needs a lead file and a positive amount, once per installment"})
+        return nil
+    case errors.Is(err, errAllocationMismatch):
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Allocations must add up to the amount", "code": "allocation_mismatch"})
+        return nil
+    case errors.Is(err, errNothingOutstanding):
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Nothing is outstanding on these properties", "code": "nothing_outstanding"})
+        return nil
+    case err != nil:
+        log.Printf("Error validating %s payment for customer %s: %v", label, user.CustomerNumber, err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to initiate %s payment", label)})
+        return nil
+    }
+
+    // Refuse to take more than is owed unless the customer explicitly asked to overpay
+    if plan.Overpayment && !req.AllowOverpayment {
+        outstanding := currency.Format(plan.Outstanding, currency.Base)
+        if quote != nil {
+            outstanding += " (" + currency.Format(quote.FromBase(plan.Outstanding), quote.Currency) + ")"
+        }
+        c.JSON(http.StatusBadRequest, gin.H{
+            "error":       "Amount exceeds the outstanding balance of " + outstanding,
+            "code":        "amount_exceeds_balance",
+            "outstanding": plan.Outstanding,
+        })
+        return nil
+    }
+    primary := plan.Primary()
+
+    providerRequest := gateway.Request{
+        Amount:           chargeAmount,
+        Currency:         currency.Base,
+        PhoneNumber:      req.PhoneNumber,
+        Email:            strings.TrimSpace(req.Email),
+        CustomerName:     primary.LeadFile.CustomerName,
+        AccountReference: primary.LeadFile.PlotNumber,
+        Description:      "Payment of Installment",
+        ReturnURL:        strings.TrimSpace(req.ReturnURL),
+    }
+    if quote != nil {
+        providerRequest.Currency = quote.Currency
+    }
+    if providerRequest.Email == "" {
+        providerRequest.Email = user.Email
+    }
+
+    callbackTokenHash := ""
+    switch method {
+    case gateway.MethodMpesa:
+        callbackURL := os.Getenv("DARAJA_CALLBACK_URL")
+        if !daraja.Default.Configured() || callbackURL == "" {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "M-PESA configuration not properly set"})
+            return nil
+        }
+
+        // Every payment gets its own callback URL carrying a secret only Safaricom and we know
+        providerRequest.CallbackURL, callbackTokenHash, err = newCallbackURL(callbackURL)
+        if err != nil {
+            log.Printf("Error generating callback token: %v", err)
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to initiate M-PESA payment"})
+            return nil
+        }
+    case gateway.MethodCard:
+        providerRequest.CallbackURL = os.Getenv("CARD_WEBHOOK_URL")
+        if providerRequest.CallbackURL == "" {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Card payments are not properly configured"})
+            return nil
+        }
+    case gateway.MethodBankTransfer:
+        // Transfers go to the account of the project the plot belongs to
+        var project models.Project
+        if err := utils.DefaultDB.Where("EPR_id = ?", primary.LeadFile.ProjectNumber).First(&project).Error; err != nil &&
+            !errors.Is(err, gorm.ErrRecordNotFound) {
+            log.Printf("Error fetching project %s: %v", primary.LeadFile.ProjectNumber, err)
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to initiate bank transfer payment"})
+            return nil
+        }
+        providerRequest.BankName = project.Bank
+        providerRequest.AccountNumber = project.AccountNumber
+    }
+
+    session, err := provider.Start(providerRequest)
+    if err != nil {
+        log.Printf("Error starting %s payment: %v", label, err)
+        var apiErr *daraja.APIError
+        switch {
+        case errors.As(err, &apiErr):
+            c.JSON(http.StatusInternalServerError, gin.H{"error": apiErr.Message})
+        case errors.Is(err, gateway.ErrNoBankAccount):
+            c.JSON(http.StatusBadRequest, gin.H{"error": "No bank account is on record for this project", "code": "no_bank_account"})
+        default:
+            c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to initiate %s payment", label)})
+        }
+        return nil
+    }
+
+    installmentScheduleID := ""
+    if primary.Installment != nil {
+        installmentScheduleID = strconv.Itoa(primary.Installment.ISID)
+    }
+
+    payment := models.MpesaPayment{
+        CheckoutRequestID:     session.Reference,
+        Method:                string(method),
+        Source:                string(method),
+        InstallmentScheduleID: installmentScheduleID,
+        CustomerNumber:        user.CustomerNumber,
+        LeadFileNo:            primary.LeadFile.LeadFileNo,
+        PhoneNumber:           req.PhoneNumber,
+        MerchantRequestID:     session.MerchantReference,
+        Amount:                amount,
+        Currency:              currency.Base,
+        Status:                models.MpesaStatusPending,
+        PlotNumber:            primary.LeadFile.PlotNumber,
+        Overpayment:           plan.Overpayment,
+        CallbackTokenHash:     callbackTokenHash,
+    }
+    if method == gateway.MethodMpesa {
+        payment.Source = models.MpesaSourceSTK
+    }
+    if quote != nil {
+        payment.Currency = quote.Currency
+        payment.OriginalAmount = &chargeAmount
+        payment.ExchangeRate = &quote.Rate
+    }
+    if session.Instructions != nil {
+        if instructions, err := json.Marshal(session.Instructions); err == nil {
+            payment.Instructions = string(instructions)
+        }
+    }
+
+    allocations, err := savePayment(&payment, *plan)
+    if err != nil {
+        log.Printf("Error saving %s payment: %v", label, err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to save %s payment", label)})
+        return nil
+    }
+
+    return &startedPayment{Payment: payment, Session: session, Allocations: allocations}
+}
+
+// savePayment saves a payment together with its split
+func savePayment(payment *models.MpesaPayment, plan allocationPlan) ([]models.PaymentAllocation, error) {
+    var allocations []models.PaymentAllocation
+    err := utils.CustomerPortalDB.Transaction(func(tx *gorm.DB) error {
+        if err := tx.Create(payment).Error; err != nil {
+            return err
+        }
+        allocations = allocationRecords(payment.ID, plan)
+        return tx.Create(&allocations).Error
+    })
+    return allocations, err
+}
+
+// amountsToBase converts the amount of a payment in another currency, and any split proposed
+// with it, to KES. Each line of the split is converted on its own and the amount becomes their
+// sum, so the split still adds up exactly after rounding.
+func amountsToBase(req *MpesaPaymentRequest, quote currency.Quote, amount float64) (float64, error) {
+    if len(req.Allocations) == 0 {
+        return quote.ToBase(amount), nil
+    }
+
+    allocations := make([]AllocationRequest, len(req.Allocations))
+    total, converted := 0.0, 0.0
+    for i, line := range req.Allocations {
+        lineAmount, err := strconv.ParseFloat(strings.TrimSpace(line.Amount), 64)
+        if err != nil || lineAmount <= 0 {
+            return 0, errInvalidAllocation
+        }
+        total += lineAmount
+
+        lineBase := quote.ToBase(lineAmount)
+        converted += lineBase
+        line.Amount = strconv.FormatFloat(lineBase, 'f', 2, 64)
+        allocations[i] = line
+    }
+    if math.Abs(total-amount) > 0.005 {
+        return 0, errAllocationMismatch
+    }
+
+    req.Allocations = allocations
+    return currency.Round(converted), nil
+}
+
+// CardWebhook records the outcome the card provider posts for a checkout session. Webhooks
+// without a valid signature are rejected; a payment is only finalized once, so repeated
+// deliveries are acknowledged without notifying the customer again.
+func CardWebhook(c *gin.Context) {
+    provider, err := gateway.Get(gateway.MethodCard)
+    if err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Card payments are not enabled"})
+        return
+    }
+    parser, ok := provider.(gateway.WebhookParser)
+    if !ok {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Card payments are not enabled"})
+        return
+    }
+
+    bodyBytes, err := io.ReadAll(c.Request.Body)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook data"})
+        return
+    }
+
+    event, err := parser.ParseWebhook(c.Request.Header, bodyBytes)
+    if err != nil {
+        if errors.Is(err, gateway.ErrInvalidSignature) {
+            log.Printf("Rejected card webhook with invalid signature from %s", c.ClientIP())
+            c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+            return
+        }
+        log.Printf("Error parsing card webhook: %v", err)
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook data"})
+        return
+    }
+
+    var payment models.MpesaPayment
+    if err := utils.CustomerPortalDB.
+        Where("checkout_request_id = ? AND method = ?", event.Reference, models.PaymentMethodCard).
+        First(&payment).Error; err != nil {
+        log.Printf("Card webhook for unknown checkout session %s", event.Reference)
+        c.JSON(http.StatusNotFound, gin.H{"error": "Payment not found"})
+        return
+    }
+
+    if event.Status == gateway.StatusPending {
+        c.JSON(http.StatusOK, gin.H{"message": "Webhook received"})
+        return
+    }
+
+    finalized, err := finalizeProviderEvent(payment, *event, string(bodyBytes))
+    if err != nil {
+        log.Printf("Failed to update card payment %s: %v", payment.CheckoutRequestID, err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process webhook"})
+        return
+    }
+    if !finalized {
+        log.Printf("Ignoring repeated card webhook for %s", payment.CheckoutRequestID)
+        c.JSON(http.StatusOK, gin.H{"message": "Webhook already processed"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{"message": "Webhook received"})
+}
+
+// statusForEvent maps a provider's outcome to the payment status it ends in
+func statusForEvent(status string) string {
+    switch status {
+    case gateway.StatusSuccess:
+        return models.MpesaStatusSuccess
+    case gateway.StatusCancelled:
+        return models.MpesaStatusCancelled
+    default:
+        return models.MpesaStatusFailed
+    }
+}
+
+// finalizeProviderEvent finalizes a payment from what a non M-PESA provider reported about it.
+// A payment the provider settled for another amount or currency than was charged is not
+// credited: it is failed and raised as a match exception for finance to refund or post by hand.
+func finalizeProviderEvent(payment models.MpesaPayment, event gateway.Event, raw string) (bool, error) {
+    status := statusForEvent(event.Status)
+
+    outcome := paymentOutcome{
+        ResultDesc:            event.Message,
+        RawCallback:           raw,
+        ProviderTransactionID: event.TransactionID,
+    }
+    if status != models.MpesaStatusSuccess {
+        return finalizePayment(payment, status, outcome)
+    }
+
+    // The provider reports what it charged, in the currency the payment was charged in
+    amount, expected := event.Amount, payment.Amount
+    if payment.OriginalAmount != nil {
+        expected = *payment.OriginalAmount
+    }
+    if math.Abs(amount-expected) >= 0.005 || !strings.EqualFold(strings.TrimSpace(event.Currency), payment.Currency) {
+        detail := fmt.Sprintf("Card provider settled %s %.2f for a payment charged as %s %.2f (transaction %s)",
+            event.Currency, amount, payment.Currency, expected, event.TransactionID)
+        log.Printf("Card payment %s not credited: %s", payment.CheckoutRequestID, detail)
+
+        outcome.ResultDesc = "Settled amount does not match the amount charged"
+        finalized, err := finalizePayment(payment, models.MpesaStatusFailed, outcome)
+        if finalized {
+            recordMatchException(payment, models.MatchExceptionAmountMismatch, 0, detail)
+        }
+        return finalized, err
+    }
+
+    if payment.ExchangeRate != nil {
+        amount = currency.Round(amount * *payment.ExchangeRate)
+    }
+    outcome.Metadata = callbackMetadata{Amount: &amount, TransactionDate: event.PaidAt}
+    return finalizePayment(payment, status, outcome)
+}
@@ -0,0 +1,192 @@
+package payments
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"mobile-customer-portal-server/gateway"
+	"mobile-customer-portal-server/gateway/cardfake"
+	"mobile-customer-portal-server/models"
+	"mobile-customer-portal-server/utils"
+	"mobile-customer-portal-server/utils/testdb"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+const testWebhookSecret = "whsec_test"
+
+// useCardFake registers a card provider backed by a fresh fake for the duration of a test, and
+// serves CardWebhook at the returned callback URL
+func useCardFake(t *testing.T) (*gateway.CardProvider, *cardfake.Server, string) {
+	t.Helper()
+	fake := cardfake.New("", testWebhookSecret)
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	fake.PublicURL = server.URL
+
+	provider := &gateway.CardProvider{
+		BaseURL:       server.URL,
+		APIKey:        "sk_test",
+		WebhookSecret: testWebhookSecret,
+		HTTPClient:    server.Client(),
+	}
+	if previous, err := gateway.Get(gateway.MethodCard); err == nil {
+		t.Cleanup(func() { gateway.Register(previous) })
+	}
+	gateway.Register(provider)
+
+	router := gin.New()
+	router.POST("/payments/card/webhook", CardWebhook)
+	portal := httptest.NewServer(router)
+	t.Cleanup(portal.Close)
+
+	return provider, fake, portal.URL + "/payments/card/webhook"
+}
+
+// startCardPayment opens a checkout for 100 USD and saves the pending payment for it, converted
+// at 130 KES to the dollar
+func startCardPayment(t *testing.T, provider *gateway.CardProvider, callbackURL string) models.MpesaPayment {
+	t.Helper()
+	session, err := provider.Start(gateway.Request{
+		Amount:           100,
+		Currency:         "USD",
+		AccountReference: "VP123",
+		CallbackURL:      callbackURL,
+	})
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	original, rate := 100.0, 130.0
+	payment := models.MpesaPayment{
+		CheckoutRequestID:     session.Reference,
+		Method:                models.PaymentMethodCard,
+		Source:                models.MpesaSourceSTK,
+		InstallmentScheduleID: "1",
+		CustomerNumber:        "C001",
+		PhoneNumber:           "254712345678",
+		Amount:                13000,
+		Status:                models.MpesaStatusPending,
+		PlotNumber:            "VP123",
+		Currency:              "USD",
+		OriginalAmount:        &original,
+		ExchangeRate:          &rate,
+	}
+	if err := utils.CustomerPortalDB.Create(&payment).Error; err != nil {
+		t.Fatal(err)
+	}
+	return payment
+}
+
+func reloadPayment(t *testing.T, payment models.MpesaPayment) models.MpesaPayment {
+	t.Helper()
+	var current models.MpesaPayment
+	if err := utils.CustomerPortalDB.First(&current, payment.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	return current
+}
+
+func TestCardWebhookCreditsMatchingPayment(t *testing.T) {
+	testdb.Setup(t)
+	provider, fake, callbackURL := useCardFake(t)
+	payment := startCardPayment(t, provider, callbackURL)
+
+	if err := fake.Complete(payment.CheckoutRequestID, "completed"); err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+
+	current := reloadPayment(t, payment)
+	if current.Status != models.MpesaStatusSuccess || current.ProviderTransactionID == "" || current.TransactionDate == nil {
+		t.Fatalf("payment = status %q, transaction %q, date %v", current.Status, current.ProviderTransactionID, current.TransactionDate)
+	}
+	if current.AmountPaid == nil || *current.AmountPaid != 13000 {
+		t.Fatalf("amount paid = %v, want 13000 KES", current.AmountPaid)
+	}
+
+	var exceptions int64
+	utils.CustomerPortalDB.Model(&models.PaymentMatchException{}).Count(&exceptions)
+	if exceptions != 0 {
+		t.Fatalf("%d match exceptions raised for a matching payment", exceptions)
+	}
+
+	// A repeated delivery is acknowledged and changes nothing
+	if err := fake.Complete(payment.CheckoutRequestID, "completed"); err != nil {
+		t.Fatalf("repeated Complete: %v", err)
+	}
+	if again := reloadPayment(t, payment); again.ProviderTransactionID != current.ProviderTransactionID {
+		t.Fatalf("repeated webhook changed the transaction to %q", again.ProviderTransactionID)
+	}
+}
+
+func TestCardWebhookHoldsMismatchedPayment(t *testing.T) {
+	tests := []struct {
+		name     string
+		amount   float64
+		currency string
+	}{
+		{"amount", 90, "USD"},
+		{"currency", 100, "EUR"},
+		{"amount and currency", 13000, "KES"},
+		{"no currency", 100, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testdb.Setup(t)
+			provider, fake, callbackURL := useCardFake(t)
+			payment := startCardPayment(t, provider, callbackURL)
+
+			if err := fake.Charge(payment.CheckoutRequestID, tt.amount, tt.currency); err != nil {
+				t.Fatal(err)
+			}
+			if err := fake.Complete(payment.CheckoutRequestID, "completed"); err != nil {
+				t.Fatalf("Complete: %v", err)
+			}
+
+			current := reloadPayment(t, payment)
+			if current.Status != models.MpesaStatusFailed || current.AmountPaid != nil {
+				t.Fatalf("payment = status %q, amount paid %v; want failed and not credited", current.Status, current.AmountPaid)
+			}
+			if current.ProviderTransactionID == "" {
+				t.Fatal("provider transaction not kept for finance to trace the charge")
+			}
+
+			var exception models.PaymentMatchException
+			if err := utils.CustomerPortalDB.Where("mpesa_payment_id = ?", payment.ID).First(&exception).Error; err != nil {
+				t.Fatalf("match exception: %v", err)
+			}
+			if exception.Reason != models.MatchExceptionAmountMismatch || exception.ResolvedAt != nil {
+				t.Fatalf("exception = %+v", exception)
+			}
+		})
+	}
+}
+
+func TestCardWebhookRejectsInvalidSignature(t *testing.T) {
+	testdb.Setup(t)
+	provider, _, callbackURL := useCardFake(t)
+	payment := startCardPayment(t, provider, callbackURL)
+
+	body := []byte(`{"id":"` + payment.CheckoutRequestID + `","status":"completed","amount":100,"currency":"USD"}`)
+	req, _ := http.NewRequest(http.MethodPost, callbackURL, bytes.NewReader(body))
+	req.Header.Set(gateway.SignatureHeader, gateway.Sign("whsec_other", body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+	if current := reloadPayment(t, payment); current.Status != models.MpesaStatusPending {
+		t.Fatalf("payment status = %q after a forged webhook", current.Status)
+	}
+}
@@ -0,0 +1,144 @@
+package payments
+
+import (
+    "log"
+    "mobile-customer-portal-server/daraja"
+    "mobile-customer-portal-server/models"
+    "mobile-customer-portal-server/utils"
+    "time"
+)
+
+// statusForResultCode maps a Daraja result code to the payment status it ends in
+func statusForResultCode(code int) string {
+    switch code {
+    case daraja.ResultCodeSuccess:
+        return models.MpesaStatusSuccess
+    case daraja.ResultCodeCancelled:
+        return models.MpesaStatusCancelled
+    case daraja.ResultCodeTimeout:
+        return models.MpesaStatusTimeout
+    default:
+        return models.MpesaStatusFailed
+    }
+}
+
+// paymentOutcome is what M-PESA reported about an STK push, either through the callback or
+// through an STK push query, or what a card provider reported about a checkout
+type paymentOutcome struct {
+    ResultCode        *int
+    ResultDesc        string
+    MerchantRequestID string
+    Metadata          callbackMetadata
+    RawCallback       string
+    // ProviderTransactionID is the card processor's reference for a successful card payment
+    ProviderTransactionID string
+}
+
+// finalizePayment moves a pending payment to status, records the outcome and notifies the
+// customer. Only the first caller wins: if the payment has already been finalized nothing is
+// changed and false is returned, so a callback racing the reconciler never notifies twice.
+func finalizePayment(payment models.MpesaPayment, status string, outcome paymentOutcome) (bool, error) {
+    updates := map[string]interface{}{
+        "status":      status,
+        "result_code": outcome.ResultCode,
+        "result_desc": outcome.ResultDesc,
+    }
+    if outcome.MerchantRequestID != "" {
+        updates["merchant_request_id"] = outcome.MerchantRequestID
+    }
+    if outcome.RawCallback != "" {
+        updates["raw_callback"] = outcome.RawCallback
+    }
+    if outcome.ProviderTransactionID != "" {
+        updates["provider_transaction_id"] = outcome.ProviderTransactionID
+    }
+
+    if status == models.MpesaStatusSuccess {
+        // Keep what M-PESA reports about the transaction for the app and for reconciliation
+        metadata := outcome.Metadata
+        updates["mpesa_receipt_number"] = metadata.MpesaReceiptNumber
+        updates["transaction_date"] = metadata.TransactionDate
+        updates["amount_paid"] = metadata.Amount
+        updates["payer_phone_number"] = metadata.PhoneNumber
+        payment.AmountPaid = metadata.Amount
+        payment.MpesaReceiptNumber = metadata.MpesaReceiptNumber
+    }
+
+    query := utils.CustomerPortalDB.Model(&models.MpesaPayment{}).Where("id = ?", payment.ID)
+    if status == models.MpesaStatusSuccess {
+        // A payment the reconciler gave up on (Timeout without a result code) can still turn
+        // out to have gone through
+        query = query.Where("status = ? OR (status = ? AND result_code IS NULL)",
+            models.MpesaStatusPending, models.MpesaStatusTimeout)
+    } else {
+        query = query.Where("status = ?", models.MpesaStatusPending)
+    }
+
+    result := query.Updates(updates)
+    if result.Error != nil {
+        return false, result.Error
+    }
+    if result.RowsAffected == 0 {
+        return false, nil
+    }
+
+    log.Printf("M-PESA payment %s finalized as %s: %s", payment.CheckoutRequestID, status, outcome.ResultDesc)
+    notifyPaymentOutcome(payment, status)
+    return true, nil
+}
+
+// recordLateReceipt stores the receipt metadata of a callback that arrived after the
+// reconciler had already marked the payment successful from an STK query, which carries none
+func recordLateReceipt(payment models.MpesaPayment, outcome paymentOutcome) error {
+    metadata := outcome.Metadata
+    if metadata.MpesaReceiptNumber == "" {
+        return nil
+    }
+
+    return utils.CustomerPortalDB.Model(&models.MpesaPayment{}).
+        Where("id = ? AND status = ? AND mpesa_receipt_number = ''", payment.ID, models.MpesaStatusSuccess).
+        Updates(map[string]interface{}{
+            "mpesa_receipt_number": metadata.MpesaReceiptNumber,
+            "transaction_date":     metadata.TransactionDate,
+            "amount_paid":          metadata.Amount,
+            "payer_phone_number":   metadata.PhoneNumber,
+            "raw_callback":         outcome.RawCallback,
+        }).Error
+}
+
+// notifyPaymentOutcome tells the customer how their payment ended
+func notifyPaymentOutcome(payment models.MpesaPayment, status string) {
+    var user models.User
+    if err := utils.CustomerPortalDB.
+        Where("customer_number = ?", payment.CustomerNumber).
+        First(&user).Error; err != nil {
+        log.Printf("Failed to find user: %v", err)
+        return
+    }
+
+    if status != models.MpesaStatusSuccess {
+        notifyUser(user, "payment_failed", map[string]interface{}{"Method": payment.Method})
+        return
+    }
+
+    // Since we are not modifying the installment schedule table at this point,
+    // just notify the user that the payment has been received and is being processed.
+    amount := payment.Amount
+    if payment.AmountPaid != nil {
+        amount = *payment.AmountPaid
+    }
+    notifyUser(user, "payment_received", map[string]interface{}{
+        "Amount":        formatAmount(amount),
+        "PlotNumber":    payment.PlotNumber,
+        "ReceiptNumber": payment.MpesaReceiptNumber,
+    })
+}
+
+// markQueried records when the reconciler last asked Daraja about a payment
+func markQueried(payment models.MpesaPayment, now time.Time) {
+    if err := utils.CustomerPortalDB.Model(&models.MpesaPayment{}).
+        Where("id = ?", payment.ID).
+        Update("last_queried_at", now).Error; err != nil {
+        log.Printf("Failed to record STK query time for %s: %v", payment.CheckoutRequestID, err)
+    }
+}
@@ -0,0 +1,277 @@
+package payments
+
+import (
+    "mobile-customer-portal-server/models"
+    "mobile-customer-portal-server/utils"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
+)
+
+// maxHistoryLimit caps the page size of the payment history endpoints
+const maxHistoryLimit = 100
+
+// paymentStatuses lists the statuses the history endpoints can be filtered by
+var paymentStatuses = []string{
+    models.MpesaStatusPending,
+    models.MpesaStatusSuccess,
+    models.MpesaStatusFailed,
+    models.MpesaStatusCancelled,
+    models.MpesaStatusTimeout,
+}
+
+// GetPayments lists the payments the user made through the app, newest first
+func GetPayments(c *gin.Context) {
+    userInterface, exists := c.Get("user")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+        return
+    }
+    user := userInterface.(models.User)
+
+    query := utils.CustomerPortalDB.Model(&models.MpesaPayment{}).
+        Where("customer_number = ?", user.CustomerNumber)
+    respondWithPayments(c, user, query)
+}
+
+// GetPropertyPayments lists the payments the user made through the app for one property
+func GetPropertyPayments(c *gin.Context) {
+    userInterface, exists := c.Get("user")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+        return
+    }
+    user := userInterface.(models.User)
+
+    leadFileNo := c.Param("lead_file_no")
+
+    // Verify that the lead file belongs to the user and is not dropped
+    var leadFile models.LeadFile
+    if err := utils.CRMDB.
+        Where("lead_file_no = ? AND customer_id = ? AND lead_file_status_dropped = ?", leadFileNo, user.CustomerNumber, "No").
+        First(&leadFile).Error; err != nil {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Property not found, does not belong to the user, or is dropped"})
+        return
+    }
+
+    // Payments made before lead files were recorded are only tagged with the plot number
+    query := utils.CustomerPortalDB.Model(&models.MpesaPayment{}).
+        Where("customer_number = ?", user.CustomerNumber).
+        Where("lead_file_no = ? OR (lead_file_no = '' AND plot_number = ?)", leadFile.LeadFileNo, leadFile.PlotNumber)
+    respondWithPayments(c, user, query)
+}
+
+// respondWithPayments applies the page, limit and status query parameters to query and writes
+// the resulting page of payments
+func respondWithPayments(c *gin.Context, user models.User, query *gorm.DB) {
+    page, err := strconv.Atoi(c.Query("page"))
+    if err != nil || page < 1 {
+        page = 1
+    }
+
+    limit, err := strconv.Atoi(c.Query("limit"))
+    if err != nil || limit < 1 {
+        limit = 20
+    }
+    if limit > maxHistoryLimit {
+        limit = maxHistoryLimit
+    }
+
+    // status accepts a comma separated list, e.g. status=Pending,Success
+    if status := strings.TrimSpace(c.Query("status")); status != "" {
+        statuses, ok := parseStatusFilter(status)
+        if !ok {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status filter"})
+            return
+        }
+        query = query.Where("status IN ?", statuses)
+    }
+
+    var total int64
+    if err := query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch payments"})
+        return
+    }
+
+    var payments []models.MpesaPayment
+    if err := query.
+        Order("created_at DESC").
+        Offset((page - 1) * limit).
+        Limit(limit).
+        Find(&payments).Error; err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch payments"})
+        return
+    }
+
+    receipts := postedReceipts(user.CustomerNumber, payments)
+    allocations := paymentAllocations(payments)
+
+    result := make([]gin.H, 0, len(payments))
+    for _, payment := range payments {
+        item := paymentHistoryItem(payment, receipts)
+        item["allocations"] = allocationsOrEmpty(allocations[payment.ID])
+        result = append(result, item)
+    }
+
+    c.JSON(http.StatusOK, gin.H{
+        "payments": result,
+        "page":     page,
+        "limit":    limit,
+        "total":    total,
+    })
+}
+
+// parseStatusFilter validates a comma separated list of statuses, ignoring case
+func parseStatusFilter(value string) ([]string, bool) {
+    var statuses []string
+    for _, part := range strings.Split(value, ",") {
+        part = strings.TrimSpace(part)
+        found := false
+        for _, status := range paymentStatuses {
+            if strings.EqualFold(part, status) {
+                statuses = append(statuses, status)
+                found = true
+                break
+            }
+        }
+        if !found {
+            return nil, false
+        }
+    }
+    return statuses, true
+}
+
+// postedReceipt is an ERP receipt a payment was posted as, the allocation it was posted for (0
+// for the whole payment), and how sure the match is
+type postedReceipt struct {
+    Receipt      models.Receipt
+    AllocationID uint
+    Confidence   float64
+}
+
+// postedReceipts looks up the posted ERP receipts of the given payments, keyed by payment ID.
+// A split payment has one receipt for each allocation finance has posted. Receipts the matcher
+// linked to a payment are used first; otherwise a receipt carrying the payment's M-PESA receipt
+// number counts as posted.
+func postedReceipts(customerNumber string, payments []models.MpesaPayment) map[uint][]postedReceipt {
+    found := map[uint][]postedReceipt{}
+    if len(payments) == 0 {
+        return found
+    }
+
+    paymentIDs := make([]uint, 0, len(payments))
+    for _, payment := range payments {
+        paymentIDs = append(paymentIDs, payment.ID)
+    }
+
+    var matches []models.PaymentReceiptMatch
+    utils.CustomerPortalDB.Where("mpesa_payment_id IN ?", paymentIDs).Order("id ASC").Find(&matches)
+
+    if len(matches) > 0 {
+        receiptIDs := make([]int, 0, len(matches))
+        for _, match := range matches {
+            receiptIDs = append(receiptIDs, match.ReceiptID)
+        }
+
+        var receipts []models.Receipt
+        if err := utils.DefaultDB.Where("id IN ?", receiptIDs).Find(&receipts).Error; err == nil {
+            byID := map[int]models.Receipt{}
+            for _, receipt := range receipts {
+                byID[receipt.ID] = receipt
+            }
+            for _, match := range matches {
+                if receipt, ok := byID[match.ReceiptID]; ok {
+                    found[match.MpesaPaymentID] = append(found[match.MpesaPaymentID], postedReceipt{
+                        Receipt:      receipt,
+                        AllocationID: match.PaymentAllocationID,
+                        Confidence:   match.Confidence,
+                    })
+                }
+            }
+        }
+    }
+
+    var receiptNumbers []string
+    for _, payment := range payments {
+        if _, ok := found[payment.ID]; !ok && payment.MpesaReceiptNumber != "" {
+            receiptNumbers = append(receiptNumbers, payment.MpesaReceiptNumber)
+        }
+    }
+    if len(receiptNumbers) == 0 {
+        return found
+    }
+
+    var receipts []models.Receipt
+    if err := utils.DefaultDB.
+        Where("Customer_Id = ? AND Type = ? AND (Receipt_No IN ? OR transfer_receipt IN ?)",
+            customerNumber, receiptTypePosted, receiptNumbers, receiptNumbers).
+        Find(&receipts).Error; err != nil {
+        return found
+    }
+
+    byNumber := map[string]models.Receipt{}
+    for _, receipt := range receipts {
+        for _, number := range []string{receipt.ReceiptNo, receipt.TransferReceipt} {
+            if number != "" {
+                byNumber[strings.ToUpper(number)] = receipt
+            }
+        }
+    }
+    for _, payment := range payments {
+        if _, ok := found[payment.ID]; ok || payment.MpesaReceiptNumber == "" {
+            continue
+        }
+        if receipt, ok := byNumber[strings.ToUpper(payment.MpesaReceiptNumber)]; ok {
+            found[payment.ID] = []postedReceipt{{Receipt: receipt, Confidence: 1}}
+        }
+    }
+    return found
+}
+
+// paymentHistoryItem describes a payment for the history endpoints
+func paymentHistoryItem(payment models.MpesaPayment, receipts map[uint][]postedReceipt) gin.H {
+    item := gin.H{
+        "id":                   payment.ID,
+        "checkout_request_id":  payment.CheckoutRequestID,
+        "method":               payment.Method,
+        "source":               payment.Source,
+        "lead_file_no":         payment.LeadFileNo,
+        "plot_number":          payment.PlotNumber,
+        "amount":               payment.Amount,
+        "amount_paid":          payment.AmountPaid,
+        "currency":             payment.Currency,
+        "original_amount":      payment.OriginalAmount,
+        "exchange_rate":        payment.ExchangeRate,
+        "status":               payment.Status,
+        "result_desc":          payment.ResultDesc,
+        "mpesa_receipt_number": payment.MpesaReceiptNumber,
+        "transaction_date":     payment.TransactionDate,
+        "created_at":           payment.CreatedAt.Format(time.RFC3339),
+        "posted":               false,
+        "receipt":              nil,
+        "receipts":             []gin.H{},
+    }
+
+    if posted := receipts[payment.ID]; len(posted) > 0 {
+        views := make([]gin.H, 0, len(posted))
+        for _, p := range posted {
+            views = append(views, gin.H{
+                "id":                    p.Receipt.ID,
+                "receipt_no":            p.Receipt.ReceiptNo,
+                "date_posted":           p.Receipt.DatePosted,
+                "amount":                p.Receipt.AmountLCY,
+                "match_confidence":      p.Confidence,
+                "payment_allocation_id": p.AllocationID,
+            })
+        }
+        item["posted"] = true
+        // receipt is the first receipt, kept for clients that predate split payments
+        item["receipt"] = views[0]
+        item["receipts"] = views
+    }
+    return item
+}
@@ -0,0 +1,339 @@
+package payments
+
+import (
+    "context"
+    "errors"
+    "log"
+    "math"
+    "mobile-customer-portal-server/currency"
+    "mobile-customer-portal-server/daraja"
+    "mobile-customer-portal-server/gateway"
+    "mobile-customer-portal-server/models"
+    "mobile-customer-portal-server/utils"
+    "os"
+    "strconv"
+    "time"
+
+    "gorm.io/gorm"
+)
+
+// MandateSchedulerConfig controls when payment mandates prompt customers to pay
+type MandateSchedulerConfig struct {
+    // Interval is how often mandates are looked at
+    Interval time.Duration
+    // DaysBefore is how many days before an installment's due date the prompt goes out at the
+    // latest
+    DaysBefore int
+    // BatchSize is how many mandates are loaded at a time
+    BatchSize int
+    // MaxAttempts is how many times a push that failed to start is tried for an installment
+    MaxAttempts int
+    // RetryAfter is how long a failed prompt waits before it is tried again. A prompt that was
+    // recorded but never started a payment, e.g. because the server stopped, counts as failed
+    // after this long too.
+    RetryAfter time.Duration
+}
+
+// DefaultMandateSchedulerConfig is used by StartMandateScheduler. MANDATE_DAYS_BEFORE
+// overrides DaysBefore.
+var DefaultMandateSchedulerConfig = MandateSchedulerConfig{
+    Interval:    time.Hour,
+    DaysBefore:  3,
+    BatchSize:   100,
+    MaxAttempts: 3,
+    RetryAfter:  30 * time.Minute,
+}
+
+// StartMandateScheduler periodically sends the STK pushes active payment mandates are due. It
+// runs until ctx is cancelled.
+func StartMandateScheduler(ctx context.Context) {
+    config := DefaultMandateSchedulerConfig
+    if value := os.Getenv("MANDATE_DAYS_BEFORE"); value != "" {
+        days, err := strconv.Atoi(value)
+        if err != nil || days < 0 {
+            log.Fatalf("Invalid MANDATE_DAYS_BEFORE %q", value)
+        }
+        config.DaysBefore = days
+    }
+
+    go func() {
+        ticker := time.NewTicker(config.Interval)
+        defer ticker.Stop()
+
+        for {
+            select {
+            case <-ctx.Done():
+                return
+            case <-ticker.C:
+                if err := config.Prompt(); err != nil {
+                    log.Printf("Payment mandate prompts failed: %v", err)
+                }
+            }
+        }
+    }()
+}
+
+// Prompt sends each active mandate's STK push for the next unpaid installment whose prompt date
+// has come and that is not yet due. A mandate prompts at most once per run, so a customer is
+// never sent two pushes at once, and once per installment unless the push could not be started.
+func (config MandateSchedulerConfig) Prompt() error {
+    if !daraja.Default.Configured() || os.Getenv("DARAJA_CALLBACK_URL") == "" {
+        return nil
+    }
+
+    now := time.Now()
+    var mandates []models.PaymentMandate
+    return utils.CustomerPortalDB.
+        Where("status = ?", models.MandateStatusActive).
+        Order("id ASC").
+        FindInBatches(&mandates, config.BatchSize, func(tx *gorm.DB, batch int) error {
+            for _, mandate := range mandates {
+                config.promptMandate(mandate, now)
+            }
+            return nil
+        }).Error
+}
+
+// promptMandate sends a mandate's push for its next installment, if one is due a prompt
+func (config MandateSchedulerConfig) promptMandate(mandate models.PaymentMandate, now time.Time) {
+    today := startOfDay(now)
+
+    var installments []models.InstallmentSchedule
+    if err := utils.CRMDB.
+        Where("member_no = ? AND leadfile_no = ?", mandate.CustomerNumber, mandate.LeadFileNo).
+        Where("due_date >= ? AND due_date < ?", today, config.promptWindowEnd(today)).
+        Order("due_date ASC, installment_no ASC").
+        Find(&installments).Error; err != nil {
+        log.Printf("Failed to fetch installments for mandate %d: %v", mandate.ID, err)
+        return
+    }
+    if len(installments) == 0 {
+        return
+    }
+
+    installmentIDs := make([]int, 0, len(installments))
+    for _, installment := range installments {
+        installmentIDs = append(installmentIDs, installment.ISID)
+    }
+    var runs []models.PaymentMandateRun
+    if err := utils.CustomerPortalDB.
+        Where("payment_mandate_id = ? AND installment_schedule_id IN ?", mandate.ID, installmentIDs).
+        Find(&runs).Error; err != nil {
+        log.Printf("Failed to fetch prompts of mandate %d: %v", mandate.ID, err)
+        return
+    }
+    prompted := map[int]models.PaymentMandateRun{}
+    for _, run := range runs {
+        prompted[run.InstallmentScheduleID] = run
+    }
+
+    for _, installment := range installments {
+        if installment.IsPaid() || installment.DueDate == nil {
+            continue
+        }
+        run, ok := prompted[installment.ISID]
+        if ok && !config.retryable(run, now) {
+            continue
+        }
+        if config.promptDate(mandate.DayOfMonth, *installment.DueDate).After(today) {
+            continue
+        }
+
+        amount := math.Round(math.Min(mandate.Amount, installmentOutstanding(installment)))
+        if amount < 1 {
+            continue
+        }
+
+        if ok {
+            config.retryInstallment(mandate, installment, run, amount)
+        } else {
+            config.promptInstallment(mandate, installment, amount)
+        }
+        return
+    }
+}
+
+// retryable reports whether a prompt that has not started a payment may be tried again
+func (config MandateSchedulerConfig) retryable(run models.PaymentMandateRun, now time.Time) bool {
+    return run.MpesaPaymentID == nil &&
+        run.Attempts < config.MaxAttempts &&
+        run.UpdatedAt.Before(now.Add(-config.RetryAfter))
+}
+
+// promptInstallment records and sends a mandate's push for one installment. The run is saved
+// first, so that two servers cannot both prompt for the same installment.
+func (config MandateSchedulerConfig) promptInstallment(mandate models.PaymentMandate, installment models.InstallmentSchedule, amount float64) {
+    run := models.PaymentMandateRun{
+        PaymentMandateID:      mandate.ID,
+        InstallmentScheduleID: installment.ISID,
+        InstallmentNo:         installment.InstallmentNo,
+        DueDate:               installment.DueDate,
+        Amount:                amount,
+        Status:                models.MandateRunSent,
+        Attempts:              1,
+    }
+    if err := utils.CustomerPortalDB.Create(&run).Error; err != nil {
+        // Most likely another server got to it first
+        log.Printf("Skipping prompt of mandate %d for installment %d: %v", mandate.ID, installment.ISID, err)
+        return
+    }
+
+    config.sendPrompt(mandate, installment, run, amount)
+}
+
+// retryInstallment tries a failed prompt again. The attempt is claimed on the run first, so
+// that two servers cannot both retry it.
+func (config MandateSchedulerConfig) retryInstallment(mandate models.PaymentMandate, installment models.InstallmentSchedule, run models.PaymentMandateRun, amount float64) {
+    result := utils.CustomerPortalDB.Model(&models.PaymentMandateRun{}).
+        Where("id = ? AND attempts = ? AND mpesa_payment_id IS NULL", run.ID, run.Attempts).
+        Updates(map[string]interface{}{
+            "status":   models.MandateRunSent,
+            "attempts": run.Attempts + 1,
+            "amount":   amount,
+            "error":    "",
+        })
+    if result.Error != nil {
+        log.Printf("Failed to retry prompt %d of mandate %d: %v", run.ID, mandate.ID, result.Error)
+        return
+    }
+    if result.RowsAffected == 0 {
+        return
+    }
+
+    run.Attempts++
+    run.Amount = amount
+    config.sendPrompt(mandate, installment, run, amount)
+}
+
+// sendPrompt starts the payment for a run and records how it went. The customer is only told
+// the installment was not prompted for once the last attempt has failed.
+func (config MandateSchedulerConfig) sendPrompt(mandate models.PaymentMandate, installment models.InstallmentSchedule, run models.PaymentMandateRun, amount float64) {
+    payment, err := startMandatePayment(mandate, installment, amount)
+    updates := map[string]interface{}{}
+    if err != nil {
+        log.Printf("Failed to prompt mandate %d for installment %d (attempt %d): %v",
+            mandate.ID, installment.ISID, run.Attempts, err)
+        updates["status"] = models.MandateRunFailed
+        updates["error"] = err.Error()
+        if run.Attempts >= config.MaxAttempts {
+            notifyMandateFailed(mandate, installment, amount)
+        }
+    } else {
+        updates["status"] = models.MandateRunSent
+        updates["mpesa_payment_id"] = payment.ID
+    }
+    if err := utils.CustomerPortalDB.Model(&run).Updates(updates).Error; err != nil {
+        log.Printf("Failed to update prompt %d of mandate %d: %v", run.ID, mandate.ID, err)
+    }
+}
+
+// promptDate is the day a mandate prompts for an installment due on dueDate: the last of the
+// mandate's days of the month that falls at least DaysBefore days before the due date. Months
+// shorter than the day use their last day.
+func (config MandateSchedulerConfig) promptDate(dayOfMonth int, dueDate time.Time) time.Time {
+    latest := startOfDay(dueDate).AddDate(0, 0, -config.DaysBefore)
+    prompt := dayInMonth(latest.Year(), latest.Month(), dayOfMonth, latest.Location())
+    if prompt.After(latest) {
+        prompt = dayInMonth(latest.Year(), latest.Month()-1, dayOfMonth, latest.Location())
+    }
+    return prompt
+}
+
+// promptWindowEnd is the first due date that cannot be prompted for by today. A prompt goes out
+// less than 31 days before the latest day it may, which is DaysBefore days ahead of the due date;
+// a calendar month is not enough, since the month before the latest day can be longer.
+func (config MandateSchedulerConfig) promptWindowEnd(today time.Time) time.Time {
+    return today.AddDate(0, 0, config.DaysBefore+31)
+}
+
+// dayInMonth is the given day of a month, or the month's last day if it is shorter
+func dayInMonth(year int, month time.Month, day int, loc *time.Location) time.Time {
+    if last := time.Date(year, month+1, 0, 0, 0, 0, 0, loc).Day(); day > last {
+        day = last
+    }
+    return time.Date(year, month, day, 0, 0, 0, 0, loc)
+}
+
+// startOfDay truncates t to midnight in its own time zone
+func startOfDay(t time.Time) time.Time {
+    return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// startMandatePayment sends a mandate's STK push for an installment and saves the payment as
+// if the customer had started it
+func startMandatePayment(mandate models.PaymentMandate, installment models.InstallmentSchedule, amount float64) (*models.MpesaPayment, error) {
+    provider, err := gateway.Get(gateway.MethodMpesa)
+    if err != nil {
+        return nil, err
+    }
+
+    // The property may have been dropped or transferred since the mandate was set up
+    plan, err := planAllocations(mandate.CustomerNumber, MpesaPaymentRequest{
+        LeadFileNo:            mandate.LeadFileNo,
+        InstallmentScheduleID: strconv.Itoa(installment.ISID),
+    }, amount)
+    if err != nil {
+        return nil, err
+    }
+    primary := plan.Primary()
+
+    callbackURL, callbackTokenHash, err := newCallbackURL(os.Getenv("DARAJA_CALLBACK_URL"))
+    if err != nil {
+        return nil, err
+    }
+
+    session, err := provider.Start(gateway.Request{
+        Amount:           amount,
+        Currency:         currency.Base,
+        PhoneNumber:      mandate.PhoneNumber,
+        AccountReference: primary.LeadFile.PlotNumber,
+        Description:      "Auto-pay of Installment",
+        CallbackURL:      callbackURL,
+    })
+    if err != nil {
+        var apiErr *daraja.APIError
+        if errors.As(err, &apiErr) {
+            return nil, errors.New(apiErr.Message)
+        }
+        return nil, err
+    }
+
+    payment := models.MpesaPayment{
+        CheckoutRequestID:     session.Reference,
+        Method:                models.PaymentMethodMpesa,
+        Source:                models.MpesaSourceMandate,
+        MerchantRequestID:     session.MerchantReference,
+        InstallmentScheduleID: strconv.Itoa(installment.ISID),
+        CustomerNumber:        mandate.CustomerNumber,
+        LeadFileNo:            primary.LeadFile.LeadFileNo,
+        PhoneNumber:           mandate.PhoneNumber,
+        Amount:                amount,
+        Currency:              currency.Base,
+        Status:                models.MpesaStatusPending,
+        PlotNumber:            primary.LeadFile.PlotNumber,
+        Overpayment:           plan.Overpayment,
+        CallbackTokenHash:     callbackTokenHash,
+    }
+    if _, err := savePayment(&payment, *plan); err != nil {
+        return nil, err
+    }
+    return &payment, nil
+}
+
+// notifyMandateFailed tells the customer their installment was not prompted for, so they can
+// pay it themselves
+func notifyMandateFailed(mandate models.PaymentMandate, installment models.InstallmentSchedule, amount float64) {
+    var user models.User
+    if err := utils.CustomerPortalDB.Where("customer_number = ?", mandate.CustomerNumber).First(&user).Error; err != nil {
+        if !errors.Is(err, gorm.ErrRecordNotFound) {
+            log.Printf("Failed to find user: %v", err)
+        }
+        return
+    }
+
+    notifyUser(user, "mandate_failed", map[string]interface{}{
+        "Amount":     formatAmount(amount),
+        "PlotNumber": mandate.PlotNumber,
+        "DueDate":    installment.DueDate.Format("02 Jan 2006"),
+    })
+}
@@ -0,0 +1,111 @@
+package payments
+
+import (
+	"testing"
+	"time"
+)
+
+func date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+func TestDayInMonth(t *testing.T) {
+	tests := []struct {
+		name  string
+		year  int
+		month time.Month
+		day   int
+		want  time.Time
+	}{
+		{"day that exists", 2025, time.March, 15, date(2025, time.March, 15)},
+		{"31st of a 31-day month", 2025, time.January, 31, date(2025, time.January, 31)},
+		{"31st of a 30-day month", 2025, time.April, 31, date(2025, time.April, 30)},
+		{"31st of February", 2025, time.February, 31, date(2025, time.February, 28)},
+		{"30th of February in a leap year", 2024, time.February, 30, date(2024, time.February, 29)},
+		{"month before January", 2025, time.January - 1, 15, date(2024, time.December, 15)},
+		{"31st of the month before January", 2025, time.January - 1, 31, date(2024, time.December, 31)},
+		{"31st of the month before March", 2025, time.March - 1, 31, date(2025, time.February, 28)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dayInMonth(tt.year, tt.month, tt.day, time.UTC); !got.Equal(tt.want) {
+				t.Fatalf("dayInMonth(%d, %d, %d) = %s, want %s", tt.year, tt.month, tt.day, got.Format("2006-01-02"), tt.want.Format("2006-01-02"))
+			}
+		})
+	}
+}
+
+func TestPromptDate(t *testing.T) {
+	tests := []struct {
+		name       string
+		daysBefore int
+		dayOfMonth int
+		due        time.Time
+		want       time.Time
+	}{
+		{"day before the latest day", 3, 5, date(2025, time.March, 10), date(2025, time.March, 5)},
+		{"on the latest day", 3, 7, date(2025, time.March, 10), date(2025, time.March, 7)},
+		{"day after the latest day rolls back a month", 3, 10, date(2025, time.March, 10), date(2025, time.February, 10)},
+		{"on the due date without days before", 0, 10, date(2025, time.March, 10), date(2025, time.March, 10)},
+		{"rollover into the previous year", 3, 20, date(2025, time.January, 10), date(2024, time.December, 20)},
+		{"time of day is ignored", 3, 7, time.Date(2025, time.March, 10, 23, 59, 0, 0, time.UTC), date(2025, time.March, 7)},
+
+		{"31st in February", 3, 31, date(2025, time.March, 10), date(2025, time.February, 28)},
+		{"31st in February of a leap year", 3, 31, date(2024, time.March, 10), date(2024, time.February, 29)},
+		{"31st in a 30-day month on its last day", 0, 31, date(2025, time.April, 30), date(2025, time.April, 30)},
+		{"31st in a 31-day month", 0, 31, date(2025, time.May, 31), date(2025, time.May, 31)},
+		{"31st before the last day of a 31-day month", 0, 31, date(2025, time.May, 30), date(2025, time.April, 30)},
+		{"31st before a 30th after February", 0, 31, date(2025, time.March, 30), date(2025, time.February, 28)},
+
+		{"days before cross into the previous month", 3, 25, date(2025, time.March, 2), date(2025, time.February, 25)},
+		{"days before cross into February, day after the latest", 3, 28, date(2025, time.March, 2), date(2025, time.January, 28)},
+		{"days before cross into the previous year", 5, 1, date(2025, time.January, 2), date(2024, time.December, 1)},
+		{"days before cross into a 30-day month, 31st", 5, 31, date(2025, time.May, 3), date(2025, time.March, 31)},
+		{"days before span more than a month", 40, 15, date(2025, time.March, 10), date(2025, time.January, 15)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := MandateSchedulerConfig{DaysBefore: tt.daysBefore}
+			got := config.promptDate(tt.dayOfMonth, tt.due)
+			if !got.Equal(tt.want) {
+				t.Fatalf("promptDate(%d, %s) with %d days before = %s, want %s", tt.dayOfMonth, tt.due.Format("2006-01-02"),
+					tt.daysBefore, got.Format("2006-01-02"), tt.want.Format("2006-01-02"))
+			}
+			if latest := startOfDay(tt.due).AddDate(0, 0, -tt.daysBefore); got.After(latest) {
+				t.Fatalf("prompt %s is after the latest day %s", got.Format("2006-01-02"), latest.Format("2006-01-02"))
+			}
+		})
+	}
+}
+
+// TestPromptWindowCoversEveryPromptableInstallment checks that every installment not yet due whose
+// prompt date has come falls inside the window the installments are queried for, on every day of
+// two years. A window of one calendar month is too short: on 28 February with the 31st as the
+// mandate's day and 3 days before, an installment due on 2 April is prompted for that day.
+func TestPromptWindowCoversEveryPromptableInstallment(t *testing.T) {
+	for _, daysBefore := range []int{0, 3, 10} {
+		config := MandateSchedulerConfig{DaysBefore: daysBefore}
+		for _, dayOfMonth := range []int{1, 15, 28, 29, 30, 31} {
+			for today := date(2024, time.January, 1); today.Year() < 2026; today = today.AddDate(0, 0, 1) {
+				end := config.promptWindowEnd(today)
+				for due := today; due.Before(today.AddDate(0, 0, daysBefore+62)); due = due.AddDate(0, 0, 1) {
+					if config.promptDate(dayOfMonth, due).After(today) {
+						continue
+					}
+					if !due.Before(end) {
+						t.Fatalf("%d days before, day %d: on %s the installment due %s is prompted for but the window ends %s",
+							daysBefore, dayOfMonth, today.Format("2006-01-02"), due.Format("2006-01-02"), end.Format("2006-01-02"))
+					}
+				}
+			}
+		}
+	}
+
+	config := MandateSchedulerConfig{DaysBefore: 3}
+	today := date(2025, time.February, 28)
+	if due := date(2025, time.April, 2); !config.promptDate(31, due).Equal(today) || !due.Before(config.promptWindowEnd(today)) {
+		t.Fatalf("installment due %s not prompted for on %s", due.Format("2006-01-02"), today.Format("2006-01-02"))
+	}
+}
@@ -0,0 +1,223 @@
+package payments
+
+import (
+    "errors"
+    "log"
+    "mobile-customer-portal-server/models"
+    "mobile-customer-portal-server/utils"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
+)
+
+// mandateRunsShown caps the recent prompts returned with each mandate
+const mandateRunsShown = 12
+
+// MandateRequest is the body of a new payment mandate. Amount is in whole shillings and is
+// asked for on each installment, or what is left of it if that is less.
+type MandateRequest struct {
+    LeadFileNo  string `json:"lead_file_no"`
+    Amount      string `json:"amount"`
+    DayOfMonth  int    `json:"day_of_month"`
+    PhoneNumber string `json:"phone_number"`
+}
+
+// mandateView is a mandate with the prompts it sent most recently
+type mandateView struct {
+    models.PaymentMandate
+    Runs []models.PaymentMandateRun `json:"runs"`
+}
+
+// CreateMandate sets up a standing order for the installments of one of the customer's
+// properties. A property can only have one mandate that has not been cancelled.
+func CreateMandate(c *gin.Context) {
+    var req MandateRequest
+    if err := c.BindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+        return
+    }
+
+    amount, err := strconv.Atoi(strings.TrimSpace(req.Amount))
+    if err != nil || amount <= 0 {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid amount format"})
+        return
+    }
+    if req.DayOfMonth < 1 || req.DayOfMonth > 31 {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Day of month must be between 1 and 31"})
+        return
+    }
+    if !isValidPhoneNumber(req.PhoneNumber) {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid phone number format"})
+        return
+    }
+
+    userInterface, exists := c.Get("user")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+        return
+    }
+    user := userInterface.(models.User)
+
+    target, err := resolvePaymentTarget(user.CustomerNumber, strings.TrimSpace(req.LeadFileNo), "", "")
+    switch {
+    case errors.Is(err, errPropertyNotFound):
+        c.JSON(http.StatusForbidden, gin.H{"error": "Property not found, does not belong to the user, or is dropped"})
+        return
+    case errors.Is(err, errLeadFileRequired):
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Lead file number is required"})
+        return
+    case err != nil:
+        log.Printf("Error validating mandate for customer %s: %v", user.CustomerNumber, err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create mandate"})
+        return
+    }
+
+    var existing int64
+    if err := utils.CustomerPortalDB.Model(&models.PaymentMandate{}).
+        Where("customer_number = ? AND lead_file_no = ? AND status <> ?",
+            user.CustomerNumber, target.LeadFile.LeadFileNo, models.MandateStatusCancelled).
+        Count(&existing).Error; err != nil {
+        log.Printf("Error checking mandates for customer %s: %v", user.CustomerNumber, err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create mandate"})
+        return
+    }
+    if existing > 0 {
+        c.JSON(http.StatusConflict, gin.H{"error": "This property already has a payment mandate", "code": "mandate_exists"})
+        return
+    }
+
+    mandate := models.PaymentMandate{
+        CustomerNumber: user.CustomerNumber,
+        LeadFileNo:     target.LeadFile.LeadFileNo,
+        PlotNumber:     target.LeadFile.PlotNumber,
+        PhoneNumber:    req.PhoneNumber,
+        Amount:         float64(amount),
+        DayOfMonth:     req.DayOfMonth,
+        Status:         models.MandateStatusActive,
+    }
+    if err := utils.CustomerPortalDB.Create(&mandate).Error; err != nil {
+        log.Printf("Error saving mandate: %v", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create mandate"})
+        return
+    }
+
+    c.JSON(http.StatusCreated, gin.H{"mandate": mandateView{PaymentMandate: mandate, Runs: []models.PaymentMandateRun{}}})
+}
+
+// GetMandates lists the customer's payment mandates, newest first, with their recent prompts
+func GetMandates(c *gin.Context) {
+    userInterface, exists := c.Get("user")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+        return
+    }
+    user := userInterface.(models.User)
+
+    var mandates []models.PaymentMandate
+    if err := utils.CustomerPortalDB.
+        Where("customer_number = ?", user.CustomerNumber).
+        Order("created_at DESC").
+        Find(&mandates).Error; err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch mandates"})
+        return
+    }
+
+    views := make([]mandateView, 0, len(mandates))
+    for _, mandate := range mandates {
+        runs := []models.PaymentMandateRun{}
+        if err := utils.CustomerPortalDB.
+            Where("payment_mandate_id = ?", mandate.ID).
+            Order("created_at DESC").
+            Limit(mandateRunsShown).
+            Find(&runs).Error; err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch mandates"})
+            return
+        }
+        views = append(views, mandateView{PaymentMandate: mandate, Runs: runs})
+    }
+
+    c.JSON(http.StatusOK, gin.H{"mandates": views})
+}
+
+// PauseMandate stops an active mandate from prompting until it is resumed
+func PauseMandate(c *gin.Context) {
+    now := time.Now()
+    changeMandateStatus(c, models.MandateStatusActive, models.MandateStatusPaused, map[string]interface{}{
+        "status":    models.MandateStatusPaused,
+        "paused_at": &now,
+    })
+}
+
+// ResumeMandate lets a paused mandate prompt again. Installments whose prompt date passed while
+// it was paused are still prompted for if they are not yet due.
+func ResumeMandate(c *gin.Context) {
+    changeMandateStatus(c, models.MandateStatusPaused, models.MandateStatusActive, map[string]interface{}{
+        "status":    models.MandateStatusActive,
+        "paused_at": nil,
+    })
+}
+
+// CancelMandate ends a mandate for good. Prompts already sent are not affected.
+func CancelMandate(c *gin.Context) {
+    now := time.Now()
+    changeMandateStatus(c, "", models.MandateStatusCancelled, map[string]interface{}{
+        "status":       models.MandateStatusCancelled,
+        "cancelled_at": &now,
+    })
+}
+
+// changeMandateStatus moves one of the customer's mandates from status from (any status that
+// is not cancelled when from is empty) to status to
+func changeMandateStatus(c *gin.Context, from, to string, updates map[string]interface{}) {
+    userInterface, exists := c.Get("user")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+        return
+    }
+    user := userInterface.(models.User)
+
+    id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid mandate ID"})
+        return
+    }
+
+    var mandate models.PaymentMandate
+    if err := utils.CustomerPortalDB.
+        Where("id = ? AND customer_number = ?", id, user.CustomerNumber).
+        First(&mandate).Error; err != nil {
+        if errors.Is(err, gorm.ErrRecordNotFound) {
+            c.JSON(http.StatusNotFound, gin.H{"error": "Mandate not found"})
+            return
+        }
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update mandate"})
+        return
+    }
+
+    // The status is checked in the update so a concurrent change cannot be overwritten
+    query := utils.CustomerPortalDB.Model(&mandate)
+    if from != "" {
+        query = query.Where("status = ?", from)
+    } else {
+        query = query.Where("status <> ?", models.MandateStatusCancelled)
+    }
+    result := query.Updates(updates)
+    if result.Error != nil {
+        log.Printf("Error updating mandate %d: %v", mandate.ID, result.Error)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update mandate"})
+        return
+    }
+    if result.RowsAffected == 0 {
+        c.JSON(http.StatusConflict, gin.H{"error": "Mandate is " + mandate.Status, "code": "invalid_mandate_status"})
+        return
+    }
+
+    if err := utils.CustomerPortalDB.First(&mandate, mandate.ID).Error; err != nil {
+        mandate.Status = to
+    }
+    c.JSON(http.StatusOK, gin.H{"mandate": mandate})
+}
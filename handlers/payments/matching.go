@@ -0,0 +1,514 @@
+package payments
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log"
+    "math"
+    "mobile-customer-portal-server/models"
+    "mobile-customer-portal-server/outbox"
+    "mobile-customer-portal-server/utils"
+    "strings"
+    "time"
+
+    "gorm.io/gorm"
+    "gorm.io/gorm/clause"
+)
+
+// receiptTypePosted is the Type of receipts finance has posted in the ERP
+const receiptTypePosted = "Posted"
+
+// receiptDateLayouts are the formats the ERP stores receipt dates in
+var receiptDateLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"}
+
+// MatcherConfig controls how successful payments are matched to the receipts finance posts
+type MatcherConfig struct {
+    // Interval is how often unmatched payments are looked at
+    Interval time.Duration
+    // DateWindow is how far apart the M-PESA transaction and the receipt's payment date may be
+    // for a match on amount and plot
+    DateWindow time.Duration
+    // ExceptionAfter is how long a payment may stay unmatched before it is recorded as an exception
+    ExceptionAfter time.Duration
+    // LookBack is how long after a payment the matcher keeps looking for its receipt
+    LookBack time.Duration
+    // BatchSize caps the payments matched per run
+    BatchSize int
+}
+
+// DefaultMatcherConfig is used by StartMatcher
+var DefaultMatcherConfig = MatcherConfig{
+    Interval:       10 * time.Minute,
+    DateWindow:     72 * time.Hour,
+    ExceptionAfter: 72 * time.Hour,
+    LookBack:       30 * 24 * time.Hour,
+    BatchSize:      100,
+}
+
+// StartMatcher periodically links successful payments to the receipts finance posts for them.
+// It runs until ctx is cancelled.
+func StartMatcher(ctx context.Context) {
+    config := DefaultMatcherConfig
+    go func() {
+        ticker := time.NewTicker(config.Interval)
+        defer ticker.Stop()
+
+        for {
+            select {
+            case <-ctx.Done():
+                return
+            case <-ticker.C:
+                if err := config.Match(); err != nil {
+                    log.Printf("Payment matching failed: %v", err)
+                }
+            }
+        }
+    }()
+}
+
+// Match looks for the posted receipts of every successful payment, and every pending bank
+// transfer, that has not been fully matched yet: a split payment is done once each of its
+// allocations has a receipt. Payments finance has resolved by hand, and paybill payments to an
+// unknown account, are left alone.
+func (config MatcherConfig) Match() error {
+    now := time.Now()
+
+    var payments []models.MpesaPayment
+    if err := utils.CustomerPortalDB.
+        Where("status = ? OR (status = ? AND method = ?)",
+            models.MpesaStatusSuccess, models.MpesaStatusPending, models.PaymentMethodBankTransfer).
+        Where("created_at >= ?", now.Add(-config.LookBack)).
+        Where("customer_number <> ''").
+        Where("match_checked_at IS NULL OR match_checked_at <= ?", now.Add(-config.Interval)).
+        Where("NOT EXISTS (SELECT 1 FROM payment_receipt_matches m WHERE m.mpesa_payment_id = mpesa_payments.id AND m.payment_allocation_id = 0)").
+        Where("NOT EXISTS (SELECT 1 FROM payment_allocations a WHERE a.mpesa_payment_id = mpesa_payments.id) OR "+
+            "EXISTS (SELECT 1 FROM payment_allocations a WHERE a.mpesa_payment_id = mpesa_payments.id AND "+
+            "NOT EXISTS (SELECT 1 FROM payment_receipt_matches m WHERE m.payment_allocation_id = a.id))").
+        Where("NOT EXISTS (SELECT 1 FROM payment_match_exceptions e WHERE e.mpesa_payment_id = mpesa_payments.id AND e.resolved_at IS NOT NULL)").
+        Order("created_at ASC").
+        Limit(config.BatchSize).
+        Find(&payments).Error; err != nil {
+        return err
+    }
+
+    for _, payment := range payments {
+        config.matchPayment(payment, now)
+    }
+    return nil
+}
+
+// matchTarget is the part of a payment looked for on a single receipt: one of its allocations,
+// or the whole payment when it was not split (AllocationID 0)
+type matchTarget struct {
+    AllocationID uint
+    PlotNumber   string
+    Amount       float64
+}
+
+// matchTargets lists the parts of a payment still without a receipt
+func matchTargets(payment models.MpesaPayment) ([]matchTarget, error) {
+    var allocations []models.PaymentAllocation
+    if err := utils.CustomerPortalDB.
+        Where("mpesa_payment_id = ?", payment.ID).
+        Order("id ASC").
+        Find(&allocations).Error; err != nil {
+        return nil, err
+    }
+    if len(allocations) == 0 {
+        return []matchTarget{{PlotNumber: payment.PlotNumber, Amount: paymentAmount(payment)}}, nil
+    }
+
+    var matched []uint
+    if err := utils.CustomerPortalDB.Model(&models.PaymentReceiptMatch{}).
+        Where("mpesa_payment_id = ?", payment.ID).
+        Pluck("payment_allocation_id", &matched).Error; err != nil {
+        return nil, err
+    }
+    done := map[uint]bool{}
+    for _, id := range matched {
+        done[id] = true
+    }
+
+    var targets []matchTarget
+    for _, allocation := range allocations {
+        if done[allocation.ID] {
+            continue
+        }
+        amount := allocation.Amount
+        if len(allocations) == 1 {
+            // Whatever the customer actually paid went to the only allocation
+            amount = paymentAmount(payment)
+        }
+        targets = append(targets, matchTarget{AllocationID: allocation.ID, PlotNumber: allocation.PlotNumber, Amount: amount})
+    }
+    return targets, nil
+}
+
+// matchPayment links each part of a payment still without a receipt to its receipt, or records
+// why it could not
+func (config MatcherConfig) matchPayment(payment models.MpesaPayment, now time.Time) {
+    markMatchChecked(payment, now)
+
+    targets, err := matchTargets(payment)
+    if err != nil {
+        log.Printf("Failed to load allocations of payment %d: %v", payment.ID, err)
+        return
+    }
+
+    // Receipts carrying the M-PESA receipt number or the transfer reference are certain
+    references, err := receiptsByReference(payment)
+    if err != nil {
+        log.Printf("Failed to look up receipt for payment %d: %v", payment.ID, err)
+        return
+    }
+
+    taken := map[int]bool{}
+    var matched []models.Receipt
+    var unmatched, ambiguous []string
+    candidates := 0
+
+    for _, target := range targets {
+        if receipt := referenceFor(references, target, len(targets) == 1, taken); receipt != nil {
+            if recordMatch(payment, target, *receipt, models.MatchMethodReceiptNumber, 1) {
+                taken[receipt.ID] = true
+                matched = append(matched, *receipt)
+            }
+            continue
+        }
+
+        // Otherwise look for a single receipt for the same amount and plot close to the payment date
+        found, err := config.receiptsByAmountPlotDate(payment, target, taken)
+        if err != nil {
+            log.Printf("Failed to look up receipts for payment %d: %v", payment.ID, err)
+            return
+        }
+
+        switch len(found) {
+        case 1:
+            if recordMatch(payment, target, found[0].Receipt, models.MatchMethodAmountPlotDate,
+                config.heuristicConfidence(found[0].Gap)) {
+                taken[found[0].Receipt.ID] = true
+                matched = append(matched, found[0].Receipt)
+            }
+        case 0:
+            unmatched = append(unmatched, describeTarget(target))
+        default:
+            numbers := make([]string, 0, len(found))
+            for _, candidate := range found {
+                numbers = append(numbers, candidate.Receipt.ReceiptNo)
+            }
+            ambiguous = append(ambiguous, fmt.Sprintf("%s: %s", describeTarget(target), strings.Join(numbers, ", ")))
+            candidates += len(found)
+        }
+    }
+
+    if len(matched) > 0 {
+        settleBankTransfer(payment, matched)
+    }
+
+    switch {
+    case len(ambiguous) > 0:
+        recordMatchException(payment, models.MatchExceptionAmbiguous, candidates,
+            "Several posted receipts match the amount and plot of "+strings.Join(ambiguous, "; "))
+    case len(unmatched) > 0:
+        // A bank transfer the customer has not made yet is not an exception
+        if payment.Status == models.MpesaStatusSuccess && now.Sub(paymentTime(payment)) >= config.ExceptionAfter {
+            recordMatchException(payment, models.MatchExceptionUnmatched, 0,
+                "No posted receipt found for the M-PESA receipt number, amount and plot of "+strings.Join(unmatched, "; "))
+        }
+    case len(matched) == len(targets):
+        resolveMatchException(payment)
+    }
+}
+
+// describeTarget names the part of a payment a receipt is looked for, for finance
+func describeTarget(target matchTarget) string {
+    return fmt.Sprintf("%s (%s)", target.PlotNumber, formatAmount(target.Amount))
+}
+
+// receiptsByReference finds the unmatched posted receipts carrying the payment's M-PESA receipt
+// number, or for a bank transfer the reference the customer was asked to quote. Finance posts
+// one for each property a split payment went to.
+func receiptsByReference(payment models.MpesaPayment) ([]models.Receipt, error) {
+    reference := payment.MpesaReceiptNumber
+    if payment.Method == models.PaymentMethodBankTransfer {
+        reference = payment.CheckoutRequestID
+    }
+    if reference == "" {
+        return nil, nil
+    }
+
+    var receipts []models.Receipt
+    if err := utils.DefaultDB.
+        Where("Customer_Id = ? AND Type = ? AND (Receipt_No = ? OR transfer_receipt = ?)",
+            payment.CustomerNumber, receiptTypePosted, reference, reference).
+        Order("id ASC").
+        Find(&receipts).Error; err != nil {
+        return nil, err
+    }
+    return withoutMatchedReceipts(receipts)
+}
+
+// referenceFor picks the receipt carrying the payment's reference that belongs to target: the
+// first one when the payment has a single part left, otherwise the one for the same plot,
+// preferring one for the same amount
+func referenceFor(receipts []models.Receipt, target matchTarget, only bool, taken map[int]bool) *models.Receipt {
+    var samePlot *models.Receipt
+    for i := range receipts {
+        receipt := &receipts[i]
+        if taken[receipt.ID] {
+            continue
+        }
+        if only {
+            return receipt
+        }
+        if receipt.PlotNo != target.PlotNumber {
+            continue
+        }
+        if math.Abs(receipt.AmountLCY-target.Amount) < 0.005 {
+            return receipt
+        }
+        if samePlot == nil {
+            samePlot = receipt
+        }
+    }
+    return samePlot
+}
+
+// receiptCandidate is a receipt that may belong to a payment, with how far apart their dates are
+type receiptCandidate struct {
+    Receipt models.Receipt
+    Gap     time.Duration
+}
+
+// receiptsByAmountPlotDate finds the unmatched posted receipts for the target's amount and plot
+// whose payment date is within DateWindow of the M-PESA transaction, leaving out receipts
+// already taken by another part of the payment
+func (config MatcherConfig) receiptsByAmountPlotDate(payment models.MpesaPayment, target matchTarget, taken map[int]bool) ([]receiptCandidate, error) {
+    if target.PlotNumber == "" {
+        return nil, nil
+    }
+
+    amount := target.Amount
+
+    var receipts []models.Receipt
+    if err := utils.DefaultDB.
+        Where("Customer_Id = ? AND Type = ? AND Plot_NO = ? AND Amount_LCY BETWEEN ? AND ?",
+            payment.CustomerNumber, receiptTypePosted, target.PlotNumber, amount-0.005, amount+0.005).
+        Find(&receipts).Error; err != nil {
+        return nil, err
+    }
+
+    receipts, err := withoutMatchedReceipts(receipts)
+    if err != nil {
+        return nil, err
+    }
+
+    paidAt := paymentTime(payment)
+
+    var candidates []receiptCandidate
+    for _, receipt := range receipts {
+        if taken[receipt.ID] {
+            continue
+        }
+        date, ok := receiptPaymentDate(receipt)
+        if !ok {
+            continue
+        }
+        gap := date.Sub(paidAt)
+        if gap < 0 {
+            gap = -gap
+        }
+        if gap <= config.DateWindow {
+            candidates = append(candidates, receiptCandidate{Receipt: receipt, Gap: gap})
+        }
+    }
+    return candidates, nil
+}
+
+// heuristicConfidence scores a match on amount, plot and date. The further apart the dates,
+// the less certain the match.
+func (config MatcherConfig) heuristicConfidence(gap time.Duration) float64 {
+    confidence := 0.9 - 0.3*float64(gap)/float64(config.DateWindow)
+    return math.Round(confidence*100) / 100
+}
+
+// withoutMatchedReceipts drops the receipts already matched to another payment
+func withoutMatchedReceipts(receipts []models.Receipt) ([]models.Receipt, error) {
+    if len(receipts) == 0 {
+        return receipts, nil
+    }
+
+    ids := make([]int, 0, len(receipts))
+    for _, receipt := range receipts {
+        ids = append(ids, receipt.ID)
+    }
+
+    var matched []int
+    if err := utils.CustomerPortalDB.Model(&models.PaymentReceiptMatch{}).
+        Where("receipt_id IN ?", ids).
+        Pluck("receipt_id", &matched).Error; err != nil {
+        return nil, err
+    }
+
+    taken := map[int]bool{}
+    for _, id := range matched {
+        taken[id] = true
+    }
+
+    var unmatched []models.Receipt
+    for _, receipt := range receipts {
+        if !taken[receipt.ID] {
+            unmatched = append(unmatched, receipt)
+        }
+    }
+    return unmatched, nil
+}
+
+// receiptPaymentDate parses the date the customer paid according to the ERP, falling back to
+// the date the receipt was posted
+func receiptPaymentDate(receipt models.Receipt) (time.Time, bool) {
+    for _, value := range []string{receipt.PaymentDate, receipt.PaymentDate1, receipt.DatePosted} {
+        value = strings.TrimSpace(value)
+        if value == "" {
+            continue
+        }
+        for _, layout := range receiptDateLayouts {
+            if parsed, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+                return parsed, true
+            }
+        }
+    }
+    return time.Time{}, false
+}
+
+// paymentTime is when M-PESA says the customer paid, or when the payment was started
+func paymentTime(payment models.MpesaPayment) time.Time {
+    if payment.TransactionDate != nil {
+        return *payment.TransactionDate
+    }
+    return payment.CreatedAt
+}
+
+// paymentAmount is what the customer actually paid, or the amount requested if M-PESA did not say
+func paymentAmount(payment models.MpesaPayment) float64 {
+    if payment.AmountPaid != nil {
+        return *payment.AmountPaid
+    }
+    return payment.Amount
+}
+
+// recordMatch links a part of the payment to its receipt and tells the customer the receipt
+// has been posted. It reports whether the match was recorded.
+func recordMatch(payment models.MpesaPayment, target matchTarget, receipt models.Receipt, method string, confidence float64) bool {
+    match := models.PaymentReceiptMatch{
+        MpesaPaymentID:      payment.ID,
+        PaymentAllocationID: target.AllocationID,
+        ReceiptID:           receipt.ID,
+        ReceiptNo:           receipt.ReceiptNo,
+        Method:              method,
+        Confidence:          confidence,
+    }
+    if err := utils.CustomerPortalDB.Create(&match).Error; err != nil {
+        // Both sides are unique, so an allocation or receipt matched concurrently ends up here
+        log.Printf("Failed to match payment %d to receipt %s: %v", payment.ID, receipt.ReceiptNo, err)
+        return false
+    }
+
+    log.Printf("M-PESA payment %s (%s) matched to receipt %s by %s (confidence %.2f)",
+        payment.CheckoutRequestID, target.PlotNumber, receipt.ReceiptNo, method, confidence)
+
+    if notifyPaymentPosted(payment, target.PlotNumber, receipt) {
+        if err := utils.CustomerPortalDB.Model(&match).Update("notified_at", time.Now()).Error; err != nil {
+            log.Printf("Failed to record posting notification for payment %d: %v", payment.ID, err)
+        }
+    }
+    return true
+}
+
+// settleBankTransfer adds the receipts finance posted for a bank transfer to what it paid, and
+// settles it if it was still pending: finance posting a transfer is what tells us the money
+// arrived. Other methods already know what was paid.
+func settleBankTransfer(payment models.MpesaPayment, receipts []models.Receipt) {
+    if payment.Method != models.PaymentMethodBankTransfer {
+        return
+    }
+
+    posted := 0.0
+    for _, receipt := range receipts {
+        posted += receipt.AmountLCY
+    }
+
+    updates := map[string]interface{}{
+        "amount_paid": gorm.Expr("COALESCE(amount_paid, 0) + ?", posted),
+    }
+    if payment.Status == models.MpesaStatusPending {
+        updates["status"] = models.MpesaStatusSuccess
+        updates["result_desc"] = "Bank transfer posted"
+    }
+    if err := utils.CustomerPortalDB.Model(&models.MpesaPayment{}).
+        Where("id = ? AND status = ?", payment.ID, payment.Status).
+        Updates(updates).Error; err != nil {
+        log.Printf("Failed to settle bank transfer %s: %v", payment.CheckoutRequestID, err)
+    }
+}
+
+// resolveMatchException closes any exception raised for a payment now fully matched
+func resolveMatchException(payment models.MpesaPayment) {
+    if err := utils.CustomerPortalDB.Model(&models.PaymentMatchException{}).
+        Where("mpesa_payment_id = ? AND resolved_at IS NULL", payment.ID).
+        Update("resolved_at", time.Now()).Error; err != nil {
+        log.Printf("Failed to resolve match exception for payment %d: %v", payment.ID, err)
+    }
+}
+
+// recordMatchException records, or refreshes, why a payment could not be matched
+func recordMatchException(payment models.MpesaPayment, reason string, candidates int, detail string) {
+    exception := models.PaymentMatchException{
+        MpesaPaymentID: payment.ID,
+        Reason:         reason,
+        Candidates:     candidates,
+        Detail:         detail,
+    }
+    if err := utils.CustomerPortalDB.Clauses(clause.OnConflict{
+        Columns:   []clause.Column{{Name: "mpesa_payment_id"}},
+        DoUpdates: clause.AssignmentColumns([]string{"reason", "candidates", "detail", "updated_at"}),
+    }).Create(&exception).Error; err != nil {
+        log.Printf("Failed to record match exception for payment %d: %v", payment.ID, err)
+    }
+}
+
+// notifyPaymentPosted tells the customer finance has posted their payment, or the part of it
+// that went to plotNumber, and reports whether the notification was sent
+func notifyPaymentPosted(payment models.MpesaPayment, plotNumber string, receipt models.Receipt) bool {
+    var user models.User
+    if err := utils.CustomerPortalDB.
+        Where("customer_number = ?", payment.CustomerNumber).
+        First(&user).Error; err != nil {
+        if !errors.Is(err, gorm.ErrRecordNotFound) {
+            log.Printf("Failed to find user: %v", err)
+        }
+        return false
+    }
+
+    if _, err := outbox.NotifyTemplate(user, "payment_posted", map[string]interface{}{
+        "Amount":             formatAmount(receipt.AmountLCY),
+        "PlotNumber":         plotNumber,
+        "ReceiptNo":          receipt.ReceiptNo,
+        "MpesaReceiptNumber": payment.MpesaReceiptNumber,
+    }); err != nil {
+        log.Printf("Failed to send payment_posted notification: %v", err)
+        return false
+    }
+    return true
+}
+
+// markMatchChecked records when the matcher last looked for a payment's receipt
+func markMatchChecked(payment models.MpesaPayment, now time.Time) {
+    if err := utils.CustomerPortalDB.Model(&models.MpesaPayment{}).
+        Where("id = ?", payment.ID).
+        Update("match_checked_at", now).Error; err != nil {
+        log.Printf("Failed to record match check time for payment %d: %v", payment.ID, err)
+    }
+}
@@ -0,0 +1,242 @@
+package payments
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"mobile-customer-portal-server/models"
+	"mobile-customer-portal-server/utils"
+	"mobile-customer-portal-server/utils/testdb"
+)
+
+// testMatcherConfig looks at every unmatched payment on each run
+var testMatcherConfig = MatcherConfig{
+	Interval:       0,
+	DateWindow:     72 * time.Hour,
+	ExceptionAfter: 72 * time.Hour,
+	LookBack:       30 * 24 * time.Hour,
+	BatchSize:      100,
+}
+
+// part is one allocation of a test payment
+type part struct {
+	plot   string
+	amount float64
+}
+
+// createSplitPayment saves a payment of parts made at paidAt, one allocation per part. A single
+// M-PESA part is saved without allocations, like a paybill payment; a bank transfer is pending.
+func createSplitPayment(t *testing.T, method, reference string, paidAt time.Time, parts ...part) (models.MpesaPayment, []models.PaymentAllocation) {
+	t.Helper()
+	total := 0.0
+	for _, p := range parts {
+		total += p.amount
+	}
+
+	payment := models.MpesaPayment{
+		CheckoutRequestID:     "ws_CO_" + strings.ReplaceAll(t.Name(), "/", "_"),
+		Method:                method,
+		Source:                models.MpesaSourceSTK,
+		InstallmentScheduleID: "1",
+		CustomerNumber:        "C001",
+		PhoneNumber:           "254712345678",
+		Amount:                total,
+		Status:                models.MpesaStatusSuccess,
+		PlotNumber:            parts[0].plot,
+		MpesaReceiptNumber:    reference,
+		TransactionDate:       &paidAt,
+		AmountPaid:            &total,
+	}
+	if method == models.PaymentMethodBankTransfer {
+		payment.CheckoutRequestID = reference
+		payment.MpesaReceiptNumber = ""
+		payment.Status = models.MpesaStatusPending
+		payment.AmountPaid = nil
+	}
+	if err := utils.CustomerPortalDB.Create(&payment).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	var allocations []models.PaymentAllocation
+	if len(parts) > 1 || method == models.PaymentMethodBankTransfer {
+		for _, p := range parts {
+			allocations = append(allocations, models.PaymentAllocation{
+				MpesaPaymentID: payment.ID,
+				LeadFileNo:     "LF-" + p.plot,
+				PlotNumber:     p.plot,
+				Amount:         p.amount,
+			})
+		}
+		if err := utils.CustomerPortalDB.Create(&allocations).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	return payment, allocations
+}
+
+// postReceipt posts a receipt in the ERP for plot, paid at paidAt
+func postReceipt(t *testing.T, number, plot string, amount float64, paidAt time.Time, reference string) models.Receipt {
+	t.Helper()
+	receipt := models.Receipt{
+		ReceiptNo:       number,
+		CustomerID:      "C001",
+		LeadFileNo:      "LF-" + plot,
+		PlotNo:          plot,
+		AmountLCY:       amount,
+		Type:            receiptTypePosted,
+		PaymentDate:     paidAt.Format("2006-01-02 15:04:05"),
+		TransferReceipt: reference,
+	}
+	if err := utils.DefaultDB.Create(&receipt).Error; err != nil {
+		t.Fatal(err)
+	}
+	return receipt
+}
+
+func paymentMatches(t *testing.T, payment models.MpesaPayment) map[uint]models.PaymentReceiptMatch {
+	t.Helper()
+	var matches []models.PaymentReceiptMatch
+	if err := utils.CustomerPortalDB.Where("mpesa_payment_id = ?", payment.ID).Find(&matches).Error; err != nil {
+		t.Fatal(err)
+	}
+	byAllocation := map[uint]models.PaymentReceiptMatch{}
+	for _, match := range matches {
+		byAllocation[match.PaymentAllocationID] = match
+	}
+	return byAllocation
+}
+
+func runMatcher(t *testing.T) {
+	t.Helper()
+	if err := testMatcherConfig.Match(); err != nil {
+		t.Fatalf("Match: %v", err)
+	}
+}
+
+func TestMatchSplitPaymentPerAllocation(t *testing.T) {
+	testdb.Setup(t)
+	paidAt := time.Now().Add(-time.Hour)
+	payment, allocations := createSplitPayment(t, models.PaymentMethodMpesa, "", paidAt,
+		part{"VP1", 10000}, part{"VP2", 5000})
+
+	// A receipt for the whole amount on one plot is not either part
+	postReceipt(t, "R-WHOLE", "VP1", 15000, paidAt, "")
+	first := postReceipt(t, "R-1", "VP1", 10000, paidAt, "")
+	second := postReceipt(t, "R-2", "VP2", 5000, paidAt.Add(time.Hour), "")
+
+	runMatcher(t)
+
+	matches := paymentMatches(t, payment)
+	if len(matches) != 2 {
+		t.Fatalf("%d matches, want one per allocation", len(matches))
+	}
+	if match := matches[allocations[0].ID]; match.ReceiptID != first.ID || match.Method != models.MatchMethodAmountPlotDate {
+		t.Errorf("VP1 allocation matched %+v, want receipt %d", match, first.ID)
+	}
+	if match := matches[allocations[1].ID]; match.ReceiptID != second.ID {
+		t.Errorf("VP2 allocation matched %+v, want receipt %d", match, second.ID)
+	}
+
+	// A fully matched payment is left alone
+	utils.CustomerPortalDB.Model(&models.MpesaPayment{}).Where("id = ?", payment.ID).Update("match_checked_at", nil)
+	postReceipt(t, "R-3", "VP2", 5000, paidAt, "")
+	runMatcher(t)
+	if matches := paymentMatches(t, payment); len(matches) != 2 {
+		t.Fatalf("%d matches after another run, want 2", len(matches))
+	}
+}
+
+func TestMatchSplitPaymentPartially(t *testing.T) {
+	testdb.Setup(t)
+	paidAt := time.Now().Add(-4 * 24 * time.Hour)
+	payment, allocations := createSplitPayment(t, models.PaymentMethodMpesa, "", paidAt,
+		part{"VP1", 10000}, part{"VP2", 5000})
+
+	postReceipt(t, "R-1", "VP1", 10000, paidAt, "")
+	runMatcher(t)
+
+	if matches := paymentMatches(t, payment); len(matches) != 1 || matches[allocations[0].ID].ReceiptNo != "R-1" {
+		t.Fatalf("matches = %+v, want only the VP1 allocation", matches)
+	}
+	var exception models.PaymentMatchException
+	if err := utils.CustomerPortalDB.Where("mpesa_payment_id = ?", payment.ID).First(&exception).Error; err != nil {
+		t.Fatalf("no exception for the unmatched part: %v", err)
+	}
+	if exception.Reason != models.MatchExceptionUnmatched || !strings.Contains(exception.Detail, "VP2") || strings.Contains(exception.Detail, "VP1") {
+		t.Fatalf("exception = %+v, want VP2 unmatched", exception)
+	}
+
+	// The payment is looked at again until its last part is posted
+	postReceipt(t, "R-2", "VP2", 5000, paidAt, "")
+	runMatcher(t)
+
+	if matches := paymentMatches(t, payment); len(matches) != 2 || matches[allocations[1].ID].ReceiptNo != "R-2" {
+		t.Fatalf("matches = %+v, want both allocations", matches)
+	}
+	utils.CustomerPortalDB.First(&exception, exception.ID)
+	if exception.ResolvedAt == nil {
+		t.Fatal("exception not resolved once every part was matched")
+	}
+}
+
+func TestMatchSplitPaymentByReference(t *testing.T) {
+	testdb.Setup(t)
+	paidAt := time.Now().Add(-time.Hour)
+	payment, allocations := createSplitPayment(t, models.PaymentMethodMpesa, "QAB123", paidAt,
+		part{"VP1", 10000}, part{"VP2", 5000})
+
+	// Finance posted one receipt per plot, both quoting the M-PESA receipt number
+	second := postReceipt(t, "R-2", "VP2", 5000, paidAt, "QAB123")
+	first := postReceipt(t, "R-1", "VP1", 10000, paidAt, "QAB123")
+
+	runMatcher(t)
+
+	matches := paymentMatches(t, payment)
+	if match := matches[allocations[0].ID]; match.ReceiptID != first.ID || match.Method != models.MatchMethodReceiptNumber || match.Confidence != 1 {
+		t.Errorf("VP1 allocation matched %+v, want receipt %d by receipt number", match, first.ID)
+	}
+	if match := matches[allocations[1].ID]; match.ReceiptID != second.ID || match.Method != models.MatchMethodReceiptNumber {
+		t.Errorf("VP2 allocation matched %+v, want receipt %d by receipt number", match, second.ID)
+	}
+}
+
+func TestMatchPaymentWithoutAllocations(t *testing.T) {
+	testdb.Setup(t)
+	paidAt := time.Now().Add(-time.Hour)
+	payment, _ := createSplitPayment(t, models.PaymentMethodMpesa, "", paidAt, part{"VP1", 7500})
+	receipt := postReceipt(t, "R-1", "VP1", 7500, paidAt, "")
+
+	runMatcher(t)
+
+	matches := paymentMatches(t, payment)
+	if match, ok := matches[0]; len(matches) != 1 || !ok || match.ReceiptID != receipt.ID {
+		t.Fatalf("matches = %+v, want the whole payment matched to receipt %d", matches, receipt.ID)
+	}
+}
+
+func TestMatchSettlesSplitBankTransfer(t *testing.T) {
+	testdb.Setup(t)
+	paidAt := time.Now().Add(-time.Hour)
+	payment, _ := createSplitPayment(t, models.PaymentMethodBankTransfer, "VP1-9F2A41C0", paidAt,
+		part{"VP1", 10000}, part{"VP2", 5000})
+
+	postReceipt(t, "R-1", "VP1", 10000, paidAt, "VP1-9F2A41C0")
+	runMatcher(t)
+
+	current := reloadPayment(t, payment)
+	if current.Status != models.MpesaStatusSuccess || current.AmountPaid == nil || *current.AmountPaid != 10000 {
+		t.Fatalf("after the first receipt: status %q, amount paid %v", current.Status, current.AmountPaid)
+	}
+
+	postReceipt(t, "R-2", "VP2", 5000, paidAt, "VP1-9F2A41C0")
+	runMatcher(t)
+
+	current = reloadPayment(t, payment)
+	if current.AmountPaid == nil || *current.AmountPaid != 15000 {
+		t.Fatalf("after the second receipt: amount paid %v, want 15000", current.AmountPaid)
+	}
+	if matches := paymentMatches(t, payment); len(matches) != 2 {
+		t.Fatalf("%d matches, want 2", len(matches))
+	}
+}
@@ -1,31 +1,39 @@
 package payments
 
 import (
-	"bytes"
-	"encoding/base64"
 	"encoding/json"
-	"fmt"
 	"io"
 	"log"
+	"mobile-customer-portal-server/daraja"
+	"mobile-customer-portal-server/gateway"
 	"mobile-customer-portal-server/models"
+	"mobile-customer-portal-server/outbox"
 	"mobile-customer-portal-server/utils"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
-	"time"
 
+	"github.com/dustin/go-humanize"
 	"github.com/gin-gonic/gin"
-	mpesa "github.com/jwambugu/mpesa-golang-sdk"
 )
 
 
+// MpesaPaymentRequest is the body of an STK push request. The customer is always the logged
+// in user; LeadFileNo (or PlotNumber for older clients) and InstallmentScheduleID must belong
+// to them. A payment can instead be split across properties and installments, either as
+// proposed in Allocations or, with AutoAllocate, oldest unpaid installment first.
 type MpesaPaymentRequest struct {
-    Amount                string `json:"amount"`
-    PhoneNumber           string `json:"phone_number"`
-    InstallmentScheduleID string `json:"installment_schedule_id"`
-    CustomerNumber        string `json:"customer_number"`
-    PlotNumber            string `json:"plot_number"`
+    Amount                string              `json:"amount"`
+    PhoneNumber           string              `json:"phone_number"`
+    LeadFileNo            string              `json:"lead_file_no"`
+    InstallmentScheduleID string              `json:"installment_schedule_id"`
+    PlotNumber            string              `json:"plot_number"`
+    // AllowOverpayment lets the customer pay more than is outstanding
+    AllowOverpayment      bool                `json:"allow_overpayment"`
+    Allocations           []AllocationRequest `json:"allocations"`
+    // AutoAllocate spreads the amount over the unpaid installments of LeadFileNo, or of all the
+    // customer's properties when it is empty
+    AutoAllocate          bool                `json:"auto_allocate"`
 }
 
 func isValidPhoneNumber(phoneNumber string) bool {
@@ -40,62 +48,6 @@ func isValidPhoneNumber(phoneNumber string) bool {
     return err == nil
 }
 
-type STKPushRequest struct {
-    BusinessShortCode string `json:"BusinessShortCode"`
-    Password          string `json:"Password"`
-    Timestamp         string `json:"Timestamp"`
-    TransactionType   string `json:"TransactionType"`
-    Amount            int    `json:"Amount"`
-    PartyA            string `json:"PartyA"`
-    PartyB            string `json:"PartyB"`
-    PhoneNumber       string `json:"PhoneNumber"`
-    CallBackURL       string `json:"CallBackURL"`
-    AccountReference  string `json:"AccountReference"`
-    TransactionDesc   string `json:"TransactionDesc"`
-}
-
-func getAccessToken(consumerKey, consumerSecret string) (string, error) {
-    url := "https://api.safaricom.co.ke/oauth/v1/generate?grant_type=client_credentials"
-
-    client := &http.Client{}
-    req, err := http.NewRequest("GET", url, nil)
-    if err != nil {
-        return "", err
-    }
-
-    // Set Basic Auth header
-    auth := base64.StdEncoding.EncodeToString([]byte(consumerKey + ":" + consumerSecret))
-    req.Header.Add("Authorization", "Basic "+auth)
-
-    resp, err := client.Do(req)
-    if err != nil {
-        return "", err
-    }
-    defer resp.Body.Close()
-
-    bodyBytes, err := io.ReadAll(resp.Body)
-    if err != nil {
-        return "", err
-    }
-
-    if resp.StatusCode != http.StatusOK {
-        return "", fmt.Errorf("failed to get access token: %s", string(bodyBytes))
-    }
-
-    var result map[string]interface{}
-    err = json.Unmarshal(bodyBytes, &result)
-    if err != nil {
-        return "", err
-    }
-
-    accessToken, ok := result["access_token"].(string)
-    if !ok {
-        return "", fmt.Errorf("access_token not found in response")
-    }
-
-    return accessToken, nil
-}
-
 // InitiateMpesaPayment handles the initiation of an M-PESA STK Push payment.
 func InitiateMpesaPayment(c *gin.Context) {
     var req MpesaPaymentRequest
@@ -123,129 +75,35 @@ func InitiateMpesaPayment(c *gin.Context) {
         return
     }
 
-    // Initialize variables
-    consumerKey := os.Getenv("DARAJA_CONSUMER_KEY")
-    consumerSecret := os.Getenv("DARAJA_CONSUMER_SECRET")
-    passKey := os.Getenv("DARAJA_PASSKEY")
-    callbackURL := os.Getenv("DARAJA_CALLBACK_URL")
-
-    if consumerKey == "" || consumerSecret == "" || passKey == "" || callbackURL == "" {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "M-PESA configuration not properly set"})
+    userInterface, exists := c.Get("user")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
         return
     }
+    user := userInterface.(models.User)
 
-    // Get access token
-    accessToken, err := getAccessToken(consumerKey, consumerSecret)
-    if err != nil {
-        log.Printf("Error getting access token: %v", err)
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get access token"})
-        return
-    }
-
-    // Prepare the STK Push request
-    businessShortCode := os.Getenv("DARAJA_BUSINESS_SHORT_CODE")
-    timestamp := time.Now().Format("20060102150405")
-    passwordStr := businessShortCode + passKey + timestamp
-    password := base64.StdEncoding.EncodeToString([]byte(passwordStr))
-
-    stkPushRequest := STKPushRequest{
-        BusinessShortCode: businessShortCode,
-        Password:          password,
-        Timestamp:         timestamp,
-        TransactionType:   "CustomerPayBillOnline",
-        Amount:            amount,
-        PartyA:            req.PhoneNumber,
-        PartyB:            businessShortCode,
-        PhoneNumber:       req.PhoneNumber,
-        CallBackURL:       callbackURL,
-        AccountReference:  req.PlotNumber,
-        TransactionDesc:   "Payment of Installment",
-    }
-
-    // Marshal the request to JSON
-    requestBody, err := json.Marshal(stkPushRequest)
-    if err != nil {
-        log.Printf("Error marshalling STKPushRequest: %v", err)
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to initiate M-PESA payment"})
-        return
-    }
-
-    // Send the HTTP request
-    stkPushURL := "https://api.safaricom.co.ke/mpesa/stkpush/v1/processrequest"
-    reqHTTP, err := http.NewRequest("POST", stkPushURL, bytes.NewBuffer(requestBody))
-    if err != nil {
-        log.Printf("Error creating HTTP request: %v", err)
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to initiate M-PESA payment"})
-        return
-    }
-    reqHTTP.Header.Set("Content-Type", "application/json")
-    reqHTTP.Header.Set("Authorization", "Bearer "+accessToken)
-
-    client := &http.Client{}
-    resp, err := client.Do(reqHTTP)
-    if err != nil {
-        log.Printf("Error sending STK Push request: %v", err)
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to initiate M-PESA payment"})
-        return
-    }
-    defer resp.Body.Close()
-
-    responseBody, err := io.ReadAll(resp.Body)
-    if err != nil {
-        log.Printf("Error reading response body: %v", err)
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to initiate M-PESA payment"})
-        return
-    }
-
-    // Parse the response
-    var stkPushResponse map[string]interface{}
-    err = json.Unmarshal(responseBody, &stkPushResponse)
-    if err != nil {
-        log.Printf("Error unmarshalling STK Push response: %v", err)
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to initiate M-PESA payment"})
-        return
-    }
-
-    // Check for errors in the response
-    if resp.StatusCode != http.StatusOK {
-        log.Printf("Error from M-PESA API: %s", string(responseBody))
-        c.JSON(http.StatusInternalServerError, gin.H{"error": stkPushResponse["errorMessage"]})
-        return
-    }
-
-    // Save the payment details
-    checkoutRequestID, _ := stkPushResponse["CheckoutRequestID"].(string)
-    merchantRequestID, _ := stkPushResponse["MerchantRequestID"].(string)
-
-    mpesaPayment := models.MpesaPayment{
-        CheckoutRequestID:     checkoutRequestID,
-        InstallmentScheduleID: req.InstallmentScheduleID,
-        CustomerNumber:        req.CustomerNumber,
-        PhoneNumber:           req.PhoneNumber,
-        Amount:                req.Amount,
-        Status:                "Pending",
-        PlotNumber:            req.PlotNumber,
-    }
-
-    if err := utils.CustomerPortalDB.Create(&mpesaPayment).Error; err != nil {
-        log.Printf("Error saving M-PESA payment: %v", err)
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save M-PESA payment"})
+    started := startPayment(c, user, PaymentRequest{MpesaPaymentRequest: req}, gateway.MethodMpesa, float64(amount))
+    if started == nil {
         return
     }
 
     c.JSON(http.StatusOK, gin.H{
         "message":             "M-PESA payment initiated",
-        "CheckoutRequestID":   checkoutRequestID,
-        "MerchantRequestID":   merchantRequestID,
-        "ResponseCode":        stkPushResponse["ResponseCode"],
-        "ResponseDescription": stkPushResponse["ResponseDescription"],
-        "CustomerMessage":     stkPushResponse["CustomerMessage"],
+        "allocations":         started.Allocations,
+        "CheckoutRequestID":   started.Session.Reference,
+        "MerchantRequestID":   started.Session.MerchantReference,
+        "ResponseCode":        "0",
+        "ResponseDescription": started.Session.Detail,
+        "CustomerMessage":     started.Session.Message,
     })
 }
 
-// MpesaCallback handles the M-PESA STK Push callback.
+// MpesaCallback handles the M-PESA STK Push callback. The callback URL carries the payment's
+// secret token; callbacks with an unknown token or for another checkout request are rejected.
+// A payment is only finalized once, so repeated deliveries of the same callback are
+// acknowledged without changing its status or notifying the customer again.
 func MpesaCallback(c *gin.Context) {
-    var callback mpesa.STKPushCallback
+    var callback daraja.STKCallback
 
     // Read the request body
     bodyBytes, err := io.ReadAll(c.Request.Body)
@@ -264,145 +122,82 @@ func MpesaCallback(c *gin.Context) {
 
     stkCallback := callback.Body.STKCallback
 
-    if stkCallback.ResultCode == 0 {
-        // Payment successful
+    // Find the payment this callback URL was issued for
+    mpesaPayment, err := callbackPayment(c.Param("token"), stkCallback.CheckoutRequestID)
+    if err != nil {
+        log.Printf("Rejected M-PESA callback with unknown token from %s", c.ClientIP())
+        c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+        return
+    }
+
+    if stkCallback.CheckoutRequestID != mpesaPayment.CheckoutRequestID {
+        log.Printf("Rejected M-PESA callback for %s on the callback URL of %s",
+            stkCallback.CheckoutRequestID, mpesaPayment.CheckoutRequestID)
+        c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+        return
+    }
+
+    if stkCallback.ResultCode == daraja.ResultCodeSuccess {
         log.Printf("M-PESA payment successful: %+v", stkCallback)
-    
-        checkoutRequestID := stkCallback.CheckoutRequestID
-    
-        // Update the M-Pesa payment status to Success
-        if err := utils.CustomerPortalDB.Model(&models.MpesaPayment{}).
-            Where("checkout_request_id = ?", checkoutRequestID).
-            Updates(map[string]interface{}{"status": "Success"}).Error; err != nil {
-            log.Printf("Failed to update M-PESA payment status: %v", err)
-        }
-    
-        // Get the M-Pesa payment record
-        var mpesaPayment models.MpesaPayment
-        if err := utils.CustomerPortalDB.
-            Where("checkout_request_id = ?", checkoutRequestID).
-            First(&mpesaPayment).Error; err != nil {
-            log.Printf("Error finding M-PESA payment: %v", err)
-            return
-        }
-    
-        // Fetch the user
-        customerNumber := mpesaPayment.CustomerNumber
-        var user models.User
-        if err := utils.CustomerPortalDB.
-            Where("customer_number = ?", customerNumber).
-            First(&user).Error; err != nil {
-            log.Printf("Failed to find user: %v", err)
-            return
-        }
-    
-        // Since we are not modifying the installment schedule table at this point,
-        // just notify the user that the payment has been received and is being processed.
-        message := fmt.Sprintf("We've received your payment of KES %s for plot %s. Your payment is currently being processed.",
-            mpesaPayment.Amount, mpesaPayment.PlotNumber)
-    
-        if user.PushToken != "" {
-            sendPushNotification(user.PushToken, "Payment Received", message)
-        } else {
-            log.Printf("User does not have a push token")
-        }
-    
-        // Save notification
-        notification := models.Notification{
-            UserID: user.ID,
-            Title:  "Payment Received",
-            Body:   message,
-            Data:   "",
-        }
-    
-        if err := utils.CustomerPortalDB.Create(&notification).Error; err != nil {
-            log.Printf("Failed to save notification: %v", err)
-        }
-    
     } else {
         // Payment failed or cancelled
         log.Printf("M-PESA payment failed or cancelled: %+v", stkCallback)
+    }
 
-        // Extract necessary details
-        checkoutRequestID := stkCallback.CheckoutRequestID
-
-        // Update the payment status to Failed
-        if err := utils.CustomerPortalDB.Model(&models.MpesaPayment{}).
-            Where("checkout_request_id = ?", checkoutRequestID).
-            Updates(map[string]interface{}{
-                "status": "Failed",
-            }).Error; err != nil {
-            log.Printf("Failed to update M-PESA payment status: %v", err)
-        }
-
-        // Optionally, notify the user
-        var mpesaPayment models.MpesaPayment
-        if err := utils.CustomerPortalDB.
-            Where("checkout_request_id = ?", checkoutRequestID).
-            First(&mpesaPayment).Error; err != nil {
-            log.Printf("Error finding M-PESA payment: %v", err)
-            return
-        }
-        customerNumber := mpesaPayment.CustomerNumber
-
-        var user models.User
-        if err := utils.CustomerPortalDB.
-            Where("customer_number = ?", customerNumber).
-            First(&user).Error; err != nil {
-            log.Printf("Failed to find user: %v", err)
-            return
-        }
-
-        // Send push notification and save notification
-        if user.PushToken != "" {
-            sendPushNotification(user.PushToken, "Payment Failed", "Your M-PESA payment failed or was cancelled.")
-        } else {
-            log.Printf("User does not have a push token")
-        }
-
-        // Save notification to database
-        notification := models.Notification{
-            UserID: user.ID,
-            Title:  "Payment Failed",
-            Body:   "Your M-PESA payment failed or was cancelled.",
-            Data:   "",
-        }
-
-        if err := utils.CustomerPortalDB.Create(&notification).Error; err != nil {
-            log.Printf("Failed to save notification: %v", err)
+    resultCode := stkCallback.ResultCode
+    outcome := paymentOutcome{
+        ResultCode:        &resultCode,
+        ResultDesc:        stkCallback.ResultDesc,
+        MerchantRequestID: stkCallback.MerchantRequestID,
+        Metadata:          parseCallbackMetadata(stkCallback.CallbackMetadata.Item),
+        RawCallback:       string(bodyBytes),
+    }
+    finalized, err := finalizePayment(mpesaPayment, statusForResultCode(resultCode), outcome)
+    if err != nil {
+        log.Printf("Failed to update M-PESA payment status: %v", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process callback"})
+        return
+    }
+    if !finalized {
+        if resultCode == daraja.ResultCodeSuccess {
+            if err := recordLateReceipt(mpesaPayment, outcome); err != nil {
+                log.Printf("Failed to record M-PESA receipt for %s: %v", mpesaPayment.CheckoutRequestID, err)
+            }
         }
+        log.Printf("Ignoring repeated M-PESA callback for %s", mpesaPayment.CheckoutRequestID)
+        c.JSON(http.StatusOK, gin.H{"message": "Callback already processed"})
+        return
     }
 
     // Return 200 OK
     c.JSON(http.StatusOK, gin.H{"message": "Callback received"})
 }
 
-// sendPushNotification sends a push notification to the user.
-func sendPushNotification(pushToken, title, message string) {
-    notification := map[string]interface{}{
-        "to":    pushToken,
-        "sound": "default",
-        "title": title,
-        "body":  message,
-    }
-
-    payload, err := json.Marshal(notification)
-    if err != nil {
-        log.Printf("Failed to marshal notification payload: %v", err)
-        return
-    }
+// callbackPayment finds the payment a callback URL was issued for. Payments started before
+// callback URLs carried a token were sent to the bare /mpesa/callback, which Daraja still calls
+// for them; those are found by checkout request ID, and only while still pending. The column was
+// added after them, so their hash is empty or NULL.
+func callbackPayment(token, checkoutRequestID string) (models.MpesaPayment, error) {
+    var payment models.MpesaPayment
+    query := utils.CustomerPortalDB.Where("callback_token_hash = ?", utils.HashSecret(token))
+    if token == "" {
+        query = utils.CustomerPortalDB.
+            Where("checkout_request_id = ? AND status = ?", checkoutRequestID, models.MpesaStatusPending).
+            Where("callback_token_hash = ? OR callback_token_hash IS NULL", "")
+    }
+    err := query.First(&payment).Error
+    return payment, err
+}
 
-    resp, err := http.Post("https://exp.host/--/api/v2/push/send", "application/json", bytes.NewBuffer(payload))
-    if err != nil {
-        log.Printf("Failed to send push notification: %v", err)
-        return
-    }
-    defer resp.Body.Close()
+// formatAmount formats an amount for display, e.g. 12,500.5
+func formatAmount(amount float64) string {
+    return humanize.CommafWithDigits(amount, 2)
+}
 
-    if resp.StatusCode != http.StatusOK {
-        bodyBytes, _ := io.ReadAll(resp.Body)
-        log.Printf("Failed to send push notification, status: %d, response: %s", resp.StatusCode, string(bodyBytes))
-    } else {
-        log.Printf("Push notification sent successfully to %s", pushToken)
+// notifyUser renders a notification template in the user's language, saves it to the user's
+// notifications and queues it for push delivery.
+func notifyUser(user models.User, templateName string, data map[string]interface{}) {
+    if _, err := outbox.NotifyTemplate(user, templateName, data); err != nil {
+        log.Printf("Failed to send %s notification: %v", templateName, err)
     }
 }
@@ -0,0 +1,158 @@
+package payments
+
+import (
+    "context"
+    "log"
+    "mobile-customer-portal-server/daraja"
+    "mobile-customer-portal-server/gateway"
+    "mobile-customer-portal-server/models"
+    "mobile-customer-portal-server/utils"
+    "time"
+)
+
+// ReconcilerConfig controls how stale pending payments are checked with Daraja
+type ReconcilerConfig struct {
+    // Interval is how often pending payments are looked at
+    Interval time.Duration
+    // StaleAfter is how long a payment may wait for its callback before it is queried
+    StaleAfter time.Duration
+    // GiveUpAfter is how long a payment may stay unresolved before it is marked Timeout
+    GiveUpAfter time.Duration
+    // BatchSize caps the queries sent to Daraja per run
+    BatchSize int
+}
+
+// DefaultReconcilerConfig is used by StartReconciler
+var DefaultReconcilerConfig = ReconcilerConfig{
+    Interval:    time.Minute,
+    StaleAfter:  2 * time.Minute,
+    GiveUpAfter: time.Hour,
+    BatchSize:   50,
+}
+
+// StartReconciler periodically resolves payments whose callback never arrived. It runs until
+// ctx is cancelled.
+func StartReconciler(ctx context.Context) {
+    config := DefaultReconcilerConfig
+    go func() {
+        ticker := time.NewTicker(config.Interval)
+        defer ticker.Stop()
+
+        for {
+            select {
+            case <-ctx.Done():
+                return
+            case <-ticker.C:
+                if err := config.Reconcile(); err != nil {
+                    log.Printf("M-PESA reconciliation failed: %v", err)
+                }
+            }
+        }
+    }()
+}
+
+// Reconcile runs an STK push query for every M-PESA payment that has been pending longer than
+// StaleAfter and finalizes those Daraja has a result for, and asks the card provider about
+// card payments in the same way. Payments still unresolved after GiveUpAfter are marked
+// Timeout. Bank transfers stay pending until they are matched to a posted receipt.
+func (config ReconcilerConfig) Reconcile() error {
+    now := time.Now()
+
+    if daraja.Default.Configured() {
+        payments, err := config.stalePayments(models.PaymentMethodMpesa, now)
+        if err != nil {
+            return err
+        }
+        for _, payment := range payments {
+            config.reconcilePayment(payment, now)
+        }
+    }
+
+    if provider, err := gateway.Get(gateway.MethodCard); err == nil {
+        if checker, ok := provider.(gateway.StatusChecker); ok {
+            payments, err := config.stalePayments(models.PaymentMethodCard, now)
+            if err != nil {
+                return err
+            }
+            for _, payment := range payments {
+                config.reconcileCardPayment(checker, payment, now)
+            }
+        }
+    }
+    return nil
+}
+
+// stalePayments lists the pending payments of a method that are due a status query
+func (config ReconcilerConfig) stalePayments(method string, now time.Time) ([]models.MpesaPayment, error) {
+    var payments []models.MpesaPayment
+    err := utils.CustomerPortalDB.
+        Where("status = ? AND method = ? AND created_at <= ?", models.MpesaStatusPending, method, now.Add(-config.StaleAfter)).
+        Where("last_queried_at IS NULL OR last_queried_at <= ?", now.Add(-config.Interval)).
+        Order("created_at ASC").
+        Limit(config.BatchSize).
+        Find(&payments).Error
+    return payments, err
+}
+
+// reconcileCardPayment asks the card provider how a pending checkout ended and finalizes it
+func (config ReconcilerConfig) reconcileCardPayment(checker gateway.StatusChecker, payment models.MpesaPayment, now time.Time) {
+    markQueried(payment, now)
+
+    event, err := checker.Status(payment.CheckoutRequestID)
+    if err == nil && event.Status != gateway.StatusPending {
+        if _, err := finalizeProviderEvent(payment, *event, ""); err != nil {
+            log.Printf("Failed to reconcile card payment %s: %v", payment.CheckoutRequestID, err)
+        }
+        return
+    }
+    if err != nil {
+        log.Printf("Card status query for %s failed: %v", payment.CheckoutRequestID, err)
+    }
+
+    if now.Sub(payment.CreatedAt) >= config.GiveUpAfter {
+        // The customer never finished the checkout
+        if _, err := finalizePayment(payment, models.MpesaStatusTimeout, paymentOutcome{
+            ResultDesc: "Card checkout was not completed",
+        }); err != nil {
+            log.Printf("Failed to time out card payment %s: %v", payment.CheckoutRequestID, err)
+        }
+    }
+}
+
+// reconcilePayment queries and, where possible, finalizes a single pending payment
+func (config ReconcilerConfig) reconcilePayment(payment models.MpesaPayment, now time.Time) {
+    markQueried(payment, now)
+
+    response, err := daraja.Default.STKPushQuery(payment.CheckoutRequestID)
+    if err != nil {
+        if now.Sub(payment.CreatedAt) < config.GiveUpAfter {
+            if !daraja.IsStillProcessing(err) {
+                log.Printf("STK query for %s failed: %v", payment.CheckoutRequestID, err)
+            }
+            return
+        }
+
+        // No callback and no answer from Daraja for too long; stop waiting
+        if _, err := finalizePayment(payment, models.MpesaStatusTimeout, paymentOutcome{
+            ResultDesc: "No result received from M-PESA",
+        }); err != nil {
+            log.Printf("Failed to time out M-PESA payment %s: %v", payment.CheckoutRequestID, err)
+        }
+        return
+    }
+
+    resultCode, err := response.Code()
+    if err != nil {
+        log.Printf("STK query for %s: %v", payment.CheckoutRequestID, err)
+        return
+    }
+
+    // The query does not return the receipt metadata; a callback arriving later fills it in
+    if _, err := finalizePayment(payment, statusForResultCode(resultCode), paymentOutcome{
+        ResultCode:        &resultCode,
+        ResultDesc:        response.ResultDesc,
+        MerchantRequestID: response.MerchantRequestID,
+    }); err != nil {
+        log.Printf("Failed to reconcile M-PESA payment %s: %v", payment.CheckoutRequestID, err)
+    }
+}
@@ -0,0 +1,55 @@
+package payments
+
+import (
+    "encoding/json"
+    "mobile-customer-portal-server/models"
+    "mobile-customer-portal-server/utils"
+    "net/http"
+
+    "github.com/gin-gonic/gin"
+)
+
+// GetPaymentStatus lets the app poll the status of one of the user's payments, by STK
+// CheckoutRequestID, card checkout session or bank transfer reference
+func GetPaymentStatus(c *gin.Context) {
+    userInterface, exists := c.Get("user")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+        return
+    }
+    user := userInterface.(models.User)
+
+    var payment models.MpesaPayment
+    if err := utils.CustomerPortalDB.
+        Where("checkout_request_id = ? AND customer_number = ?", c.Param("checkout_request_id"), user.CustomerNumber).
+        First(&payment).Error; err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Payment not found"})
+        return
+    }
+
+    // Bank transfers keep the details the customer needs to pay until the transfer is posted
+    var instructions interface{}
+    if payment.Instructions != "" {
+        instructions = json.RawMessage(payment.Instructions)
+    }
+
+    c.JSON(http.StatusOK, gin.H{
+        "checkout_request_id":  payment.CheckoutRequestID,
+        "method":               payment.Method,
+        "instructions":         instructions,
+        "status":               payment.Status,
+        "result_code":          payment.ResultCode,
+        "result_desc":          payment.ResultDesc,
+        "amount":               payment.Amount,
+        "amount_paid":          payment.AmountPaid,
+        "currency":             payment.Currency,
+        "original_amount":      payment.OriginalAmount,
+        "exchange_rate":        payment.ExchangeRate,
+        "mpesa_receipt_number": payment.MpesaReceiptNumber,
+        "transaction_date":     payment.TransactionDate,
+        "plot_number":          payment.PlotNumber,
+        "allocations":          allocationsOrEmpty(paymentAllocations([]models.MpesaPayment{payment})[payment.ID]),
+        "created_at":           payment.CreatedAt,
+        "updated_at":           payment.UpdatedAt,
+    })
+}
@@ -0,0 +1,83 @@
+package payments
+
+import (
+    "errors"
+    "math"
+    "mobile-customer-portal-server/models"
+    "mobile-customer-portal-server/utils"
+    "strconv"
+
+    "gorm.io/gorm"
+)
+
+// Errors returned by resolvePaymentTarget for requests that are not the customer's to make
+var (
+    errPropertyNotFound   = errors.New("property not found, does not belong to the user, or is dropped")
+    errLeadFileRequired   = errors.New("lead file number is required")
+    errInvalidInstallment = errors.New("invalid installment schedule ID")
+)
+
+// paymentTarget is what a payment is for, as verified against the CRM
+type paymentTarget struct {
+    LeadFile    models.LeadFile
+    Installment *models.InstallmentSchedule
+    // Outstanding is the most the customer can pay without overpaying
+    Outstanding float64
+}
+
+// resolvePaymentTarget checks that the lead file (or, for older clients, the plot) and the
+// optional installment belong to the customer, and works out how much is still outstanding
+func resolvePaymentTarget(customerNumber, leadFileNo, plotNumber, installmentScheduleID string) (*paymentTarget, error) {
+    query := utils.CRMDB.Where("customer_id = ? AND lead_file_status_dropped = ?", customerNumber, "No")
+    switch {
+    case leadFileNo != "":
+        query = query.Where("lead_file_no = ?", leadFileNo)
+    case plotNumber != "":
+        query = query.Where("plot_number = ?", plotNumber)
+    default:
+        return nil, errLeadFileRequired
+    }
+
+    var target paymentTarget
+    if err := query.First(&target.LeadFile).Error; err != nil {
+        if errors.Is(err, gorm.ErrRecordNotFound) {
+            return nil, errPropertyNotFound
+        }
+        return nil, err
+    }
+
+    if plotNumber != "" && plotNumber != target.LeadFile.PlotNumber {
+        return nil, errPropertyNotFound
+    }
+
+    target.Outstanding = target.LeadFile.BalanceLCY
+
+    if installmentScheduleID != "" {
+        id, err := strconv.Atoi(installmentScheduleID)
+        if err != nil {
+            return nil, errInvalidInstallment
+        }
+
+        var installment models.InstallmentSchedule
+        if err := utils.CRMDB.
+            Where("IS_id = ? AND member_no = ? AND leadfile_no = ?", id, customerNumber, target.LeadFile.LeadFileNo).
+            First(&installment).Error; err != nil {
+            if errors.Is(err, gorm.ErrRecordNotFound) {
+                return nil, errPropertyNotFound
+            }
+            return nil, err
+        }
+        target.Installment = &installment
+
+        // An installment is capped at what is left of it, and never more than the plot's balance
+        target.Outstanding = math.Min(installmentOutstanding(installment), target.LeadFile.BalanceLCY)
+    }
+
+    target.Outstanding = math.Max(target.Outstanding, 0)
+    return &target, nil
+}
+
+// installmentOutstanding is what is left to pay on an installment
+func installmentOutstanding(installment models.InstallmentSchedule) float64 {
+    return installment.Outstanding()
+}
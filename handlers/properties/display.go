@@ -0,0 +1,141 @@
+package properties
+
+import (
+    "errors"
+    "log"
+    "net/http"
+    "strings"
+
+    "github.com/gin-gonic/gin"
+
+    "mobile-customer-portal-server/currency"
+    "mobile-customer-portal-server/models"
+)
+
+// propertyView is a lead file with its amounts in the customer's display currency
+type propertyView struct {
+    models.LeadFile
+    Display *propertyAmounts `json:"display,omitempty"`
+}
+
+type propertyAmounts struct {
+    Currency      string  `json:"currency"`
+    Balance       float64 `json:"balance"`
+    PurchasePrice float64 `json:"purchase_price"`
+    TotalPaid     float64 `json:"total_paid"`
+}
+
+// scheduleView is an installment with its amounts in the customer's display currency
+type scheduleView struct {
+    models.InstallmentSchedule
+    Display *scheduleAmounts `json:"display,omitempty"`
+}
+
+type scheduleAmounts struct {
+    Currency          string  `json:"currency"`
+    InstallmentAmount float64 `json:"installment_amount"`
+    RemainingAmount   float64 `json:"remaining_amount"`
+    AmountPaid        float64 `json:"amount_paid"`
+    PenaltiesAccrued  float64 `json:"penalties_accrued"`
+}
+
+// receiptView is a receipt with its amount in the customer's display currency
+type receiptView struct {
+    models.Receipt
+    Display *receiptAmounts `json:"display,omitempty"`
+}
+
+type receiptAmounts struct {
+    Currency string  `json:"currency"`
+    Amount   float64 `json:"amount"`
+}
+
+// displayQuote returns the rate for the currency the customer wants amounts shown in: the
+// currency query parameter, else their saved preference. It returns nil when amounts are only
+// to be shown in KES. An unsupported currency in the query is an error; a preference whose rate
+// has gone away falls back to KES.
+func displayQuote(c *gin.Context, user models.User) (*currency.Quote, error) {
+    code := strings.TrimSpace(c.Query("currency"))
+    fromQuery := code != ""
+    if !fromQuery {
+        code = user.DisplayCurrency
+    }
+    if code == "" || currency.Normalize(code) == currency.Base {
+        return nil, nil
+    }
+
+    quote, err := currency.Default.Quote(code)
+    if err != nil {
+        if fromQuery && errors.Is(err, currency.ErrUnsupported) {
+            return nil, err
+        }
+        log.Printf("Showing amounts in %s, no rate for %q: %v", currency.Base, code, err)
+        return nil, nil
+    }
+    return &quote, nil
+}
+
+// displayQuoteOrAbort is displayQuote for handlers; it writes the error response and returns
+// false for an unsupported currency
+func displayQuoteOrAbort(c *gin.Context, user models.User) (*currency.Quote, bool) {
+    quote, err := displayQuote(c, user)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported currency"})
+        return nil, false
+    }
+    return quote, true
+}
+
+func propertyViews(leadFiles []models.LeadFile, quote *currency.Quote) []propertyView {
+    views := make([]propertyView, 0, len(leadFiles))
+    for _, leadFile := range leadFiles {
+        view := propertyView{LeadFile: leadFile}
+        if quote != nil {
+            view.Display = &propertyAmounts{
+                Currency:      quote.Currency,
+                Balance:       quote.FromBase(leadFile.BalanceLCY),
+                PurchasePrice: quote.FromBase(leadFile.PurchasePrice),
+                TotalPaid:     quote.FromBase(leadFile.TotalPaid),
+            }
+        }
+        views = append(views, view)
+    }
+    return views
+}
+
+func scheduleViews(schedules []models.InstallmentSchedule, quote *currency.Quote) []scheduleView {
+    views := make([]scheduleView, 0, len(schedules))
+    for _, schedule := range schedules {
+        view := scheduleView{InstallmentSchedule: schedule}
+        if quote != nil {
+            view.Display = &scheduleAmounts{
+                Currency:          quote.Currency,
+                InstallmentAmount: quote.FromBase(parseFloat(schedule.InstallmentAmount)),
+                RemainingAmount:   quote.FromBase(parseFloat(schedule.RemainingAmount)),
+                AmountPaid:        quote.FromBase(parseFloat(schedule.AmountPaid)),
+                PenaltiesAccrued:  quote.FromBase(float64(schedule.PenaltiesAccrued)),
+            }
+        }
+        views = append(views, view)
+    }
+    return views
+}
+
+func receiptViews(receipts []models.Receipt, quote *currency.Quote) []receiptView {
+    views := make([]receiptView, 0, len(receipts))
+    for _, receipt := range receipts {
+        view := receiptView{Receipt: receipt}
+        if quote != nil {
+            view.Display = &receiptAmounts{Currency: quote.Currency, Amount: quote.FromBase(receipt.AmountLCY)}
+        }
+        views = append(views, view)
+    }
+    return views
+}
+
+// rateNote explains the conversion on PDFs shown in another currency
+func rateNote(quote currency.Quote) string {
+    return "Amounts in " + quote.Currency + " at 1 " + quote.Currency + " = " +
+        currency.Format(quote.Rate, currency.Base) + " as of " + quote.AsOf.Format("02 Jan 2006 15:04") +
+        ". KES is the currency of record."
+}
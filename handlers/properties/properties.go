@@ -15,6 +15,7 @@ import (
 	"golang.org/x/text/cases"
 	"golang.org/x/text/language"
 
+	"mobile-customer-portal-server/currency"
 	"mobile-customer-portal-server/models"
 	"mobile-customer-portal-server/utils"
 )
@@ -88,8 +89,15 @@ func GetProperties(c *gin.Context) {
         return
     }
 
+    quote, ok := displayQuoteOrAbort(c, user)
+    if !ok {
+        return
+    }
+
     c.JSON(http.StatusOK, gin.H{
-        "properties": leadFiles,
+        "properties":    propertyViews(leadFiles, quote),
+        // The rate amounts under "display" were converted at, null when they are only in KES
+        "exchange_rate": quote,
     })
 }
 
@@ -127,8 +135,14 @@ func GetInstallmentSchedule(c *gin.Context) {
         return
     }
 
+    quote, ok := displayQuoteOrAbort(c, user)
+    if !ok {
+        return
+    }
+
     c.JSON(http.StatusOK, gin.H{
-        "installment_schedules": schedules,
+        "installment_schedules": scheduleViews(schedules, quote),
+        "exchange_rate":         quote,
     })
 }
 
@@ -172,6 +186,18 @@ func GetInstallmentSchedulePDF(c *gin.Context) {
         return
     }
 
+    quote, ok := displayQuoteOrAbort(c, user)
+    if !ok {
+        return
+    }
+    // Amounts are in KES unless the customer asked for another currency
+    convert := func(amount float64) float64 { return amount }
+    amountCurrency := currency.Base
+    if quote != nil {
+        convert = quote.FromBase
+        amountCurrency = quote.Currency
+    }
+
     // Generate the PDF
     pdf := gofpdf.New("P", "mm", "A4", "")
     pdf.SetMargins(15, 20, 15)
@@ -191,6 +217,12 @@ func GetInstallmentSchedulePDF(c *gin.Context) {
     pdf.CellFormat(0, 8, "Customer Number: "+user.CustomerNumber, "", 1, "", false, 0, "")
     pdf.CellFormat(0, 8, "Property: "+leadFile.PlotNumber, "", 1, "", false, 0, "")
     pdf.CellFormat(0, 8, "Date: "+time.Now().Format("02 January 2006"), "", 1, "", false, 0, "")
+    pdf.CellFormat(0, 8, "Currency: "+amountCurrency, "", 1, "", false, 0, "")
+    if quote != nil {
+        pdf.SetFont("Helvetica", "I", 9)
+        pdf.MultiCell(0, 5, rateNote(*quote), "", "L", false)
+        pdf.SetFont("Helvetica", "", 12)
+    }
     pdf.Ln(5)
 
     // Table Headers
@@ -227,19 +259,19 @@ func GetInstallmentSchedulePDF(c *gin.Context) {
 
         // Installment Amount
         installmentAmount := parseFloat(schedule.InstallmentAmount)
-        pdf.CellFormat(widths[2], 8, formatAmount(installmentAmount), "1", 0, "R", true, 0, "")
+        pdf.CellFormat(widths[2], 8, formatAmount(convert(installmentAmount)), "1", 0, "R", true, 0, "")
 
         // Remaining Amount
         remainingAmount := parseFloat(schedule.RemainingAmount)
-        pdf.CellFormat(widths[3], 8, formatAmount(remainingAmount), "1", 0, "R", true, 0, "")
+        pdf.CellFormat(widths[3], 8, formatAmount(convert(remainingAmount)), "1", 0, "R", true, 0, "")
 
         // Amount Paid
         amountPaid := parseFloat(schedule.AmountPaid)
-        pdf.CellFormat(widths[4], 8, formatAmount(amountPaid), "1", 0, "R", true, 0, "")
+        pdf.CellFormat(widths[4], 8, formatAmount(convert(amountPaid)), "1", 0, "R", true, 0, "")
 
         // Penalties Accrued
         penaltiesAccrued := float64(schedule.PenaltiesAccrued)
-        pdf.CellFormat(widths[5], 8, formatAmount(penaltiesAccrued), "1", 0, "R", true, 0, "")
+        pdf.CellFormat(widths[5], 8, formatAmount(convert(penaltiesAccrued)), "1", 0, "R", true, 0, "")
 
         // Paid Status
         paidStatus := cases.Title(language.English).String(schedule.Paid)
@@ -299,6 +331,11 @@ func GetTransactions(c *gin.Context) {
     }
     
 
+    quote, ok := displayQuoteOrAbort(c, user)
+    if !ok {
+        return
+    }
+
     // Map the receipts data to transactions
     var transactions []map[string]interface{}
     for _, receipt := range receipts {
@@ -333,11 +370,16 @@ func GetTransactions(c *gin.Context) {
             "amount": receipt.AmountLCY,
             "time":   timeStr,
         }
+        if quote != nil {
+            transaction["display_amount"] = quote.FromBase(receipt.AmountLCY)
+            transaction["display_currency"] = quote.Currency
+        }
         transactions = append(transactions, transaction)
     }
 
     c.JSON(http.StatusOK, gin.H{
-        "transactions": transactions,
+        "transactions":  transactions,
+        "exchange_rate": quote,
     })
 }
 
@@ -427,8 +469,14 @@ func GetUserPropertiesByProject(c *gin.Context) {
         return
     }
 
+    quote, ok := displayQuoteOrAbort(c, user)
+    if !ok {
+        return
+    }
+
     c.JSON(http.StatusOK, gin.H{
-        "properties": leadFiles,
+        "properties":    propertyViews(leadFiles, quote),
+        "exchange_rate": quote,
     })
 }
 
@@ -463,11 +511,81 @@ func GetReceiptsByProperty(c *gin.Context) {
         return
     }
 
+    quote, ok := displayQuoteOrAbort(c, user)
+    if !ok {
+        return
+    }
+
     c.JSON(http.StatusOK, gin.H{
-        "receipts": receipts,
+        "receipts":      receiptViews(receipts, quote),
+        "exchange_rate": quote,
+        // The part of an app payment each of these receipts was posted for, keyed by receipt ID
+        "allocations": receiptAllocations(receipts),
     })
 }
 
+// receiptAllocations looks up the part of an app payment each receipt was posted for, keyed by
+// receipt ID. A split payment is matched one allocation at a time, so a receipt normally has a
+// single allocation; a payment matched as a whole before that contributes its allocations for
+// the receipt's property.
+func receiptAllocations(receipts []models.Receipt) map[int][]models.PaymentAllocation {
+    found := map[int][]models.PaymentAllocation{}
+    if len(receipts) == 0 {
+        return found
+    }
+
+    receiptIDs := make([]int, 0, len(receipts))
+    leadFiles := map[int]string{}
+    for _, receipt := range receipts {
+        receiptIDs = append(receiptIDs, receipt.ID)
+        leadFiles[receipt.ID] = receipt.LeadFileNo
+    }
+
+    var matches []models.PaymentReceiptMatch
+    if err := utils.CustomerPortalDB.Where("receipt_id IN ?", receiptIDs).Find(&matches).Error; err != nil || len(matches) == 0 {
+        return found
+    }
+
+    receiptByAllocation := map[uint]int{}
+    receiptByPayment := map[uint]int{}
+    allocationIDs := []uint{}
+    paymentIDs := []uint{}
+    for _, match := range matches {
+        if match.PaymentAllocationID != 0 {
+            receiptByAllocation[match.PaymentAllocationID] = match.ReceiptID
+            allocationIDs = append(allocationIDs, match.PaymentAllocationID)
+        } else {
+            receiptByPayment[match.MpesaPaymentID] = match.ReceiptID
+            paymentIDs = append(paymentIDs, match.MpesaPaymentID)
+        }
+    }
+
+    query := utils.CustomerPortalDB.Where("id IN ?", allocationIDs)
+    if len(allocationIDs) == 0 {
+        query = utils.CustomerPortalDB.Where("mpesa_payment_id IN ?", paymentIDs)
+    } else if len(paymentIDs) > 0 {
+        query = query.Or("mpesa_payment_id IN ?", paymentIDs)
+    }
+
+    var allocations []models.PaymentAllocation
+    if err := query.Order("id ASC").Find(&allocations).Error; err != nil {
+        return found
+    }
+
+    for _, allocation := range allocations {
+        if receiptID, ok := receiptByAllocation[allocation.ID]; ok {
+            found[receiptID] = append(found[receiptID], allocation)
+            continue
+        }
+        receiptID, ok := receiptByPayment[allocation.MpesaPaymentID]
+        if !ok || !strings.EqualFold(allocation.LeadFileNo, leadFiles[receiptID]) {
+            continue
+        }
+        found[receiptID] = append(found[receiptID], allocation)
+    }
+    return found
+}
+
 func GetUserTotalSpent(c *gin.Context) {
     // Get the user from the context
     userInterface, exists := c.Get("user")
@@ -508,9 +626,20 @@ func GetUserTotalSpent(c *gin.Context) {
         totalSpent += amount
     }
 
-    c.JSON(http.StatusOK, gin.H{
-        "total_spent": totalSpent,
-    })
+    quote, ok := displayQuoteOrAbort(c, user)
+    if !ok {
+        return
+    }
+
+    response := gin.H{
+        "total_spent":   totalSpent,
+        "exchange_rate": quote,
+    }
+    if quote != nil {
+        response["display_total_spent"] = quote.FromBase(totalSpent)
+        response["display_currency"] = quote.Currency
+    }
+    c.JSON(http.StatusOK, response)
 }
 
 func GetFeaturedProjects(c *gin.Context) {
@@ -655,7 +784,15 @@ func GetReceiptPDF(c *gin.Context) {
         {"Date:", datePosted},
         {"Customer:", user.CustomerNumber},
         {"Property:", leadFile.PlotNumber},
-        {"Amount:", "KES " + formatAmount(receipt.AmountLCY)},
+        {"Amount:", currency.Format(receipt.AmountLCY, currency.Base)},
+    }
+    // The receipt stays in KES; a customer who chose another currency also sees what it came to
+    if quote, err := displayQuote(c, user); err == nil && quote != nil {
+        data = append(data, []string{
+            "Equivalent:",
+            currency.Format(quote.FromBase(receipt.AmountLCY), quote.Currency) +
+                " (1 " + quote.Currency + " = " + currency.Format(quote.Rate, currency.Base) + ")",
+        })
     }
 
     // Set column widths
@@ -676,6 +813,34 @@ func GetReceiptPDF(c *gin.Context) {
     }
     pdf.Ln(10)
 
+    // Show how the payment was split when it was made through the app
+    if allocations := receiptAllocations([]models.Receipt{receipt})[receipt.ID]; len(allocations) > 0 {
+        pdf.SetFont("Helvetica", "B", 12)
+        pdf.CellFormat(0, 8, "Allocation", "", 1, "L", false, 0, "")
+
+        allocationWidths := []float64{60, 60, 60}
+        pdf.SetFillColor(240, 240, 240)
+        for i, header := range []string{"Property", "Installment", "Amount"} {
+            pdf.CellFormat(allocationWidths[i], 8, header, "1", 0, "C", true, 0, "")
+        }
+        pdf.Ln(-1)
+
+        pdf.SetFont("Helvetica", "", 11)
+        for _, allocation := range allocations {
+            installment := "Balance"
+            if allocation.InstallmentNo != nil {
+                installment = fmt.Sprintf("No. %d", *allocation.InstallmentNo)
+                if allocation.DueDate != nil {
+                    installment += " (" + allocation.DueDate.Format("02 Jan 2006") + ")"
+                }
+            }
+            pdf.CellFormat(allocationWidths[0], 8, allocation.PlotNumber, "1", 0, "L", false, 0, "")
+            pdf.CellFormat(allocationWidths[1], 8, installment, "1", 0, "L", false, 0, "")
+            pdf.CellFormat(allocationWidths[2], 8, currency.Format(allocation.Amount, currency.Base), "1", 1, "R", false, 0, "")
+        }
+        pdf.Ln(10)
+    }
+
     // Thank you message
     pdf.SetFont("Helvetica", "I", 12)
     pdf.MultiCell(0, 8, "Thank you for your payment. If you have any questions, please contact our customer service.", "", "C", false)
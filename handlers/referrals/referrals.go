@@ -1,11 +1,13 @@
 package referrals
 
 import (
+	"log"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
 
 	"mobile-customer-portal-server/models"
+	"mobile-customer-portal-server/outbox"
 	"mobile-customer-portal-server/utils"
 )
 
@@ -33,6 +35,8 @@ func SubmitReferral(c *gin.Context) {
 			return
 	}
 
+	notifyReferrer(user, "referral_submitted", referral)
+
 	c.JSON(http.StatusOK, gin.H{"message": "Referral submitted successfully"})
 }
 
@@ -70,5 +74,21 @@ func RedeemReferralReward(c *gin.Context) {
 			return
 	}
 
+	var referrer models.User
+	if err := utils.CustomerPortalDB.Where("customer_number = ?", referral.ReferrerID).First(&referrer).Error; err == nil {
+		notifyReferrer(referrer, "referral_redeemed", referral)
+	}
+
 	c.JSON(http.StatusOK, gin.H{"message": "Reward redeemed successfully"})
+}
+
+// notifyReferrer tells the customer who made a referral how it is getting on. The notification
+// links to the referral, so it is filed under referrals.
+func notifyReferrer(user models.User, templateName string, referral models.Referral) {
+	if _, err := outbox.NotifyTemplate(user, templateName, map[string]interface{}{
+		"ReferredName": referral.ReferredName,
+		"referral_id":  referral.ID,
+	}); err != nil {
+		log.Printf("Failed to send %s notification: %v", templateName, err)
+	}
 }
\ No newline at end of file
@@ -1,18 +1,26 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
+	"strings"
 	"time"
 
+	"mobile-customer-portal-server/currency"
+	"mobile-customer-portal-server/daraja"
+	"mobile-customer-portal-server/gateway"
 	"mobile-customer-portal-server/handlers/auth"
 	"mobile-customer-portal-server/handlers/campaigns"
 	"mobile-customer-portal-server/handlers/notifications"
 	"mobile-customer-portal-server/handlers/payments"
 	"mobile-customer-portal-server/handlers/properties"
 	"mobile-customer-portal-server/handlers/referrals"
+	"mobile-customer-portal-server/messaging"
 	"mobile-customer-portal-server/migrations"
 	"mobile-customer-portal-server/models"
+	"mobile-customer-portal-server/outbox"
+	"mobile-customer-portal-server/reminders"
 	"mobile-customer-portal-server/seed"
 	"mobile-customer-portal-server/utils"
 
@@ -30,6 +38,14 @@ func init() {
 func main() {
     r := gin.Default()
 
+    // Only honour X-Forwarded-For from our own proxies, so client IPs used for rate limiting
+    // and the M-PESA callback allowlist cannot be spoofed
+    if proxies := os.Getenv("TRUSTED_PROXIES"); proxies != "" {
+        if err := r.SetTrustedProxies(strings.Split(proxies, ",")); err != nil {
+            log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+        }
+    }
+
     r.Use(cors.New(cors.Config{
 			AllowOrigins:     []string{"https://optivenconnect.optiven.co.ke"},
 			AllowMethods:     []string{"GET", "POST", "PUT", "DELETE"},
@@ -40,10 +56,50 @@ func main() {
 	}))
 	
 
+    utils.RequireJWTSecret()
     utils.ConnectDatabase()
+    messaging.Setup()
+    if err := daraja.Setup(); err != nil {
+        log.Fatalf("Failed to configure Daraja: %v", err)
+    }
+    gateway.Setup()
+    currency.Setup()
+    // Tell M-PESA where to send paybill payments; a failure is not fatal as the URLs registered
+    // last time stay in place
+    if os.Getenv("DARAJA_C2B_URL") != "" {
+        if err := payments.RegisterC2BURLs(); err != nil {
+            log.Printf("Failed to register C2B URLs: %v", err)
+        }
+    }
 
     migrations.MigrateNotifications()
     migrations.MigrateCampaigns()
+    migrations.MigrateRefreshTokens()
+    migrations.MigrateSessions()
+    migrations.MigrateOTPCodes()
+    migrations.MigrateRegistrationChallenges()
+    migrations.MigrateOutbox()
+    migrations.MigratePushTickets()
+    migrations.MigrateDeviceTokens()
+    migrations.MigratePaymentMatches()
+    migrations.MigratePaymentAllocations()
+    migrations.MigratePaymentMandates()
+    migrations.MigrateInstallmentReminders()
+
+    // Deliver queued push, email and WhatsApp messages and collect push receipts in the background
+    outbox.Start(context.Background())
+
+    // Resolve M-PESA payments whose callback never arrived
+    payments.StartReconciler(context.Background())
+
+    // Link successful payments to the receipts finance posts and tell customers when they are posted
+    payments.StartMatcher(context.Background())
+
+    // Send the STK pushes customers' standing orders are due ahead of each installment
+    payments.StartMandateScheduler(context.Background())
+
+    // Remind customers of installments coming due and overdue
+    reminders.Start(context.Background())
 
     // Seed Initial Data
     if err := seed.SeedCampaign(); err != nil {
@@ -53,13 +109,19 @@ func main() {
     // Routes setup remains the same
     r.POST("/login", auth.Login)
     r.POST("/logout", auth.AuthMiddleware(), auth.Logout)
+    r.POST("/token/refresh", auth.RefreshToken)
     r.POST("/verify-user", auth.VerifyUser)
     r.POST("/verify-otp", auth.VerifyOTP)
     r.POST("/complete-registration", auth.CompleteRegistration)
     r.POST("/request-otp", auth.RequestOTP)
     r.POST("/verify-otp-reset", auth.VerifyOTPReset)
     r.POST("/reset-password", auth.ResetPassword)
-    r.POST("/mpesa/callback", payments.MpesaCallback)
+    r.POST("/mpesa/callback/:token", payments.CallbackIPAllowlist(), payments.MpesaCallback)
+    // Payments started before callback URLs carried a token are still called back here
+    r.POST("/mpesa/callback", payments.CallbackIPAllowlist(), payments.MpesaCallback)
+    r.POST("/c2b/validation/:token", payments.CallbackIPAllowlist(), payments.C2BValidation)
+    r.POST("/c2b/confirmation/:token", payments.CallbackIPAllowlist(), payments.C2BConfirmation)
+    r.POST("/payments/card/webhook", payments.CardWebhook)
 
     protected := r.Group("/")
     protected.Use(auth.AuthMiddleware())
@@ -73,7 +135,23 @@ func main() {
         protected.GET("/projects/:project_id/properties", properties.GetUserPropertiesByProject)
         protected.GET("/properties/:lead_file_no/receipts", properties.GetReceiptsByProperty)
         protected.POST("/save-push-token", auth.SavePushToken)
+        protected.POST("/unregister-push-token", auth.UnregisterPushToken)
+        protected.GET("/user/preferences", auth.GetPreferences)
+        protected.PUT("/user/preferences", auth.UpdatePreferences)
+        protected.GET("/sessions", auth.GetSessions)
+        protected.DELETE("/sessions/:id", auth.RevokeSession)
+        protected.POST("/sessions/revoke-others", auth.RevokeOtherSessions)
         protected.POST("/initiate-mpesa-payment", payments.InitiateMpesaPayment)
+        protected.POST("/payments", payments.InitiatePayment)
+        protected.GET("/payment-methods", payments.GetPaymentMethods)
+        protected.GET("/payments", payments.GetPayments)
+        protected.GET("/payments/:checkout_request_id/status", payments.GetPaymentStatus)
+        protected.GET("/properties/:lead_file_no/payments", payments.GetPropertyPayments)
+        protected.POST("/mandates", payments.CreateMandate)
+        protected.GET("/mandates", payments.GetMandates)
+        protected.POST("/mandates/:id/pause", payments.PauseMandate)
+        protected.POST("/mandates/:id/resume", payments.ResumeMandate)
+        protected.DELETE("/mandates/:id", payments.CancelMandate)
         protected.GET("/user/total-spent", properties.GetUserTotalSpent)
         protected.POST("/referrals", referrals.SubmitReferral)
         protected.GET("/referrals", referrals.GetUserReferrals)
@@ -0,0 +1,170 @@
+package messaging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// defaultExpoURL is the Expo push service
+const defaultExpoURL = "https://exp.host"
+
+// ExpoMessenger sends push notifications through the Expo push API
+type ExpoMessenger struct {
+	BaseURL     string
+	AccessToken string
+	Client      *http.Client
+}
+
+// NewExpoMessengerFromEnv configures an ExpoMessenger from EXPO_BASE_URL (default https://exp.host)
+// and the optional EXPO_ACCESS_TOKEN
+func NewExpoMessengerFromEnv() *ExpoMessenger {
+	baseURL := os.Getenv("EXPO_BASE_URL")
+	if baseURL == "" {
+		baseURL = defaultExpoURL
+	}
+
+	return &ExpoMessenger{
+		BaseURL:     baseURL,
+		AccessToken: os.Getenv("EXPO_ACCESS_TOKEN"),
+		Client:      &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+// expoPushMessage is the body of a single push sent to Expo
+type expoPushMessage struct {
+	To    string                 `json:"to"`
+	Sound string                 `json:"sound"`
+	Title string                 `json:"title"`
+	Body  string                 `json:"body"`
+	Data  map[string]interface{} `json:"data,omitempty"`
+}
+
+// expoTicket is Expo's answer for a single push message
+type expoTicket struct {
+	Status  string `json:"status"`
+	ID      string `json:"id"`
+	Message string `json:"message"`
+	Details struct {
+		Error string `json:"error"`
+	} `json:"details"`
+}
+
+// ExpoError is returned when Expo rejects a push message. Code holds Expo's error code,
+// e.g. "DeviceNotRegistered".
+type ExpoError struct {
+	Code    string
+	Message string
+}
+
+func (e *ExpoError) Error() string {
+	return fmt.Sprintf("expo: %s: %s", e.Code, e.Message)
+}
+
+// post sends a JSON body to an Expo API path and returns the response body
+func (m *ExpoMessenger) post(path string, body interface{}) ([]byte, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", m.BaseURL+path, bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if m.AccessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+m.AccessToken)
+	}
+
+	resp, err := m.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("expo: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("expo: received status code %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	return respBody, nil
+}
+
+func (m *ExpoMessenger) Send(msg Message) (Result, error) {
+	respBody, err := m.post("/--/api/v2/push/send", expoPushMessage{
+		To:    msg.To,
+		Sound: "default",
+		Title: msg.Subject,
+		Body:  msg.Text,
+		Data:  msg.Data,
+	})
+	if err != nil {
+		return Result{}, err
+	}
+
+	var response struct {
+		Data expoTicket `json:"data"`
+	}
+	if err := json.Unmarshal(respBody, &response); err != nil {
+		return Result{}, fmt.Errorf("expo: decode ticket: %w", err)
+	}
+
+	if response.Data.Status != "ok" {
+		return Result{}, &ExpoError{Code: response.Data.Details.Error, Message: response.Data.Message}
+	}
+
+	return Result{ProviderID: response.Data.ID}, nil
+}
+
+// ExpoDeviceNotRegistered is the Expo error code for a push token that will never work again
+const ExpoDeviceNotRegistered = "DeviceNotRegistered"
+
+// ExpoReceipt is Expo's final word on a push ticket. Status is "ok" or "error"; on error,
+// Details.Error holds the code, e.g. "DeviceNotRegistered" or "MessageRateExceeded".
+type ExpoReceipt struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Details struct {
+		Error string `json:"error"`
+	} `json:"details"`
+}
+
+// ReceiptChecker is implemented by push transports that can look up delivery receipts
+type ReceiptChecker interface {
+	GetReceipts(ids []string) (map[string]ExpoReceipt, error)
+}
+
+// GetReceipts fetches the receipts for the given ticket IDs. Receipts that are not ready yet
+// are missing from the result.
+func (m *ExpoMessenger) GetReceipts(ids []string) (map[string]ExpoReceipt, error) {
+	respBody, err := m.post("/--/api/v2/push/getReceipts", map[string][]string{"ids": ids})
+	if err != nil {
+		return nil, err
+	}
+
+	var response struct {
+		Data map[string]ExpoReceipt `json:"data"`
+	}
+	if err := json.Unmarshal(respBody, &response); err != nil {
+		return nil, fmt.Errorf("expo: decode receipts: %w", err)
+	}
+
+	return response.Data, nil
+}
+
+// IsDeviceNotRegistered reports whether err is Expo telling us the push token is no longer valid
+func IsDeviceNotRegistered(err error) bool {
+	var expoErr *ExpoError
+	return errors.As(err, &expoErr) && expoErr.Code == ExpoDeviceNotRegistered
+}
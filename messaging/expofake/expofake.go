@@ -0,0 +1,211 @@
+// Package expofake is a stand-in for the Expo push API. It accepts pushes, hands out tickets
+// and answers receipt lookups, and can be told to reject particular tokens so that ticket
+// errors, receipt errors and DeviceNotRegistered cleanup can be exercised locally. Point
+// EXPO_BASE_URL at a running instance (see cmd/expofake) to use it with the server.
+package expofake
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// Push is a push notification the fake received
+type Push struct {
+	TicketID string                 `json:"ticket_id"`
+	To       string                 `json:"to"`
+	Title    string                 `json:"title"`
+	Body     string                 `json:"body"`
+	Data     map[string]interface{} `json:"data,omitempty"`
+}
+
+type pushMessage struct {
+	To    string                 `json:"to"`
+	Title string                 `json:"title"`
+	Body  string                 `json:"body"`
+	Data  map[string]interface{} `json:"data"`
+}
+
+type details struct {
+	Error string `json:"error,omitempty"`
+}
+
+type ticket struct {
+	Status  string   `json:"status"`
+	ID      string   `json:"id,omitempty"`
+	Message string   `json:"message,omitempty"`
+	Details *details `json:"details,omitempty"`
+}
+
+type receipt struct {
+	Status  string   `json:"status"`
+	Message string   `json:"message,omitempty"`
+	Details *details `json:"details,omitempty"`
+}
+
+// Server is an http.Handler implementing the Expo push send and getReceipts endpoints
+type Server struct {
+	mu           sync.Mutex
+	seq          int
+	pushes       []Push
+	tickets      map[string]string // ticket ID -> push token
+	ticketErrors map[string]string // push token -> error code returned on the ticket
+	receiptErrs  map[string]string // push token -> error code returned on the receipt
+	held         map[string]bool   // push token -> receipts are not ready yet
+}
+
+// New creates an empty fake Expo server
+func New() *Server {
+	return &Server{
+		tickets:      map[string]string{},
+		ticketErrors: map[string]string{},
+		receiptErrs:  map[string]string{},
+		held:         map[string]bool{},
+	}
+}
+
+// Unregister makes receipts for token report DeviceNotRegistered, as Expo does once an app
+// has been uninstalled
+func (s *Server) Unregister(token string) {
+	s.FailReceipts(token, "DeviceNotRegistered")
+}
+
+// FailTickets makes pushes to token be rejected immediately with the given error code
+func (s *Server) FailTickets(token, code string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ticketErrors[token] = code
+}
+
+// FailReceipts makes pushes to token be accepted but report the given error code in their receipts
+func (s *Server) FailReceipts(token, code string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.receiptErrs[token] = code
+}
+
+// HoldReceipts leaves receipts for pushes to token out of getReceipts responses, as Expo does
+// while a receipt is not ready yet, until ReleaseReceipts is called
+func (s *Server) HoldReceipts(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.held[token] = true
+}
+
+// ReleaseReceipts makes receipts for pushes to token available again
+func (s *Server) ReleaseReceipts(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.held, token)
+}
+
+// Pushes returns a copy of every push accepted so far
+func (s *Server) Pushes() []Push {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Push(nil), s.pushes...)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/--/api/v2/push/send":
+		s.send(w, r)
+	case "/--/api/v2/push/getReceipts":
+		s.receipts(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// send accepts either a single push message or an array of them, like Expo
+func (s *Server) send(w http.ResponseWriter, r *http.Request) {
+	var raw json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var messages []pushMessage
+	batch := len(raw) > 0 && raw[0] == '['
+	if batch {
+		if err := json.Unmarshal(raw, &messages); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		var msg pushMessage
+		if err := json.Unmarshal(raw, &msg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		messages = []pushMessage{msg}
+	}
+
+	s.mu.Lock()
+	tickets := make([]ticket, 0, len(messages))
+	for _, msg := range messages {
+		if code := s.ticketErrors[msg.To]; code != "" {
+			tickets = append(tickets, ticket{
+				Status:  "error",
+				Message: fmt.Sprintf("%q is not a registered push notification recipient", msg.To),
+				Details: &details{Error: code},
+			})
+			continue
+		}
+
+		s.seq++
+		id := fmt.Sprintf("fake-ticket-%d", s.seq)
+		s.tickets[id] = msg.To
+		s.pushes = append(s.pushes, Push{TicketID: id, To: msg.To, Title: msg.Title, Body: msg.Body, Data: msg.Data})
+		tickets = append(tickets, ticket{Status: "ok", ID: id})
+	}
+	s.mu.Unlock()
+
+	var data interface{} = tickets
+	if !batch {
+		data = tickets[0]
+	}
+	writeJSON(w, map[string]interface{}{"data": data})
+}
+
+func (s *Server) receipts(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		IDs []string `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	receipts := map[string]receipt{}
+	for _, id := range body.IDs {
+		token, ok := s.tickets[id]
+		if !ok || s.held[token] {
+			continue
+		}
+		if code := s.receiptErrs[token]; code != "" {
+			receipts[id] = receipt{
+				Status:  "error",
+				Message: fmt.Sprintf("%q is not a registered push notification recipient", token),
+				Details: &details{Error: code},
+			}
+			continue
+		}
+		receipts[id] = receipt{Status: "ok"}
+	}
+	s.mu.Unlock()
+
+	writeJSON(w, map[string]interface{}{"data": receipts})
+}
+
+func writeJSON(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,46 @@
+package messaging
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileMessenger writes each message as a JSON file into Dir instead of sending it. The files
+// hold OTPs in plain text, so only the server's user can read them.
+type FileMessenger struct {
+	Dir string
+
+	mu  sync.Mutex
+	seq int
+}
+
+// NewFileMessenger creates a FileMessenger writing into dir
+func NewFileMessenger(dir string) *FileMessenger {
+	return &FileMessenger{Dir: dir}
+}
+
+func (m *FileMessenger) Send(msg Message) (Result, error) {
+	m.mu.Lock()
+	m.seq++
+	id := fmt.Sprintf("%s-%s-%04d", time.Now().Format("20060102T150405.000"), msg.Channel, m.seq)
+	m.mu.Unlock()
+
+	if err := os.MkdirAll(m.Dir, 0o700); err != nil {
+		return Result{}, err
+	}
+
+	payload, err := json.MarshalIndent(msg, "", "  ")
+	if err != nil {
+		return Result{}, err
+	}
+
+	if err := os.WriteFile(filepath.Join(m.Dir, id+".json"), payload, 0o600); err != nil {
+		return Result{}, err
+	}
+
+	return Result{ProviderID: id}, nil
+}
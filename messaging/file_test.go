@@ -0,0 +1,61 @@
+package messaging
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileMessengerWritesPrivateFiles(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "messages")
+	messenger := NewFileMessenger(dir)
+
+	result, err := messenger.Send(Message{Channel: ChannelSMS, To: "254712345678", Text: "Your OTP code is: 123456"})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	path := filepath.Join(dir, result.ProviderID+".json")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0o600 {
+		t.Errorf("file mode = %v, want 0600", mode)
+	}
+	if info, err := os.Stat(dir); err != nil || info.Mode().Perm() != 0o700 {
+		t.Errorf("dir = %v, %v, want mode 0700", info, err)
+	}
+
+	payload, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg Message
+	if err := json.Unmarshal(payload, &msg); err != nil || msg.Text != "Your OTP code is: 123456" {
+		t.Fatalf("wrote %s (%v)", payload, err)
+	}
+}
+
+func TestSetupFileModeDefaultsOutsideTheSourceTree(t *testing.T) {
+	t.Setenv("MESSAGING_MODE", "file")
+	t.Setenv("MESSAGING_OUTBOX_DIR", "")
+	t.Cleanup(func() {
+		mu.Lock()
+		transports = map[Channel]Messenger{}
+		mu.Unlock()
+	})
+
+	Setup()
+
+	mu.RLock()
+	messenger, ok := transports[ChannelSMS].(*FileMessenger)
+	mu.RUnlock()
+	if !ok {
+		t.Fatalf("sms transport = %T, want *FileMessenger", transports[ChannelSMS])
+	}
+	if messenger.Dir != OutboxDir() || !filepath.IsAbs(messenger.Dir) {
+		t.Fatalf("dir = %q, want %q", messenger.Dir, OutboxDir())
+	}
+}
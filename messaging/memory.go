@@ -0,0 +1,75 @@
+package messaging
+
+import (
+	"fmt"
+	"sync"
+)
+
+// MemoryMessenger records messages instead of sending them, so tests and local runs can
+// inspect everything that would have gone out
+type MemoryMessenger struct {
+	mu       sync.Mutex
+	messages []Message
+	failing  map[Channel]error
+}
+
+// Memory is the shared in-memory transport registered when MESSAGING_MODE=memory
+var Memory = NewMemoryMessenger()
+
+// NewMemoryMessenger creates an empty MemoryMessenger
+func NewMemoryMessenger() *MemoryMessenger {
+	return &MemoryMessenger{failing: map[Channel]error{}}
+}
+
+func (m *MemoryMessenger) Send(msg Message) (Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failing[msg.Channel]; err != nil {
+		return Result{}, err
+	}
+
+	m.messages = append(m.messages, msg)
+	return Result{ProviderID: fmt.Sprintf("memory-%d", len(m.messages))}, nil
+}
+
+// Messages returns a copy of every message sent so far
+func (m *MemoryMessenger) Messages() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message(nil), m.messages...)
+}
+
+// Fail makes every send over channel return err until it is cleared with a nil error
+func (m *MemoryMessenger) Fail(channel Channel, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err == nil {
+		delete(m.failing, channel)
+		return
+	}
+	m.failing[channel] = err
+}
+
+// Reset forgets all recorded messages and failures
+func (m *MemoryMessenger) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = nil
+	m.failing = map[Channel]error{}
+}
+
+// GetReceipts reports every push the memory transport accepted as delivered
+func (m *MemoryMessenger) GetReceipts(ids []string) (map[string]ExpoReceipt, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	receipts := map[string]ExpoReceipt{}
+	for _, id := range ids {
+		var n int
+		if _, err := fmt.Sscanf(id, "memory-%d", &n); err == nil && n > 0 && n <= len(m.messages) {
+			receipts[id] = ExpoReceipt{Status: "ok"}
+		}
+	}
+	return receipts, nil
+}
@@ -0,0 +1,127 @@
+// Package messaging delivers outgoing messages (email, WhatsApp, SMS and push notifications)
+// through pluggable transports. Live transports talk to SMTP, Wati, the SMS gateway and Expo;
+// the memory and file transports keep everything local so flows can be exercised offline.
+package messaging
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Channel identifies how a message reaches the recipient
+type Channel string
+
+const (
+	ChannelEmail    Channel = "email"
+	ChannelWhatsApp Channel = "whatsapp"
+	ChannelSMS      Channel = "sms"
+	ChannelPush     Channel = "push"
+)
+
+// Message is a single outgoing message. To is an email address, a phone number in 2547XXXXXXXX
+// form, or an Expo push token depending on the channel.
+type Message struct {
+	Channel Channel                `json:"channel"`
+	To      string                 `json:"to"`
+	Subject string                 `json:"subject,omitempty"`
+	Text    string                 `json:"text"`
+	HTML    string                 `json:"html,omitempty"`
+	Data    map[string]interface{} `json:"data,omitempty"`
+}
+
+// Result carries what the provider told us about an accepted message
+type Result struct {
+	// ProviderID is the provider's reference for the message, e.g. an Expo push ticket ID
+	ProviderID string `json:"provider_id,omitempty"`
+}
+
+// Messenger sends messages over one or more channels
+type Messenger interface {
+	Send(msg Message) (Result, error)
+}
+
+// ErrNoTransport is returned when no messenger is registered for a message's channel
+var ErrNoTransport = errors.New("no transport registered for channel")
+
+var (
+	mu         sync.RWMutex
+	transports = map[Channel]Messenger{}
+)
+
+// Register sets the messenger used for a channel
+func Register(channel Channel, messenger Messenger) {
+	mu.Lock()
+	defer mu.Unlock()
+	transports[channel] = messenger
+}
+
+// Send delivers msg through the messenger registered for its channel
+func Send(msg Message) (Result, error) {
+	mu.RLock()
+	messenger, ok := transports[msg.Channel]
+	mu.RUnlock()
+
+	if !ok {
+		return Result{}, fmt.Errorf("%w: %s", ErrNoTransport, msg.Channel)
+	}
+	return messenger.Send(msg)
+}
+
+// Receipts looks up delivery receipts for push tickets through the registered push transport.
+// It returns ErrNoTransport when that transport cannot check receipts.
+func Receipts(ids []string) (map[string]ExpoReceipt, error) {
+	mu.RLock()
+	messenger := transports[ChannelPush]
+	mu.RUnlock()
+
+	checker, ok := messenger.(ReceiptChecker)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s receipts", ErrNoTransport, ChannelPush)
+	}
+	return checker.GetReceipts(ids)
+}
+
+// OutboxDir is where the file transport writes when MESSAGING_OUTBOX_DIR is not set. It is
+// outside the source tree, since the files hold OTPs and other message text in plain form.
+func OutboxDir() string {
+	return filepath.Join(os.TempDir(), "portal-messages")
+}
+
+// Setup registers transports for every channel according to MESSAGING_MODE:
+//
+//	live (default) - SMTP, Wati, SMS gateway and Expo, configured from the environment
+//	memory         - keep messages in memory; see Memory
+//	file           - write messages as JSON files under MESSAGING_OUTBOX_DIR (default OutboxDir)
+func Setup() {
+	mode := os.Getenv("MESSAGING_MODE")
+
+	switch mode {
+	case "memory":
+		for _, channel := range []Channel{ChannelEmail, ChannelWhatsApp, ChannelSMS, ChannelPush} {
+			Register(channel, Memory)
+		}
+	case "file":
+		dir := os.Getenv("MESSAGING_OUTBOX_DIR")
+		if dir == "" {
+			dir = OutboxDir()
+		}
+		fileMessenger := NewFileMessenger(dir)
+		for _, channel := range []Channel{ChannelEmail, ChannelWhatsApp, ChannelSMS, ChannelPush} {
+			Register(channel, fileMessenger)
+		}
+	case "", "live":
+		mode = "live"
+		Register(ChannelEmail, NewSMTPMessengerFromEnv())
+		Register(ChannelWhatsApp, NewWatiMessengerFromEnv())
+		Register(ChannelSMS, NewSMSMessengerFromEnv())
+		Register(ChannelPush, NewExpoMessengerFromEnv())
+	default:
+		log.Fatalf("Unknown MESSAGING_MODE %q", mode)
+	}
+
+	log.Printf("Messaging transports configured in %s mode", mode)
+}
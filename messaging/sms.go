@@ -0,0 +1,72 @@
+package messaging
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// defaultSMSURL is the Africa's Talking bulk SMS endpoint
+const defaultSMSURL = "https://api.africastalking.com/version1/messaging"
+
+// SMSMessenger sends text messages through the Africa's Talking SMS API
+type SMSMessenger struct {
+	URL      string
+	Username string
+	APIKey   string
+	SenderID string
+	Client   *http.Client
+}
+
+// NewSMSMessengerFromEnv configures an SMSMessenger from SMS_API_URL, SMS_USERNAME,
+// SMS_API_KEY and SMS_SENDER_ID
+func NewSMSMessengerFromEnv() *SMSMessenger {
+	apiURL := os.Getenv("SMS_API_URL")
+	if apiURL == "" {
+		apiURL = defaultSMSURL
+	}
+
+	return &SMSMessenger{
+		URL:      apiURL,
+		Username: os.Getenv("SMS_USERNAME"),
+		APIKey:   os.Getenv("SMS_API_KEY"),
+		SenderID: os.Getenv("SMS_SENDER_ID"),
+		Client:   &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+func (m *SMSMessenger) Send(msg Message) (Result, error) {
+	form := url.Values{}
+	form.Set("username", m.Username)
+	form.Set("to", "+"+strings.TrimPrefix(msg.To, "+"))
+	form.Set("message", msg.Text)
+	if m.SenderID != "" {
+		form.Set("from", m.SenderID)
+	}
+
+	req, err := http.NewRequest("POST", m.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Result{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("apiKey", m.APIKey)
+
+	resp, err := m.Client.Do(req)
+	if err != nil {
+		return Result{}, fmt.Errorf("sms: send to %s: %w", msg.To, err)
+	}
+	defer resp.Body.Close()
+
+	// Africa's Talking answers 201 Created when the message is queued
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(resp.Body)
+		return Result{}, fmt.Errorf("sms: received status code %d: %s", resp.StatusCode, string(body))
+	}
+
+	return Result{}, nil
+}
@@ -0,0 +1,53 @@
+package messaging
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"gopkg.in/gomail.v2"
+)
+
+// SMTPMessenger sends email through an SMTP server
+type SMTPMessenger struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+// NewSMTPMessengerFromEnv configures an SMTPMessenger from SMTP_HOST, SMTP_PORT (default 465),
+// SMTP_USER, SMTP_PASS and SMTP_SENDER
+func NewSMTPMessengerFromEnv() *SMTPMessenger {
+	port, err := strconv.Atoi(os.Getenv("SMTP_PORT"))
+	if err != nil || port <= 0 {
+		port = 465
+	}
+
+	return &SMTPMessenger{
+		Host:     os.Getenv("SMTP_HOST"),
+		Port:     port,
+		Username: os.Getenv("SMTP_USER"),
+		Password: os.Getenv("SMTP_PASS"),
+		From:     os.Getenv("SMTP_SENDER"),
+	}
+}
+
+func (m *SMTPMessenger) Send(msg Message) (Result, error) {
+	email := gomail.NewMessage()
+	email.SetHeader("From", m.From)
+	email.SetHeader("To", msg.To)
+	email.SetHeader("Subject", msg.Subject)
+	email.SetBody("text/plain", msg.Text)
+	if msg.HTML != "" {
+		email.AddAlternative("text/html", msg.HTML)
+	}
+
+	dialer := gomail.NewDialer(m.Host, m.Port, m.Username, m.Password)
+	if err := dialer.DialAndSend(email); err != nil {
+		return Result{}, fmt.Errorf("smtp: send to %s: %w", msg.To, err)
+	}
+
+	return Result{}, nil
+}
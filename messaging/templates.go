@@ -0,0 +1,158 @@
+package messaging
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+)
+
+// DefaultLocale is used when a user has no preferred language or a template has no translation
+const DefaultLocale = "en"
+
+// SupportedLocales lists the languages every template is translated into
+var SupportedLocales = []string{"en", "sw"}
+
+//go:embed templates
+var templateFS embed.FS
+
+// Brand holds the company details shown on every message
+type Brand struct {
+	Company string
+	Phone   string
+	Email   string
+	Address string
+	Color   string
+}
+
+// DefaultBrand is merged into the data of every rendered template under the "Brand" key
+var DefaultBrand = Brand{
+	Company: "Optiven Limited",
+	Phone:   "+254790300300",
+	Email:   "info@optiven.co.ke",
+	Address: "Head Office: Absa Towers, Loita Street, 2nd Floor",
+	Color:   "#0b6b3a",
+}
+
+// Rendered is a template rendered for one locale. Subject doubles as the push title, and Text
+// is the body used for push, WhatsApp and SMS as well as the plain-text part of email.
+type Rendered struct {
+	Subject string
+	Text    string
+	HTML    string
+}
+
+type parsedTemplate struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+var (
+	templateMu    sync.Mutex
+	templateCache = map[string]parsedTemplate{}
+	layout        = htmltemplate.Must(htmltemplate.ParseFS(templateFS, "templates/layout.html"))
+)
+
+// IsSupportedLocale reports whether templates are available in locale
+func IsSupportedLocale(locale string) bool {
+	for _, supported := range SupportedLocales {
+		if locale == supported {
+			return true
+		}
+	}
+	return false
+}
+
+// NormalizeLocale maps a language tag such as "sw-KE" or "EN" to a supported locale,
+// falling back to DefaultLocale
+func NormalizeLocale(locale string) string {
+	locale = strings.ToLower(strings.TrimSpace(locale))
+	if i := strings.IndexAny(locale, "-_"); i > 0 {
+		locale = locale[:i]
+	}
+	if IsSupportedLocale(locale) {
+		return locale
+	}
+	return DefaultLocale
+}
+
+// loadTemplate parses templates/<locale>/<name>.tmpl once and caches it
+func loadTemplate(name, locale string) (parsedTemplate, error) {
+	key := locale + "/" + name
+
+	templateMu.Lock()
+	defer templateMu.Unlock()
+
+	if tmpl, ok := templateCache[key]; ok {
+		return tmpl, nil
+	}
+
+	path := "templates/" + key + ".tmpl"
+	text, err := texttemplate.ParseFS(templateFS, path)
+	if err != nil {
+		return parsedTemplate{}, err
+	}
+	html, err := htmltemplate.ParseFS(templateFS, path)
+	if err != nil {
+		return parsedTemplate{}, err
+	}
+
+	tmpl := parsedTemplate{text: text, html: html}
+	templateCache[key] = tmpl
+	return tmpl, nil
+}
+
+// Render renders the named template in the given locale, falling back to DefaultLocale when
+// the locale is unsupported
+func Render(name, locale string, data map[string]interface{}) (Rendered, error) {
+	locale = NormalizeLocale(locale)
+
+	tmpl, err := loadTemplate(name, locale)
+	if err != nil {
+		return Rendered{}, fmt.Errorf("template %s (%s): %w", name, locale, err)
+	}
+
+	values := map[string]interface{}{"Brand": DefaultBrand, "Locale": locale}
+	for k, v := range data {
+		values[k] = v
+	}
+
+	var subject, text, content, page bytes.Buffer
+	if err := tmpl.text.ExecuteTemplate(&subject, "subject", values); err != nil {
+		return Rendered{}, err
+	}
+	if err := tmpl.text.ExecuteTemplate(&text, "text", values); err != nil {
+		return Rendered{}, err
+	}
+	if err := tmpl.html.ExecuteTemplate(&content, "html", values); err != nil {
+		return Rendered{}, err
+	}
+
+	if err := layout.ExecuteTemplate(&page, "layout", map[string]interface{}{
+		"Brand":   DefaultBrand,
+		"Locale":  locale,
+		"Subject": strings.TrimSpace(subject.String()),
+		"Content": htmltemplate.HTML(content.String()),
+	}); err != nil {
+		return Rendered{}, err
+	}
+
+	return Rendered{
+		Subject: strings.TrimSpace(subject.String()),
+		Text:    strings.TrimSpace(text.String()),
+		HTML:    page.String(),
+	}, nil
+}
+
+// Message addresses the rendered content to a recipient over a channel. Only email carries the
+// HTML variant.
+func (r Rendered) Message(channel Channel, to string) Message {
+	msg := Message{Channel: channel, To: to, Subject: r.Subject, Text: r.Text}
+	if channel == ChannelEmail {
+		msg.HTML = r.HTML
+	}
+	return msg
+}
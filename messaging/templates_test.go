@@ -0,0 +1,81 @@
+package messaging
+
+import (
+	"io/fs"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestRenderLocales(t *testing.T) {
+	data := map[string]interface{}{
+		"Amount":        "12,500",
+		"PlotNumber":    "VP-104",
+		"ReceiptNumber": "QKX1234ABC",
+	}
+
+	tests := []struct {
+		locale      string
+		wantSubject string
+		wantText    string
+		wantHTML    string
+	}{
+		{"en", "Payment Received", "We've received your payment of KES 12,500 for plot VP-104 (M-PESA receipt QKX1234ABC).", `lang="en"`},
+		{"sw", "Malipo Yamepokelewa", "Tumepokea malipo yako ya KES 12,500 kwa kiwanja VP-104 (risiti ya M-PESA QKX1234ABC).", `lang="sw"`},
+		{"SW_ke", "Malipo Yamepokelewa", "Tumepokea malipo yako ya KES 12,500", `lang="sw"`},
+		{"", "Payment Received", "We've received your payment of KES 12,500", `lang="en"`},
+		{"fr", "Payment Received", "We've received your payment of KES 12,500", `lang="en"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.locale, func(t *testing.T) {
+			rendered, err := Render("payment_received", tt.locale, data)
+			if err != nil {
+				t.Fatalf("Render: %v", err)
+			}
+			if rendered.Subject != tt.wantSubject {
+				t.Errorf("subject = %q, want %q", rendered.Subject, tt.wantSubject)
+			}
+			if !strings.HasPrefix(rendered.Text, tt.wantText) {
+				t.Errorf("text = %q, want it to start with %q", rendered.Text, tt.wantText)
+			}
+			if !strings.Contains(rendered.HTML, tt.wantHTML) || !strings.Contains(rendered.HTML, DefaultBrand.Company) {
+				t.Errorf("html is missing %q or the brand", tt.wantHTML)
+			}
+		})
+	}
+}
+
+func TestRenderEscapesHTML(t *testing.T) {
+	rendered, err := Render("referral_submitted", "en", map[string]interface{}{"ReferredName": "<b>Jane</b>"})
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	if strings.Contains(rendered.HTML, "<b>Jane</b>") {
+		t.Error("html body was not escaped")
+	}
+	if !strings.Contains(rendered.Text, "<b>Jane</b>") {
+		t.Error("text body should be left as is")
+	}
+}
+
+func TestEveryTemplateIsTranslated(t *testing.T) {
+	names := map[string]bool{}
+	for _, locale := range SupportedLocales {
+		files, err := fs.Glob(templateFS, path.Join("templates", locale, "*.tmpl"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, file := range files {
+			names[strings.TrimSuffix(path.Base(file), ".tmpl")] = true
+		}
+	}
+
+	for name := range names {
+		for _, locale := range SupportedLocales {
+			if _, err := loadTemplate(name, locale); err != nil {
+				t.Errorf("%s has no %s translation: %v", name, locale, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package messaging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// WatiMessenger sends WhatsApp session messages through the Wati API
+type WatiMessenger struct {
+	BaseURL string
+	APIKey  string
+	Client  *http.Client
+}
+
+// NewWatiMessengerFromEnv configures a WatiMessenger from WATI_URL and WATI_API_KEY
+func NewWatiMessengerFromEnv() *WatiMessenger {
+	return &WatiMessenger{
+		BaseURL: os.Getenv("WATI_URL"),
+		APIKey:  os.Getenv("WATI_API_KEY"),
+		Client:  &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+// watiMessage represents the structure of a message to send via Wati API
+type watiMessage struct {
+	Phone   string `json:"phone"`
+	Message string `json:"message"`
+}
+
+func (m *WatiMessenger) Send(msg Message) (Result, error) {
+	payload, err := json.Marshal(watiMessage{Phone: msg.To, Message: msg.Text})
+	if err != nil {
+		return Result{}, err
+	}
+
+	req, err := http.NewRequest("POST", m.BaseURL+"/api/v1/sendSessionMessage", bytes.NewBuffer(payload))
+	if err != nil {
+		return Result{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+m.APIKey)
+
+	resp, err := m.Client.Do(req)
+	if err != nil {
+		return Result{}, fmt.Errorf("wati: send to %s: %w", msg.To, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return Result{}, fmt.Errorf("wati: received status code %d", resp.StatusCode)
+	}
+
+	return Result{}, nil
+}
@@ -0,0 +1,22 @@
+package migrations
+
+import (
+	"log"
+	"mobile-customer-portal-server/models"
+	"mobile-customer-portal-server/utils"
+)
+
+// MigrateDeviceTokens creates the device token table and carries over the single push token
+// users registered before devices were tracked
+func MigrateDeviceTokens() {
+	utils.CustomerPortalDB.AutoMigrate(&models.DeviceToken{})
+
+	if err := utils.CustomerPortalDB.Exec(`
+		INSERT INTO device_tokens (created_at, updated_at, user_id, token, last_registered_at)
+		SELECT NOW(), NOW(), u.id, u.push_token, u.updated_at
+		FROM users u
+		WHERE u.push_token <> '' AND u.deleted_at IS NULL
+		  AND NOT EXISTS (SELECT 1 FROM device_tokens d WHERE d.token = u.push_token)`).Error; err != nil {
+		log.Printf("Failed to carry over existing push tokens: %v", err)
+	}
+}
@@ -1,10 +1,18 @@
 package migrations
 
 import (
+	"log"
+
 	"mobile-customer-portal-server/models"
+	"mobile-customer-portal-server/outbox"
 	"mobile-customer-portal-server/utils"
 )
 
 func MigrateNotifications() {
 	utils.CustomerPortalDB.AutoMigrate(&models.Notification{})
+
+	// Notifications saved before categories existed are all general
+	if err := outbox.BackfillCategories(); err != nil {
+		log.Printf("Failed to backfill notification categories: %v", err)
+	}
 }
\ No newline at end of file
@@ -0,0 +1,10 @@
+package migrations
+
+import (
+	"mobile-customer-portal-server/models"
+	"mobile-customer-portal-server/utils"
+)
+
+func MigrateOutbox() {
+	utils.CustomerPortalDB.AutoMigrate(&models.OutboxMessage{}, &models.DeliveryAttempt{}, &models.DeadLetter{})
+}
@@ -0,0 +1,23 @@
+package migrations
+
+import (
+	"log"
+
+	"mobile-customer-portal-server/models"
+	"mobile-customer-portal-server/utils"
+)
+
+// paymentMatchPaymentIndex is the unique index that allowed a payment a single receipt, before
+// split payments were matched one allocation at a time
+const paymentMatchPaymentIndex = "idx_payment_receipt_matches_mpesa_payment_id"
+
+func MigratePaymentMatches() {
+	utils.CustomerPortalDB.AutoMigrate(&models.PaymentReceiptMatch{}, &models.PaymentMatchException{})
+
+	migrator := utils.CustomerPortalDB.Migrator()
+	if migrator.HasIndex(&models.PaymentReceiptMatch{}, paymentMatchPaymentIndex) {
+		if err := migrator.DropIndex(&models.PaymentReceiptMatch{}, paymentMatchPaymentIndex); err != nil {
+			log.Printf("Failed to drop index %s: %v", paymentMatchPaymentIndex, err)
+		}
+	}
+}
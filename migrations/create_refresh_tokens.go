@@ -0,0 +1,10 @@
+package migrations
+
+import (
+	"mobile-customer-portal-server/models"
+	"mobile-customer-portal-server/utils"
+)
+
+func MigrateRefreshTokens() {
+	utils.CustomerPortalDB.AutoMigrate(&models.RefreshToken{})
+}
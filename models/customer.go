@@ -1,8 +1,7 @@
 package models
 
-import "time"
-
-// Customer struct to map the fields in the customer table in the CRM database
+// Customer struct to map the fields in the customer table in the CRM database.
+// The portal only ever reads this table.
 type Customer struct {
     CustomerNo         string `gorm:"column:customer_no;primaryKey"`
     CustomerName       string `gorm:"column:customer_name"`
@@ -23,8 +22,6 @@ type Customer struct {
     CountryOfResidence string `gorm:"column:country_of_residence"`
     DateOfRegistration string `gorm:"column:date_of_registration"`
     AlternativePhone   string `gorm:"column:alternative_phone"`
-    OTP                string `gorm:"column:otp"`
-    OTPGeneratedAt     *time.Time `gorm:"column:otp_generated_at"`
 }
 
 // TableName overrides the default table name to "customer"
@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// DeviceToken is an Expo push token registered by one of the user's devices. A user can have
+// several; pushes fan out to every token that is not disabled.
+type DeviceToken struct {
+    ID               uint       `gorm:"primaryKey" json:"id"`
+    CreatedAt        time.Time  `json:"created_at"`
+    UpdatedAt        time.Time  `json:"-"`
+    UserID           uint       `gorm:"index;not null" json:"-"`
+    SessionID        *uint      `gorm:"index" json:"-"`
+    Token            string     `gorm:"size:255;uniqueIndex;not null" json:"token"`
+    Platform         string     `gorm:"size:16" json:"platform"`
+    AppVersion       string     `gorm:"size:32" json:"app_version"`
+    LastRegisteredAt time.Time  `json:"last_registered_at"`
+    DisabledAt       *time.Time `gorm:"index" json:"-"`
+}
@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+// InstallmentReminder records a reminder sent for one installment at one offset from its due
+// date, so that each reminder only ever goes out once
+type InstallmentReminder struct {
+    ID                    uint      `gorm:"primaryKey" json:"id"`
+    CreatedAt             time.Time `json:"created_at"`
+    InstallmentScheduleID int       `gorm:"not null;uniqueIndex:idx_installment_reminder" json:"installment_schedule_id"`
+    // OffsetDays is the reminder's day relative to the due date: negative before, positive overdue
+    OffsetDays            int       `gorm:"not null;uniqueIndex:idx_installment_reminder" json:"offset_days"`
+    DueDate               time.Time `json:"due_date"`
+    UserID                uint      `gorm:"index" json:"user_id"`
+    CustomerNumber        string    `gorm:"size:64;index" json:"customer_number"`
+    LeadFileNo            string    `gorm:"size:64" json:"lead_file_no"`
+    Amount                float64   `gorm:"type:decimal(12,2)" json:"amount"`
+    Channel               string    `gorm:"size:16" json:"channel"`
+    NotificationID        *uint     `json:"notification_id"`
+    Error                 string    `gorm:"type:text" json:"error,omitempty"`
+}
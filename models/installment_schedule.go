@@ -1,6 +1,10 @@
 package models
 
-import "time"
+import (
+    "strconv"
+    "strings"
+    "time"
+)
 
 type InstallmentSchedule struct {
     ISID             int        `gorm:"column:IS_id;primaryKey" json:"is_id"`
@@ -22,3 +26,30 @@ type InstallmentSchedule struct {
 func (InstallmentSchedule) TableName() string {
     return "installment_schedule"
 }
+
+// IsPaid reports whether the CRM has marked the installment as paid
+func (s InstallmentSchedule) IsPaid() bool {
+    return strings.EqualFold(strings.TrimSpace(s.Paid), "yes")
+}
+
+// Outstanding is what is left to pay on the installment, from RemainingAmount or, before
+// anything has been paid, InstallmentAmount
+func (s InstallmentSchedule) Outstanding() float64 {
+    if strings.TrimSpace(s.RemainingAmount) != "" {
+        return parseCRMAmount(s.RemainingAmount)
+    }
+    return parseCRMAmount(s.InstallmentAmount)
+}
+
+// parseCRMAmount parses a CRM amount stored as text, e.g. "12,500.00"
+func parseCRMAmount(value string) float64 {
+    value = strings.ReplaceAll(strings.TrimSpace(value), ",", "")
+    if value == "" {
+        return 0
+    }
+    amount, err := strconv.ParseFloat(value, 64)
+    if err != nil {
+        return 0
+    }
+    return amount
+}
@@ -1,14 +1,78 @@
 package models
 
-import "gorm.io/gorm"
+import (
+    "time"
+
+    "gorm.io/gorm"
+)
+
+// M-PESA payment statuses. A payment leaves Pending once; the only later change is a payment
+// the reconciler timed out turning out to have succeeded.
+const (
+    MpesaStatusPending   = "Pending"
+    MpesaStatusSuccess   = "Success"
+    MpesaStatusFailed    = "Failed"
+    MpesaStatusCancelled = "Cancelled"
+    MpesaStatusTimeout   = "Timeout"
+)
+
+// Where an M-PESA payment came from: an STK push the customer started, one a payment mandate
+// started for them, or a payment they made through the paybill menu. Payments by other methods
+// carry the method instead.
+const (
+    MpesaSourceSTK     = "stk"
+    MpesaSourceMandate = "mandate"
+    MpesaSourceC2B     = "c2b"
+)
+
+// How the customer paid. Card and bank transfer payments share the table with M-PESA so they
+// go through the same history, allocation, matching and notification flow.
+const (
+    PaymentMethodMpesa        = "mpesa"
+    PaymentMethodCard         = "card"
+    PaymentMethodBankTransfer = "bank_transfer"
+)
 
 type MpesaPayment struct {
     gorm.Model
-    CheckoutRequestID     string `gorm:"unique;not null"`
-    InstallmentScheduleID string `gorm:"not null"`
-    CustomerNumber        string `gorm:"not null"`
-    PhoneNumber           string `gorm:"not null"`
-    Amount                string `gorm:"not null"`
-    Status                string `gorm:"not null"`
-    PlotNumber            string `gorm:"not null"`
+    // CheckoutRequestID is the M-PESA transaction ID for paybill payments, the checkout session
+    // ID for card payments and the transfer reference for bank transfers
+    CheckoutRequestID     string  `gorm:"unique;not null"`
+    Method                string  `gorm:"size:16;not null;default:mpesa;index"`
+    Source                string  `gorm:"size:16;not null;default:stk;index"`
+    MerchantRequestID     string  `gorm:"size:64"`
+    InstallmentScheduleID string  `gorm:"not null"`
+    CustomerNumber        string  `gorm:"not null;index"`
+    LeadFileNo            string  `gorm:"size:64;index"`
+    PhoneNumber           string  `gorm:"not null"`
+    // Amount is always in KES, the currency of record
+    Amount                float64 `gorm:"type:decimal(12,2);not null"`
+    Status                string  `gorm:"not null;index"`
+    PlotNumber            string  `gorm:"not null"`
+    // Overpayment is set when the customer chose to pay more than was outstanding
+    Overpayment           bool
+    // CallbackTokenHash is the hash of the secret embedded in this payment's callback URL
+    CallbackTokenHash     string  `gorm:"size:64;index"`
+
+    // Filled in from the STK callback
+    ResultCode            *int       `gorm:"column:result_code"`
+    ResultDesc            string
+    MpesaReceiptNumber    string     `gorm:"size:32;index"`
+    TransactionDate       *time.Time
+    AmountPaid            *float64   `gorm:"type:decimal(12,2)"`
+    PayerPhoneNumber      string     `gorm:"size:32"`
+    RawCallback           string     `gorm:"type:text"`
+    // ProviderTransactionID is the card processor's reference for a successful card payment
+    ProviderTransactionID string     `gorm:"size:64"`
+    // Instructions holds the bank details, as JSON, a bank transfer is to be paid into
+    Instructions          string     `gorm:"type:text"`
+    // Currency is what the customer was charged in. For a card payment in another currency,
+    // OriginalAmount is what was charged and ExchangeRate the KES per unit it was converted at.
+    Currency              string     `gorm:"size:3;not null;default:KES"`
+    OriginalAmount        *float64   `gorm:"type:decimal(12,2)"`
+    ExchangeRate          *float64   `gorm:"type:decimal(18,6)"`
+    // LastQueriedAt is when the reconciler last ran an STK push query for a pending payment
+    LastQueriedAt         *time.Time
+    // MatchCheckedAt is when the matcher last looked for the ERP receipt of a successful payment
+    MatchCheckedAt        *time.Time
 }
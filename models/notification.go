@@ -2,12 +2,55 @@ package models
 
 import "time"
 
+// Notification delivery statuses
+const (
+	NotificationStatusQueued    = "queued"
+	NotificationStatusSent      = "sent"
+	NotificationStatusDelivered = "delivered"
+	NotificationStatusFailed    = "failed"
+)
+
+// Notification categories the app can filter by
+const (
+	NotificationCategoryGeneral   = "general"
+	NotificationCategoryPayments  = "payments"
+	NotificationCategoryCampaigns = "campaigns"
+	NotificationCategoryTitle     = "title"
+	NotificationCategoryReferrals = "referrals"
+)
+
+// NotificationCategories lists every notification category
+var NotificationCategories = []string{
+	NotificationCategoryGeneral,
+	NotificationCategoryPayments,
+	NotificationCategoryCampaigns,
+	NotificationCategoryTitle,
+	NotificationCategoryReferrals,
+}
+
+// IsNotificationCategory reports whether category is one of NotificationCategories
+func IsNotificationCategory(category string) bool {
+	for _, known := range NotificationCategories {
+		if category == known {
+			return true
+		}
+	}
+	return false
+}
+
 type Notification struct {
-	ID        uint      `gorm:"primaryKey" json:"id"`
-	UserID    uint      `json:"user_id"`
-	Title     string    `json:"title"`
-	Body      string    `json:"body"`
-	Data      string    `json:"data"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID             uint   `gorm:"primaryKey" json:"id"`
+	UserID         uint   `gorm:"index" json:"user_id"`
+	Category       string `gorm:"size:32;not null;default:general;index" json:"category"`
+	Title          string `json:"title"`
+	Body           string `json:"body"`
+	Data           string `json:"data"`
+	DeliveryStatus string `gorm:"size:16;default:queued" json:"delivery_status"`
+	DeliveryError  string `gorm:"type:text" json:"delivery_error,omitempty"`
+	// ReadAt is when the user opened the notification; ArchivedAt when they put it away. An
+	// archived notification is left out of the list and the unread count.
+	ReadAt     *time.Time `json:"read_at"`
+	ArchivedAt *time.Time `gorm:"index" json:"archived_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
 }
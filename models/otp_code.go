@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// OTPCode is a one-time code issued to a subject (a customer number, a user) for a specific purpose.
+// Only a salted hash of the code is stored.
+type OTPCode struct {
+    ID        uint       `gorm:"primaryKey"`
+    CreatedAt time.Time
+    UpdatedAt time.Time
+    Subject   string     `gorm:"size:100;index:idx_otp_subject_purpose;not null"`
+    Purpose   string     `gorm:"size:32;index:idx_otp_subject_purpose;not null"`
+    Salt      string     `gorm:"size:32;not null"`
+    CodeHash  string     `gorm:"size:64;not null"`
+    ExpiresAt time.Time  `gorm:"not null"`
+    UsedAt    *time.Time
+}
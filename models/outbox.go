@@ -0,0 +1,63 @@
+package models
+
+import "time"
+
+// Outbox message statuses
+const (
+    OutboxStatusPending = "pending"
+    OutboxStatusSending = "sending"
+    OutboxStatusSent    = "sent"
+    OutboxStatusDead    = "dead"
+)
+
+// OutboxMessage is an outgoing push, email, WhatsApp or SMS message waiting to be delivered
+// by the background outbox workers
+type OutboxMessage struct {
+    ID             uint       `gorm:"primaryKey"`
+    CreatedAt      time.Time
+    UpdatedAt      time.Time
+    NotificationID *uint      `gorm:"index"`
+    UserID         uint       `gorm:"index"`
+    Channel        string     `gorm:"size:16;not null"`
+    Recipient      string     `gorm:"not null"`
+    Subject        string
+    Body           string     `gorm:"type:text"`
+    HTMLBody       string     `gorm:"type:mediumtext"`
+    Data           string     `gorm:"type:text"`
+    Status         string     `gorm:"size:16;index:idx_outbox_due;not null"`
+    NextAttemptAt  time.Time  `gorm:"index:idx_outbox_due"`
+    LockedUntil    *time.Time
+    Attempts       int
+    LastError      string     `gorm:"type:text"`
+    ProviderID     string
+    SentAt         *time.Time
+}
+
+// DeliveryAttempt records a single try at delivering an outbox message
+type DeliveryAttempt struct {
+    ID              uint      `gorm:"primaryKey" json:"id"`
+    CreatedAt       time.Time `json:"created_at"`
+    OutboxMessageID uint      `gorm:"index;not null" json:"outbox_message_id"`
+    NotificationID  *uint     `gorm:"index" json:"notification_id"`
+    Channel         string    `gorm:"size:16" json:"channel"`
+    Attempt         int       `json:"attempt"`
+    Success         bool      `json:"success"`
+    Error           string    `gorm:"type:text" json:"error"`
+    ProviderID      string    `json:"provider_id"`
+}
+
+// DeadLetter keeps an outbox message that exhausted its retries, for manual follow-up
+type DeadLetter struct {
+    ID              uint      `gorm:"primaryKey"`
+    CreatedAt       time.Time
+    OutboxMessageID uint      `gorm:"uniqueIndex;not null"`
+    NotificationID  *uint     `gorm:"index"`
+    UserID          uint      `gorm:"index"`
+    Channel         string    `gorm:"size:16"`
+    Recipient       string
+    Subject         string
+    Body            string    `gorm:"type:text"`
+    Data            string    `gorm:"type:text"`
+    Attempts        int
+    LastError       string    `gorm:"type:text"`
+}
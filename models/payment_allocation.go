@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// PaymentAllocation is the part of a payment applied to one property and, optionally, one of
+// its installments. A payment split across several plots or installments has one row for each.
+type PaymentAllocation struct {
+    ID                    uint       `gorm:"primaryKey" json:"id"`
+    CreatedAt             time.Time  `json:"created_at"`
+    MpesaPaymentID        uint       `gorm:"index;not null" json:"mpesa_payment_id"`
+    LeadFileNo            string     `gorm:"size:64;index;not null" json:"lead_file_no"`
+    PlotNumber            string     `gorm:"size:64" json:"plot_number"`
+    // InstallmentScheduleID is empty when the amount goes to the plot's balance as a whole
+    InstallmentScheduleID *int       `json:"installment_schedule_id"`
+    InstallmentNo         *int       `json:"installment_no"`
+    DueDate               *time.Time `json:"due_date"`
+    Amount                float64    `gorm:"type:decimal(12,2);not null" json:"amount"`
+}
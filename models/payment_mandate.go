@@ -0,0 +1,53 @@
+package models
+
+import "time"
+
+// Payment mandate statuses. A paused mandate can be resumed; a cancelled one is final.
+const (
+    MandateStatusActive    = "active"
+    MandateStatusPaused    = "paused"
+    MandateStatusCancelled = "cancelled"
+)
+
+// Outcomes of a mandate's prompt for one installment
+const (
+    MandateRunSent   = "sent"
+    MandateRunFailed = "failed"
+)
+
+// PaymentMandate is a customer's standing order for the installments of one lead file: an STK
+// push for Amount is sent to PhoneNumber on DayOfMonth ahead of each due date.
+type PaymentMandate struct {
+    ID             uint       `gorm:"primaryKey" json:"id"`
+    CreatedAt      time.Time  `json:"created_at"`
+    UpdatedAt      time.Time  `json:"updated_at"`
+    CustomerNumber string     `gorm:"size:64;not null;index" json:"customer_number"`
+    LeadFileNo     string     `gorm:"size:64;not null;index" json:"lead_file_no"`
+    PlotNumber     string     `gorm:"size:64" json:"plot_number"`
+    PhoneNumber    string     `gorm:"size:32;not null" json:"phone_number"`
+    Amount         float64    `gorm:"type:decimal(12,2);not null" json:"amount"`
+    DayOfMonth     int        `gorm:"not null" json:"day_of_month"`
+    Status         string     `gorm:"size:16;not null;default:active;index" json:"status"`
+    PausedAt       *time.Time `json:"paused_at"`
+    CancelledAt    *time.Time `json:"cancelled_at"`
+}
+
+// PaymentMandateRun records the prompt a mandate sent for one installment, so each installment
+// is only ever prompted for once. A prompt that failed to start a payment is retried on the same
+// row, up to a limit.
+type PaymentMandateRun struct {
+    ID                    uint       `gorm:"primaryKey" json:"id"`
+    CreatedAt             time.Time  `json:"created_at"`
+    UpdatedAt             time.Time  `json:"updated_at"`
+    PaymentMandateID      uint       `gorm:"not null;uniqueIndex:idx_mandate_installment" json:"payment_mandate_id"`
+    InstallmentScheduleID int        `gorm:"not null;uniqueIndex:idx_mandate_installment" json:"installment_schedule_id"`
+    InstallmentNo         int        `json:"installment_no"`
+    DueDate               *time.Time `json:"due_date"`
+    Amount                float64    `gorm:"type:decimal(12,2);not null" json:"amount"`
+    Status                string     `gorm:"size:16;not null" json:"status"`
+    // Attempts counts the pushes tried for the installment
+    Attempts              int        `gorm:"not null;default:1" json:"attempts"`
+    // MpesaPaymentID is the STK push payment the prompt started
+    MpesaPaymentID        *uint      `gorm:"index" json:"mpesa_payment_id"`
+    Error                 string     `gorm:"type:text" json:"error,omitempty"`
+}
@@ -0,0 +1,51 @@
+package models
+
+import "time"
+
+// How a payment was matched to a posted receipt
+const (
+    MatchMethodReceiptNumber  = "receipt_number"
+    MatchMethodAmountPlotDate = "amount_plot_date"
+)
+
+// Why a payment could not be matched
+const (
+    MatchExceptionUnmatched      = "unmatched"
+    MatchExceptionAmbiguous      = "ambiguous"
+    // A paybill payment whose account number matched none of our plots or lead files
+    MatchExceptionUnknownAccount = "unknown_account"
+    // A card payment the provider settled for another amount or currency than was charged
+    MatchExceptionAmountMismatch = "amount_mismatch"
+)
+
+// PaymentReceiptMatch links a successful M-PESA payment to the receipt finance posted for it
+// in the ERP Recipts table. A payment split across properties or installments is matched one
+// allocation at a time, each to its own receipt; PaymentAllocationID is 0 for a payment matched
+// as a whole, such as a paybill payment that has no allocations.
+type PaymentReceiptMatch struct {
+    ID                  uint       `gorm:"primaryKey" json:"id"`
+    CreatedAt           time.Time  `json:"created_at"`
+    UpdatedAt           time.Time  `json:"-"`
+    MpesaPaymentID      uint       `gorm:"not null;uniqueIndex:idx_payment_receipt_match_allocation,priority:1" json:"mpesa_payment_id"`
+    PaymentAllocationID uint       `gorm:"not null;default:0;uniqueIndex:idx_payment_receipt_match_allocation,priority:2" json:"payment_allocation_id"`
+    ReceiptID           int        `gorm:"uniqueIndex;not null" json:"receipt_id"`
+    ReceiptNo           string     `gorm:"size:64" json:"receipt_no"`
+    Method              string     `gorm:"size:32" json:"method"`
+    // Confidence is 1 for a match on the M-PESA receipt number and lower for heuristic matches
+    Confidence          float64    `json:"confidence"`
+    NotifiedAt          *time.Time `json:"notified_at"`
+}
+
+// PaymentMatchException records a successful payment that could not be matched to a posted
+// receipt, or a card payment held back because the provider settled it for something other
+// than what was charged, for finance to follow up
+type PaymentMatchException struct {
+    ID             uint       `gorm:"primaryKey" json:"id"`
+    CreatedAt      time.Time  `json:"created_at"`
+    UpdatedAt      time.Time  `json:"updated_at"`
+    MpesaPaymentID uint       `gorm:"uniqueIndex;not null" json:"mpesa_payment_id"`
+    Reason         string     `gorm:"size:32;index" json:"reason"`
+    Candidates     int        `json:"candidates"`
+    Detail         string     `gorm:"type:text" json:"detail"`
+    ResolvedAt     *time.Time `gorm:"index" json:"resolved_at"`
+}
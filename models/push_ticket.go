@@ -0,0 +1,28 @@
+package models
+
+import "time"
+
+// Push ticket statuses
+const (
+    PushTicketStatusPending = "pending"
+    PushTicketStatusOK      = "ok"
+    PushTicketStatusError   = "error"
+    PushTicketStatusExpired = "expired"
+)
+
+// PushTicket is the ticket Expo handed out for an accepted push. Its receipt is fetched later
+// to learn whether the push actually reached the device.
+type PushTicket struct {
+    ID              uint       `gorm:"primaryKey" json:"id"`
+    CreatedAt       time.Time  `json:"created_at"`
+    UpdatedAt       time.Time  `json:"updated_at"`
+    TicketID        string     `gorm:"size:64;uniqueIndex;not null" json:"ticket_id"`
+    OutboxMessageID uint       `gorm:"index" json:"outbox_message_id"`
+    NotificationID  *uint      `gorm:"index" json:"notification_id"`
+    UserID          uint       `gorm:"index" json:"user_id"`
+    PushToken       string     `json:"-"`
+    Status          string     `gorm:"size:16;index;not null" json:"status"`
+    ErrorCode       string     `gorm:"size:64" json:"error_code,omitempty"`
+    ErrorMessage    string     `gorm:"type:text" json:"error_message,omitempty"`
+    CheckedAt       *time.Time `json:"checked_at"`
+}
@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// RefreshToken is a server-side record of an issued refresh token. Only the hash of the token is stored.
+// Tokens issued from the same login share a FamilyID and SessionID so that reuse of a rotated token revokes the whole chain.
+type RefreshToken struct {
+    ID           uint       `gorm:"primaryKey"`
+    CreatedAt    time.Time
+    UpdatedAt    time.Time
+    UserID       uint       `gorm:"index;not null"`
+    SessionID    uint       `gorm:"index;not null"`
+    FamilyID     string     `gorm:"size:64;index;not null"`
+    TokenHash    string     `gorm:"size:64;uniqueIndex;not null"`
+    ExpiresAt    time.Time  `gorm:"not null"`
+    RevokedAt    *time.Time
+    ReplacedByID *uint
+}
@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// RegistrationChallenge tracks a customer's self-registration from OTP issue to account creation.
+// It lives in the portal database so registration never writes to the CRM.
+type RegistrationChallenge struct {
+    ID             uint       `gorm:"primaryKey"`
+    CreatedAt      time.Time
+    UpdatedAt      time.Time
+    CustomerNumber string     `gorm:"size:64;index;not null"`
+    Email          string     `gorm:"not null"`
+    OTPCodeID      uint       `gorm:"not null"`
+    ExpiresAt      time.Time  `gorm:"not null"`
+    VerifiedAt     *time.Time
+    CompletedAt    *time.Time
+}
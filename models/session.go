@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// Session is a login on a single device. Access tokens carry the session's JTI so that
+// each device can be listed and revoked on its own.
+type Session struct {
+    ID         uint       `gorm:"primaryKey" json:"id"`
+    CreatedAt  time.Time  `json:"created_at"`
+    UpdatedAt  time.Time  `json:"-"`
+    UserID     uint       `gorm:"index;not null" json:"-"`
+    JTI        string     `gorm:"column:jti;size:64;uniqueIndex;not null" json:"-"`
+    DeviceName string     `json:"device_name"`
+    Platform   string     `json:"platform"`
+    IPAddress  string     `json:"ip_address"`
+    LastSeenAt time.Time  `json:"last_seen_at"`
+    RevokedAt  *time.Time `json:"-"`
+}
@@ -8,12 +8,18 @@ import (
 
 type User struct {
     gorm.Model
-    CustomerNumber string     `gorm:"unique;not null" json:"customer_number"`
-    Email          string     `gorm:"unique;not null" json:"email"`
-    PhoneNumber    string     `json:"phone_number"`
-    Password       string     `gorm:"not null" json:"password"`
-    Verified       bool       `gorm:"default:false" json:"verified"`
-    UserType       string     `gorm:"not null" json:"user_type"`
-    PushToken      string     `gorm:"column:push_token" json:"push_token"`
-    LastLogoutAt   *time.Time `gorm:"column:last_logout_at" json:"-"`
+    CustomerNumber      string     `gorm:"unique;not null" json:"customer_number"`
+    Email               string     `gorm:"unique;not null" json:"email"`
+    PhoneNumber         string     `json:"phone_number"`
+    Password            string     `gorm:"not null" json:"password"`
+    Verified            bool       `gorm:"default:false" json:"verified"`
+    UserType            string     `gorm:"not null" json:"user_type"`
+    PushToken           string     `gorm:"column:push_token" json:"push_token"`
+    PreferredLanguage   string     `gorm:"column:preferred_language;size:8;default:en" json:"preferred_language"`
+    // DisplayCurrency is the currency balances and statements are shown in; KES stays the
+    // currency of record
+    DisplayCurrency     string     `gorm:"column:display_currency;size:3;default:KES" json:"display_currency"`
+    // NotificationChannel is where reminders go: push, email or whatsapp
+    NotificationChannel string     `gorm:"column:notification_channel;size:16;default:push" json:"notification_channel"`
+    LastLogoutAt        *time.Time `gorm:"column:last_logout_at" json:"-"`
 }
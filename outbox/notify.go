@@ -0,0 +1,236 @@
+package outbox
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"mobile-customer-portal-server/messaging"
+	"mobile-customer-portal-server/models"
+	"mobile-customer-portal-server/utils"
+)
+
+// templateCategories files the notifications rendered from each template; templates not
+// listed are general
+var templateCategories = map[string]string{
+	"payment_received":    models.NotificationCategoryPayments,
+	"payment_failed":      models.NotificationCategoryPayments,
+	"payment_posted":      models.NotificationCategoryPayments,
+	"mandate_failed":      models.NotificationCategoryPayments,
+	"installment_due":     models.NotificationCategoryPayments,
+	"installment_overdue": models.NotificationCategoryPayments,
+	"referral_submitted":  models.NotificationCategoryReferrals,
+	"referral_redeemed":   models.NotificationCategoryReferrals,
+}
+
+// dataCategories files notifications sent without a category by what their data links to
+var dataCategories = map[string]string{
+	"campaign_id": models.NotificationCategoryCampaigns,
+	"referral_id": models.NotificationCategoryReferrals,
+}
+
+// templateCategory is the category of notifications rendered from templateName
+func templateCategory(templateName string) string {
+	if category, ok := templateCategories[templateName]; ok {
+		return category
+	}
+	return models.NotificationCategoryGeneral
+}
+
+// DataCategory is the category of a notification whose data links to a campaign or a
+// referral, general otherwise
+func DataCategory(data map[string]interface{}) string {
+	for key, category := range dataCategories {
+		if _, ok := data[key]; ok {
+			return category
+		}
+	}
+	return models.NotificationCategoryGeneral
+}
+
+// BackfillCategories files the general notifications saved before categories existed: those
+// whose data links to a campaign or a referral, and those with the title of a template that
+// has a category of its own
+func BackfillCategories() error {
+	general := utils.CustomerPortalDB.Model(&models.Notification{}).
+		Where("category = ?", models.NotificationCategoryGeneral)
+
+	for key, category := range dataCategories {
+		if err := general.Session(&gorm.Session{}).
+			Where("data LIKE ?", `%"`+key+`":%`).
+			Update("category", category).Error; err != nil {
+			return err
+		}
+	}
+
+	for templateName, category := range templateCategories {
+		titles, err := templateTitles(templateName)
+		if err != nil {
+			return err
+		}
+		if err := general.Session(&gorm.Session{}).
+			Where("title IN ?", titles).
+			Update("category", category).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// templateTitles lists the titles notifications rendered from templateName can have, in every
+// locale
+func templateTitles(templateName string) ([]string, error) {
+	seen := map[string]bool{}
+	var titles []string
+	for _, locale := range messaging.SupportedLocales {
+		// Some subjects depend on how many days away the due date is
+		for _, days := range []int{0, 1} {
+			rendered, err := messaging.Render(templateName, locale, map[string]interface{}{
+				"Days":   days,
+				"Method": "",
+			})
+			if err != nil {
+				return nil, err
+			}
+			if !seen[rendered.Subject] {
+				seen[rendered.Subject] = true
+				titles = append(titles, rendered.Subject)
+			}
+		}
+	}
+	return titles, nil
+}
+
+// Notify saves a notification in category for the user and queues it as a push notification
+// to each of the user's active devices
+func Notify(user models.User, category, title, body string, data map[string]interface{}) (*models.Notification, error) {
+	notification := models.Notification{
+		UserID:   user.ID,
+		Category: category,
+		Title:    title,
+		Body:     body,
+		Data:     notificationData(data),
+	}
+
+	if err := utils.CustomerPortalDB.Create(&notification).Error; err != nil {
+		return nil, err
+	}
+
+	devices, err := ActiveDeviceTokens(user.ID)
+	if err != nil {
+		return &notification, err
+	}
+	if len(devices) == 0 {
+		log.Printf("User %d does not have a push token", user.ID)
+		return &notification, nil
+	}
+
+	// Fan out to every device the user is signed in on
+	for _, device := range devices {
+		if _, err := Enqueue(messaging.Message{
+			Channel: messaging.ChannelPush,
+			To:      device.Token,
+			Subject: title,
+			Text:    body,
+			Data:    data,
+		}, user.ID, &notification.ID); err != nil {
+			return &notification, err
+		}
+	}
+
+	return &notification, nil
+}
+
+// notificationData encodes the data saved with a notification, which the app uses to open the
+// screen it is about
+func notificationData(data map[string]interface{}) string {
+	if data == nil {
+		return ""
+	}
+	dataBytes, err := json.Marshal(data)
+	if err != nil {
+		return ""
+	}
+	return string(dataBytes)
+}
+
+// ActiveDeviceTokens returns the push tokens of the user's devices that have not been unregistered
+func ActiveDeviceTokens(userID uint) ([]models.DeviceToken, error) {
+	var devices []models.DeviceToken
+	err := utils.CustomerPortalDB.
+		Where("user_id = ? AND disabled_at IS NULL", userID).
+		Find(&devices).Error
+	return devices, err
+}
+
+// NotifyTemplate renders a notification template in the user's language, then saves and
+// queues it like Notify. data is kept with the notification and sent with the push, so the app
+// can open what it is about.
+func NotifyTemplate(user models.User, templateName string, data map[string]interface{}) (*models.Notification, error) {
+	rendered, err := messaging.Render(templateName, user.PreferredLanguage, data)
+	if err != nil {
+		return nil, err
+	}
+	return Notify(user, templateCategory(templateName), rendered.Subject, rendered.Text, data)
+}
+
+// NotificationChannels are the channels a user can choose to get reminders on
+var NotificationChannels = []messaging.Channel{messaging.ChannelPush, messaging.ChannelEmail, messaging.ChannelWhatsApp}
+
+// IsNotificationChannel reports whether channel is one of NotificationChannels
+func IsNotificationChannel(channel string) bool {
+	for _, known := range NotificationChannels {
+		if messaging.Channel(channel) == known {
+			return true
+		}
+	}
+	return false
+}
+
+// NotificationChannel is the channel the user chose to get reminders on, push by default
+func NotificationChannel(user models.User) messaging.Channel {
+	if IsNotificationChannel(user.NotificationChannel) {
+		return messaging.Channel(user.NotificationChannel)
+	}
+	return messaging.ChannelPush
+}
+
+// NotifyTemplateOn renders a notification template in the user's language and sends it on
+// channel. The notification is saved for the in-app list either way; email and WhatsApp
+// messages are queued to the user's address or number, and go out as push notifications when
+// the user has none.
+func NotifyTemplateOn(user models.User, channel messaging.Channel, templateName string, data map[string]interface{}) (*models.Notification, error) {
+	rendered, err := messaging.Render(templateName, user.PreferredLanguage, data)
+	if err != nil {
+		return nil, err
+	}
+
+	to := ""
+	switch channel {
+	case messaging.ChannelEmail:
+		to = strings.TrimSpace(user.Email)
+	case messaging.ChannelWhatsApp:
+		to = utils.NormalizePhoneNumber(user.PhoneNumber)
+	}
+	if to == "" {
+		return Notify(user, templateCategory(templateName), rendered.Subject, rendered.Text, data)
+	}
+
+	notification := models.Notification{
+		UserID:   user.ID,
+		Category: templateCategory(templateName),
+		Title:    rendered.Subject,
+		Body:     rendered.Text,
+		Data:     notificationData(data),
+	}
+	if err := utils.CustomerPortalDB.Create(&notification).Error; err != nil {
+		return nil, err
+	}
+
+	if _, err := Enqueue(rendered.Message(channel, to), user.ID, &notification.ID); err != nil {
+		return &notification, err
+	}
+	return &notification, nil
+}
@@ -0,0 +1,56 @@
+package outbox
+
+import (
+	"testing"
+
+	"mobile-customer-portal-server/models"
+)
+
+func TestDataCategory(t *testing.T) {
+	tests := []struct {
+		name string
+		data map[string]interface{}
+		want string
+	}{
+		{"no data", nil, models.NotificationCategoryGeneral},
+		{"unrelated data", map[string]interface{}{"PlotNumber": "A1"}, models.NotificationCategoryGeneral},
+		{"campaign", map[string]interface{}{"campaign_id": 3}, models.NotificationCategoryCampaigns},
+		{"referral", map[string]interface{}{"referral_id": 7, "ReferredName": "Jane"}, models.NotificationCategoryReferrals},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DataCategory(tt.data); got != tt.want {
+				t.Fatalf("DataCategory = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTemplateTitlesCoverEveryLocale(t *testing.T) {
+	titles, err := templateTitles("installment_due")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{
+		"Installment Due Today":    true,
+		"Installment Due Soon":     true,
+		"Awamu Inadaiwa Leo":       true,
+		"Awamu Inakaribia Kudaiwa": true,
+	}
+	if len(titles) != len(want) {
+		t.Fatalf("titles = %q, want %d titles", titles, len(want))
+	}
+	for _, title := range titles {
+		if !want[title] {
+			t.Errorf("unexpected title %q", title)
+		}
+	}
+
+	// Every categorised template renders in every locale
+	for templateName := range templateCategories {
+		if _, err := templateTitles(templateName); err != nil {
+			t.Errorf("%s: %v", templateName, err)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+// Package outbox queues outgoing messages in the portal database and delivers them from a
+// pool of background workers, retrying failures with exponential backoff and moving messages
+// that exhaust their retries to the dead-letter table.
+package outbox
+
+import (
+	"encoding/json"
+	"time"
+
+	"mobile-customer-portal-server/messaging"
+	"mobile-customer-portal-server/models"
+	"mobile-customer-portal-server/utils"
+)
+
+// Enqueue stores msg for background delivery. userID and notificationID link the message to
+// the user and notification it belongs to; notificationID may be nil.
+func Enqueue(msg messaging.Message, userID uint, notificationID *uint) (*models.OutboxMessage, error) {
+	data := ""
+	if msg.Data != nil {
+		encoded, err := json.Marshal(msg.Data)
+		if err != nil {
+			return nil, err
+		}
+		data = string(encoded)
+	}
+
+	record := models.OutboxMessage{
+		NotificationID: notificationID,
+		UserID:         userID,
+		Channel:        string(msg.Channel),
+		Recipient:      msg.To,
+		Subject:        msg.Subject,
+		Body:           msg.Text,
+		HTMLBody:       msg.HTML,
+		Data:           data,
+		Status:         models.OutboxStatusPending,
+		NextAttemptAt:  time.Now(),
+	}
+	if err := utils.CustomerPortalDB.Create(&record).Error; err != nil {
+		return nil, err
+	}
+
+	return &record, nil
+}
+
+// message rebuilds the messaging.Message stored in an outbox record
+func message(record models.OutboxMessage) messaging.Message {
+	msg := messaging.Message{
+		Channel: messaging.Channel(record.Channel),
+		To:      record.Recipient,
+		Subject: record.Subject,
+		Text:    record.Body,
+		HTML:    record.HTMLBody,
+	}
+	if record.Data != "" {
+		_ = json.Unmarshal([]byte(record.Data), &msg.Data)
+	}
+	return msg
+}
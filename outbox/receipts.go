@@ -0,0 +1,187 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"mobile-customer-portal-server/messaging"
+	"mobile-customer-portal-server/models"
+	"mobile-customer-portal-server/utils"
+)
+
+// receiptBatchSize is the most ticket IDs Expo accepts in one getReceipts call
+const receiptBatchSize = 1000
+
+// recordPushTicket stores the ticket Expo returned for a delivered push so its receipt can be
+// checked later
+func recordPushTicket(record models.OutboxMessage, ticketID string) {
+	if record.Channel != string(messaging.ChannelPush) || ticketID == "" {
+		return
+	}
+
+	ticket := models.PushTicket{
+		TicketID:        ticketID,
+		OutboxMessageID: record.ID,
+		NotificationID:  record.NotificationID,
+		UserID:          record.UserID,
+		PushToken:       record.Recipient,
+		Status:          models.PushTicketStatusPending,
+	}
+	if err := utils.CustomerPortalDB.Create(&ticket).Error; err != nil {
+		log.Printf("Outbox: failed to record push ticket for message %d: %v", record.ID, err)
+	}
+}
+
+// setNotificationStatus updates the delivery status shown on a notification, if the message
+// belongs to one. A notification goes out as one message per device, so one device's outcome
+// must not hide another's: it stays delivered once any device has received it, and a message
+// that failed or is being retried leaves it alone while another of its messages was sent.
+func setNotificationStatus(notificationID *uint, messageID uint, status, deliveryError string) {
+	if notificationID == nil {
+		return
+	}
+	if (status == models.NotificationStatusFailed || status == models.NotificationStatusQueued) &&
+		otherMessageSent(*notificationID, messageID) {
+		return
+	}
+
+	query := utils.CustomerPortalDB.Model(&models.Notification{}).Where("id = ?", *notificationID)
+	if status != models.NotificationStatusDelivered {
+		query = query.Where("delivery_status <> ?", models.NotificationStatusDelivered)
+	}
+	if err := query.
+		Updates(map[string]interface{}{"delivery_status": status, "delivery_error": deliveryError}).Error; err != nil {
+		log.Printf("Outbox: failed to update notification %d: %v", *notificationID, err)
+	}
+}
+
+// otherMessageSent reports whether a message of the notification other than messageID was sent
+// and has not since been reported undeliverable by its push receipt
+func otherMessageSent(notificationID, messageID uint) bool {
+	var count int64
+	if err := utils.CustomerPortalDB.Model(&models.OutboxMessage{}).
+		Where("notification_id = ? AND id <> ? AND status = ?", notificationID, messageID, models.OutboxStatusSent).
+		Where("NOT EXISTS (SELECT 1 FROM push_tickets WHERE push_tickets.outbox_message_id = outbox_messages.id AND push_tickets.status = ?)",
+			models.PushTicketStatusError).
+		Count(&count).Error; err != nil {
+		log.Printf("Outbox: failed to check the other messages of notification %d: %v", notificationID, err)
+		return false
+	}
+	return count > 0
+}
+
+// clearPushToken disables a push token Expo reported as no longer registered
+func clearPushToken(token string) {
+	if token == "" {
+		return
+	}
+	if err := utils.CustomerPortalDB.Model(&models.DeviceToken{}).
+		Where("token = ? AND disabled_at IS NULL", token).
+		Update("disabled_at", time.Now()).Error; err != nil {
+		log.Printf("Outbox: failed to disable push token: %v", err)
+	}
+	if err := utils.CustomerPortalDB.Model(&models.User{}).
+		Where("push_token = ?", token).
+		Update("push_token", "").Error; err != nil {
+		log.Printf("Outbox: failed to clear push token: %v", err)
+	}
+}
+
+// pollReceipts checks push receipts every ReceiptInterval until ctx is cancelled
+func (config Config) pollReceipts(ctx context.Context) {
+	ticker := time.NewTicker(config.ReceiptInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := config.CheckReceipts(); err != nil {
+				log.Printf("Outbox: failed to check push receipts: %v", err)
+			}
+		}
+	}
+}
+
+// CheckReceipts fetches receipts for pending push tickets that are old enough to have one,
+// updates the tickets and their notifications, and clears push tokens Expo reports as
+// DeviceNotRegistered. Tickets whose receipts never arrive are marked expired.
+func (config Config) CheckReceipts() error {
+	now := time.Now()
+
+	if err := utils.CustomerPortalDB.Model(&models.PushTicket{}).
+		Where("status = ? AND created_at < ?", models.PushTicketStatusPending, now.Add(-config.ReceiptExpiry)).
+		Updates(map[string]interface{}{"status": models.PushTicketStatusExpired, "checked_at": now}).Error; err != nil {
+		return err
+	}
+
+	var tickets []models.PushTicket
+	if err := utils.CustomerPortalDB.
+		Where("status = ? AND created_at <= ?", models.PushTicketStatusPending, now.Add(-config.ReceiptDelay)).
+		Order("created_at ASC").
+		Limit(receiptBatchSize).
+		Find(&tickets).Error; err != nil {
+		return err
+	}
+	if len(tickets) == 0 {
+		return nil
+	}
+
+	ids := make([]string, len(tickets))
+	for i, ticket := range tickets {
+		ids[i] = ticket.TicketID
+	}
+
+	receipts, err := messaging.Receipts(ids)
+	if errors.Is(err, messaging.ErrNoTransport) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, ticket := range tickets {
+		receipt, ok := receipts[ticket.TicketID]
+		if !ok {
+			// Not ready yet; try again on the next poll
+			continue
+		}
+		applyReceipt(ticket, receipt, now)
+	}
+
+	return nil
+}
+
+// applyReceipt records the outcome of a single receipt
+func applyReceipt(ticket models.PushTicket, receipt messaging.ExpoReceipt, now time.Time) {
+	updates := map[string]interface{}{"checked_at": now}
+
+	if receipt.Status == "ok" {
+		updates["status"] = models.PushTicketStatusOK
+		setNotificationStatus(ticket.NotificationID, ticket.OutboxMessageID, models.NotificationStatusDelivered, "")
+	} else {
+		code := receipt.Details.Error
+		updates["status"] = models.PushTicketStatusError
+		updates["error_code"] = code
+		updates["error_message"] = receipt.Message
+
+		deliveryError := receipt.Message
+		if code != "" {
+			deliveryError = code + ": " + receipt.Message
+		}
+		setNotificationStatus(ticket.NotificationID, ticket.OutboxMessageID, models.NotificationStatusFailed, deliveryError)
+
+		if code == messaging.ExpoDeviceNotRegistered {
+			clearPushToken(ticket.PushToken)
+		}
+	}
+
+	if err := utils.CustomerPortalDB.Model(&models.PushTicket{}).
+		Where("id = ?", ticket.ID).
+		Updates(updates).Error; err != nil {
+		log.Printf("Outbox: failed to update push ticket %s: %v", ticket.TicketID, err)
+	}
+}
@@ -0,0 +1,253 @@
+package outbox
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"mobile-customer-portal-server/messaging"
+	"mobile-customer-portal-server/messaging/expofake"
+	"mobile-customer-portal-server/models"
+	"mobile-customer-portal-server/utils"
+	"mobile-customer-portal-server/utils/testdb"
+)
+
+// testConfig delivers and checks receipts straight away
+var testConfig = Config{
+	Workers:         1,
+	MaxAttempts:     3,
+	BaseBackoff:     time.Minute,
+	MaxBackoff:      time.Hour,
+	LockTimeout:     time.Minute,
+	ReceiptDelay:    0,
+	ReceiptExpiry:   24 * time.Hour,
+	ReceiptInterval: time.Minute,
+}
+
+// useTransport registers messenger for channel for the duration of a test
+func useTransport(t *testing.T, channel messaging.Channel, messenger messaging.Messenger) {
+	t.Helper()
+	messaging.Register(channel, messenger)
+	t.Cleanup(func() { messaging.Register(channel, messaging.Memory) })
+}
+
+// useExpoFake sends pushes to a fake Expo server for the duration of a test
+func useExpoFake(t *testing.T) *expofake.Server {
+	t.Helper()
+	fake := expofake.New()
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	useTransport(t, messaging.ChannelPush, &messaging.ExpoMessenger{BaseURL: server.URL, Client: server.Client()})
+	return fake
+}
+
+// drain delivers every message that is due
+func drain(t *testing.T, config Config) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		record, err := config.claim()
+		if err != nil {
+			t.Fatalf("claim: %v", err)
+		}
+		if record == nil {
+			return
+		}
+		config.deliver(*record)
+	}
+	t.Fatal("outbox did not drain")
+}
+
+func createUser(t *testing.T, tokens ...string) models.User {
+	t.Helper()
+	user := models.User{Email: "jane@example.com", CustomerNumber: "C001"}
+	if err := utils.CustomerPortalDB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range tokens {
+		device := models.DeviceToken{UserID: user.ID, Token: token, LastRegisteredAt: time.Now()}
+		if err := utils.CustomerPortalDB.Create(&device).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	return user
+}
+
+func ticketFor(t *testing.T, token string) models.PushTicket {
+	t.Helper()
+	var ticket models.PushTicket
+	if err := utils.CustomerPortalDB.Where("push_token = ?", token).First(&ticket).Error; err != nil {
+		t.Fatalf("ticket for %s: %v", token, err)
+	}
+	return ticket
+}
+
+func TestCheckReceipts(t *testing.T) {
+	testdb.Setup(t)
+	fake := useExpoFake(t)
+
+	const (
+		delivered = "ExponentPushToken[delivered]"
+		gone      = "ExponentPushToken[gone]"
+		slow      = "ExponentPushToken[slow]"
+	)
+	user := createUser(t, delivered, gone, slow)
+
+	notification, err := Notify(user, models.NotificationCategoryGeneral, "Hello", "World", map[string]interface{}{"campaign_id": 1})
+	if err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	drain(t, testConfig)
+
+	if pushes := fake.Pushes(); len(pushes) != 3 {
+		t.Fatalf("fake received %d pushes, want 3", len(pushes))
+	}
+
+	fake.Unregister(gone)
+	fake.HoldReceipts(slow)
+	if err := testConfig.CheckReceipts(); err != nil {
+		t.Fatalf("CheckReceipts: %v", err)
+	}
+
+	if ticket := ticketFor(t, delivered); ticket.Status != models.PushTicketStatusOK || ticket.CheckedAt == nil {
+		t.Errorf("delivered ticket: status %q, checked %v", ticket.Status, ticket.CheckedAt)
+	}
+
+	ticket := ticketFor(t, gone)
+	if ticket.Status != models.PushTicketStatusError || ticket.ErrorCode != messaging.ExpoDeviceNotRegistered {
+		t.Errorf("unregistered ticket: status %q, error %q", ticket.Status, ticket.ErrorCode)
+	}
+	var device models.DeviceToken
+	utils.CustomerPortalDB.Where("token = ?", gone).First(&device)
+	if device.DisabledAt == nil {
+		t.Error("DeviceNotRegistered did not disable the device token")
+	}
+	active, err := ActiveDeviceTokens(user.ID)
+	if err != nil || len(active) != 2 {
+		t.Errorf("active device tokens = %d, %v; want 2", len(active), err)
+	}
+
+	// A receipt that is not ready leaves the ticket to be checked again
+	if ticket := ticketFor(t, slow); ticket.Status != models.PushTicketStatusPending || ticket.CheckedAt != nil {
+		t.Errorf("held ticket: status %q, checked %v; want pending and unchecked", ticket.Status, ticket.CheckedAt)
+	}
+
+	fake.ReleaseReceipts(slow)
+	if err := testConfig.CheckReceipts(); err != nil {
+		t.Fatalf("CheckReceipts: %v", err)
+	}
+	if ticket := ticketFor(t, slow); ticket.Status != models.PushTicketStatusOK {
+		t.Errorf("released ticket: status %q, want %q", ticket.Status, models.PushTicketStatusOK)
+	}
+
+	// One device got it, so the notification counts as delivered
+	var saved models.Notification
+	utils.CustomerPortalDB.First(&saved, notification.ID)
+	if saved.DeliveryStatus != models.NotificationStatusDelivered {
+		t.Errorf("notification delivery status = %q, want %q", saved.DeliveryStatus, models.NotificationStatusDelivered)
+	}
+}
+
+func TestCheckReceiptsExpiresOldTickets(t *testing.T) {
+	testdb.Setup(t)
+	fake := useExpoFake(t)
+
+	const token = "ExponentPushToken[old]"
+	user := createUser(t, token)
+	if _, err := Notify(user, models.NotificationCategoryGeneral, "Hello", "World", nil); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	drain(t, testConfig)
+
+	// Expo only keeps receipts for a day
+	fake.HoldReceipts(token)
+	if err := utils.CustomerPortalDB.Model(&models.PushTicket{}).
+		Where("push_token = ?", token).
+		Update("created_at", time.Now().Add(-25*time.Hour)).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := testConfig.CheckReceipts(); err != nil {
+		t.Fatalf("CheckReceipts: %v", err)
+	}
+
+	if ticket := ticketFor(t, token); ticket.Status != models.PushTicketStatusExpired {
+		t.Errorf("status = %q, want %q", ticket.Status, models.PushTicketStatusExpired)
+	}
+}
+
+func notificationStatus(t *testing.T, notification *models.Notification) string {
+	t.Helper()
+	var saved models.Notification
+	if err := utils.CustomerPortalDB.First(&saved, notification.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	return saved.DeliveryStatus
+}
+
+func TestNotificationSentToOneDeviceIsNotFailedByAnother(t *testing.T) {
+	const (
+		working = "ExponentPushToken[working]"
+		gone    = "ExponentPushToken[gone]"
+	)
+	tests := []struct {
+		name   string
+		tokens []string
+	}{
+		{"failing device last", []string{working, gone}},
+		{"failing device first", []string{gone, working}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testdb.Setup(t)
+			fake := useExpoFake(t)
+			fake.FailTickets(gone, messaging.ExpoDeviceNotRegistered)
+			user := createUser(t, tt.tokens...)
+
+			notification, err := Notify(user, models.NotificationCategoryGeneral, "Hello", "World", nil)
+			if err != nil {
+				t.Fatalf("Notify: %v", err)
+			}
+			drain(t, testConfig)
+
+			if status := notificationStatus(t, notification); status != models.NotificationStatusSent {
+				t.Fatalf("delivery status = %q, want %q", status, models.NotificationStatusSent)
+			}
+		})
+	}
+}
+
+func TestNotificationFailedReceipts(t *testing.T) {
+	testdb.Setup(t)
+	fake := useExpoFake(t)
+
+	const (
+		slow = "ExponentPushToken[slow]"
+		gone = "ExponentPushToken[gone]"
+	)
+	user := createUser(t, slow, gone)
+	notification, err := Notify(user, models.NotificationCategoryGeneral, "Hello", "World", nil)
+	if err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	drain(t, testConfig)
+
+	// One device's receipt failing does not fail a notification sent to another
+	fake.HoldReceipts(slow)
+	fake.Unregister(gone)
+	if err := testConfig.CheckReceipts(); err != nil {
+		t.Fatalf("CheckReceipts: %v", err)
+	}
+	if status := notificationStatus(t, notification); status != models.NotificationStatusSent {
+		t.Fatalf("delivery status = %q, want %q", status, models.NotificationStatusSent)
+	}
+
+	// Once every device's receipt has failed, so has the notification
+	fake.ReleaseReceipts(slow)
+	fake.FailReceipts(slow, "MessageRateExceeded")
+	if err := testConfig.CheckReceipts(); err != nil {
+		t.Fatalf("CheckReceipts: %v", err)
+	}
+	if status := notificationStatus(t, notification); status != models.NotificationStatusFailed {
+		t.Fatalf("delivery status = %q, want %q", status, models.NotificationStatusFailed)
+	}
+}
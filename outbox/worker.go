@@ -0,0 +1,225 @@
+package outbox
+
+import (
+	"context"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"mobile-customer-portal-server/messaging"
+	"mobile-customer-portal-server/models"
+	"mobile-customer-portal-server/utils"
+)
+
+// Config controls the worker pool and retry policy
+type Config struct {
+	Workers      int
+	PollInterval time.Duration
+	MaxAttempts  int
+	BaseBackoff  time.Duration
+	MaxBackoff   time.Duration
+	// LockTimeout is how long a claimed message may stay in "sending" before another worker
+	// assumes its worker died and picks it up again
+	LockTimeout time.Duration
+	// ReceiptInterval is how often push receipts are polled. Tickets are only checked once they
+	// are ReceiptDelay old, and given up on after ReceiptExpiry, when Expo discards receipts.
+	ReceiptInterval time.Duration
+	ReceiptDelay    time.Duration
+	ReceiptExpiry   time.Duration
+}
+
+// DefaultConfig is used by Start, with Workers and MaxAttempts overridable through
+// OUTBOX_WORKERS and OUTBOX_MAX_ATTEMPTS
+var DefaultConfig = Config{
+	Workers:      4,
+	PollInterval: 2 * time.Second,
+	MaxAttempts:  8,
+	BaseBackoff:  30 * time.Second,
+	MaxBackoff:   time.Hour,
+	LockTimeout:  5 * time.Minute,
+
+	ReceiptInterval: time.Minute,
+	ReceiptDelay:    15 * time.Minute,
+	ReceiptExpiry:   24 * time.Hour,
+}
+
+// Start launches the outbox workers and the push receipt poller. They run until ctx is cancelled.
+func Start(ctx context.Context) *sync.WaitGroup {
+	config := DefaultConfig
+	if n, err := strconv.Atoi(os.Getenv("OUTBOX_WORKERS")); err == nil && n > 0 {
+		config.Workers = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("OUTBOX_MAX_ATTEMPTS")); err == nil && n > 0 {
+		config.MaxAttempts = n
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < config.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			config.run(ctx)
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		config.pollReceipts(ctx)
+	}()
+
+	log.Printf("Started %d outbox workers", config.Workers)
+	return &wg
+}
+
+// run claims and delivers due messages until ctx is cancelled, sleeping when the queue is empty
+func (config Config) run(ctx context.Context) {
+	for {
+		record, err := config.claim()
+		if err != nil {
+			log.Printf("Outbox: failed to claim message: %v", err)
+		}
+
+		if record != nil {
+			config.deliver(*record)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(config.PollInterval):
+		}
+	}
+}
+
+// claim picks the oldest due message and marks it as being sent. It returns nil when nothing
+// is due or another worker won the race for the message.
+func (config Config) claim() (*models.OutboxMessage, error) {
+	now := time.Now()
+
+	var record models.OutboxMessage
+	result := utils.CustomerPortalDB.
+		Where("(status = ? AND next_attempt_at <= ?) OR (status = ? AND locked_until < ?)",
+			models.OutboxStatusPending, now, models.OutboxStatusSending, now).
+		Order("next_attempt_at ASC").
+		Limit(1).
+		Find(&record)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return nil, result.Error
+	}
+
+	lockedUntil := now.Add(config.LockTimeout)
+	claimed := utils.CustomerPortalDB.Model(&models.OutboxMessage{}).
+		Where("id = ? AND status = ? AND updated_at = ?", record.ID, record.Status, record.UpdatedAt).
+		Updates(map[string]interface{}{
+			"status":       models.OutboxStatusSending,
+			"locked_until": lockedUntil,
+			"updated_at":   now,
+		})
+	if claimed.Error != nil || claimed.RowsAffected == 0 {
+		return nil, claimed.Error
+	}
+
+	record.Status = models.OutboxStatusSending
+	record.LockedUntil = &lockedUntil
+	return &record, nil
+}
+
+// backoff returns how long to wait before the given attempt number is retried
+func (config Config) backoff(attempt int) time.Duration {
+	delay := config.BaseBackoff
+	for i := 1; i < attempt && delay < config.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > config.MaxBackoff {
+		delay = config.MaxBackoff
+	}
+	return delay
+}
+
+// deliver sends a claimed message, records the attempt and schedules a retry or dead-letters
+// the message on failure
+func (config Config) deliver(record models.OutboxMessage) {
+	result, sendErr := messaging.Send(message(record))
+
+	record.Attempts++
+	attempt := models.DeliveryAttempt{
+		OutboxMessageID: record.ID,
+		NotificationID:  record.NotificationID,
+		Channel:         record.Channel,
+		Attempt:         record.Attempts,
+		Success:         sendErr == nil,
+		ProviderID:      result.ProviderID,
+	}
+	if sendErr != nil {
+		attempt.Error = sendErr.Error()
+	}
+	if err := utils.CustomerPortalDB.Create(&attempt).Error; err != nil {
+		log.Printf("Outbox: failed to record delivery attempt for message %d: %v", record.ID, err)
+	}
+
+	now := time.Now()
+	updates := map[string]interface{}{
+		"attempts":     record.Attempts,
+		"locked_until": nil,
+	}
+
+	switch {
+	case sendErr == nil:
+		updates["status"] = models.OutboxStatusSent
+		updates["sent_at"] = now
+		updates["provider_id"] = result.ProviderID
+		updates["last_error"] = ""
+		recordPushTicket(record, result.ProviderID)
+		setNotificationStatus(record.NotificationID, record.ID, models.NotificationStatusSent, "")
+	case messaging.IsDeviceNotRegistered(sendErr):
+		// Retrying will never help; forget the token and give up straight away
+		log.Printf("Outbox: message %d push token is no longer registered: %v", record.ID, sendErr)
+		updates["status"] = models.OutboxStatusDead
+		updates["last_error"] = sendErr.Error()
+		deadLetter(record, sendErr)
+		clearPushToken(record.Recipient)
+		setNotificationStatus(record.NotificationID, record.ID, models.NotificationStatusFailed, sendErr.Error())
+	case record.Attempts >= config.MaxAttempts:
+		log.Printf("Outbox: message %d exhausted %d attempts: %v", record.ID, record.Attempts, sendErr)
+		updates["status"] = models.OutboxStatusDead
+		updates["last_error"] = sendErr.Error()
+		deadLetter(record, sendErr)
+		setNotificationStatus(record.NotificationID, record.ID, models.NotificationStatusFailed, sendErr.Error())
+	default:
+		delay := config.backoff(record.Attempts)
+		log.Printf("Outbox: message %d attempt %d failed, retrying in %s: %v", record.ID, record.Attempts, delay, sendErr)
+		updates["status"] = models.OutboxStatusPending
+		updates["next_attempt_at"] = now.Add(delay)
+		updates["last_error"] = sendErr.Error()
+		setNotificationStatus(record.NotificationID, record.ID, models.NotificationStatusQueued, sendErr.Error())
+	}
+
+	if err := utils.CustomerPortalDB.Model(&models.OutboxMessage{}).
+		Where("id = ?", record.ID).
+		Updates(updates).Error; err != nil {
+		log.Printf("Outbox: failed to update message %d: %v", record.ID, err)
+	}
+}
+
+// deadLetter copies a message that will not be retried into the dead-letter table
+func deadLetter(record models.OutboxMessage, sendErr error) {
+	letter := models.DeadLetter{
+		OutboxMessageID: record.ID,
+		NotificationID:  record.NotificationID,
+		UserID:          record.UserID,
+		Channel:         record.Channel,
+		Recipient:       record.Recipient,
+		Subject:         record.Subject,
+		Body:            record.Body,
+		Data:            record.Data,
+		Attempts:        record.Attempts,
+		LastError:       sendErr.Error(),
+	}
+	if err := utils.CustomerPortalDB.Create(&letter).Error; err != nil {
+		log.Printf("Outbox: failed to dead-letter message %d: %v", record.ID, err)
+	}
+}
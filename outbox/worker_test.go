@@ -0,0 +1,138 @@
+package outbox
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"mobile-customer-portal-server/messaging"
+	"mobile-customer-portal-server/models"
+	"mobile-customer-portal-server/utils"
+	"mobile-customer-portal-server/utils/testdb"
+)
+
+// useMemoryTransport sends email through a fresh in-memory transport for the duration of a test
+func useMemoryTransport(t *testing.T) *messaging.MemoryMessenger {
+	t.Helper()
+	memory := messaging.NewMemoryMessenger()
+	useTransport(t, messaging.ChannelEmail, memory)
+	return memory
+}
+
+func enqueueEmail(t *testing.T) models.OutboxMessage {
+	t.Helper()
+	record, err := Enqueue(messaging.Message{
+		Channel: messaging.ChannelEmail,
+		To:      "jane@example.com",
+		Subject: "Hello",
+		Text:    "World",
+	}, 1, nil)
+	if err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	return *record
+}
+
+func reload(t *testing.T, record models.OutboxMessage) models.OutboxMessage {
+	t.Helper()
+	var current models.OutboxMessage
+	if err := utils.CustomerPortalDB.First(&current, record.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	return current
+}
+
+// makeDue moves a message's next attempt into the past
+func makeDue(t *testing.T, record models.OutboxMessage) {
+	t.Helper()
+	if err := utils.CustomerPortalDB.Model(&models.OutboxMessage{}).
+		Where("id = ?", record.ID).
+		Update("next_attempt_at", time.Now().Add(-time.Second)).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeliverRetriesThenSends(t *testing.T) {
+	testdb.Setup(t)
+	memory := useMemoryTransport(t)
+	memory.Fail(messaging.ChannelEmail, errors.New("smtp unavailable"))
+
+	record := enqueueEmail(t)
+	start := time.Now()
+	drain(t, testConfig)
+
+	current := reload(t, record)
+	if current.Status != models.OutboxStatusPending || current.Attempts != 1 || current.LastError != "smtp unavailable" {
+		t.Fatalf("after a failure: status %q, attempts %d, error %q", current.Status, current.Attempts, current.LastError)
+	}
+	if wait := current.NextAttemptAt.Sub(start); wait < testConfig.BaseBackoff {
+		t.Fatalf("retry scheduled after %s, want at least %s", wait, testConfig.BaseBackoff)
+	}
+
+	// Nothing is sent again before the backoff has passed
+	drain(t, testConfig)
+	if current := reload(t, record); current.Attempts != 1 {
+		t.Fatalf("retried before the backoff, attempts %d", current.Attempts)
+	}
+
+	memory.Fail(messaging.ChannelEmail, nil)
+	makeDue(t, record)
+	drain(t, testConfig)
+
+	current = reload(t, record)
+	if current.Status != models.OutboxStatusSent || current.Attempts != 2 || current.SentAt == nil {
+		t.Fatalf("after a retry: status %q, attempts %d, sent %v", current.Status, current.Attempts, current.SentAt)
+	}
+	if sent := memory.Messages(); len(sent) != 1 || sent[0].To != "jane@example.com" {
+		t.Fatalf("sent %+v", sent)
+	}
+
+	var attempts []models.DeliveryAttempt
+	utils.CustomerPortalDB.Where("outbox_message_id = ?", record.ID).Order("attempt").Find(&attempts)
+	if len(attempts) != 2 || attempts[0].Success || !attempts[1].Success {
+		t.Fatalf("delivery attempts = %+v", attempts)
+	}
+}
+
+func TestDeliverDeadLettersAfterMaxAttempts(t *testing.T) {
+	testdb.Setup(t)
+	memory := useMemoryTransport(t)
+	memory.Fail(messaging.ChannelEmail, errors.New("mailbox full"))
+
+	record := enqueueEmail(t)
+	for i := 0; i < testConfig.MaxAttempts; i++ {
+		makeDue(t, record)
+		drain(t, testConfig)
+	}
+
+	current := reload(t, record)
+	if current.Status != models.OutboxStatusDead || current.Attempts != testConfig.MaxAttempts {
+		t.Fatalf("status %q, attempts %d; want dead after %d", current.Status, current.Attempts, testConfig.MaxAttempts)
+	}
+
+	var letter models.DeadLetter
+	if err := utils.CustomerPortalDB.Where("outbox_message_id = ?", record.ID).First(&letter).Error; err != nil {
+		t.Fatalf("dead letter: %v", err)
+	}
+	if letter.Attempts != testConfig.MaxAttempts || letter.LastError != "mailbox full" || letter.Recipient != "jane@example.com" {
+		t.Fatalf("dead letter = %+v", letter)
+	}
+
+	// A dead message is never picked up again
+	memory.Fail(messaging.ChannelEmail, nil)
+	makeDue(t, record)
+	drain(t, testConfig)
+	if sent := memory.Messages(); len(sent) != 0 {
+		t.Fatalf("dead message was sent: %+v", sent)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	config := Config{BaseBackoff: 30 * time.Second, MaxBackoff: 5 * time.Minute}
+	want := []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute}
+	for i, expected := range want {
+		if got := config.backoff(i + 1); got != expected {
+			t.Errorf("backoff(%d) = %s, want %s", i+1, got, expected)
+		}
+	}
+}
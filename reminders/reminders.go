@@ -0,0 +1,345 @@
+// Package reminders tells customers about installments coming due and overdue. Once a day it
+// scans the CRM installment schedules for unpaid installments that are a configured number of
+// days from their due date and notifies the customer on the channel they chose. Every reminder
+// sent is recorded in the portal database, so restarts and repeated scans never send one twice.
+package reminders
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+
+	"mobile-customer-portal-server/models"
+	"mobile-customer-portal-server/outbox"
+	"mobile-customer-portal-server/utils"
+)
+
+// Config controls when reminders are sent
+type Config struct {
+	// Offsets are the days relative to the due date a reminder goes out on: negative before the
+	// due date, 0 on it and positive once it is overdue
+	Offsets []int
+	// SendHour is the local hour from which the day's reminders are sent
+	SendHour int
+	// CatchUpDays is how many days late a reminder is still sent, e.g. after the server was down
+	// on the day it was due. It never reaches the day of the next offset.
+	CatchUpDays int
+	// CheckInterval is how often the scheduler checks whether the day's scan is due
+	CheckInterval time.Duration
+}
+
+// DefaultConfig is used by Start, with Offsets and SendHour overridable through
+// REMINDER_OFFSETS (e.g. "-7,-1,0,3") and REMINDER_SEND_HOUR
+var DefaultConfig = Config{
+	Offsets:       []int{-7, -1, 0, 3},
+	SendHour:      8,
+	CatchUpDays:   2,
+	CheckInterval: 15 * time.Minute,
+}
+
+// ParseOffsets parses a comma separated list of day offsets, sorted and without duplicates
+func ParseOffsets(value string) ([]int, error) {
+	var offsets []int
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		offset, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid offset %q", part)
+		}
+		offsets = append(offsets, offset)
+	}
+	if len(offsets) == 0 {
+		return nil, errors.New("no offsets")
+	}
+	return uniqueOffsets(offsets), nil
+}
+
+// uniqueOffsets returns offsets sorted, without duplicates
+func uniqueOffsets(offsets []int) []int {
+	sorted := append([]int(nil), offsets...)
+	sort.Ints(sorted)
+	unique := sorted[:0]
+	for i, offset := range sorted {
+		if i == 0 || offset != sorted[i-1] {
+			unique = append(unique, offset)
+		}
+	}
+	return unique
+}
+
+// Start runs the day's reminder scan once the clock passes SendHour, every day until ctx is
+// cancelled
+func Start(ctx context.Context) {
+	config := DefaultConfig
+	if value := os.Getenv("REMINDER_OFFSETS"); value != "" {
+		offsets, err := ParseOffsets(value)
+		if err != nil {
+			log.Fatalf("Invalid REMINDER_OFFSETS %q: %v", value, err)
+		}
+		config.Offsets = offsets
+	}
+	if value := os.Getenv("REMINDER_SEND_HOUR"); value != "" {
+		hour, err := strconv.Atoi(value)
+		if err != nil || hour < 0 || hour > 23 {
+			log.Fatalf("Invalid REMINDER_SEND_HOUR %q", value)
+		}
+		config.SendHour = hour
+	}
+
+	go func() {
+		ticker := time.NewTicker(config.CheckInterval)
+		defer ticker.Stop()
+
+		var lastRun time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				if now.Hour() < config.SendHour || sameDay(lastRun, now) {
+					continue
+				}
+				lastRun = now
+				if err := config.Send(now); err != nil {
+					log.Printf("Installment reminders failed: %v", err)
+				}
+			}
+		}
+	}()
+
+	log.Printf("Installment reminders scheduled at offsets %v from %02d:00", config.Offsets, config.SendHour)
+}
+
+// Send sends the reminders due on the day of now, one offset at a time, along with those of
+// the last CatchUpDays days that have not gone out
+func (config Config) Send(now time.Time) error {
+	today := startOfDay(now)
+	for _, window := range config.windows(today) {
+		if err := config.sendOffset(today, window); err != nil {
+			return fmt.Errorf("offset %d: %w", window.Offset, err)
+		}
+	}
+	return nil
+}
+
+// dueWindow is the range of due dates an offset reminds about on a day
+type dueWindow struct {
+	Offset int
+	// From is the earliest due date and To the day after the latest
+	From, To time.Time
+}
+
+// windows returns the due dates each offset reminds about on today: those offset days before
+// today, and up to CatchUpDays days earlier that have not gone out. Catching up stops short of
+// the next offset's day, so that no installment is reminded about for two offsets at once.
+func (config Config) windows(today time.Time) []dueWindow {
+	offsets := uniqueOffsets(config.Offsets)
+	windows := make([]dueWindow, 0, len(offsets))
+	for i, offset := range offsets {
+		catchUp := config.CatchUpDays
+		if i+1 < len(offsets) && offsets[i+1]-offset-1 < catchUp {
+			catchUp = offsets[i+1] - offset - 1
+		}
+		dueDate := today.AddDate(0, 0, -offset)
+		windows = append(windows, dueWindow{
+			Offset: offset,
+			From:   dueDate.AddDate(0, 0, -catchUp),
+			To:     dueDate.AddDate(0, 0, 1),
+		})
+	}
+	return windows
+}
+
+// sendOffset reminds the customers of unpaid installments due within the window about them.
+// Reminders already sent are skipped here and, should two servers race, by the unique index on
+// the reminder records.
+func (config Config) sendOffset(today time.Time, window dueWindow) error {
+	offset := window.Offset
+
+	var installments []models.InstallmentSchedule
+	if err := utils.CRMDB.
+		Where("due_date >= ? AND due_date < ?", window.From, window.To).
+		Order("member_no ASC, due_date ASC").
+		Find(&installments).Error; err != nil {
+		return err
+	}
+
+	var unpaid []models.InstallmentSchedule
+	for _, installment := range installments {
+		if !installment.IsPaid() && installment.Outstanding() > 0 {
+			unpaid = append(unpaid, installment)
+		}
+	}
+	if len(unpaid) == 0 {
+		return nil
+	}
+
+	sent, err := alreadySent(unpaid, offset)
+	if err != nil {
+		return err
+	}
+	users, err := portalUsers(unpaid)
+	if err != nil {
+		return err
+	}
+	active, err := activeLeadFiles(unpaid)
+	if err != nil {
+		return err
+	}
+
+	for _, installment := range unpaid {
+		user, ok := users[installment.MemberNo]
+		if !ok || sent[installment.ISID] || !active[installment.LeadfileNo] {
+			continue
+		}
+		remind(user, installment, offset, today)
+	}
+	return nil
+}
+
+// remind records and sends one reminder. The record is saved first so that two servers cannot
+// both send it. A reminder caught up late tells the customer where things stand today rather
+// than on the day it was meant for.
+func remind(user models.User, installment models.InstallmentSchedule, offset int, today time.Time) {
+	channel := outbox.NotificationChannel(user)
+	reminder := models.InstallmentReminder{
+		InstallmentScheduleID: installment.ISID,
+		OffsetDays:            offset,
+		DueDate:               *installment.DueDate,
+		UserID:                user.ID,
+		CustomerNumber:        installment.MemberNo,
+		LeadFileNo:            installment.LeadfileNo,
+		Amount:                installment.Outstanding(),
+		Channel:               string(channel),
+	}
+	if err := utils.CustomerPortalDB.Create(&reminder).Error; err != nil {
+		log.Printf("Skipping reminder for installment %d at offset %d: %v", installment.ISID, offset, err)
+		return
+	}
+
+	days := int(math.Round(today.Sub(startOfDay(*installment.DueDate)).Hours() / 24))
+	templateName := "installment_due"
+	if days > 0 {
+		templateName = "installment_overdue"
+	}
+	if days < 0 {
+		days = -days
+	}
+
+	notification, err := outbox.NotifyTemplateOn(user, channel, templateName, map[string]interface{}{
+		"Amount":     humanize.CommafWithDigits(reminder.Amount, 2),
+		"PlotNumber": installment.PlotNo,
+		"DueDate":    installment.DueDate.Format("02 Jan 2006"),
+		"Days":       days,
+		"Penalties":  penalties(installment),
+	})
+
+	updates := map[string]interface{}{}
+	if notification != nil {
+		updates["notification_id"] = notification.ID
+	}
+	if err != nil {
+		log.Printf("Failed to send %s reminder for installment %d: %v", templateName, installment.ISID, err)
+		updates["error"] = err.Error()
+	}
+	if len(updates) > 0 {
+		if err := utils.CustomerPortalDB.Model(&reminder).Updates(updates).Error; err != nil {
+			log.Printf("Failed to update reminder %d: %v", reminder.ID, err)
+		}
+	}
+}
+
+// penalties formats the penalties accrued on an installment, empty when there are none
+func penalties(installment models.InstallmentSchedule) string {
+	if installment.PenaltiesAccrued <= 0 {
+		return ""
+	}
+	return humanize.Comma(int64(installment.PenaltiesAccrued))
+}
+
+// alreadySent returns the installments among installments already reminded about at offset
+func alreadySent(installments []models.InstallmentSchedule, offset int) (map[int]bool, error) {
+	ids := make([]int, 0, len(installments))
+	for _, installment := range installments {
+		ids = append(ids, installment.ISID)
+	}
+
+	var sentIDs []int
+	if err := utils.CustomerPortalDB.Model(&models.InstallmentReminder{}).
+		Where("offset_days = ? AND installment_schedule_id IN ?", offset, ids).
+		Pluck("installment_schedule_id", &sentIDs).Error; err != nil {
+		return nil, err
+	}
+
+	sent := make(map[int]bool, len(sentIDs))
+	for _, id := range sentIDs {
+		sent[id] = true
+	}
+	return sent, nil
+}
+
+// portalUsers returns the portal users owning installments, keyed by customer number.
+// Customers who have not registered for the app are left out.
+func portalUsers(installments []models.InstallmentSchedule) (map[string]models.User, error) {
+	numbers := distinct(installments, func(installment models.InstallmentSchedule) string { return installment.MemberNo })
+
+	var users []models.User
+	if err := utils.CustomerPortalDB.Where("customer_number IN ?", numbers).Find(&users).Error; err != nil {
+		return nil, err
+	}
+
+	byNumber := make(map[string]models.User, len(users))
+	for _, user := range users {
+		byNumber[user.CustomerNumber] = user
+	}
+	return byNumber, nil
+}
+
+// activeLeadFiles returns which of the installments' lead files have not been dropped
+func activeLeadFiles(installments []models.InstallmentSchedule) (map[string]bool, error) {
+	numbers := distinct(installments, func(installment models.InstallmentSchedule) string { return installment.LeadfileNo })
+
+	var leadFileNos []string
+	if err := utils.CRMDB.Model(&models.LeadFile{}).
+		Where("lead_file_no IN ? AND lead_file_status_dropped = ?", numbers, "No").
+		Pluck("lead_file_no", &leadFileNos).Error; err != nil {
+		return nil, err
+	}
+
+	active := make(map[string]bool, len(leadFileNos))
+	for _, leadFileNo := range leadFileNos {
+		active[leadFileNo] = true
+	}
+	return active, nil
+}
+
+func distinct(installments []models.InstallmentSchedule, key func(models.InstallmentSchedule) string) []string {
+	seen := map[string]bool{}
+	var values []string
+	for _, installment := range installments {
+		if value := key(installment); !seen[value] {
+			seen[value] = true
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+func sameDay(a, b time.Time) bool {
+	return a.Year() == b.Year() && a.YearDay() == b.YearDay()
+}
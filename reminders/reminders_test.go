@@ -0,0 +1,176 @@
+package reminders
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"mobile-customer-portal-server/models"
+	"mobile-customer-portal-server/utils"
+	"mobile-customer-portal-server/utils/testdb"
+)
+
+func TestParseOffsets(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []int
+		wantErr bool
+	}{
+		{value: "-7,-1,0,3", want: []int{-7, -1, 0, 3}},
+		{value: " 3, 0 ,-1,-7 ", want: []int{-7, -1, 0, 3}},
+		{value: "0,0", want: []int{0}},
+		{value: "3,-1,3,0,-1", want: []int{-1, 0, 3}},
+		{value: "0,,1", want: []int{0, 1}},
+		{value: "", wantErr: true},
+		{value: " , ", wantErr: true},
+		{value: "0,tomorrow", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParseOffsets(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseOffsets(%q) = %v, want an error", tt.value, got)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("ParseOffsets(%q) = %v, %v, want %v", tt.value, got, err, tt.want)
+			}
+		})
+	}
+}
+
+// dueRange is the first and last due date, as days after today, an offset reminds about
+type dueRange struct {
+	offset, first, last int
+}
+
+func TestWindows(t *testing.T) {
+	tests := []struct {
+		name    string
+		offsets []int
+		catchUp int
+		want    []dueRange
+	}{
+		{
+			name:    "default offsets",
+			offsets: []int{-7, -1, 0, 3},
+			catchUp: 2,
+			want:    []dueRange{{-7, 5, 7}, {-1, 1, 1}, {0, -2, 0}, {3, -5, -3}},
+		},
+		{
+			name:    "unsorted",
+			offsets: []int{3, 0, -7, -1},
+			catchUp: 2,
+			want:    []dueRange{{-7, 5, 7}, {-1, 1, 1}, {0, -2, 0}, {3, -5, -3}},
+		},
+		{
+			name:    "adjacent offsets do not catch up",
+			offsets: []int{0, 1, 2},
+			catchUp: 2,
+			want:    []dueRange{{0, 0, 0}, {1, -1, -1}, {2, -4, -2}},
+		},
+		{
+			name:    "catch up stops short of the next offset",
+			offsets: []int{0, 2},
+			catchUp: 5,
+			want:    []dueRange{{0, -1, 0}, {2, -7, -2}},
+		},
+		{
+			name:    "duplicates are reminded about once",
+			offsets: []int{0, 0, 3, 3},
+			catchUp: 2,
+			want:    []dueRange{{0, -2, 0}, {3, -5, -3}},
+		},
+		{
+			name:    "no catching up",
+			offsets: []int{-7, -1, 0, 3},
+			catchUp: 0,
+			want:    []dueRange{{-7, 7, 7}, {-1, 1, 1}, {0, 0, 0}, {3, -3, -3}},
+		},
+	}
+
+	today := time.Date(2025, time.March, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := Config{Offsets: tt.offsets, CatchUpDays: tt.catchUp}
+
+			var got []dueRange
+			for _, window := range config.windows(today) {
+				got = append(got, dueRange{
+					offset: window.Offset,
+					first:  int(window.From.Sub(today).Hours() / 24),
+					last:   int(window.To.Sub(today).Hours()/24) - 1,
+				})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("windows = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func createInstallment(t *testing.T, id int, due time.Time) {
+	t.Helper()
+	installment := models.InstallmentSchedule{
+		ISID:              id,
+		MemberNo:          "C001",
+		LeadfileNo:        "LF-1",
+		InstallmentNo:     id,
+		InstallmentAmount: "10,000.00",
+		DueDate:           &due,
+		Paid:              "No",
+		PlotNo:            "VP1",
+	}
+	if err := utils.CRMDB.Create(&installment).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSendRemindsEachInstallmentOnce(t *testing.T) {
+	testdb.Setup(t)
+	if err := utils.CustomerPortalDB.Create(&models.User{
+		CustomerNumber: "C001",
+		Email:          "jane@example.com",
+		Password:       "hash",
+		UserType:       "customer",
+	}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := utils.CRMDB.Create(&models.LeadFile{LeadFileNo: "LF-1", LeadFileStatusDropped: "No"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	today := time.Date(2025, time.March, 10, 0, 0, 0, 0, time.UTC)
+	// Installments due 8 days ahead to 6 days ago, keyed by days after today
+	for days := -6; days <= 8; days++ {
+		createInstallment(t, 100+days, today.AddDate(0, 0, days))
+	}
+
+	config := Config{Offsets: []int{-7, -1, 0, 0, 3}, CatchUpDays: 2}
+	if err := config.Send(today.Add(9 * time.Hour)); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	// A second run the same day sends nothing more
+	if err := config.Send(today.Add(10 * time.Hour)); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	var reminders []models.InstallmentReminder
+	if err := utils.CustomerPortalDB.Order("installment_schedule_id ASC").Find(&reminders).Error; err != nil {
+		t.Fatal(err)
+	}
+	got := map[int]int{}
+	for _, reminder := range reminders {
+		if _, ok := got[reminder.InstallmentScheduleID-100]; ok {
+			t.Fatalf("installment due in %d days reminded about twice", reminder.InstallmentScheduleID-100)
+		}
+		got[reminder.InstallmentScheduleID-100] = reminder.OffsetDays
+	}
+	want := map[int]int{7: -7, 6: -7, 5: -7, 1: -1, 0: 0, -1: 0, -2: 0, -3: 3, -4: 3, -5: 3}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("offsets by days until due = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+// AttemptRecord holds the failed-attempt state for a single key (an account, an IP address, an OTP)
+type AttemptRecord struct {
+	Failures    int
+	Lockouts    int
+	LockedUntil time.Time
+	LastFailure time.Time
+}
+
+// AttemptStore persists attempt records. Implementations must be safe for concurrent use.
+type AttemptStore interface {
+	Get(key string) (AttemptRecord, bool)
+	Set(key string, record AttemptRecord, ttl time.Duration)
+	Delete(key string)
+}
+
+type memoryAttempt struct {
+	record    AttemptRecord
+	expiresAt time.Time
+}
+
+// MemoryAttemptStore is an in-process AttemptStore. Counters are lost on restart and are not
+// shared between instances.
+type MemoryAttemptStore struct {
+	mu      sync.Mutex
+	entries map[string]memoryAttempt
+	now     func() time.Time
+}
+
+// NewMemoryAttemptStore creates an empty in-memory attempt store
+func NewMemoryAttemptStore() *MemoryAttemptStore {
+	return &MemoryAttemptStore{entries: make(map[string]memoryAttempt), now: time.Now}
+}
+
+func (s *MemoryAttemptStore) Get(key string) (AttemptRecord, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[key]
+	if !ok {
+		return AttemptRecord{}, false
+	}
+	if s.now().After(entry.expiresAt) {
+		delete(s.entries, key)
+		return AttemptRecord{}, false
+	}
+	return entry.record, true
+}
+
+func (s *MemoryAttemptStore) Set(key string, record AttemptRecord, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.entries[key] = memoryAttempt{record: record, expiresAt: now.Add(ttl)}
+
+	// Opportunistically drop expired entries so the map does not grow without bound
+	if len(s.entries)%256 == 0 {
+		for k, entry := range s.entries {
+			if now.After(entry.expiresAt) {
+				delete(s.entries, k)
+			}
+		}
+	}
+}
+
+func (s *MemoryAttemptStore) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+}
+
+// AttemptLimiter locks a key out after MaxFailures failed attempts. Each consecutive lockout
+// doubles in length, starting at BaseLockout and capped at MaxLockout. State is forgotten once
+// the key has seen no failures for Window.
+type AttemptLimiter struct {
+	Store       AttemptStore
+	MaxFailures int
+	BaseLockout time.Duration
+	MaxLockout  time.Duration
+	Window      time.Duration
+	Now         func() time.Time
+}
+
+func (l *AttemptLimiter) now() time.Time {
+	if l.Now != nil {
+		return l.Now()
+	}
+	return time.Now()
+}
+
+// Check reports whether key may attempt again, and if not, how long until it may
+func (l *AttemptLimiter) Check(key string) (bool, time.Duration) {
+	record, ok := l.Store.Get(key)
+	if !ok {
+		return true, 0
+	}
+	now := l.now()
+	if now.Before(record.LockedUntil) {
+		return false, record.LockedUntil.Sub(now)
+	}
+	return true, 0
+}
+
+// Fail records a failed attempt for key. If this failure triggers a lockout, it returns the
+// lockout duration; otherwise it returns zero.
+func (l *AttemptLimiter) Fail(key string) time.Duration {
+	now := l.now()
+	record, _ := l.Store.Get(key)
+
+	// A lockout that has run its course resets the failure count but not the backoff level
+	if !record.LockedUntil.IsZero() && !now.Before(record.LockedUntil) {
+		record.Failures = 0
+		record.LockedUntil = time.Time{}
+	}
+
+	record.Failures++
+	record.LastFailure = now
+
+	var lockout time.Duration
+	if record.Failures >= l.MaxFailures {
+		lockout = l.BaseLockout << uint(record.Lockouts)
+		if lockout <= 0 || lockout > l.MaxLockout {
+			lockout = l.MaxLockout
+		}
+		record.Lockouts++
+		record.LockedUntil = now.Add(lockout)
+	}
+
+	ttl := l.Window
+	if lockout > ttl {
+		ttl = lockout
+	}
+	l.Store.Set(key, record, ttl)
+
+	return lockout
+}
+
+// Reset clears all recorded failures for key
+func (l *AttemptLimiter) Reset(key string) {
+	l.Store.Delete(key)
+}
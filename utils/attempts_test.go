@@ -0,0 +1,140 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeClock is a settable clock shared by a limiter and its store
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func newTestLimiter(maxFailures int) (*AttemptLimiter, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)}
+	store := NewMemoryAttemptStore()
+	store.now = clock.Now
+	return &AttemptLimiter{
+		Store:       store,
+		MaxFailures: maxFailures,
+		BaseLockout: time.Minute,
+		MaxLockout:  time.Hour,
+		Window:      24 * time.Hour,
+		Now:         clock.Now,
+	}, clock
+}
+
+func TestAttemptLimiterLocksOutAfterMaxFailures(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxFailures int
+	}{
+		{"account", 5},
+		{"ip", 20},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter, _ := newTestLimiter(tt.maxFailures)
+
+			for i := 1; i < tt.maxFailures; i++ {
+				if lockout := limiter.Fail("key"); lockout != 0 {
+					t.Fatalf("failure %d: locked out for %s, want no lockout", i, lockout)
+				}
+				if ok, _ := limiter.Check("key"); !ok {
+					t.Fatalf("failure %d: Check refused before %d failures", i, tt.maxFailures)
+				}
+			}
+
+			if lockout := limiter.Fail("key"); lockout != time.Minute {
+				t.Fatalf("failure %d: lockout = %s, want %s", tt.maxFailures, lockout, time.Minute)
+			}
+			ok, retryAfter := limiter.Check("key")
+			if ok || retryAfter != time.Minute {
+				t.Fatalf("Check = %v, %s; want false, %s", ok, retryAfter, time.Minute)
+			}
+
+			// Other keys are not affected
+			if ok, _ := limiter.Check("other"); !ok {
+				t.Fatal("Check refused a key with no failures")
+			}
+		})
+	}
+}
+
+func TestAttemptLimiterBackoff(t *testing.T) {
+	limiter, clock := newTestLimiter(5)
+
+	// Each lockout doubles the next one, up to MaxLockout
+	want := []time.Duration{
+		time.Minute,
+		2 * time.Minute,
+		4 * time.Minute,
+		8 * time.Minute,
+		16 * time.Minute,
+		32 * time.Minute,
+		time.Hour,
+		time.Hour,
+	}
+	for i, expected := range want {
+		var lockout time.Duration
+		for j := 0; j < 5; j++ {
+			lockout = limiter.Fail("key")
+		}
+		if lockout != expected {
+			t.Fatalf("lockout %d = %s, want %s", i+1, lockout, expected)
+		}
+
+		clock.Advance(lockout - time.Second)
+		if ok, retryAfter := limiter.Check("key"); ok || retryAfter != time.Second {
+			t.Fatalf("lockout %d: Check just before expiry = %v, %s; want false, 1s", i+1, ok, retryAfter)
+		}
+		clock.Advance(time.Second)
+		if ok, _ := limiter.Check("key"); !ok {
+			t.Fatalf("lockout %d: Check refused after the lockout ran out", i+1)
+		}
+	}
+}
+
+func TestAttemptLimiterResetOnSuccess(t *testing.T) {
+	limiter, _ := newTestLimiter(5)
+
+	for i := 0; i < 5; i++ {
+		limiter.Fail("key")
+	}
+	if ok, _ := limiter.Check("key"); ok {
+		t.Fatal("Check allowed a locked out key")
+	}
+
+	limiter.Reset("key")
+	if ok, _ := limiter.Check("key"); !ok {
+		t.Fatal("Check refused a key after Reset")
+	}
+
+	// The backoff starts over too
+	for i := 0; i < 4; i++ {
+		if lockout := limiter.Fail("key"); lockout != 0 {
+			t.Fatalf("failure %d after Reset locked out for %s", i+1, lockout)
+		}
+	}
+	if lockout := limiter.Fail("key"); lockout != time.Minute {
+		t.Fatalf("first lockout after Reset = %s, want %s", lockout, time.Minute)
+	}
+}
+
+func TestAttemptLimiterForgetsAfterWindow(t *testing.T) {
+	limiter, clock := newTestLimiter(5)
+
+	for i := 0; i < 4; i++ {
+		limiter.Fail("key")
+	}
+	clock.Advance(24*time.Hour + time.Second)
+
+	if lockout := limiter.Fail("key"); lockout != 0 {
+		t.Fatalf("failure after the window locked out for %s, want the count to have started over", lockout)
+	}
+}
@@ -1,10 +1,12 @@
 package utils
 
 import (
+	"errors"
 	"fmt"
 	"log"
-	"mobile-customer-portal-server/models"
 	"os"
+	"strings"
+	"unicode"
 
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
@@ -35,10 +37,16 @@ func ConnectDatabase() {
         os.Getenv("CUSTOMER_PORTAL_DB"),
     )
 
-    // Construct the DSN for the CRM database
+    // Construct the DSN for the CRM database. The portal only reads from the CRM, so in
+    // production it should connect as a user granted nothing but SELECT, set through
+    // CRM_DB_USER and CRM_DB_PASSWORD; guardReadOnly below is only a second line of defence.
+    crmUser, crmPassword := os.Getenv("CRM_DB_USER"), os.Getenv("CRM_DB_PASSWORD")
+    if crmUser == "" {
+        crmUser, crmPassword = os.Getenv("DB_USER"), os.Getenv("DB_PASSWORD")
+    }
     crmDSN := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=utf8mb4&parseTime=True&loc=Local",
-        os.Getenv("DB_USER"),
-        os.Getenv("DB_PASSWORD"),
+        crmUser,
+        crmPassword,
         os.Getenv("DB_HOST"),
         os.Getenv("DB_PORT"),
         os.Getenv("CRM_DB"),
@@ -64,10 +72,69 @@ func ConnectDatabase() {
         log.Fatalf("Failed to connect to CRM database: %v", err)
     }
 
-    // Automatically migrate the schema for the PasswordReset model to the customer portal database
-    CustomerPortalDB.AutoMigrate(&models.PasswordReset{})
-
-    // No need to migrate CRMDB models since we're only reading existing tables
+    // No need to migrate CRMDB models since we're only reading existing tables.
+    // Reject any write to the CRM before it reaches the database.
+    if err := guardReadOnly(CRMDB); err != nil {
+        log.Fatalf("Failed to install CRM read-only guard: %v", err)
+    }
 
     log.Println("Successfully connected to all databases")
 }
+
+// ErrReadOnlyDatabase is returned when code tries to write through a read-only connection
+var ErrReadOnlyDatabase = errors.New("database connection is read-only")
+
+// readOnlyStatements are the statements a raw query on a read-only connection may start with
+var readOnlyStatements = []string{"SELECT", "WITH", "SHOW", "DESCRIBE", "DESC", "EXPLAIN"}
+
+// guardReadOnly makes every create, update and delete on db fail with ErrReadOnlyDatabase, as
+// well as any raw statement (db.Exec, db.Raw) that is not a query.
+//
+// The guard only catches mistakes in our own code. The CRM must still be reached as a database
+// user that has nothing but SELECT on its tables (CRM_DB_USER), which is what actually keeps
+// the portal from changing CRM data.
+func guardReadOnly(db *gorm.DB) error {
+    reject := func(tx *gorm.DB) {
+        tx.AddError(ErrReadOnlyDatabase)
+    }
+    rejectWrites := func(tx *gorm.DB) {
+        if !isReadOnlyStatement(tx.Statement.SQL.String()) {
+            tx.AddError(ErrReadOnlyDatabase)
+        }
+    }
+
+    if err := db.Callback().Create().Before("gorm:create").Register("portal:read_only_create", reject); err != nil {
+        return err
+    }
+    if err := db.Callback().Update().Before("gorm:update").Register("portal:read_only_update", reject); err != nil {
+        return err
+    }
+    if err := db.Callback().Delete().Before("gorm:delete").Register("portal:read_only_delete", reject); err != nil {
+        return err
+    }
+    if err := db.Callback().Raw().Before("gorm:raw").Register("portal:read_only_raw", rejectWrites); err != nil {
+        return err
+    }
+    return db.Callback().Row().Before("gorm:row").Register("portal:read_only_row", rejectWrites)
+}
+
+// isReadOnlyStatement reports whether sql is a query. An empty statement is one gorm is still
+// to build from the query builder, which only ever builds a SELECT for a row query.
+func isReadOnlyStatement(sql string) bool {
+    sql = strings.TrimLeft(sql, " \t\r\n(")
+    if sql == "" {
+        return true
+    }
+    // Comments and anything else in front of the keyword are refused rather than parsed
+    end := strings.IndexFunc(sql, func(r rune) bool { return !unicode.IsLetter(r) })
+    if end == -1 {
+        end = len(sql)
+    }
+    keyword := strings.ToUpper(sql[:end])
+    for _, allowed := range readOnlyStatements {
+        if keyword == allowed {
+            return true
+        }
+    }
+    return false
+}
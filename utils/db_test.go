@@ -0,0 +1,139 @@
+package utils
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// nopConnPool stands in for a connection; dry runs never reach it
+type nopConnPool struct{}
+
+var errNoConnection = errors.New("no connection")
+
+func (nopConnPool) PrepareContext(context.Context, string) (*sql.Stmt, error) {
+	return nil, errNoConnection
+}
+
+func (nopConnPool) ExecContext(context.Context, string, ...interface{}) (sql.Result, error) {
+	return nil, errNoConnection
+}
+
+func (nopConnPool) QueryContext(context.Context, string, ...interface{}) (*sql.Rows, error) {
+	return nil, errNoConnection
+}
+
+func (nopConnPool) QueryRowContext(context.Context, string, ...interface{}) *sql.Row {
+	return nil
+}
+
+func newGuardedDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(mysql.New(mysql.Config{Conn: nopConnPool{}, SkipInitializeWithVersion: true}),
+		&gorm.Config{DryRun: true, Logger: logger.Discard})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if err := guardReadOnly(db); err != nil {
+		t.Fatalf("guardReadOnly: %v", err)
+	}
+	return db
+}
+
+type guardedRow struct {
+	ID   int
+	Name string
+}
+
+func TestGuardReadOnlyRejectsWrites(t *testing.T) {
+	db := newGuardedDB(t)
+
+	tests := []struct {
+		name string
+		run  func() error
+	}{
+		{"create", func() error { return db.Create(&guardedRow{Name: "x"}).Error }},
+		{"update", func() error { return db.Model(&guardedRow{ID: 1}).Update("name", "x").Error }},
+		{"delete", func() error { return db.Delete(&guardedRow{ID: 1}).Error }},
+		{"exec insert", func() error { return db.Exec("INSERT INTO guarded_rows (name) VALUES (?)", "x").Error }},
+		{"exec update", func() error { return db.Exec("  update guarded_rows SET name = ?", "x").Error }},
+		{"exec drop", func() error { return db.Exec("DROP TABLE guarded_rows").Error }},
+		{"raw delete", func() error {
+			rows, err := db.Raw("DELETE FROM guarded_rows WHERE id = ?", 1).Rows()
+			if rows != nil {
+				rows.Close()
+			}
+			return err
+		}},
+		{"raw scan replace", func() error {
+			var result []guardedRow
+			return db.Raw("REPLACE INTO guarded_rows (id, name) VALUES (1, 'x')").Scan(&result).Error
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.run(); !errors.Is(err, ErrReadOnlyDatabase) {
+				t.Fatalf("err = %v, want ErrReadOnlyDatabase", err)
+			}
+		})
+	}
+}
+
+func TestGuardReadOnlyAllowsQueries(t *testing.T) {
+	db := newGuardedDB(t)
+
+	tests := []struct {
+		name string
+		run  func() error
+	}{
+		{"find", func() error {
+			var result []guardedRow
+			return db.Where("name = ?", "x").Find(&result).Error
+		}},
+		{"raw select", func() error {
+			var result []guardedRow
+			return db.Raw("SELECT id, name FROM guarded_rows WHERE id = ?", 1).Scan(&result).Error
+		}},
+		{"raw with", func() error {
+			var result []guardedRow
+			return db.Raw("(WITH r AS (SELECT 1 AS id) SELECT id FROM r)").Scan(&result).Error
+		}},
+		{"exec show", func() error { return db.Exec("SHOW TABLES").Error }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.run(); errors.Is(err, ErrReadOnlyDatabase) {
+				t.Fatalf("query rejected: %v", err)
+			}
+		})
+	}
+}
+
+func TestIsReadOnlyStatement(t *testing.T) {
+	tests := []struct {
+		sql  string
+		want bool
+	}{
+		{"", true},
+		{"SELECT 1", true},
+		{"\n\tselect * from t", true},
+		{"EXPLAIN SELECT 1", true},
+		{"INSERT INTO t VALUES (1)", false},
+		{"/* SELECT */ DELETE FROM t", false},
+		{"TRUNCATE t", false},
+		{"123", false},
+	}
+
+	for _, tt := range tests {
+		if got := isReadOnlyStatement(tt.sql); got != tt.want {
+			t.Errorf("isReadOnlyStatement(%q) = %v, want %v", tt.sql, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"mobile-customer-portal-server/models"
+	"time"
+)
+
+// OTPPurpose scopes an OTP so that a code issued for one flow cannot be used in another
+type OTPPurpose string
+
+const (
+	OTPPurposeRegistration        OTPPurpose = "registration"
+	OTPPurposePasswordReset       OTPPurpose = "password_reset"
+	OTPPurposePaymentConfirmation OTPPurpose = "payment_confirmation"
+)
+
+var (
+	ErrOTPNotFound = errors.New("otp not found")
+	ErrOTPExpired  = errors.New("otp expired")
+	ErrOTPInvalid  = errors.New("otp invalid")
+)
+
+// GenerateOTPCode returns a uniformly random 6-digit code from crypto/rand
+func GenerateOTPCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// hashOTP derives the stored hash of a code from its salt, subject and purpose
+func hashOTP(salt, subject string, purpose OTPPurpose, code string) string {
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte(string(purpose) + ":" + subject + ":" + code))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// IssueOTP generates and stores a new code for the subject and purpose, replacing any unused
+// code issued earlier. The plaintext code is returned for delivery and never stored.
+func IssueOTP(subject string, purpose OTPPurpose, ttl time.Duration) (string, *models.OTPCode, error) {
+	code, err := GenerateOTPCode()
+	if err != nil {
+		return "", nil, err
+	}
+	salt, err := GenerateRandomHex(16)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Only the latest code for a subject and purpose is ever valid
+	if err := CustomerPortalDB.
+		Where("subject = ? AND purpose = ? AND used_at IS NULL", subject, string(purpose)).
+		Delete(&models.OTPCode{}).Error; err != nil {
+		return "", nil, err
+	}
+
+	record := models.OTPCode{
+		Subject:   subject,
+		Purpose:   string(purpose),
+		Salt:      salt,
+		CodeHash:  hashOTP(salt, subject, purpose, code),
+		ExpiresAt: time.Now().Add(ttl),
+	}
+	if err := CustomerPortalDB.Create(&record).Error; err != nil {
+		return "", nil, err
+	}
+
+	return code, &record, nil
+}
+
+// CheckOTP verifies a code without using it up. The latest record is returned whenever one
+// exists, even if the code does not match, so callers can track wrong guesses against it.
+func CheckOTP(subject string, purpose OTPPurpose, code string) (*models.OTPCode, error) {
+	var record models.OTPCode
+	if err := CustomerPortalDB.
+		Where("subject = ? AND purpose = ? AND used_at IS NULL", subject, string(purpose)).
+		Order("created_at DESC").
+		First(&record).Error; err != nil {
+		return nil, ErrOTPNotFound
+	}
+
+	expected := []byte(record.CodeHash)
+	actual := []byte(hashOTP(record.Salt, subject, purpose, code))
+	if !hmac.Equal(expected, actual) {
+		return &record, ErrOTPInvalid
+	}
+
+	if time.Now().After(record.ExpiresAt) {
+		return &record, ErrOTPExpired
+	}
+
+	return &record, nil
+}
+
+// ConsumeOTP verifies a code and marks it as used so it can never be accepted again
+func ConsumeOTP(subject string, purpose OTPPurpose, code string) (*models.OTPCode, error) {
+	record, err := CheckOTP(subject, purpose, code)
+	if err != nil {
+		return record, err
+	}
+
+	// Guard against the same code being consumed twice concurrently
+	result := CustomerPortalDB.Model(&models.OTPCode{}).
+		Where("id = ? AND used_at IS NULL", record.ID).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return record, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return record, ErrOTPNotFound
+	}
+
+	return record, nil
+}
+
+// BurnOTP marks a code as used without it having been accepted, e.g. after too many wrong guesses
+func BurnOTP(record *models.OTPCode) error {
+	return CustomerPortalDB.Model(&models.OTPCode{}).
+		Where("id = ? AND used_at IS NULL", record.ID).
+		Update("used_at", time.Now()).Error
+}
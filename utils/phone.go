@@ -0,0 +1,36 @@
+package utils
+
+import "strings"
+
+// NormalizePhoneNumber converts a Kenyan phone number written as 07XXXXXXXX, 7XXXXXXXX or
+// +2547XXXXXXXX into the 2547XXXXXXXX form expected by M-PESA, Wati and SMS gateways.
+// Other numbers are returned with only spaces, dashes and the leading '+' removed.
+func NormalizePhoneNumber(phone string) string {
+	phone = strings.NewReplacer(" ", "", "-", "", "(", "", ")", "").Replace(strings.TrimSpace(phone))
+	phone = strings.TrimPrefix(phone, "+")
+
+	switch {
+	case strings.HasPrefix(phone, "0") && len(phone) == 10:
+		return "254" + phone[1:]
+	case (strings.HasPrefix(phone, "7") || strings.HasPrefix(phone, "1")) && len(phone) == 9:
+		return "254" + phone
+	}
+	return phone
+}
+
+// MaskPhoneNumber hides all but the first four and last two digits of a phone number
+func MaskPhoneNumber(phone string) string {
+	if len(phone) <= 6 {
+		return strings.Repeat("*", len(phone))
+	}
+	return phone[:4] + strings.Repeat("*", len(phone)-6) + phone[len(phone)-2:]
+}
+
+// MaskEmail hides all but the first character of the local part of an email address
+func MaskEmail(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at <= 0 {
+		return strings.Repeat("*", len(email))
+	}
+	return email[:1] + strings.Repeat("*", at-1) + email[at:]
+}
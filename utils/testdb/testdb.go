@@ -0,0 +1,83 @@
+// Package testdb points the database connections in utils at fresh in-memory SQLite databases
+// for tests, with the portal tables migrated and the CRM and ERP tables the portal reads from
+// created, so handlers and workers can be tested without a MySQL server.
+package testdb
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"mobile-customer-portal-server/models"
+	"mobile-customer-portal-server/utils"
+)
+
+var databases atomic.Int64
+
+// portalModels are the tables of the customer portal database
+var portalModels = []interface{}{
+	&models.User{},
+	&models.Notification{},
+	&models.Campaign{},
+	&models.RefreshToken{},
+	&models.Session{},
+	&models.OTPCode{},
+	&models.RegistrationChallenge{},
+	&models.OutboxMessage{},
+	&models.DeliveryAttempt{},
+	&models.DeadLetter{},
+	&models.PushTicket{},
+	&models.DeviceToken{},
+	&models.MpesaPayment{},
+	&models.PaymentReceiptMatch{},
+	&models.PaymentMatchException{},
+	&models.PaymentAllocation{},
+	&models.PaymentMandate{},
+	&models.PaymentMandateRun{},
+	&models.InstallmentReminder{},
+	&models.Referral{},
+}
+
+// Setup opens the portal, CRM and default databases for the test and restores the previous
+// connections when it ends
+func Setup(t testing.TB) {
+	t.Helper()
+
+	previous := [3]*gorm.DB{utils.CustomerPortalDB, utils.CRMDB, utils.DefaultDB}
+	t.Cleanup(func() {
+		utils.CustomerPortalDB, utils.CRMDB, utils.DefaultDB = previous[0], previous[1], previous[2]
+	})
+
+	utils.CustomerPortalDB = open(t, portalModels...)
+	utils.CRMDB = open(t, &models.Customer{}, &models.LeadFile{}, &models.InstallmentSchedule{})
+	utils.DefaultDB = open(t, &models.Receipt{}, &models.Project{})
+}
+
+// open creates an empty database holding the tables of the given models
+func open(t testing.TB, tables ...interface{}) *gorm.DB {
+	t.Helper()
+
+	// Each database gets its own name so tests never see each other's rows; the shared cache
+	// keeps it alive across the pool's connections
+	dsn := fmt.Sprintf("file:testdb%d?mode=memory&cache=shared", databases.Add(1))
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatalf("open test database: %v", err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatalf("open test database: %v", err)
+	}
+	// SQLite allows one writer at a time
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+
+	if err := db.AutoMigrate(tables...); err != nil {
+		t.Fatalf("migrate test database: %v", err)
+	}
+	return db
+}
@@ -11,28 +11,71 @@ import (
 
 var JwtSecret []byte
 
+// AccessTokenTTL is how long an access token stays valid after it is issued
+var AccessTokenTTL = 15 * time.Minute
+
+// RefreshTokenTTL is how long a refresh token can be exchanged for a new token pair
+var RefreshTokenTTL = 30 * 24 * time.Hour
+
 func init() {
     // Load the .env file
     if err := godotenv.Load(); err != nil {
         log.Println("No .env file found or error loading .env file:", err)
     }
 
-    secret := os.Getenv("JWT_SECRET")
-    if secret == "" {
+    JwtSecret = []byte(os.Getenv("JWT_SECRET"))
+
+    // Optional overrides, e.g. ACCESS_TOKEN_TTL=30m, REFRESH_TOKEN_TTL=720h
+    AccessTokenTTL = durationFromEnv("ACCESS_TOKEN_TTL", AccessTokenTTL)
+    RefreshTokenTTL = durationFromEnv("REFRESH_TOKEN_TTL", RefreshTokenTTL)
+}
+
+// RequireJWTSecret stops the server if JWT_SECRET is not set. It is called from main rather
+// than init so that packages depending on utils can be tested without a secret.
+func RequireJWTSecret() {
+    if len(JwtSecret) == 0 {
         log.Fatal("JWT_SECRET is not set in the environment")
     }
+}
 
-    JwtSecret = []byte(secret)
+// durationFromEnv parses a duration from the environment, falling back to def when unset or invalid
+func durationFromEnv(key string, def time.Duration) time.Duration {
+    value := os.Getenv(key)
+    if value == "" {
+        return def
+    }
+    d, err := time.ParseDuration(value)
+    if err != nil || d <= 0 {
+        log.Printf("Invalid %s %q, using default %s", key, value, def)
+        return def
+    }
+    return d
 }
 
-// GenerateAccessToken creates a new JWT access token without expiration.
-func GenerateAccessToken(userID uint) (string, error) {
+// GenerateAccessToken creates a new short-lived JWT access token bound to the session identified by jti.
+func GenerateAccessToken(userID uint, jti string) (string, error) {
+    now := time.Now()
     claims := jwt.MapClaims{
         "user_id": userID,
-        // No 'exp' claim, making it non-expiring by default.
-        "iat": time.Now().Unix(),
+        "jti":     jti,
+        "iat":     now.Unix(),
+        "exp":     now.Add(AccessTokenTTL).Unix(),
     }
 
     token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
     return token.SignedString(JwtSecret)
 }
+
+// GenerateRefreshToken creates a new opaque refresh token and returns it along with the hash to store
+func GenerateRefreshToken() (string, string, error) {
+    token, err := GenerateRandomHex(32)
+    if err != nil {
+        return "", "", err
+    }
+    return token, HashRefreshToken(token), nil
+}
+
+// HashRefreshToken returns the SHA-256 hash under which a refresh token is stored
+func HashRefreshToken(token string) string {
+    return HashSecret(token)
+}